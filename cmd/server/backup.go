@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stephens/tcc-bridge/internal/backup"
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/web"
+)
+
+// backupPassphraseEnv can hold the backup passphrase instead of a file
+const backupPassphraseEnv = "TCC_BACKUP_PASSPHRASE"
+
+// runBackup implements "tcc-bridge backup". It is safe while the service
+// is running.
+func runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file")
+	output := fs.String("o", "", "Output file (default tcc-bridge-backup-<time>.tar.gz, - for stdout)")
+	passphraseFile := fs.String("passphrase-file", "", "File holding a passphrase to encrypt the backup (or set "+backupPassphraseEnv+")")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read passphrase: %v\n", err)
+		return 1
+	}
+
+	db, err := storage.Open(cfg.DatabasePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	path := *output
+	if path != "-" {
+		// Write beside the destination so the final rename stays on one filesystem
+		dir := "."
+		if path != "" {
+			dir = filepath.Dir(path)
+		}
+		tmp, err := os.CreateTemp(dir, ".tcc-bridge-backup-")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create backup file: %v\n", err)
+			return 1
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		out = tmp
+	}
+
+	manifest, err := backup.Create(context.Background(), out, backup.Source{
+		DB:         db,
+		KeyPath:    cfg.EncryptionKeyPath,
+		Config:     cfg,
+		AppVersion: web.Version,
+	}, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		return 1
+	}
+
+	if path != "-" {
+		tmp := out.(*os.File)
+		if err := tmp.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write backup file: %v\n", err)
+			return 1
+		}
+		if path == "" {
+			path = "tcc-bridge-backup-" + manifest.CreatedAt.Local().Format("20060102-150405") + ".tar.gz"
+			if passphrase != "" {
+				path += ".enc"
+			}
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write backup file: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s (schema version %d)\n", path, manifest.SchemaVersion)
+	}
+
+	return 0
+}
+
+// runRestore implements "tcc-bridge restore". The service must be stopped.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file, replaced by the backup's if set")
+	passphraseFile := fs.String("passphrase-file", "", "File holding the backup passphrase (or set "+backupPassphraseEnv+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tcc-bridge restore [flags] <backup file>\n\nStop the service before restoring.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read passphrase: %v\n", err)
+		return 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open backup: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	bundle, err := backup.Open(f, passphrase)
+	if errors.Is(err, backup.ErrPassphraseRequired) {
+		fmt.Fprintf(os.Stderr, "%v (use -passphrase-file or %s)\n", err, backupPassphraseEnv)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open backup: %v\n", err)
+		return 1
+	}
+
+	if err := backup.Restore(bundle, backup.Target{Config: cfg, ConfigPath: *configPath}); err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Restored backup from %s (version %s, schema version %d) to %s\n",
+		bundle.Manifest.CreatedAt.Local().Format("2006-01-02 15:04:05"), bundle.Manifest.AppVersion,
+		bundle.Manifest.SchemaVersion, cfg.DataDir)
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Configuration was not restored; pass -config to restore it")
+	}
+	return 0
+}
+
+// loadConfig loads the configuration file, or the defaults if path is empty
+func loadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return config.DefaultConfig(), nil
+	}
+	return config.Load(path)
+}
+
+// readPassphrase reads a passphrase from file, falling back to the
+// environment. An empty result means no encryption.
+func readPassphrase(file string) (string, error) {
+	if file == "" {
+		return os.Getenv(backupPassphraseEnv), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// errCommandQueued reports a command held in the outbox until TCC is
+// reachable again
+var errCommandQueued = errors.New("command queued")
+
+// defaultMatterDevice resolves commands without a device to the first
+// device
+func (s *Service) defaultMatterDevice() (int, error) {
+	state, err := s.db.GetThermostatState()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get thermostat state: %w", err)
+	}
+	if state == nil {
+		return 0, matter.NewCommandError(matter.ResultUnavailable, fmt.Errorf("no thermostat state yet"))
+	}
+	return state.DeviceID, nil
+}
+
+// runMatterCommand runs a command from the Matter bridge and returns the
+// device's state afterwards, classifying failures for the command result
+func (s *Service) runMatterCommand(ctx context.Context, cmd matter.Command) (*tcc.ThermostatState, error) {
+	err := s.handleMatterCommand(ctx, cmd)
+	if errors.Is(err, errCommandQueued) {
+		// The stored state doesn't reflect the command yet, so none is sent
+		return nil, matter.NewCommandError(matter.ResultQueued, err)
+	}
+
+	var result *tcc.ThermostatState
+	if state, serr := s.db.GetThermostatStateByDeviceID(cmd.DeviceID); serr == nil && state != nil {
+		device := thermostatFromStored(state)
+		result = &device
+	}
+
+	var cmdErr *matter.CommandError
+	var violation *policy.Violation
+	switch {
+	case err == nil, errors.As(err, &cmdErr):
+	case errors.As(err, &violation):
+		err = matter.NewCommandError(matter.ResultRejected, err)
+	case tcc.IsUnavailable(err):
+		err = matter.NewCommandError(matter.ResultUnavailable, err)
+	}
+	return result, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// resolveConflict applies the conflict policy when a polled change overrode
+// a bridge command that TCC had not yet echoed back
+func (s *Service) resolveConflict(ctx context.Context, device tcc.ThermostatState, result provenance.Result) {
+	cmd := result.Command
+	polled := describePolledValue(device, cmd.Field)
+	requested := describeCommandValue(*cmd)
+
+	details := map[string]interface{}{
+		"device_id":      device.DeviceID,
+		"field":          cmd.Field,
+		"requested":      requested,
+		"polled":         polled,
+		"command_source": cmd.Source,
+		"issued_at":      cmd.IssuedAt,
+		"policy":         s.conflictPolicy,
+	}
+
+	if s.conflictPolicy != provenance.PolicyBridgeWins {
+		log.FromContext(ctx).Info("Wall unit overrode %s %s command (%s -> %s), keeping wall value",
+			cmd.Source, cmd.Field, requested, polled)
+		s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeConflict,
+			fmt.Sprintf("Wall unit changed %s to %s after %s requested %s; keeping wall value",
+				cmd.Field, polled, cmd.Source, requested),
+			details)
+		return
+	}
+
+	log.FromContext(ctx).Info("Wall unit overrode %s %s command (%s -> %s), re-applying bridge value",
+		cmd.Source, cmd.Field, requested, polled)
+
+	var err error
+	switch cmd.Field {
+	case provenance.FieldHeatSetpoint:
+		err = s.tccClient.SetHeatSetpoint(ctx, cmd.DeviceID, cmd.Setpoint)
+	case provenance.FieldCoolSetpoint:
+		err = s.tccClient.SetCoolSetpoint(ctx, cmd.DeviceID, cmd.Setpoint)
+	case provenance.FieldSystemMode:
+		err = s.tccClient.SetSystemMode(ctx, cmd.DeviceID, cmd.Mode)
+	}
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to re-apply %s command: %v", cmd.Source, err)
+		details["error"] = err.Error()
+		s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeError,
+			fmt.Sprintf("Failed to re-apply %s %s after wall unit change: %v", cmd.Source, cmd.Field, err),
+			details)
+		return
+	}
+
+	// Track the re-applied command so its echo is recognised
+	s.commands.Record(provenance.Command{
+		DeviceID: cmd.DeviceID,
+		Field:    cmd.Field,
+		Setpoint: cmd.Setpoint,
+		Mode:     cmd.Mode,
+		Source:   cmd.Source,
+	})
+	s.pollScheduler.NoteCommand()
+
+	s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeConflict,
+		fmt.Sprintf("Wall unit changed %s to %s after %s requested %s; re-applied %s",
+			cmd.Field, polled, cmd.Source, requested, requested),
+		details)
+}
+
+// describePolledValue formats the polled value of a field for logging
+func describePolledValue(device tcc.ThermostatState, field provenance.Field) string {
+	switch field {
+	case provenance.FieldHeatSetpoint:
+		return fmt.Sprintf("%.1f°F", device.HeatSetpoint)
+	case provenance.FieldCoolSetpoint:
+		return fmt.Sprintf("%.1f°F", device.CoolSetpoint)
+	default:
+		return device.SystemMode
+	}
+}
+
+// describeCommandValue formats the requested value of a command for logging
+func describeCommandValue(cmd provenance.Command) string {
+	if cmd.Field == provenance.FieldSystemMode {
+		return cmd.Mode
+	}
+	return fmt.Sprintf("%.1f°F", cmd.Setpoint)
+}
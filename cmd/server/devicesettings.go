@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"math"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// syncMatterSettings tells the Matter bridge how to expose a device
+func (s *Service) syncMatterSettings(ds storage.DeviceSettings) {
+	s.matterBridge.SetDeviceSettings(ds.DeviceID, matter.DeviceSettings{
+		Name:            ds.DisplayName,
+		Hidden:          ds.HideFromMatter,
+		TemperatureUnit: ds.TemperatureUnit,
+	})
+}
+
+// handleDeviceSettingsChanged applies new device settings to the stored
+// state and the Matter bridge without waiting for the next poll. A cleared
+// display name is replaced by the TCC name on the next poll.
+func (s *Service) handleDeviceSettingsChanged(ctx context.Context, prev, ds storage.DeviceSettings) {
+	s.syncMatterSettings(ds)
+
+	state, err := s.db.GetThermostatStateByDeviceID(ds.DeviceID)
+	if err != nil || state == nil {
+		return // Not polled yet
+	}
+
+	// The stored reading already includes the previous offset
+	state.CurrentTemp = math.Round((state.CurrentTemp-prev.TempOffset+ds.TempOffset)*10) / 10
+	if ds.DisplayName != "" {
+		state.Name = ds.DisplayName
+	}
+	if err := s.db.SaveThermostatState(state); err != nil {
+		log.FromContext(ctx).Error("Failed to save thermostat state: %v", err)
+		return
+	}
+
+	// Showing or hiding the device adds or removes its endpoint
+	if prev.HideFromMatter != ds.HideFromMatter {
+		s.syncStoredMatterDevices(ctx)
+		return
+	}
+	if ds.HideFromMatter || !s.matterBridge.IsRunning() {
+		return
+	}
+	if ds.DisplayName != "" && ds.DisplayName != prev.DisplayName {
+		if err := s.matterBridge.RenameDevice(ctx, ds.DeviceID, ds.DisplayName); err != nil {
+			log.FromContext(ctx).Warn("Failed to rename Matter device: %v", err)
+		}
+	}
+	s.pushStoredMatterState(ctx, ds.DeviceID)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/export"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// runExport implements "tcc-bridge export events|readings". It is safe
+// while the service is running.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file")
+	format := fs.String("format", "csv", "Output format: csv, ndjson or arrow")
+	from := fs.String("from", "", "Start of the range, RFC 3339 or YYYY-MM-DD (default 30 days before -to)")
+	to := fs.String("to", "", "End of the range, RFC 3339 or YYYY-MM-DD (default now)")
+	deviceID := fs.Int("device", 0, "Only export this device (default all)")
+	resolution := fs.String("resolution", "raw", "Readings only: raw, hourly or daily")
+	source := fs.String("source", "", "Events only: only this source")
+	eventType := fs.String("event-type", "", "Events only: only this event type")
+	gz := fs.Bool("gzip", false, "Compress the output (implied by an -o name ending in .gz)")
+	output := fs.String("o", "", "Output file (default a name derived from the range, - for stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: tcc-bridge export [flags] events|readings")
+		fs.PrintDefaults()
+	}
+
+	// Accept the dataset before or after the flags
+	var dataset string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		dataset, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if dataset == "" && fs.NArg() > 0 {
+		dataset = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	if dataset == "" {
+		fs.Usage()
+		return 2
+	}
+
+	req := export.Request{
+		Dataset:    export.Dataset(dataset),
+		Format:     export.Format(*format),
+		Gzip:       *gz || strings.HasSuffix(*output, ".gz"),
+		DeviceID:   *deviceID,
+		Resolution: storage.Resolution(*resolution),
+		To:         time.Now(),
+	}
+	if *to != "" {
+		t, err := export.ParseTime(*to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -to: %v\n", err)
+			return 2
+		}
+		req.To = t
+	}
+	req.From = req.To.AddDate(0, 0, -30)
+	if *from != "" {
+		t, err := export.ParseTime(*from)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -from: %v\n", err)
+			return 2
+		}
+		req.From = t
+	}
+	if *source != "" {
+		src := storage.EventSource(*source)
+		req.Source = &src
+	}
+	if *eventType != "" {
+		et := storage.EventType(*eventType)
+		req.EventType = &et
+	}
+	if err := req.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+
+	db, err := storage.Open(cfg.DatabasePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	path := *output
+	if path == "" {
+		path = req.Filename()
+	}
+	if path != "-" {
+		// Write beside the destination so the final rename stays on one filesystem
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".tcc-bridge-export-")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create export file: %v\n", err)
+			return 1
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		out = tmp
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rows, err := export.Export(ctx, db, req, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed after %d rows: %v\n", rows, err)
+		return 1
+	}
+
+	if path != "-" {
+		tmp := out.(*os.File)
+		if err := tmp.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write export: %v\n", err)
+			return 1
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write export: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d rows to %s\n", rows, path)
+	}
+	return 0
+}
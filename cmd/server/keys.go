@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// runRotateKey implements "tcc-bridge rotate-key". Stop the service first,
+// or use POST /api/admin/rotate-key while it runs, since a running service
+// keeps its own copy of the keys.
+func runRotateKey(args []string) int {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file")
+	newPassphraseFile := fs.String("new-passphrase-file", "", "File holding a new passphrase to protect the key with")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	passphrase, err := cfg.KeyPassphrase()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	var newPassphrase string
+	if *newPassphraseFile != "" {
+		newPassphrase, err = readPassphrase(*newPassphraseFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read new passphrase: %v\n", err)
+			return 1
+		}
+		if newPassphrase == "" {
+			fmt.Fprintf(os.Stderr, "New passphrase file %s is empty\n", *newPassphraseFile)
+			return 1
+		}
+	}
+
+	db, err := storage.Open(cfg.DatabasePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	// Never create a key here; rotating a missing key would orphan the
+	// stored credentials
+	if _, err := os.Stat(cfg.EncryptionKeyPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Encryption key %s: %v\n", cfg.EncryptionKeyPath, err)
+		return 1
+	}
+	encKey, err := storage.LoadOrCreateKey(cfg.EncryptionKeyPath, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load encryption key: %v\n", err)
+		return 1
+	}
+
+	version, count, err := encKey.Rotate(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Key rotation failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Rotated encryption key to version %d, re-encrypted %d credential(s)\n", version, count)
+
+	if newPassphrase != "" {
+		if err := encKey.SetPassphrase(newPassphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set new passphrase: %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "Key is now protected by the new passphrase; update TCC_KEY_PASSPHRASE or the passphrase file to match")
+	}
+
+	db.LogEvent(storage.EventSourceUser, storage.EventTypeCredentials,
+		fmt.Sprintf("Encryption key rotated to version %d", version),
+		map[string]interface{}{"key_version": version, "reencrypted": count, "via": "cli"})
+
+	return 0
+}
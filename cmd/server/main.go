@@ -11,15 +11,42 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/stephens/tcc-bridge/internal/automation"
 	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/devices"
+	"github.com/stephens/tcc-bridge/internal/energy"
+	"github.com/stephens/tcc-bridge/internal/history"
+	"github.com/stephens/tcc-bridge/internal/hvac"
 	"github.com/stephens/tcc-bridge/internal/log"
 	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/outbox"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/polling"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/retention"
+	"github.com/stephens/tcc-bridge/internal/schedule"
 	"github.com/stephens/tcc-bridge/internal/storage"
 	"github.com/stephens/tcc-bridge/internal/tcc"
 	"github.com/stephens/tcc-bridge/internal/web"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			os.Exit(runBackup(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "rotate-key":
+			os.Exit(runRotateKey(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "", "Path to configuration file")
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	flag.Parse()
@@ -61,7 +88,12 @@ func main() {
 	log.Info("Database initialized at %s", cfg.DatabasePath())
 
 	// Load encryption key
-	encKey, err := storage.LoadOrCreateKey(cfg.EncryptionKeyPath)
+	passphrase, err := cfg.KeyPassphrase()
+	if err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+	encKey, err := storage.LoadOrCreateKey(cfg.EncryptionKeyPath, passphrase)
 	if err != nil {
 		log.Error("Failed to load encryption key: %v", err)
 		os.Exit(1)
@@ -81,7 +113,7 @@ func main() {
 		os.Exit(1)
 	}
 	if creds != nil {
-		password, err := encKey.DecryptString(creds.PasswordEncrypted)
+		password, err := encKey.DecryptString(creds.KeyVersion, creds.PasswordEncrypted)
 		if err != nil {
 			log.Warn("Failed to decrypt stored password: %v", err)
 		} else {
@@ -90,21 +122,109 @@ func main() {
 		}
 	}
 
+	// Create polling scheduler
+	pollScheduler, err := newPollScheduler(cfg)
+	if err != nil {
+		log.Error("Invalid polling configuration: %v", err)
+		os.Exit(1)
+	}
+	tccClient.SetMinPollInterval(minPollInterval(cfg))
+
+	// Create command provenance tracker
+	conflictPolicy, err := provenance.ParsePolicy(cfg.ConflictPolicy)
+	if err != nil {
+		log.Error("Invalid conflict policy: %v", err)
+		os.Exit(1)
+	}
+	commands := provenance.NewTracker(time.Duration(cfg.CommandEchoWindow) * time.Second)
+
+	// Create command policy enforcer
+	guard, err := policy.NewEnforcer(cfg, db)
+	if err != nil {
+		log.Error("Invalid command policy: %v", err)
+		os.Exit(1)
+	}
+
+	// Create schedule engine
+	scheduleEngine := schedule.NewEngine(db, tccClient, guard)
+
+	// Create automation engine
+	automationEngine := automation.NewEngine(db, tccClient, guard)
+
+	// Create command outbox
+	commandOutbox := outbox.New(db, tccClient, guard, cfg.CommandQueueEnabled,
+		time.Duration(cfg.CommandQueueTTL)*time.Second)
+
+	// Create reading history recorder
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+	historyRecorder := history.NewRecorder(db, history.Options{
+		RawRetention:    days(cfg.HistoryRawRetentionDays),
+		HourlyRetention: days(cfg.HistoryHourlyRetentionDays),
+		DailyRetention:  days(cfg.HistoryDailyRetentionDays),
+	})
+
+	// Create HVAC runtime tracker
+	runtimeTracker := hvac.NewTracker(db, time.Duration(cfg.RuntimeMaxGap)*time.Second)
+
+	// Create energy cost estimator
+	energyEstimator, err := energy.New(db, energy.OptionsFromConfig(cfg))
+	if err != nil {
+		log.Error("Invalid energy configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// Create event log retention job
+	retentionJob, err := retention.New(db, retention.OptionsFromConfig(cfg))
+	if err != nil {
+		log.Error("Invalid event log retention configuration: %v", err)
+		os.Exit(1)
+	}
+
 	// Create Matter bridge
 	matterBridge := matter.NewBridge(cfg.MatterBridgeURL, cfg.MatterBridgeDir)
+	matterSupervisor := matter.NewSupervisor(matterBridge, matter.SupervisorOptions{})
+	commissioning := matter.NewCommissioning(db)
+	endpoints := matter.NewEndpoints(db)
+
+	// Load per-device settings
+	deviceSettings, err := devices.NewSettings(db)
+	if err != nil {
+		log.Error("Failed to load device settings: %v", err)
+		os.Exit(1)
+	}
 
 	// Create service
 	svc := &Service{
-		cfg:          cfg,
-		db:           db,
-		encKey:       encKey,
-		tccClient:    tccClient,
-		matterBridge: matterBridge,
+		cfg:            cfg,
+		db:             db,
+		encKey:         encKey,
+		tccClient:      tccClient,
+		matterBridge:   matterBridge,
+		matterSup:      matterSupervisor,
+		commissioning:  commissioning,
+		endpoints:      endpoints,
+		settings:       deviceSettings,
+		pollScheduler:  pollScheduler,
+		commands:       commands,
+		conflictPolicy: conflictPolicy,
+		scheduleEngine: scheduleEngine,
+		guard:          guard,
+		automation:     automationEngine,
+		outbox:         commandOutbox,
+		history:        historyRecorder,
+		runtime:        runtimeTracker,
+		energy:         energyEstimator,
+		retention:      retentionJob,
 	}
 
 	// Create and start web server
 	webServer := web.NewServer(cfg.ServerPort, svc)
 
+	// Treat connected web UI clients as activity so polling doesn't go idle
+	pollScheduler.SetActivityProbe(func() bool {
+		return webServer.GetHub().ClientCount() > 0
+	})
+
 	// Set up graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -118,20 +238,56 @@ func main() {
 		cancel()
 	}()
 
-	// Start Matter bridge subprocess
-	if err := matterBridge.Start(ctx); err != nil {
-		log.Error("Failed to start Matter bridge: %v", err)
-		// Continue anyway - Matter bridge might not be built yet
-	}
+	// Start Matter bridge subprocess under supervision. Failures are retried
+	// with backoff, so a bridge that isn't built yet doesn't stop the service.
+	matterSupervisor.SetStartedHandler(svc.handleMatterStarted)
+	matterSupervisor.SetRestartHandler(svc.handleMatterRestart)
+	go matterSupervisor.Run(ctx)
 
 	// Set up command handler for HomeKit commands
-	matterBridge.SetCommandHandler(func(cmd matter.Command) error {
-		return svc.handleMatterCommand(ctx, cmd)
+	matterBridge.SetCommandHandler(svc.runMatterCommand)
+	matterBridge.SetDeviceResolver(svc.defaultMatterDevice)
+
+	// Persist commissioning changes so they outlive the bridge process
+	matterBridge.SetCommissioningHandler(func(event matter.Event) {
+		commissioning.HandleEvent(ctx, event)
+	})
+
+	// Apply device settings to the Matter bridge now and whenever they change
+	for _, ds := range deviceSettings.All() {
+		svc.syncMatterSettings(ds)
+	}
+	deviceSettings.SetChangedHandler(func(prev, ds storage.DeviceSettings) {
+		svc.handleDeviceSettingsChanged(ctx, prev, ds)
 	})
 
 	// Start polling loop
 	go svc.runPollingLoop(ctx)
 
+	// Start schedule engine
+	scheduleEngine.SetAppliedHandler(svc.handleScheduleApplied)
+	go scheduleEngine.Run(ctx)
+
+	// Start automation engine
+	automationEngine.SetAppliedHandler(svc.handleRuleApplied)
+	go automationEngine.Run(ctx)
+
+	// Start command outbox
+	commandOutbox.SetAppliedHandler(svc.handleQueuedCommandApplied)
+	go commandOutbox.Run(ctx)
+
+	// Start reading history maintenance
+	go historyRecorder.Run(ctx)
+
+	// Start weekly runtime summaries
+	go runtimeTracker.Run(ctx)
+
+	// Start monthly energy cost summaries
+	go energyEstimator.Run(ctx)
+
+	// Start event log retention
+	go retentionJob.Run(ctx)
+
 	// Start web server
 	log.Info("Starting web server on port %d", cfg.ServerPort)
 	if err := webServer.Run(ctx); err != nil {
@@ -145,15 +301,36 @@ func main() {
 
 // Service orchestrates the bridge components
 type Service struct {
-	cfg          *config.Config
-	db           *storage.DB
-	encKey       *storage.EncryptionKey
-	tccClient    *tcc.Client
-	matterBridge *matter.Bridge
+	cfg            *config.Config
+	db             *storage.DB
+	encKey         *storage.EncryptionKey
+	tccClient      *tcc.Client
+	matterBridge   *matter.Bridge
+	matterSup      *matter.Supervisor
+	commissioning  *matter.Commissioning
+	endpoints      *matter.Endpoints
+	settings       *devices.Settings
+	pollScheduler  *polling.Scheduler
+	commands       *provenance.Tracker
+	conflictPolicy provenance.Policy
+	scheduleEngine *schedule.Engine
+	guard          *policy.Enforcer
+	automation     *automation.Engine
+	outbox         *outbox.Outbox
+	history        *history.Recorder
+	runtime        *hvac.Tracker
+	energy         *energy.Estimator
+	retention      *retention.Job
+}
+
+// GetDB returns the store
+func (s *Service) GetDB() storage.Store {
+	return s.db
 }
 
-// GetDB returns the database
-func (s *Service) GetDB() *storage.DB {
+// GetSQLiteDB returns the database for maintenance only SQLite supports:
+// backups and encryption key rotation
+func (s *Service) GetSQLiteDB() *storage.DB {
 	return s.db
 }
 
@@ -177,46 +354,211 @@ func (s *Service) GetConfig() *config.Config {
 	return s.cfg
 }
 
-// runPollingLoop polls TCC at regular intervals
-func (s *Service) runPollingLoop(ctx context.Context) {
-	log.Info("Starting TCC polling loop (interval: %d seconds)", s.cfg.TCCPollInterval)
+// GetMatterSupervisor returns the Matter bridge supervisor
+func (s *Service) GetMatterSupervisor() *matter.Supervisor {
+	return s.matterSup
+}
 
-	// Initial poll
-	s.pollTCC(ctx)
+// GetMatterCommissioning returns the Matter commissioning state keeper
+func (s *Service) GetMatterCommissioning() *matter.Commissioning {
+	return s.commissioning
+}
 
-	ticker := time.NewTicker(time.Duration(s.cfg.TCCPollInterval) * time.Second)
-	defer ticker.Stop()
+// GetDeviceSettings returns the per-device settings
+func (s *Service) GetDeviceSettings() *devices.Settings {
+	return s.settings
+}
+
+// GetPollScheduler returns the TCC polling scheduler
+func (s *Service) GetPollScheduler() *polling.Scheduler {
+	return s.pollScheduler
+}
+
+// GetCommandTracker returns the command provenance tracker
+func (s *Service) GetCommandTracker() *provenance.Tracker {
+	return s.commands
+}
+
+// GetScheduleEngine returns the local schedule engine
+func (s *Service) GetScheduleEngine() *schedule.Engine {
+	return s.scheduleEngine
+}
+
+// GetPolicyEnforcer returns the command policy enforcer
+func (s *Service) GetPolicyEnforcer() *policy.Enforcer {
+	return s.guard
+}
+
+// GetOutbox returns the offline command outbox
+func (s *Service) GetOutbox() *outbox.Outbox {
+	return s.outbox
+}
+
+// GetHistory returns the reading history recorder
+func (s *Service) GetHistory() *history.Recorder {
+	return s.history
+}
+
+// GetRuntimeTracker returns the HVAC runtime tracker
+func (s *Service) GetRuntimeTracker() *hvac.Tracker {
+	return s.runtime
+}
+
+// GetEnergyEstimator returns the energy cost estimator
+func (s *Service) GetEnergyEstimator() *energy.Estimator {
+	return s.energy
+}
+
+// GetRetentionJob returns the event log retention job
+func (s *Service) GetRetentionJob() *retention.Job {
+	return s.retention
+}
+
+// handleScheduleApplied tracks changes made by the schedule engine so the
+// next poll recognises them as echoes
+func (s *Service) handleScheduleApplied(ctx context.Context, sched *storage.Schedule, target *schedule.Target) {
+	if target.SystemMode != "" {
+		s.commands.RecordMode(sched.DeviceID, target.SystemMode, storage.EventSourceSchedule)
+	}
+	if target.HeatSetpoint != nil {
+		s.commands.RecordSetpoint(sched.DeviceID, provenance.FieldHeatSetpoint, *target.HeatSetpoint, storage.EventSourceSchedule)
+	}
+	if target.CoolSetpoint != nil {
+		s.commands.RecordSetpoint(sched.DeviceID, provenance.FieldCoolSetpoint, *target.CoolSetpoint, storage.EventSourceSchedule)
+	}
+	if state, err := s.db.GetThermostatStateByDeviceID(sched.DeviceID); err == nil && state != nil && state.ActivePreset != "" {
+		s.clearActivePreset(ctx, sched.DeviceID, state.ActivePreset, fmt.Sprintf("schedule %q applied", sched.Name))
+	}
+	s.pollScheduler.NoteCommand()
+}
+
+// handleRuleApplied tracks changes made by automation rules so the next
+// poll recognises them as echoes
+func (s *Service) handleRuleApplied(ctx context.Context, rule *storage.AutomationRule, deviceID int, action storage.RuleAction) {
+	switch action.Type {
+	case automation.ActionSetMode:
+		s.commands.RecordMode(deviceID, action.Mode, storage.EventSourceAutomation)
+	case automation.ActionSetHeatSetpoint:
+		s.commands.RecordSetpoint(deviceID, provenance.FieldHeatSetpoint, *action.Value, storage.EventSourceAutomation)
+	case automation.ActionSetCoolSetpoint:
+		s.commands.RecordSetpoint(deviceID, provenance.FieldCoolSetpoint, *action.Value, storage.EventSourceAutomation)
+	}
+	if state, err := s.db.GetThermostatStateByDeviceID(deviceID); err == nil && state != nil && state.ActivePreset != "" {
+		s.clearActivePreset(ctx, deviceID, state.ActivePreset, fmt.Sprintf("rule %q applied", rule.Name))
+	}
+	s.pollScheduler.NoteCommand()
+}
+
+// handleQueuedCommandApplied tracks queued commands replayed by the outbox
+// so the next poll recognises them as echoes
+func (s *Service) handleQueuedCommandApplied(ctx context.Context, cmd *storage.QueuedCommand) {
+	field := provenance.Field(cmd.Field)
+	if field == provenance.FieldSystemMode {
+		s.commands.RecordMode(cmd.DeviceID, cmd.SystemMode, cmd.Source)
+	} else if cmd.Setpoint != nil {
+		s.commands.RecordSetpoint(cmd.DeviceID, field, *cmd.Setpoint, cmd.Source)
+	}
+	s.pollScheduler.NoteCommand()
+}
+
+// newPollScheduler builds the adaptive polling scheduler from configuration
+func newPollScheduler(cfg *config.Config) (*polling.Scheduler, error) {
+	quietStart, err := polling.ParseClock(cfg.TCCQuietHoursStart)
+	if err != nil {
+		return nil, err
+	}
+	quietEnd, err := polling.ParseClock(cfg.TCCQuietHoursEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := make(map[int]polling.Priority, len(cfg.TCCDevicePriorities))
+	for deviceID, p := range cfg.TCCDevicePriorities {
+		switch polling.Priority(p) {
+		case polling.PriorityHigh, polling.PriorityNormal, polling.PriorityLow:
+			priorities[deviceID] = polling.Priority(p)
+		default:
+			return nil, fmt.Errorf("invalid priority %q for device %d", p, deviceID)
+		}
+	}
+
+	seconds := func(n int) time.Duration { return time.Duration(n) * time.Second }
+	return polling.NewScheduler(polling.Options{
+		BaseInterval:  seconds(cfg.TCCPollInterval),
+		MinInterval:   minPollInterval(cfg),
+		BoostInterval: seconds(cfg.TCCBoostPollInterval),
+		BoostWindow:   seconds(cfg.TCCBoostWindow),
+		IdleInterval:  seconds(cfg.TCCIdlePollInterval),
+		IdleAfter:     seconds(cfg.TCCIdleAfter),
+		QuietInterval: seconds(cfg.TCCQuietPollInterval),
+		QuietStart:    quietStart,
+		QuietEnd:      quietEnd,
+		MaxBackoff:    seconds(cfg.TCCMaxBackoff),
+		Priorities:    priorities,
+	}), nil
+}
+
+// minPollInterval returns the configured polling floor. Anything below
+// TCC's request budget must be enabled with tcc_allow_fast_polling.
+func minPollInterval(cfg *config.Config) time.Duration {
+	interval := time.Duration(cfg.TCCMinPollInterval) * time.Second
+	if interval < tcc.MinPollInterval && !cfg.TCCAllowFastPolling {
+		log.Warn("Ignoring minimum poll interval of %s: below TCC's %s budget without tcc_allow_fast_polling",
+			interval, tcc.MinPollInterval)
+		return tcc.MinPollInterval
+	}
+	return interval
+}
+
+// runPollingLoop polls TCC on the schedule chosen by the polling scheduler
+func (s *Service) runPollingLoop(ctx context.Context) {
+	log.Info("Starting TCC polling loop (base interval: %d seconds, minimum: %d seconds)",
+		s.cfg.TCCPollInterval, s.cfg.TCCMinPollInterval)
 
 	for {
+		timer := time.NewTimer(time.Until(s.pollScheduler.Next()))
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return
-		case <-ticker.C:
-			s.pollTCC(ctx)
+		case <-s.pollScheduler.Wake():
+			// Next poll time moved (e.g. a command started a boost window)
+			timer.Stop()
+		case <-timer.C:
+			deviceIDs, err := s.pollTCC(ctx)
+			if err == nil {
+				// TCC is reachable, so replay anything queued while it wasn't
+				s.outbox.Kick()
+			}
+			next := s.pollScheduler.Done(deviceIDs, err)
+			status := s.pollScheduler.Status()
+			log.Debug("Next TCC poll at %s (mode: %s, interval: %d seconds)",
+				next.Format(time.RFC3339), status.Mode, status.IntervalSeconds)
 		}
 	}
 }
 
-// handleMatterCommand processes commands from HomeKit via Matter bridge
+// handleMatterCommand processes commands from HomeKit via Matter bridge for
+// the device cmd.DeviceID
 func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) error {
-	log.Debug("Processing HomeKit command: %s = %v", cmd.Action, cmd.Value)
+	ctx = log.WithCorrelationID(ctx, log.NewCorrelationID())
+	log.FromContext(ctx).Debug("Processing HomeKit command: %s = %v", cmd.Action, cmd.Value)
+	s.pollScheduler.NoteCommand()
+
+	deviceID := cmd.DeviceID
 
-	// Get device ID from database (for now, use first device)
-	state, err := s.db.GetThermostatState()
+	// Get old state for logging
+	oldState, err := s.db.GetThermostatStateByDeviceID(deviceID)
 	if err != nil {
 		return fmt.Errorf("failed to get thermostat state: %w", err)
 	}
-	deviceID := state.DeviceID
-
-	// Get old state for logging
-	oldState, _ := s.db.GetThermostatStateByDeviceID(deviceID)
 
 	// Process the command
 	switch cmd.Action {
 	case "setSystemMode":
 		mode, ok := cmd.Value.(string)
 		if !ok {
-			return fmt.Errorf("invalid system mode value type")
+			return matter.NewCommandError(matter.ResultInvalid, fmt.Errorf("invalid system mode value type"))
 		}
 
 		oldMode := "unknown"
@@ -224,17 +566,33 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 			oldMode = oldState.SystemMode.String()
 		}
 
+		if err := s.guard.CheckMode(ctx, storage.EventSourceHomeKit, deviceID, mode); err != nil {
+			return err
+		}
+
 		// Set mode in TCC
 		if err := s.tccClient.SetSystemMode(ctx, deviceID, mode); err != nil {
-			log.Error("Failed to set mode from HomeKit: %v", err)
+			if s.outbox.Enabled() && tcc.IsUnavailable(err) {
+				if _, qerr := s.outbox.EnqueueMode(ctx, storage.EventSourceHomeKit, deviceID, mode, err); qerr == nil {
+					return errCommandQueued
+				}
+			}
+			log.FromContext(ctx).Error("Failed to set mode from HomeKit: %v", err)
 			return err
 		}
+		s.commands.RecordMode(deviceID, mode, storage.EventSourceHomeKit)
+
+		if oldState != nil && oldState.ActivePreset != "" {
+			s.clearActivePreset(ctx, deviceID, oldState.ActivePreset, "overridden from HomeKit")
+		}
 
 		// Fetch updated state
 		updatedDevice, err := s.tccClient.GetDeviceData(ctx, deviceID)
 		if err != nil {
-			log.Warn("Failed to fetch updated state after HomeKit mode change: %v", err)
+			log.FromContext(ctx).Warn("Failed to fetch updated state after HomeKit mode change: %v", err)
 		} else {
+			s.settings.Apply(updatedDevice)
+
 			// Save to database
 			newState := &storage.ThermostatState{
 				DeviceID:     updatedDevice.DeviceID,
@@ -246,15 +604,17 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 				Humidity:     updatedDevice.Humidity,
 				IsHeating:    updatedDevice.IsHeating,
 				IsCooling:    updatedDevice.IsCooling,
+				OutdoorTemp:  updatedDevice.OutdoorTemp,
 			}
 			s.db.SaveThermostatState(newState)
+			s.commands.Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
 
 			// Update Matter bridge
 			s.matterBridge.UpdateState(ctx, *updatedDevice)
 		}
 
 		// Log the change
-		s.db.LogEvent(storage.EventSourceHomeKit, storage.EventTypeModeChange,
+		s.db.LogEventContext(ctx, storage.EventSourceHomeKit, storage.EventTypeModeChange,
 			fmt.Sprintf("Mode changed from %s to %s", oldMode, mode),
 			map[string]interface{}{
 				"device_id": deviceID,
@@ -262,33 +622,50 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 				"new_mode":  mode,
 			})
 
-		log.Info("HomeKit: Mode changed from %s to %s", oldMode, mode)
+		log.FromContext(ctx).Info("HomeKit: Mode changed from %s to %s", oldMode, mode)
 
 	case "setHeatingSetpoint":
 		// Value comes in Celsius, need to convert to Fahrenheit
 		celsius, ok := cmd.Value.(float64)
 		if !ok {
-			return fmt.Errorf("invalid setpoint value type")
+			return matter.NewCommandError(matter.ResultInvalid, fmt.Errorf("invalid setpoint value type"))
 		}
 		fahrenheit := celsius*9/5 + 32
-		log.Debug("HomeKit set heating setpoint request: device=%d celsius=%.3f fahrenheit=%.3f", deviceID, celsius, fahrenheit)
+		log.FromContext(ctx).Debug("HomeKit set heating setpoint request: device=%d celsius=%.3f fahrenheit=%.3f", deviceID, celsius, fahrenheit)
 
 		oldSetpoint := 0.0
 		if oldState != nil {
 			oldSetpoint = oldState.HeatSetpoint
 		}
 
+		fahrenheit, err = s.guard.CheckSetpoint(ctx, storage.EventSourceHomeKit, deviceID, "heat", fahrenheit)
+		if err != nil {
+			return err
+		}
+
 		// Set heat setpoint in TCC
 		if err := s.tccClient.SetHeatSetpoint(ctx, deviceID, fahrenheit); err != nil {
-			log.Error("Failed to set heat setpoint from HomeKit: %v", err)
+			if s.outbox.Enabled() && tcc.IsUnavailable(err) {
+				if _, qerr := s.outbox.EnqueueSetpoint(ctx, storage.EventSourceHomeKit, deviceID, provenance.FieldHeatSetpoint, fahrenheit, err); qerr == nil {
+					return errCommandQueued
+				}
+			}
+			log.FromContext(ctx).Error("Failed to set heat setpoint from HomeKit: %v", err)
 			return err
 		}
+		s.commands.RecordSetpoint(deviceID, provenance.FieldHeatSetpoint, fahrenheit, storage.EventSourceHomeKit)
+
+		if oldState != nil && oldState.ActivePreset != "" {
+			s.clearActivePreset(ctx, deviceID, oldState.ActivePreset, "overridden from HomeKit")
+		}
 
 		// Fetch updated state
 		updatedDevice, err := s.tccClient.GetDeviceData(ctx, deviceID)
 		if err != nil {
-			log.Warn("Failed to fetch updated state after HomeKit setpoint change: %v", err)
+			log.FromContext(ctx).Warn("Failed to fetch updated state after HomeKit setpoint change: %v", err)
 		} else {
+			s.settings.Apply(updatedDevice)
+
 			// Save to database
 			newState := &storage.ThermostatState{
 				DeviceID:     updatedDevice.DeviceID,
@@ -300,15 +677,17 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 				Humidity:     updatedDevice.Humidity,
 				IsHeating:    updatedDevice.IsHeating,
 				IsCooling:    updatedDevice.IsCooling,
+				OutdoorTemp:  updatedDevice.OutdoorTemp,
 			}
 			s.db.SaveThermostatState(newState)
+			s.commands.Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
 
 			// Update Matter bridge
 			s.matterBridge.UpdateState(ctx, *updatedDevice)
 		}
 
 		// Log the change
-		s.db.LogEvent(storage.EventSourceHomeKit, storage.EventTypeTempChange,
+		s.db.LogEventContext(ctx, storage.EventSourceHomeKit, storage.EventTypeTempChange,
 			fmt.Sprintf("Heat setpoint changed from %.1f°F to %.1f°F", oldSetpoint, fahrenheit),
 			map[string]interface{}{
 				"device_id":     deviceID,
@@ -318,33 +697,50 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 				"raw_celsius":   celsius,
 			})
 
-		log.Info("HomeKit: Heat setpoint changed from %.1f°F to %.1f°F", oldSetpoint, fahrenheit)
+		log.FromContext(ctx).Info("HomeKit: Heat setpoint changed from %.1f°F to %.1f°F", oldSetpoint, fahrenheit)
 
 	case "setCoolingSetpoint":
 		// Value comes in Celsius, need to convert to Fahrenheit
 		celsius, ok := cmd.Value.(float64)
 		if !ok {
-			return fmt.Errorf("invalid setpoint value type")
+			return matter.NewCommandError(matter.ResultInvalid, fmt.Errorf("invalid setpoint value type"))
 		}
 		fahrenheit := celsius*9/5 + 32
-		log.Debug("HomeKit set cooling setpoint request: device=%d celsius=%.3f fahrenheit=%.3f", deviceID, celsius, fahrenheit)
+		log.FromContext(ctx).Debug("HomeKit set cooling setpoint request: device=%d celsius=%.3f fahrenheit=%.3f", deviceID, celsius, fahrenheit)
 
 		oldSetpoint := 0.0
 		if oldState != nil {
 			oldSetpoint = oldState.CoolSetpoint
 		}
 
+		fahrenheit, err = s.guard.CheckSetpoint(ctx, storage.EventSourceHomeKit, deviceID, "cool", fahrenheit)
+		if err != nil {
+			return err
+		}
+
 		// Set cool setpoint in TCC
 		if err := s.tccClient.SetCoolSetpoint(ctx, deviceID, fahrenheit); err != nil {
-			log.Error("Failed to set cool setpoint from HomeKit: %v", err)
+			if s.outbox.Enabled() && tcc.IsUnavailable(err) {
+				if _, qerr := s.outbox.EnqueueSetpoint(ctx, storage.EventSourceHomeKit, deviceID, provenance.FieldCoolSetpoint, fahrenheit, err); qerr == nil {
+					return errCommandQueued
+				}
+			}
+			log.FromContext(ctx).Error("Failed to set cool setpoint from HomeKit: %v", err)
 			return err
 		}
+		s.commands.RecordSetpoint(deviceID, provenance.FieldCoolSetpoint, fahrenheit, storage.EventSourceHomeKit)
+
+		if oldState != nil && oldState.ActivePreset != "" {
+			s.clearActivePreset(ctx, deviceID, oldState.ActivePreset, "overridden from HomeKit")
+		}
 
 		// Fetch updated state
 		updatedDevice, err := s.tccClient.GetDeviceData(ctx, deviceID)
 		if err != nil {
-			log.Warn("Failed to fetch updated state after HomeKit setpoint change: %v", err)
+			log.FromContext(ctx).Warn("Failed to fetch updated state after HomeKit setpoint change: %v", err)
 		} else {
+			s.settings.Apply(updatedDevice)
+
 			// Save to database
 			newState := &storage.ThermostatState{
 				DeviceID:     updatedDevice.DeviceID,
@@ -356,15 +752,17 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 				Humidity:     updatedDevice.Humidity,
 				IsHeating:    updatedDevice.IsHeating,
 				IsCooling:    updatedDevice.IsCooling,
+				OutdoorTemp:  updatedDevice.OutdoorTemp,
 			}
 			s.db.SaveThermostatState(newState)
+			s.commands.Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
 
 			// Update Matter bridge
 			s.matterBridge.UpdateState(ctx, *updatedDevice)
 		}
 
 		// Log the change
-		s.db.LogEvent(storage.EventSourceHomeKit, storage.EventTypeTempChange,
+		s.db.LogEventContext(ctx, storage.EventSourceHomeKit, storage.EventTypeTempChange,
 			fmt.Sprintf("Cool setpoint changed from %.1f°F to %.1f°F", oldSetpoint, fahrenheit),
 			map[string]interface{}{
 				"device_id":     deviceID,
@@ -374,35 +772,45 @@ func (s *Service) handleMatterCommand(ctx context.Context, cmd matter.Command) e
 				"raw_celsius":   celsius,
 			})
 
-		log.Info("HomeKit: Cool setpoint changed from %.1f°F to %.1f°F", oldSetpoint, fahrenheit)
+		log.FromContext(ctx).Info("HomeKit: Cool setpoint changed from %.1f°F to %.1f°F", oldSetpoint, fahrenheit)
+
+	case "setActivePreset":
+		name, ok := cmd.Value.(string)
+		if !ok {
+			return matter.NewCommandError(matter.ResultInvalid, fmt.Errorf("invalid preset value type"))
+		}
+		return s.applyMatterPreset(ctx, deviceID, name)
 
 	default:
-		log.Warn("Unknown HomeKit command: %s", cmd.Action)
-		return fmt.Errorf("unknown command: %s", cmd.Action)
+		log.FromContext(ctx).Warn("Unknown HomeKit command: %s", cmd.Action)
+		return matter.NewCommandError(matter.ResultInvalid, fmt.Errorf("unknown command: %s", cmd.Action))
 	}
 
 	return nil
 }
 
-func (s *Service) pollTCC(ctx context.Context) {
+// pollTCC fetches all devices from TCC, records changes and returns the
+// polled device IDs
+func (s *Service) pollTCC(ctx context.Context) ([]int, error) {
+	ctx = log.WithCorrelationID(ctx, log.NewCorrelationID())
 	if !s.tccClient.IsAuthenticated() {
 		// Try to authenticate
 		if err := s.tccClient.Login(ctx); err != nil {
 			// Check for rate limiting
 			if strings.Contains(err.Error(), "rate_limited") {
-				log.Warn("TCC rate limited: %v", err)
-				s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeError,
+				log.FromContext(ctx).Warn("TCC rate limited: %v", err)
+				s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeError,
 					"Rate limited by TCC API", map[string]interface{}{"error": err.Error()})
 			} else if strings.Contains(err.Error(), "deadline exceeded") || strings.Contains(err.Error(), "connection refused") {
-				log.Error("TCC connection failed: %v", err)
-				s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeError,
+				log.FromContext(ctx).Error("TCC connection failed: %v", err)
+				s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeError,
 					"Connection to TCC failed (timeout or network error)", map[string]interface{}{"error": err.Error()})
 			} else {
-				log.Warn("TCC login failed: %v", err)
-				s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeError,
+				log.FromContext(ctx).Warn("TCC login failed: %v", err)
+				s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeError,
 					fmt.Sprintf("Login failed: %v", err), nil)
 			}
-			return
+			return nil, err
 		}
 	}
 
@@ -410,18 +818,25 @@ func (s *Service) pollTCC(ctx context.Context) {
 	if err != nil {
 		// Check for rate limiting
 		if strings.Contains(err.Error(), "rate_limited") || strings.Contains(err.Error(), "rate limit") {
-			log.Warn("TCC rate limited: %v", err)
-			s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeError,
+			log.FromContext(ctx).Warn("TCC rate limited: %v", err)
+			s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeError,
 				"Rate limited by TCC API", map[string]interface{}{"error": err.Error()})
 		} else {
-			log.Error("Failed to poll TCC: %v", err)
-			s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeError,
+			log.FromContext(ctx).Error("Failed to poll TCC: %v", err)
+			s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeError,
 				fmt.Sprintf("Poll failed: %v", err), nil)
 		}
-		return
+		return nil, err
 	}
 
+	// Bridge every device before pushing state for any of them
+	s.syncMatterDevices(ctx, devices)
+
+	deviceIDs := make([]int, 0, len(devices))
 	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.DeviceID)
+		s.settings.Apply(&device)
+
 		// Get previous state to detect changes
 		prevState, _ := s.db.GetThermostatStateByDeviceID(device.DeviceID)
 
@@ -457,44 +872,93 @@ func (s *Service) pollTCC(ctx context.Context) {
 			Humidity:     device.Humidity,
 			IsHeating:    device.IsHeating,
 			IsCooling:    device.IsCooling,
+			OutdoorTemp:  device.OutdoorTemp,
 		}
 		if err := s.db.SaveThermostatState(state); err != nil {
-			log.Error("Failed to save thermostat state: %v", err)
+			log.FromContext(ctx).Error("Failed to save thermostat state: %v", err)
 		}
+		s.history.Record(ctx, device)
+		s.runtime.Observe(ctx, device)
 
 		// Only log and push to Matter if values changed
 		if hasChanges {
+			scheduled := device.HoldStatus == tcc.HoldStatusSchedule
+			var conflicts []provenance.Result
+			presetOverridden := false
 			if prevState != nil && heatChanged {
-				log.Debug("TCC poll: heat setpoint changed from %.2f°F to %.2f°F", prevState.HeatSetpoint, device.HeatSetpoint)
-				s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeTempChange,
-					fmt.Sprintf("Heat setpoint changed from %.1f°F to %.1f°F (TCC poll)", prevState.HeatSetpoint, device.HeatSetpoint),
+				result := s.commands.ClassifySetpoint(device.DeviceID, provenance.FieldHeatSetpoint, device.HeatSetpoint, scheduled)
+				log.FromContext(ctx).Debug("TCC poll: heat setpoint changed from %.2f°F to %.2f°F (%s)", prevState.HeatSetpoint, device.HeatSetpoint, result.Describe())
+				s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeTempChange,
+					fmt.Sprintf("Heat setpoint changed from %.1f°F to %.1f°F (TCC poll: %s)", prevState.HeatSetpoint, device.HeatSetpoint, result.Describe()),
 					map[string]interface{}{
-						"device_id":     device.DeviceID,
-						"type":          "heat",
-						"old_setpoint":  prevState.HeatSetpoint,
-						"new_setpoint":  device.HeatSetpoint,
-						"current_temp":  device.CurrentTemp,
-						"system_mode":   device.SystemMode,
-						"change_source": "tcc_poll",
+						"device_id":      device.DeviceID,
+						"type":           "heat",
+						"old_setpoint":   prevState.HeatSetpoint,
+						"new_setpoint":   device.HeatSetpoint,
+						"current_temp":   device.CurrentTemp,
+						"system_mode":    device.SystemMode,
+						"hold_status":    device.HoldStatus,
+						"change_source":  "tcc_poll",
+						"classification": result.Class,
 					})
+				if result.Conflict {
+					conflicts = append(conflicts, result)
+				}
+				if result.Class != provenance.ClassEcho {
+					presetOverridden = true
+				}
 			}
 			if prevState != nil && coolChanged {
-				log.Debug("TCC poll: cool setpoint changed from %.2f°F to %.2f°F", prevState.CoolSetpoint, device.CoolSetpoint)
-				s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeTempChange,
-					fmt.Sprintf("Cool setpoint changed from %.1f°F to %.1f°F (TCC poll)", prevState.CoolSetpoint, device.CoolSetpoint),
+				result := s.commands.ClassifySetpoint(device.DeviceID, provenance.FieldCoolSetpoint, device.CoolSetpoint, scheduled)
+				log.FromContext(ctx).Debug("TCC poll: cool setpoint changed from %.2f°F to %.2f°F (%s)", prevState.CoolSetpoint, device.CoolSetpoint, result.Describe())
+				s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeTempChange,
+					fmt.Sprintf("Cool setpoint changed from %.1f°F to %.1f°F (TCC poll: %s)", prevState.CoolSetpoint, device.CoolSetpoint, result.Describe()),
 					map[string]interface{}{
-						"device_id":     device.DeviceID,
-						"type":          "cool",
-						"old_setpoint":  prevState.CoolSetpoint,
-						"new_setpoint":  device.CoolSetpoint,
-						"current_temp":  device.CurrentTemp,
-						"system_mode":   device.SystemMode,
-						"change_source": "tcc_poll",
+						"device_id":      device.DeviceID,
+						"type":           "cool",
+						"old_setpoint":   prevState.CoolSetpoint,
+						"new_setpoint":   device.CoolSetpoint,
+						"current_temp":   device.CurrentTemp,
+						"system_mode":    device.SystemMode,
+						"hold_status":    device.HoldStatus,
+						"change_source":  "tcc_poll",
+						"classification": result.Class,
 					})
+				if result.Conflict {
+					conflicts = append(conflicts, result)
+				}
+				if result.Class != provenance.ClassEcho {
+					presetOverridden = true
+				}
+			}
+			if prevState != nil && modeChanged {
+				result := s.commands.ClassifyMode(device.DeviceID, device.SystemMode)
+				log.FromContext(ctx).Debug("TCC poll: mode changed from %s to %s (%s)", prevState.SystemMode, device.SystemMode, result.Describe())
+				s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeModeChange,
+					fmt.Sprintf("Mode changed from %s to %s (TCC poll: %s)", prevState.SystemMode, device.SystemMode, result.Describe()),
+					map[string]interface{}{
+						"device_id":      device.DeviceID,
+						"old_mode":       prevState.SystemMode.String(),
+						"new_mode":       device.SystemMode,
+						"change_source":  "tcc_poll",
+						"classification": result.Class,
+					})
+				if result.Conflict {
+					conflicts = append(conflicts, result)
+				}
+				if result.Class != provenance.ClassEcho {
+					presetOverridden = true
+				}
+			}
+			for _, conflict := range conflicts {
+				s.resolveConflict(ctx, device, conflict)
+			}
+			if presetOverridden && prevState.ActivePreset != "" {
+				s.clearActivePreset(ctx, device.DeviceID, prevState.ActivePreset, "changed outside the bridge")
 			}
 
 			// Log state change from TCC
-			s.db.LogEvent(storage.EventSourceTCC, storage.EventTypeStateChange,
+			s.db.LogEventContext(ctx, storage.EventSourceTCC, storage.EventTypeStateChange,
 				fmt.Sprintf("State changed: temp=%.1f°F, heat=%.1f°F, cool=%.1f°F, mode=%s",
 					device.CurrentTemp, device.HeatSetpoint, device.CoolSetpoint, device.SystemMode),
 				map[string]interface{}{
@@ -507,10 +971,11 @@ func (s *Service) pollTCC(ctx context.Context) {
 				})
 
 			// Push to Matter bridge
+			s.syncMatterPresets(ctx, device.DeviceID)
 			if err := s.matterBridge.UpdateState(ctx, device); err != nil {
-				log.Debug("Failed to update Matter state: %v", err)
+				log.FromContext(ctx).Debug("Failed to update Matter state: %v", err)
 			} else {
-				s.db.LogEvent(storage.EventSourceMatter, storage.EventTypeStateChange,
+				s.db.LogEventContext(ctx, storage.EventSourceMatter, storage.EventTypeStateChange,
 					fmt.Sprintf("Sent to HomeKit: temp=%.1f°F, heat=%.1f°F, cool=%.1f°F, mode=%s",
 						device.CurrentTemp, device.HeatSetpoint, device.CoolSetpoint, device.SystemMode),
 					map[string]interface{}{
@@ -522,7 +987,11 @@ func (s *Service) pollTCC(ctx context.Context) {
 					})
 			}
 		}
+
+		// Let automation rules react to the new state
+		s.automation.HandleState(ctx, prevState, device)
 	}
 
-	log.Debug("Polled %d devices from TCC", len(devices))
+	log.FromContext(ctx).Debug("Polled %d devices from TCC", len(devices))
+	return deviceIDs, nil
 }
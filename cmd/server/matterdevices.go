@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// thermostatFromStored converts stored state back to the TCC form the
+// Matter bridge takes
+func thermostatFromStored(state *storage.ThermostatState) tcc.ThermostatState {
+	return tcc.ThermostatState{
+		DeviceID:     state.DeviceID,
+		Name:         state.Name,
+		CurrentTemp:  state.CurrentTemp,
+		HeatSetpoint: state.HeatSetpoint,
+		CoolSetpoint: state.CoolSetpoint,
+		SystemMode:   state.SystemMode.String(),
+		Humidity:     state.Humidity,
+		IsHeating:    state.IsHeating,
+		IsCooling:    state.IsCooling,
+		UpdatedAt:    state.UpdatedAt,
+	}
+}
+
+// syncMatterDevices bridges every device that isn't hidden from Matter on
+// its own endpoint and removes any others. Newly bridged devices are sent
+// their stored state. It returns the IDs of those devices.
+func (s *Service) syncMatterDevices(ctx context.Context, devices []tcc.ThermostatState) []int {
+	bridged := make([]matter.BridgedDevice, 0, len(devices))
+	for _, device := range devices {
+		ds := s.settings.Get(device.DeviceID)
+		if ds.HideFromMatter {
+			continue
+		}
+
+		ep, err := s.endpoints.Assign(device.DeviceID)
+		if err != nil {
+			log.FromContext(ctx).Error("Failed to assign Matter endpoint for device %d: %v", device.DeviceID, err)
+			continue
+		}
+
+		name := device.Name
+		if ds.DisplayName != "" {
+			name = ds.DisplayName
+		}
+		bridged = append(bridged, matter.BridgedDevice{
+			DeviceID:         device.DeviceID,
+			Endpoint:         ep.Endpoint,
+			HumidityEndpoint: ep.HumidityEndpoint,
+			Name:             name,
+		})
+	}
+
+	added, err := s.matterBridge.SyncDevices(ctx, bridged)
+	if err != nil {
+		log.FromContext(ctx).Warn("Failed to sync devices with Matter bridge: %v", err)
+	}
+
+	for _, deviceID := range added {
+		log.FromContext(ctx).Info("Bridged device %d to Matter", deviceID)
+		s.pushStoredMatterState(ctx, deviceID)
+	}
+	return added
+}
+
+// syncStoredMatterDevices bridges every device with stored state
+func (s *Service) syncStoredMatterDevices(ctx context.Context) []int {
+	states, err := s.db.GetAllThermostatStates()
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to load thermostat states for Matter bridge: %v", err)
+		return nil
+	}
+
+	devices := make([]tcc.ThermostatState, 0, len(states))
+	for i := range states {
+		devices = append(devices, thermostatFromStored(&states[i]))
+	}
+	return s.syncMatterDevices(ctx, devices)
+}
+
+// pushStoredMatterState sends a device's presets and last known state to
+// the Matter bridge
+func (s *Service) pushStoredMatterState(ctx context.Context, deviceID int) {
+	state, err := s.db.GetThermostatStateByDeviceID(deviceID)
+	if err != nil || state == nil {
+		return // Not polled yet
+	}
+
+	s.syncMatterPresets(ctx, deviceID)
+	if err := s.matterBridge.UpdateState(ctx, thermostatFromStored(state)); err != nil {
+		log.FromContext(ctx).Warn("Failed to send state for device %d to Matter bridge: %v", deviceID, err)
+	}
+}
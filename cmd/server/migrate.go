@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// runMigrate implements "tcc-bridge migrate status|up|down". Stop the
+// service before migrating; up and down back the database up first.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file")
+	to := fs.Int("to", -1, "Target schema version (default latest for up, one step back for down)")
+	dryRun := fs.Bool("dry-run", false, "Print the migrations that would run without applying them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: tcc-bridge migrate [flags] status|up|down")
+		fs.PrintDefaults()
+	}
+
+	// Accept the action before or after the flags
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if action == "" && fs.NArg() > 0 {
+		action = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	if err := cfg.EnsureDataDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create data directory: %v\n", err)
+		return 1
+	}
+
+	db, err := storage.OpenUnmigrated(cfg.DatabasePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if action == "status" {
+		return printMigrationStatus(db)
+	}
+	if action != "up" && action != "down" {
+		fs.Usage()
+		return 2
+	}
+
+	current, err := db.MigrationVersion()
+	if err != nil {
+		// A new database has no migrations table yet
+		current = 0
+	}
+	target := *to
+	if target < 0 {
+		target = storage.LatestMigrationVersion()
+		if action == "down" {
+			target = current - 1
+		}
+	}
+	if action == "up" && target < current {
+		fmt.Fprintf(os.Stderr, "Database is at version %d; use down to go back to %d\n", current, target)
+		return 1
+	}
+	if action == "down" && target > current {
+		fmt.Fprintf(os.Stderr, "Database is at version %d; use up to go forward to %d\n", current, target)
+		return 1
+	}
+
+	steps, err := db.PlanMigrations(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if len(steps) == 0 {
+		fmt.Fprintf(os.Stderr, "Database is already at version %d\n", current)
+		return 0
+	}
+
+	if *dryRun {
+		for _, step := range steps {
+			fmt.Printf("-- %s %d: %s\n%s\n\n", step.Direction, step.Version, step.Name, strings.TrimSpace(dedent(step.SQL)))
+		}
+		return 0
+	}
+
+	if err := db.Migrate(context.Background(), target); err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Database migrated from version %d to %d\n", current, target)
+
+	// The event log may not exist below version 3
+	if target >= 3 {
+		db.LogEvent(storage.EventSourceUser, storage.EventTypeInfo,
+			fmt.Sprintf("Database migrated from version %d to %d", current, target),
+			map[string]interface{}{"from": current, "to": target, "via": "cli"})
+	}
+	return 0
+}
+
+// printMigrationStatus lists every migration and whether it is applied
+func printMigrationStatus(db *storage.DB) int {
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read migration status: %v\n", err)
+		return 1
+	}
+
+	current, _ := db.MigrationVersion()
+	fmt.Printf("Schema version %d (this build supports up to %d)\n\n", current, storage.LatestMigrationVersion())
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT\tNOTES")
+	mismatched := false
+	for _, st := range statuses {
+		status, appliedAt := "pending", ""
+		if st.Applied {
+			status = "applied"
+		}
+		if st.AppliedAt != nil {
+			appliedAt = st.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		}
+
+		var notes []string
+		if st.Unknown {
+			notes = append(notes, "unknown to this build")
+		} else if !st.Reversible {
+			notes = append(notes, "irreversible")
+		}
+		if st.ChecksumMismatch {
+			notes = append(notes, "checksum mismatch")
+			mismatched = true
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", st.Version, st.Name, status, appliedAt, strings.Join(notes, ", "))
+	}
+	tw.Flush()
+
+	if mismatched {
+		return 1
+	}
+	return 0
+}
+
+// dedent strips the indentation migrations share from being embedded in Go
+// source
+func dedent(sql string) string {
+	lines := strings.Split(sql, "\n")
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, "\t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= indent && indent > 0 {
+			lines[i] = line[indent:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
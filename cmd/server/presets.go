@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/presets"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// syncMatterPresets refreshes the presets the Matter bridge sends with a
+// device's next state update
+func (s *Service) syncMatterPresets(ctx context.Context, deviceID int) {
+	list, err := presets.List(s.db, deviceID)
+	if err != nil {
+		log.FromContext(ctx).Warn("Failed to load presets for device %d: %v", deviceID, err)
+		return
+	}
+
+	active := ""
+	if state, err := s.db.GetThermostatStateByDeviceID(deviceID); err == nil && state != nil {
+		active = state.ActivePreset
+	}
+
+	s.matterBridge.SetPresets(deviceID, presets.ToMatter(list), active)
+}
+
+// clearActivePreset marks a device as no longer following a preset
+func (s *Service) clearActivePreset(ctx context.Context, deviceID int, name, reason string) {
+	if err := s.db.SetActivePreset(deviceID, ""); err != nil {
+		log.FromContext(ctx).Error("Failed to clear active preset: %v", err)
+		return
+	}
+	s.matterBridge.SetActivePreset(deviceID, "")
+
+	log.FromContext(ctx).Info("Preset %q no longer active: %s", name, reason)
+	s.db.LogEventContext(ctx, storage.EventSourceSystem, storage.EventTypePreset,
+		fmt.Sprintf("Preset %q no longer active: %s", name, reason),
+		map[string]interface{}{
+			"device_id": deviceID,
+			"preset":    name,
+		})
+}
+
+// recordPreset tracks the changes a preset made so the next poll recognises
+// them as echoes
+func (s *Service) recordPreset(deviceID int, preset *storage.Preset, source storage.EventSource) {
+	if preset.SystemMode != "" {
+		s.commands.RecordMode(deviceID, preset.SystemMode, source)
+	}
+	if preset.HeatSetpoint != nil {
+		s.commands.RecordSetpoint(deviceID, provenance.FieldHeatSetpoint, *preset.HeatSetpoint, source)
+	}
+	if preset.CoolSetpoint != nil {
+		s.commands.RecordSetpoint(deviceID, provenance.FieldCoolSetpoint, *preset.CoolSetpoint, source)
+	}
+}
+
+// applyMatterPreset handles a preset selected from HomeKit
+func (s *Service) applyMatterPreset(ctx context.Context, deviceID int, name string) error {
+	preset, err := presets.Apply(ctx, s.db, s.tccClient, s.guard, storage.EventSourceHomeKit, deviceID, name)
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to apply preset from HomeKit: %v", err)
+		return err
+	}
+	s.recordPreset(deviceID, preset, storage.EventSourceHomeKit)
+	s.matterBridge.SetActivePreset(deviceID, preset.Name)
+
+	// Fetch updated state
+	updatedDevice, err := s.tccClient.GetDeviceData(ctx, deviceID)
+	if err != nil {
+		log.FromContext(ctx).Warn("Failed to fetch updated state after HomeKit preset change: %v", err)
+	} else {
+		s.settings.Apply(updatedDevice)
+		s.db.SaveThermostatState(&storage.ThermostatState{
+			DeviceID:     updatedDevice.DeviceID,
+			Name:         updatedDevice.Name,
+			CurrentTemp:  updatedDevice.CurrentTemp,
+			HeatSetpoint: updatedDevice.HeatSetpoint,
+			CoolSetpoint: updatedDevice.CoolSetpoint,
+			SystemMode:   storage.ParseSystemMode(updatedDevice.SystemMode),
+			Humidity:     updatedDevice.Humidity,
+			IsHeating:    updatedDevice.IsHeating,
+			IsCooling:    updatedDevice.IsCooling,
+			OutdoorTemp:  updatedDevice.OutdoorTemp,
+		})
+		s.commands.Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
+
+		// Update Matter bridge
+		s.matterBridge.UpdateState(ctx, *updatedDevice)
+	}
+
+	s.db.LogEventContext(ctx, storage.EventSourceHomeKit, storage.EventTypePreset,
+		fmt.Sprintf("Preset %q applied", preset.Name),
+		map[string]interface{}{
+			"device_id":     deviceID,
+			"preset":        preset.Name,
+			"system_mode":   preset.SystemMode,
+			"heat_setpoint": preset.HeatSetpoint,
+			"cool_setpoint": preset.CoolSetpoint,
+		})
+
+	log.FromContext(ctx).Info("HomeKit: Preset %q applied", preset.Name)
+	return nil
+}
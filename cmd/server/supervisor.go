@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// handleMatterStarted reconciles the stored commissioning state with the
+// bridge, bridges every device and re-pushes its last known state once the
+// Matter bridge is up, so HomeKit doesn't wait for the next poll
+func (s *Service) handleMatterStarted(ctx context.Context) {
+	if err := s.commissioning.Reconcile(ctx, s.matterBridge); err != nil {
+		log.Warn("Failed to reconcile Matter commissioning state: %v", err)
+	}
+
+	if added := s.syncStoredMatterDevices(ctx); len(added) > 0 {
+		log.Info("Restored state for %d devices on Matter bridge", len(added))
+	}
+}
+
+// handleMatterRestart records a Matter bridge restart in the event log
+func (s *Service) handleMatterRestart(reason string, delay time.Duration, crashLoop bool) {
+	details := map[string]interface{}{
+		"reason":        reason,
+		"delay_seconds": int(delay.Seconds()),
+		"crash_loop":    crashLoop,
+		"restarts":      s.matterSup.Status().Restarts,
+	}
+
+	if crashLoop {
+		s.db.LogEvent(storage.EventSourceMatter, storage.EventTypeError,
+			fmt.Sprintf("Matter bridge is crash looping, restarting in %s: %s", delay, reason),
+			details)
+		return
+	}
+
+	s.db.LogEvent(storage.EventSourceMatter, storage.EventTypeConnection,
+		fmt.Sprintf("Matter bridge restarting in %s: %s", delay, reason),
+		details)
+}
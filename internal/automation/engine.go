@@ -0,0 +1,509 @@
+package automation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+const (
+	// checkInterval is how often time and event triggers are evaluated
+	checkInterval = 15 * time.Second
+	// timeTriggerGrace is how late a time trigger may still fire
+	timeTriggerGrace = 5 * time.Minute
+	// eventBatchSize limits how many new events are read per check
+	eventBatchSize = 500
+	// webhookTimeout bounds a single webhook call
+	webhookTimeout = 10 * time.Second
+)
+
+// AppliedHandler is called after a rule action changed a thermostat
+type AppliedHandler func(ctx context.Context, rule *storage.AutomationRule, deviceID int, action storage.RuleAction)
+
+// Engine evaluates automation rules and runs their actions
+type Engine struct {
+	db         storage.Store
+	tccClient  *tcc.Client
+	guard      *policy.Enforcer
+	httpClient *http.Client
+	onApplied  AppliedHandler
+
+	mu          sync.Mutex
+	lastFired   map[firingKey]time.Time
+	lastEventID int
+}
+
+type firingKey struct {
+	ruleID   int
+	deviceID int
+}
+
+// NewEngine creates a new automation engine
+func NewEngine(db storage.Store, tccClient *tcc.Client, guard *policy.Enforcer) *Engine {
+	return &Engine{
+		db:         db,
+		tccClient:  tccClient,
+		guard:      guard,
+		httpClient: &http.Client{Timeout: webhookTimeout},
+		lastFired:  make(map[firingKey]time.Time),
+	}
+}
+
+// SetAppliedHandler sets a callback for actions that changed a thermostat
+func (e *Engine) SetAppliedHandler(handler AppliedHandler) {
+	e.onApplied = handler
+}
+
+// Run evaluates time and event triggers until ctx is cancelled
+func (e *Engine) Run(ctx context.Context) {
+	log.Info("Starting automation engine")
+
+	// Only react to events logged from now on
+	id, err := e.db.GetLatestEventLogID()
+	if err != nil {
+		log.Error("%v", err)
+	}
+	e.mu.Lock()
+	e.lastEventID = id
+	e.mu.Unlock()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.checkTimeTriggers(ctx)
+			e.checkEventTriggers(ctx)
+		}
+	}
+}
+
+// HandleState evaluates state_change rules against a freshly polled state
+func (e *Engine) HandleState(ctx context.Context, prev *storage.ThermostatState, cur tcc.ThermostatState) {
+	if prev == nil {
+		return
+	}
+
+	changed := changedFields(snapshotFromStorage(prev), snapshotFromTCC(cur))
+	if len(changed) == 0 {
+		return
+	}
+
+	rules, err := e.db.GetRules()
+	if err != nil {
+		log.Error("Failed to load automation rules: %v", err)
+		return
+	}
+
+	snap := snapshotFromTCC(cur)
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Enabled || rule.Trigger.Type != TriggerStateChange || !appliesTo(rule, cur.DeviceID) {
+			continue
+		}
+		if rule.Trigger.Field != "" && !contains(changed, rule.Trigger.Field) {
+			continue
+		}
+		e.evaluate(ctx, rule, snap, fmt.Sprintf("%s changed", strings.Join(changed, ", ")))
+	}
+}
+
+// checkTimeTriggers fires time rules whose time of day has come
+func (e *Engine) checkTimeTriggers(ctx context.Context) {
+	rules, err := e.db.GetRules()
+	if err != nil {
+		log.Error("Failed to load automation rules: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Enabled || rule.Trigger.Type != TriggerTime {
+			continue
+		}
+		at, due := timeTriggerDue(rule.Trigger, now, timeTriggerGrace)
+		if !due || (rule.LastFiredAt != nil && !rule.LastFiredAt.Before(at)) {
+			continue
+		}
+
+		snaps, err := e.snapshots(rule, 0)
+		if err != nil {
+			log.Error("Failed to load state for rule %q: %v", rule.Name, err)
+			continue
+		}
+		ctx := log.WithCorrelationID(ctx, log.NewCorrelationID())
+		for _, snap := range snaps {
+			e.evaluate(ctx, rule, snap, "time "+rule.Trigger.At)
+		}
+		// Mark the occurrence handled even if conditions didn't hold
+		e.db.MarkRuleFired(rule.ID, now)
+	}
+}
+
+// checkEventTriggers fires event rules for entries logged since the last check
+func (e *Engine) checkEventTriggers(ctx context.Context) {
+	e.mu.Lock()
+	afterID := e.lastEventID
+	e.mu.Unlock()
+
+	events, err := e.db.GetEventLogsAfter(afterID, eventBatchSize)
+	if err != nil {
+		log.Error("%v", err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	e.lastEventID = events[len(events)-1].ID
+	e.mu.Unlock()
+
+	rules, err := e.db.GetRules()
+	if err != nil {
+		log.Error("Failed to load automation rules: %v", err)
+		return
+	}
+
+	for _, event := range events {
+		// Never react to our own entries, or rules could feed each other
+		if event.Source == storage.EventSourceAutomation {
+			continue
+		}
+
+		deviceID := eventDeviceID(event)
+		for i := range rules {
+			rule := &rules[i]
+			if !rule.Enabled || rule.Trigger.Type != TriggerEvent || !matchesEvent(rule.Trigger, event) {
+				continue
+			}
+			if deviceID != 0 && !appliesTo(rule, deviceID) {
+				continue
+			}
+
+			snaps, err := e.snapshots(rule, deviceID)
+			if err != nil {
+				log.Error("Failed to load state for rule %q: %v", rule.Name, err)
+				continue
+			}
+			// Continue the chain of the event that triggered the rule
+			id := event.CorrelationID
+			if id == "" {
+				id = log.NewCorrelationID()
+			}
+			ctx := log.WithCorrelationID(ctx, id)
+			for _, snap := range snaps {
+				e.evaluate(ctx, rule, snap, fmt.Sprintf("event %d: %s", event.ID, event.Message))
+			}
+		}
+	}
+}
+
+// evaluate checks a triggered rule's conditions and fires it if they hold
+func (e *Engine) evaluate(ctx context.Context, rule *storage.AutomationRule, snap Snapshot, reason string) {
+	if !conditionsHold(rule, snap) {
+		return
+	}
+
+	key := firingKey{rule.ID, snap.DeviceID}
+	cooldown := time.Duration(rule.CooldownSeconds) * time.Second
+	now := time.Now()
+
+	e.mu.Lock()
+	if last, ok := e.lastFired[key]; ok && now.Sub(last) < cooldown {
+		e.mu.Unlock()
+		log.FromContext(ctx).Debug("Rule %q for device %d still cooling down", rule.Name, snap.DeviceID)
+		return
+	}
+	e.lastFired[key] = now
+	e.mu.Unlock()
+
+	e.fire(ctx, rule, snap, reason)
+	if err := e.db.MarkRuleFired(rule.ID, now); err != nil {
+		log.FromContext(ctx).Error("%v", err)
+	}
+}
+
+// conditionsHold reports whether all of a rule's conditions are met
+func conditionsHold(rule *storage.AutomationRule, snap Snapshot) bool {
+	now := time.Now()
+	for _, c := range rule.Conditions {
+		switch c.Type {
+		case ConditionIndoorTemp:
+			if ok, _ := compare(c.Op, snap.CurrentTemp, c.Value); !ok {
+				return false
+			}
+		case ConditionOutdoorTemp:
+			// Snapshots carry the last polled outdoor temperature; without
+			// one the device has no outdoor sensor
+			if snap.OutdoorTemp == nil {
+				return false
+			}
+			if ok, _ := compare(c.Op, *snap.OutdoorTemp, c.Value); !ok {
+				return false
+			}
+		case ConditionHumidity:
+			if snap.Humidity == nil {
+				return false
+			}
+			if ok, _ := compare(c.Op, float64(*snap.Humidity), c.Value); !ok {
+				return false
+			}
+		case ConditionMode:
+			if (snap.SystemMode == c.Mode) == (c.Op == "!=") {
+				return false
+			}
+		case ConditionTimeWindow:
+			if !inWindow(now, c.Start, c.End) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fire runs a rule's actions, or records them in dry-run mode
+func (e *Engine) fire(ctx context.Context, rule *storage.AutomationRule, snap Snapshot, reason string) {
+	descriptions := make([]string, 0, len(rule.Actions))
+	for _, a := range rule.Actions {
+		descriptions = append(descriptions, describeAction(a))
+	}
+	details := map[string]interface{}{
+		"rule_id":   rule.ID,
+		"device_id": snap.DeviceID,
+		"reason":    reason,
+		"actions":   rule.Actions,
+		"state":     snap,
+		"dry_run":   rule.DryRun,
+	}
+
+	if rule.DryRun {
+		log.FromContext(ctx).Info("Rule %q would have fired for device %d (%s): %s", rule.Name, snap.DeviceID, reason, strings.Join(descriptions, ", "))
+		e.db.LogEventContext(ctx, storage.EventSourceAutomation, storage.EventTypeAutomation,
+			fmt.Sprintf("Rule %q would have fired (dry run): %s", rule.Name, strings.Join(descriptions, ", ")),
+			details)
+		return
+	}
+
+	log.FromContext(ctx).Info("Rule %q fired for device %d (%s): %s", rule.Name, snap.DeviceID, reason, strings.Join(descriptions, ", "))
+	e.db.LogEventContext(ctx, storage.EventSourceAutomation, storage.EventTypeAutomation,
+		fmt.Sprintf("Rule %q fired: %s", rule.Name, strings.Join(descriptions, ", ")),
+		details)
+
+	for _, a := range rule.Actions {
+		if err := e.runAction(ctx, rule, snap, a); err != nil {
+			log.FromContext(ctx).Error("Rule %q failed to %s: %v", rule.Name, describeAction(a), err)
+			e.db.LogEventContext(ctx, storage.EventSourceAutomation, storage.EventTypeError,
+				fmt.Sprintf("Rule %q failed to %s: %v", rule.Name, describeAction(a), err),
+				map[string]interface{}{
+					"rule_id":   rule.ID,
+					"device_id": snap.DeviceID,
+					"action":    a,
+					"error":     err.Error(),
+				})
+		}
+	}
+}
+
+// runAction performs a single rule action
+func (e *Engine) runAction(ctx context.Context, rule *storage.AutomationRule, snap Snapshot, a storage.RuleAction) error {
+	switch a.Type {
+	case ActionSetHeatSetpoint, ActionSetCoolSetpoint:
+		kind := "heat"
+		if a.Type == ActionSetCoolSetpoint {
+			kind = "cool"
+		}
+		value, err := e.guard.CheckSetpoint(ctx, storage.EventSourceAutomation, snap.DeviceID, kind, *a.Value)
+		if err != nil {
+			return err
+		}
+		if kind == "heat" {
+			err = e.tccClient.SetHeatSetpoint(ctx, snap.DeviceID, value)
+		} else {
+			err = e.tccClient.SetCoolSetpoint(ctx, snap.DeviceID, value)
+		}
+		if err != nil {
+			return err
+		}
+		applied := a
+		applied.Value = &value
+		e.applied(ctx, rule, snap.DeviceID, applied)
+
+	case ActionSetMode:
+		if err := e.guard.CheckMode(ctx, storage.EventSourceAutomation, snap.DeviceID, a.Mode); err != nil {
+			return err
+		}
+		if err := e.tccClient.SetSystemMode(ctx, snap.DeviceID, a.Mode); err != nil {
+			return err
+		}
+		e.applied(ctx, rule, snap.DeviceID, a)
+
+	case ActionWebhook:
+		return e.sendWebhook(ctx, rule, snap, a.URL)
+
+	case ActionLog:
+		message := a.Message
+		if message == "" {
+			message = fmt.Sprintf("Rule %q fired", rule.Name)
+		}
+		e.db.LogEventContext(ctx, storage.EventSourceAutomation, storage.EventTypeInfo, message,
+			map[string]interface{}{
+				"rule_id":   rule.ID,
+				"device_id": snap.DeviceID,
+			})
+
+	default:
+		return fmt.Errorf("unknown action %q", a.Type)
+	}
+
+	return nil
+}
+
+func (e *Engine) applied(ctx context.Context, rule *storage.AutomationRule, deviceID int, a storage.RuleAction) {
+	if e.onApplied != nil {
+		e.onApplied(ctx, rule, deviceID, a)
+	}
+}
+
+// sendWebhook posts the rule and thermostat state as JSON
+func (e *Engine) sendWebhook(ctx context.Context, rule *storage.AutomationRule, snap Snapshot, url string) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"rule_id":   rule.ID,
+		"rule":      rule.Name,
+		"device_id": snap.DeviceID,
+		"state":     snap,
+		"fired_at":  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := log.CorrelationID(ctx); id != "" {
+		req.Header.Set(log.CorrelationHeader, id)
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// snapshots returns the stored state of every device a rule applies to,
+// limited to deviceID when it is non-zero
+func (e *Engine) snapshots(rule *storage.AutomationRule, deviceID int) ([]Snapshot, error) {
+	states, err := e.db.GetAllThermostatStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []Snapshot
+	for i := range states {
+		state := &states[i]
+		if !appliesTo(rule, state.DeviceID) || (deviceID != 0 && state.DeviceID != deviceID) {
+			continue
+		}
+		snaps = append(snaps, snapshotFromStorage(state))
+	}
+	return snaps, nil
+}
+
+// appliesTo reports whether a rule covers a device
+func appliesTo(rule *storage.AutomationRule, deviceID int) bool {
+	return rule.DeviceID == 0 || rule.DeviceID == deviceID
+}
+
+// eventDeviceID extracts the device_id from event details, or 0
+func eventDeviceID(event storage.EventLog) int {
+	if len(event.Details) == 0 {
+		return 0
+	}
+	var details struct {
+		DeviceID int `json:"device_id"`
+	}
+	if err := json.Unmarshal(event.Details, &details); err != nil {
+		return 0
+	}
+	return details.DeviceID
+}
+
+// describeAction returns a short description of an action for logs
+func describeAction(a storage.RuleAction) string {
+	switch a.Type {
+	case ActionSetHeatSetpoint:
+		return fmt.Sprintf("set heat setpoint to %.1f°F", *a.Value)
+	case ActionSetCoolSetpoint:
+		return fmt.Sprintf("set cool setpoint to %.1f°F", *a.Value)
+	case ActionSetMode:
+		return "set mode to " + a.Mode
+	case ActionWebhook:
+		return "call webhook " + a.URL
+	case ActionLog:
+		return "write log entry"
+	default:
+		return a.Type
+	}
+}
+
+func snapshotFromStorage(state *storage.ThermostatState) Snapshot {
+	return Snapshot{
+		DeviceID:     state.DeviceID,
+		CurrentTemp:  state.CurrentTemp,
+		HeatSetpoint: state.HeatSetpoint,
+		CoolSetpoint: state.CoolSetpoint,
+		SystemMode:   state.SystemMode.String(),
+		Humidity:     state.Humidity,
+		IsHeating:    state.IsHeating,
+		IsCooling:    state.IsCooling,
+		OutdoorTemp:  state.OutdoorTemp,
+	}
+}
+
+func snapshotFromTCC(state tcc.ThermostatState) Snapshot {
+	return Snapshot{
+		DeviceID:     state.DeviceID,
+		CurrentTemp:  state.CurrentTemp,
+		HeatSetpoint: state.HeatSetpoint,
+		CoolSetpoint: state.CoolSetpoint,
+		SystemMode:   state.SystemMode,
+		Humidity:     state.Humidity,
+		IsHeating:    state.IsHeating,
+		IsCooling:    state.IsCooling,
+		OutdoorTemp:  state.OutdoorTemp,
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package automation
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+func TestConditionsHoldOutdoorTemp(t *testing.T) {
+	below := storage.RuleCondition{Type: ConditionOutdoorTemp, Op: "<", Value: 32}
+
+	tests := []struct {
+		name    string
+		outdoor *float64 // in the last polled state
+		want    bool
+	}{
+		{name: "freezing", outdoor: f(20), want: true},
+		{name: "mild", outdoor: f(50), want: false},
+		{name: "no outdoor sensor", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Time and event triggers evaluate the stored state, which must
+			// carry the polled outdoor temperature
+			snap := snapshotFromStorage(&storage.ThermostatState{DeviceID: 1, OutdoorTemp: tt.outdoor})
+			rule := &storage.AutomationRule{Conditions: []storage.RuleCondition{below}}
+
+			if got := conditionsHold(rule, snap); got != tt.want {
+				t.Errorf("conditionsHold() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDryRunRecordsWithoutApplying(t *testing.T) {
+	db, engine := newTestEngine(t, config.DeviceLimits{})
+	var applied []storage.RuleAction
+	engine.SetAppliedHandler(func(ctx context.Context, rule *storage.AutomationRule, deviceID int, action storage.RuleAction) {
+		applied = append(applied, action)
+	})
+	rule := createRule(t, db, storage.AutomationRule{
+		Name:    "Warm up",
+		DryRun:  true,
+		Trigger: storage.RuleTrigger{Type: TriggerStateChange},
+		Actions: []storage.RuleAction{{Type: ActionSetHeatSetpoint, Value: f(70)}},
+	})
+
+	// The engine has no TCC client, so applying the action would panic
+	engine.HandleState(context.Background(), &storage.ThermostatState{DeviceID: 1, CurrentTemp: 66}, tcc.ThermostatState{DeviceID: 1, CurrentTemp: 65})
+
+	if got := countEvents(t, db, `Rule "Warm up" would have fired (dry run)`); got != 1 {
+		t.Errorf("dry run recorded %d times, want 1", got)
+	}
+	if got := countEvents(t, db, `Rule "Warm up" fired:`); got != 0 {
+		t.Errorf("dry run rule fired %d times, want 0", got)
+	}
+	if len(applied) != 0 {
+		t.Errorf("dry run applied %+v", applied)
+	}
+	if rule, _ := db.GetRule(rule.ID); rule.LastFiredAt == nil {
+		t.Error("dry run did not record when the rule fired")
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown int // seconds
+		want     int // firings from two state changes
+	}{
+		{name: "within cooldown", cooldown: 3600, want: 1},
+		{name: "no cooldown", cooldown: 0, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, engine := newTestEngine(t, config.DeviceLimits{})
+			createRule(t, db, storage.AutomationRule{
+				Name:            "Note change",
+				Trigger:         storage.RuleTrigger{Type: TriggerStateChange},
+				Actions:         []storage.RuleAction{{Type: ActionLog}},
+				CooldownSeconds: tt.cooldown,
+			})
+
+			prev := &storage.ThermostatState{DeviceID: 1, CurrentTemp: 68}
+			engine.HandleState(context.Background(), prev, tcc.ThermostatState{DeviceID: 1, CurrentTemp: 69})
+			engine.HandleState(context.Background(), prev, tcc.ThermostatState{DeviceID: 1, CurrentTemp: 70})
+
+			if got := countEvents(t, db, `Rule "Note change" fired:`); got != tt.want {
+				t.Errorf("rule fired %d times, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeTriggerFiresOncePerOccurrence(t *testing.T) {
+	db, engine := newTestEngine(t, config.DeviceLimits{})
+	rule := createRule(t, db, storage.AutomationRule{
+		Name:    "Morning",
+		Trigger: storage.RuleTrigger{Type: TriggerTime, At: time.Now().Format("15:04")},
+		Actions: []storage.RuleAction{{Type: ActionLog}},
+	})
+
+	// Checks run every few seconds, well within the occurrence's grace
+	// period
+	engine.checkTimeTriggers(context.Background())
+	engine.checkTimeTriggers(context.Background())
+
+	if got := countEvents(t, db, `Rule "Morning" fired:`); got != 1 {
+		t.Errorf("rule fired %d times, want 1", got)
+	}
+	if rule, _ := db.GetRule(rule.ID); rule.LastFiredAt == nil {
+		t.Error("LastFiredAt not set")
+	}
+
+	// A restart loses the cooldown but not LastFiredAt
+	_, restarted := newTestEngineWithStore(t, db, config.DeviceLimits{})
+	restarted.checkTimeTriggers(context.Background())
+	if got := countEvents(t, db, `Rule "Morning" fired:`); got != 1 {
+		t.Errorf("rule fired %d times after a restart, want 1", got)
+	}
+}
+
+func TestEventTriggerIgnoresAutomationEvents(t *testing.T) {
+	db, engine := newTestEngine(t, config.DeviceLimits{})
+	createRule(t, db, storage.AutomationRule{
+		Name:    "Echo",
+		Trigger: storage.RuleTrigger{Type: TriggerEvent, EventType: storage.EventTypeModeChange},
+		Actions: []storage.RuleAction{{Type: ActionLog}},
+	})
+
+	ctx := context.Background()
+	db.LogEventContext(ctx, storage.EventSourceAutomation, storage.EventTypeModeChange, "Mode changed by a rule",
+		map[string]interface{}{"device_id": 1})
+	engine.checkEventTriggers(ctx)
+	if got := countEvents(t, db, `Rule "Echo" fired:`); got != 0 {
+		t.Errorf("rule fired %d times on an automation event, want 0", got)
+	}
+
+	db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypeModeChange, "Mode changed from web",
+		map[string]interface{}{"device_id": 1})
+	engine.checkEventTriggers(ctx)
+	if got := countEvents(t, db, `Rule "Echo" fired:`); got != 1 {
+		t.Errorf("rule fired %d times on a user event, want 1", got)
+	}
+}
+
+func TestPolicyRejectsAction(t *testing.T) {
+	db, engine := newTestEngine(t, config.DeviceLimits{AllowedModes: []string{"heat", "cool"}})
+	var applied []storage.RuleAction
+	engine.SetAppliedHandler(func(ctx context.Context, rule *storage.AutomationRule, deviceID int, action storage.RuleAction) {
+		applied = append(applied, action)
+	})
+	createRule(t, db, storage.AutomationRule{
+		Name:    "Switch off",
+		Trigger: storage.RuleTrigger{Type: TriggerStateChange},
+		Actions: []storage.RuleAction{{Type: ActionSetMode, Mode: "off"}},
+	})
+
+	// The guard refuses before TCC is called, so no client is needed
+	engine.HandleState(context.Background(), &storage.ThermostatState{DeviceID: 1, CurrentTemp: 68}, tcc.ThermostatState{DeviceID: 1, CurrentTemp: 69})
+
+	if got := countEvents(t, db, `Rule "Switch off" failed to set mode to off`); got != 1 {
+		t.Errorf("rejection logged %d times, want 1", got)
+	}
+	if got := countEvents(t, db, `mode "off" is not allowed`); got == 0 {
+		t.Error("policy violation was not logged")
+	}
+	if len(applied) != 0 {
+		t.Errorf("rejected action applied: %+v", applied)
+	}
+}
+
+// newTestEngine creates an engine without a TCC client over a memory store
+// holding one polled device
+func newTestEngine(t *testing.T, limits config.DeviceLimits) (*storage.MemoryStore, *Engine) {
+	t.Helper()
+	db := storage.NewMemoryStore()
+	if err := db.SaveThermostatState(&storage.ThermostatState{DeviceID: 1, CurrentTemp: 68, SystemMode: storage.SystemModeHeat}); err != nil {
+		t.Fatalf("SaveThermostatState() error = %v", err)
+	}
+	return newTestEngineWithStore(t, db, limits)
+}
+
+func newTestEngineWithStore(t *testing.T, db *storage.MemoryStore, limits config.DeviceLimits) (*storage.MemoryStore, *Engine) {
+	t.Helper()
+	guard, err := policy.NewEnforcer(&config.Config{PolicyDefaults: limits}, db)
+	if err != nil {
+		t.Fatalf("NewEnforcer() error = %v", err)
+	}
+	return db, NewEngine(db, nil, guard)
+}
+
+func createRule(t *testing.T, db storage.Store, rule storage.AutomationRule) *storage.AutomationRule {
+	t.Helper()
+	rule.Enabled = true
+	if err := db.CreateRule(&rule); err != nil {
+		t.Fatalf("CreateRule() error = %v", err)
+	}
+	return &rule
+}
+
+// countEvents counts event log entries whose message contains text
+func countEvents(t *testing.T, db storage.Store, text string) int {
+	t.Helper()
+	events, err := db.GetEventLogs(storage.EventLogFilter{})
+	if err != nil {
+		t.Fatalf("GetEventLogs() error = %v", err)
+	}
+	n := 0
+	for _, e := range events {
+		if strings.Contains(e.Message, text) {
+			n++
+		}
+	}
+	return n
+}
+
+func f(v float64) *float64 { return &v }
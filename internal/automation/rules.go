@@ -0,0 +1,307 @@
+package automation
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// Trigger types
+const (
+	TriggerStateChange = "state_change"
+	TriggerTime        = "time"
+	TriggerEvent       = "event"
+)
+
+// Condition types
+const (
+	ConditionIndoorTemp  = "indoor_temp"
+	ConditionOutdoorTemp = "outdoor_temp"
+	ConditionHumidity    = "humidity"
+	ConditionMode        = "mode"
+	ConditionTimeWindow  = "time_window"
+)
+
+// Action types
+const (
+	ActionSetHeatSetpoint = "set_heat_setpoint"
+	ActionSetCoolSetpoint = "set_cool_setpoint"
+	ActionSetMode         = "set_mode"
+	ActionWebhook         = "webhook"
+	ActionLog             = "log"
+)
+
+// DefaultCooldown is used when a rule doesn't set its own cooldown
+const DefaultCooldown = 5 * time.Minute
+
+// stateFields are the fields a state_change trigger can watch
+var stateFields = map[string]bool{
+	"current_temp":  true,
+	"heat_setpoint": true,
+	"cool_setpoint": true,
+	"system_mode":   true,
+	"humidity":      true,
+	"is_heating":    true,
+	"is_cooling":    true,
+}
+
+// validModes are the system modes rules may test for or set
+var validModes = map[string]bool{
+	"off":       true,
+	"heat":      true,
+	"cool":      true,
+	"auto":      true,
+	"emergency": true,
+}
+
+// weekdays maps day names used in triggers to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Snapshot is the thermostat state a rule is evaluated against
+type Snapshot struct {
+	DeviceID     int      `json:"device_id"`
+	CurrentTemp  float64  `json:"current_temp"`
+	HeatSetpoint float64  `json:"heat_setpoint"`
+	CoolSetpoint float64  `json:"cool_setpoint"`
+	SystemMode   string   `json:"system_mode"`
+	Humidity     *int     `json:"humidity"` // nil when TCC had no valid reading
+	IsHeating    bool     `json:"is_heating"`
+	IsCooling    bool     `json:"is_cooling"`
+	OutdoorTemp  *float64 `json:"outdoor_temp,omitempty"`
+}
+
+// Validate checks a rule for errors before it is stored
+func Validate(rule *storage.AutomationRule) error {
+	if strings.TrimSpace(rule.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if rule.DeviceID < 0 {
+		return fmt.Errorf("invalid device_id")
+	}
+	if rule.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds must not be negative")
+	}
+	if rule.CooldownSeconds == 0 {
+		rule.CooldownSeconds = int(DefaultCooldown.Seconds())
+	}
+
+	t := rule.Trigger
+	switch t.Type {
+	case TriggerStateChange:
+		if t.Field != "" && !stateFields[t.Field] {
+			return fmt.Errorf("trigger: invalid field %q", t.Field)
+		}
+	case TriggerTime:
+		if _, err := parseClock(t.At); err != nil {
+			return fmt.Errorf("trigger: %w", err)
+		}
+		for _, d := range t.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("trigger: invalid day %q", d)
+			}
+		}
+	case TriggerEvent:
+	default:
+		return fmt.Errorf("trigger: invalid type %q", t.Type)
+	}
+
+	for i, c := range rule.Conditions {
+		if err := validateCondition(c); err != nil {
+			return fmt.Errorf("condition %d: %w", i+1, err)
+		}
+	}
+
+	if len(rule.Actions) == 0 {
+		return fmt.Errorf("at least one action is required")
+	}
+	for i, a := range rule.Actions {
+		if err := validateAction(a); err != nil {
+			return fmt.Errorf("action %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func validateCondition(c storage.RuleCondition) error {
+	switch c.Type {
+	case ConditionIndoorTemp, ConditionOutdoorTemp, ConditionHumidity:
+		if _, ok := compare(c.Op, 0, 0); !ok {
+			return fmt.Errorf("invalid op %q", c.Op)
+		}
+	case ConditionMode:
+		if !validModes[c.Mode] {
+			return fmt.Errorf("invalid mode %q", c.Mode)
+		}
+		if c.Op != "" && c.Op != "==" && c.Op != "!=" {
+			return fmt.Errorf("invalid op %q for mode", c.Op)
+		}
+	case ConditionTimeWindow:
+		if _, err := parseClock(c.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(c.End); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid type %q", c.Type)
+	}
+	return nil
+}
+
+func validateAction(a storage.RuleAction) error {
+	switch a.Type {
+	case ActionSetHeatSetpoint, ActionSetCoolSetpoint:
+		if a.Value == nil {
+			return fmt.Errorf("value is required")
+		}
+	case ActionSetMode:
+		if !validModes[a.Mode] {
+			return fmt.Errorf("invalid mode %q", a.Mode)
+		}
+	case ActionWebhook:
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url %q", a.URL)
+		}
+	case ActionLog:
+	default:
+		return fmt.Errorf("invalid type %q", a.Type)
+	}
+	return nil
+}
+
+// changedFields lists the state fields that differ between two snapshots
+func changedFields(prev, cur Snapshot) []string {
+	var fields []string
+	if prev.CurrentTemp != cur.CurrentTemp {
+		fields = append(fields, "current_temp")
+	}
+	if prev.HeatSetpoint != cur.HeatSetpoint {
+		fields = append(fields, "heat_setpoint")
+	}
+	if prev.CoolSetpoint != cur.CoolSetpoint {
+		fields = append(fields, "cool_setpoint")
+	}
+	if prev.SystemMode != cur.SystemMode {
+		fields = append(fields, "system_mode")
+	}
+	if !sameInt(prev.Humidity, cur.Humidity) {
+		fields = append(fields, "humidity")
+	}
+	if prev.IsHeating != cur.IsHeating {
+		fields = append(fields, "is_heating")
+	}
+	if prev.IsCooling != cur.IsCooling {
+		fields = append(fields, "is_cooling")
+	}
+	return fields
+}
+
+// sameInt reports whether two optional readings are equal
+func sameInt(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// matchesEvent reports whether an event log entry fires an event trigger
+func matchesEvent(t storage.RuleTrigger, event storage.EventLog) bool {
+	if t.EventSource != "" && t.EventSource != event.Source {
+		return false
+	}
+	if t.EventType != "" && t.EventType != event.EventType {
+		return false
+	}
+	if t.MessageContains != "" && !strings.Contains(strings.ToLower(event.Message), strings.ToLower(t.MessageContains)) {
+		return false
+	}
+	return true
+}
+
+// timeTriggerDue returns the occurrence of a time trigger that is due at
+// now, if any. Occurrences older than grace are skipped so a restart
+// doesn't replay them.
+func timeTriggerDue(t storage.RuleTrigger, now time.Time, grace time.Duration) (time.Time, bool) {
+	minutes, err := parseClock(t.At)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if len(t.Days) > 0 {
+		runs := false
+		for _, d := range t.Days {
+			if weekdays[strings.ToLower(d)] == now.Weekday() {
+				runs = true
+				break
+			}
+		}
+		if !runs {
+			return time.Time{}, false
+		}
+	}
+
+	at := time.Date(now.Year(), now.Month(), now.Day(), minutes/60, minutes%60, 0, 0, now.Location())
+	if now.Before(at) || now.Sub(at) > grace {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// inWindow reports whether now falls in the [start, end) window, which may
+// wrap past midnight
+func inWindow(now time.Time, start, end string) bool {
+	s, err := parseClock(start)
+	if err != nil {
+		return false
+	}
+	e, err := parseClock(end)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if s <= e {
+		return minute >= s && minute < e
+	}
+	return minute >= s || minute < e
+}
+
+// compare applies a comparison operator; ok is false for unknown operators
+func compare(op string, a, b float64) (result, ok bool) {
+	switch op {
+	case "<":
+		return a < b, true
+	case "<=":
+		return a <= b, true
+	case ">":
+		return a > b, true
+	case ">=":
+		return a >= b, true
+	case "==":
+		return a == b, true
+	case "!=":
+		return a != b, true
+	default:
+		return false, false
+	}
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
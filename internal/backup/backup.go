@@ -0,0 +1,459 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"golang.org/x/crypto/scrypt"
+)
+
+// FormatVersion is the bundle layout this build writes and understands
+const FormatVersion = 1
+
+// Bundle entry names
+const (
+	manifestFile = "manifest.json"
+	databaseFile = "tcc-bridge.db"
+	keyFile      = "encryption.key"
+	configFile   = "config.json"
+)
+
+// encryptedMagic starts a passphrase-encrypted bundle from before chunked
+// encryption. It is followed by the scrypt salt, the GCM nonce and the
+// sealed tar.gz.
+var encryptedMagic = []byte("TCCBAK\x00\x01")
+
+// scrypt parameters for deriving the bundle key from a passphrase
+const (
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	saltSize  = 16
+	maxEntry  = 1 << 30 // Refuse absurd entries in a bundle
+	keyLength = 32
+)
+
+var (
+	// ErrPassphraseRequired is returned when opening an encrypted bundle
+	// without a passphrase
+	ErrPassphraseRequired = errors.New("backup is encrypted, a passphrase is required")
+	// ErrBadPassphrase is returned when the passphrase does not decrypt the bundle
+	ErrBadPassphrase = errors.New("wrong passphrase or corrupted backup")
+)
+
+// Manifest describes a backup bundle
+type Manifest struct {
+	Format        int       `json:"format"`
+	AppVersion    string    `json:"app_version"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Source is what a backup is taken from
+type Source struct {
+	DB         *storage.DB
+	KeyPath    string
+	Config     *config.Config
+	AppVersion string
+}
+
+// Bundle is an opened backup
+type Bundle struct {
+	Manifest Manifest
+	Database []byte
+	Key      []byte
+	Config   []byte // Empty if the backup had no configuration
+}
+
+// Target is where a backup is restored to
+type Target struct {
+	Config     *config.Config // Supplies the database and key paths
+	ConfigPath string         // Configuration file to replace, empty to skip
+}
+
+// Create writes a bundle of the live database, encryption key and
+// configuration to w, encrypted when passphrase is not empty
+func Create(ctx context.Context, w io.Writer, src Source, passphrase string) (*Manifest, error) {
+	tmpDir, err := os.MkdirTemp("", "tcc-bridge-backup-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, databaseFile)
+	if err := src.DB.BackupTo(ctx, dbPath); err != nil {
+		return nil, err
+	}
+	schemaVersion, err := storage.ReadMigrationVersion(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	database, err := os.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database copy: %w", err)
+	}
+	defer database.Close()
+	info, err := database.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database copy: %w", err)
+	}
+
+	key, err := os.ReadFile(src.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+
+	var cfg []byte
+	if src.Config != nil {
+		cfg, err = json.MarshalIndent(src.Config, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode config: %w", err)
+		}
+	}
+
+	manifest := &Manifest{
+		Format:        FormatVersion,
+		AppVersion:    src.AppVersion,
+		SchemaVersion: schemaVersion,
+		CreatedAt:     time.Now().UTC(),
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	// Stream tar -> gzip -> cipher -> w so the database is never held in
+	// memory
+	out := w
+	var sealer *sealWriter
+	if passphrase != "" {
+		sealer, err = newSealWriter(w, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		out = sealer
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	type entry struct {
+		name string
+		size int64
+		data io.Reader
+	}
+	entries := []entry{
+		{manifestFile, int64(len(manifestJSON)), bytes.NewReader(manifestJSON)},
+		{databaseFile, info.Size(), database},
+		{keyFile, int64(len(key)), bytes.NewReader(key)},
+	}
+	if cfg != nil {
+		entries = append(entries, entry{configFile, int64(len(cfg)), bytes.NewReader(cfg)})
+	}
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:    e.name,
+			Mode:    0600,
+			Size:    e.size,
+			ModTime: manifest.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", e.name, err)
+		}
+		if _, err := io.Copy(tw, e.data); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress archive: %w", err)
+	}
+	if sealer != nil {
+		if err := sealer.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// Open reads a bundle, decrypting it with passphrase if it is encrypted
+func Open(r io.Reader, passphrase string) (*Bundle, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(streamMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	var archive io.Reader = br
+	switch {
+	case bytes.Equal(magic, streamMagic):
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		archive, err = newOpenReader(br, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	case bytes.Equal(magic, encryptedMagic):
+		// Bundles from before chunked encryption are sealed in one piece
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup: %w", err)
+		}
+		data, err = unseal(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		archive = bytes.NewReader(data)
+	}
+
+	gz, err := gzip.NewReader(archive)
+	if errors.Is(err, ErrBadPassphrase) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not a backup file: %w", err)
+	}
+	defer gz.Close()
+
+	bundle := &Bundle{}
+	var haveManifest bool
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrBadPassphrase) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup archive: %w", err)
+		}
+		if hdr.Size > maxEntry {
+			return nil, fmt.Errorf("backup entry %s is too large", hdr.Name)
+		}
+
+		content, err := io.ReadAll(io.LimitReader(tr, maxEntry))
+		if errors.Is(err, ErrBadPassphrase) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+		}
+
+		switch hdr.Name {
+		case manifestFile:
+			if err := json.Unmarshal(content, &bundle.Manifest); err != nil {
+				return nil, fmt.Errorf("invalid backup manifest: %w", err)
+			}
+			haveManifest = true
+		case databaseFile:
+			bundle.Database = content
+		case keyFile:
+			bundle.Key = content
+		case configFile:
+			bundle.Config = content
+		}
+	}
+
+	// Read to the end so a cut off encrypted bundle is noticed
+	if _, ok := archive.(*openReader); ok {
+		if _, err := io.Copy(io.Discard, archive); err != nil {
+			return nil, err
+		}
+	}
+
+	if !haveManifest {
+		return nil, fmt.Errorf("backup has no manifest")
+	}
+	if bundle.Manifest.Format > FormatVersion {
+		return nil, fmt.Errorf("backup format %d is newer than this build supports (%d)",
+			bundle.Manifest.Format, FormatVersion)
+	}
+	if bundle.Database == nil {
+		return nil, fmt.Errorf("backup has no database")
+	}
+	if !storage.IsKeyFile(bundle.Key) {
+		return nil, fmt.Errorf("backup has no valid encryption key")
+	}
+
+	return bundle, nil
+}
+
+// Restore replaces the database, key and optionally the configuration file
+// with the bundle's. The service must be stopped. Files that are replaced
+// are kept beside the originals with a .pre-restore suffix, and are put
+// back if the restore fails part way.
+func Restore(b *Bundle, target Target) (err error) {
+	dbPath := target.Config.DatabasePath()
+	keyPath := target.Config.EncryptionKeyPath
+
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Check the database before touching anything
+	staged := dbPath + ".restore"
+	if err := os.WriteFile(staged, b.Database, 0600); err != nil {
+		return fmt.Errorf("failed to stage database: %w", err)
+	}
+	defer os.Remove(staged)
+
+	version, err := storage.ReadMigrationVersion(staged)
+	if err != nil {
+		return fmt.Errorf("backup database is unreadable: %w", err)
+	}
+	if version != b.Manifest.SchemaVersion {
+		return fmt.Errorf("backup database is at schema version %d but its manifest says %d",
+			version, b.Manifest.SchemaVersion)
+	}
+	if latest := storage.LatestMigrationVersion(); version > latest {
+		return fmt.Errorf("backup schema version %d is newer than this build supports (%d); upgrade first",
+			version, latest)
+	}
+
+	var cfg []byte
+	if target.ConfigPath != "" && len(b.Config) > 0 {
+		restored := config.DefaultConfig()
+		if err := json.Unmarshal(b.Config, restored); err != nil {
+			return fmt.Errorf("backup configuration is invalid: %w", err)
+		}
+		// Keep this machine's locations so the restored files are found
+		restored.DataDir = target.Config.DataDir
+		restored.EncryptionKeyPath = target.Config.EncryptionKeyPath
+		restored.MatterBridgeDir = target.Config.MatterBridgeDir
+		cfg, err = json.MarshalIndent(restored, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+	}
+
+	replaced := []string{dbPath, dbPath + "-wal", dbPath + "-shm", keyPath}
+	if cfg != nil {
+		replaced = append(replaced, target.ConfigPath)
+	}
+
+	// On failure, drop what was written and put the originals back
+	suffix := ".pre-restore-" + time.Now().Format("20060102-150405")
+	var moved, written []string
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, rollback(moved, written, suffix))
+		}
+	}()
+
+	for _, path := range replaced {
+		ok, err := moveAside(path, suffix)
+		if err != nil {
+			return err
+		}
+		if ok {
+			moved = append(moved, path)
+		}
+	}
+
+	written = append(written, dbPath)
+	if err := os.Rename(staged, dbPath); err != nil {
+		return fmt.Errorf("failed to restore database: %w", err)
+	}
+	written = append(written, keyPath)
+	if err := os.WriteFile(keyPath, b.Key, 0600); err != nil {
+		return fmt.Errorf("failed to restore encryption key: %w", err)
+	}
+	if cfg != nil {
+		written = append(written, target.ConfigPath)
+		if err := os.WriteFile(target.ConfigPath, cfg, 0644); err != nil {
+			return fmt.Errorf("failed to restore config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// moveAside renames path by adding suffix, reporting whether it existed
+func moveAside(path, suffix string) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := os.Rename(path, path+suffix); err != nil {
+		return false, fmt.Errorf("failed to keep existing %s: %w", filepath.Base(path), err)
+	}
+	return true, nil
+}
+
+// rollback undoes a failed restore: it removes the written files and moves
+// the originals back
+func rollback(moved, written []string, suffix string) error {
+	var errs []error
+	for _, path := range written {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove restored %s: %w", filepath.Base(path), err))
+		}
+	}
+	for _, path := range moved {
+		if err := os.Rename(path+suffix, path); err != nil {
+			errs = append(errs, fmt.Errorf("failed to put back %s: %w", filepath.Base(path), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// unseal decrypts a bundle sealed in one piece
+func unseal(data []byte, passphrase string) ([]byte, error) {
+	data = data[len(encryptedMagic):]
+	if len(data) < saltSize {
+		return nil, ErrBadPassphrase
+	}
+	salt, data := data[:saltSize], data[saltSize:]
+
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrBadPassphrase
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, data, encryptedMagic)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return plaintext, nil
+}
+
+// passphraseCipher derives an AES-GCM cipher from passphrase and salt
+func passphraseCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keyLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// streamMagic starts a passphrase-encrypted bundle written in chunks. It is
+// followed by the scrypt salt, a nonce prefix and the sealed chunks of the
+// tar.gz. Each chunk's nonce is the prefix, the chunk number and a flag
+// marking the last chunk, so chunks can't be reordered, dropped or cut off
+// without failing to open.
+var streamMagic = []byte("TCCBAK\x00\x02")
+
+const (
+	chunkSize   = 64 << 10 // Plaintext bytes per sealed chunk
+	prefixSize  = 7
+	counterSize = 4
+)
+
+// sealWriter encrypts what is written to it in chunks. Close must be called
+// to write the last chunk.
+type sealWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	prefix []byte
+	buf    []byte
+	out    []byte
+	count  uint32
+}
+
+// newSealWriter writes the encrypted bundle header to w and returns a writer
+// that encrypts with a key derived from passphrase
+func newSealWriter(w io.Writer, passphrase string) (*sealWriter, error) {
+	header := make([]byte, len(streamMagic)+saltSize+prefixSize)
+	copy(header, streamMagic)
+	if _, err := rand.Read(header[len(streamMagic):]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	salt := header[len(streamMagic) : len(streamMagic)+saltSize]
+	prefix := header[len(streamMagic)+saltSize:]
+
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	return &sealWriter{
+		w:      w,
+		gcm:    gcm,
+		prefix: prefix,
+		buf:    make([]byte, 0, chunkSize),
+		out:    make([]byte, 0, chunkSize+gcm.Overhead()),
+	}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunkSize-len(s.buf))
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(s.buf) == chunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals and writes the last chunk, which may be empty
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(last bool) error {
+	if s.count == math.MaxUint32 {
+		return fmt.Errorf("backup is too large to encrypt")
+	}
+	s.out = s.gcm.Seal(s.out[:0], chunkNonce(s.prefix, s.count, last), s.buf, streamMagic)
+	if _, err := s.w.Write(s.out); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	s.count++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// openReader decrypts a bundle written by sealWriter
+type openReader struct {
+	r      *bufio.Reader
+	gcm    cipher.AEAD
+	prefix []byte
+	chunk  []byte
+	plain  []byte
+	count  uint32
+	done   bool
+}
+
+// newOpenReader reads the encrypted bundle header from r, which must start
+// with streamMagic, and returns a reader of the decrypted tar.gz
+func newOpenReader(r *bufio.Reader, passphrase string) (*openReader, error) {
+	header := make([]byte, len(streamMagic)+saltSize+prefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrBadPassphrase
+	}
+	salt := header[len(streamMagic) : len(streamMagic)+saltSize]
+
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openReader{
+		r:      r,
+		gcm:    gcm,
+		prefix: header[len(streamMagic)+saltSize:],
+		chunk:  make([]byte, chunkSize+gcm.Overhead()),
+	}, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// next decrypts the following chunk. A short chunk, or a full one at the
+// end of the stream, is the last.
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.chunk)
+	last := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case errors.Is(err, io.EOF):
+		return ErrBadPassphrase // Cut off before the last chunk
+	case err != nil:
+		return fmt.Errorf("failed to read backup: %w", err)
+	default:
+		if _, err := o.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		}
+	}
+
+	plain, err := o.gcm.Open(o.chunk[:0], chunkNonce(o.prefix, o.count, last), o.chunk[:n], streamMagic)
+	if err != nil {
+		return ErrBadPassphrase
+	}
+	o.plain = plain
+	o.count++
+	o.done = last
+	return nil
+}
+
+// chunkNonce builds the GCM nonce for chunk number count
+func chunkNonce(prefix []byte, count uint32, last bool) []byte {
+	nonce := make([]byte, prefixSize+counterSize+1)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], count)
+	if last {
+		nonce[prefixSize+counterSize] = 1
+	}
+	return nonce
+}
@@ -2,8 +2,10 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // Config holds application configuration
@@ -21,8 +23,130 @@ type Config struct {
 	TCCBaseURL      string `json:"tcc_base_url"`
 	TCCPollInterval int    `json:"tcc_poll_interval_seconds"`
 
+	// Adaptive polling settings
+	TCCMinPollInterval   int            `json:"tcc_min_poll_interval_seconds"`
+	TCCBoostPollInterval int            `json:"tcc_boost_poll_interval_seconds"`
+	TCCBoostWindow       int            `json:"tcc_boost_window_seconds"`
+	TCCIdlePollInterval  int            `json:"tcc_idle_poll_interval_seconds"`
+	TCCIdleAfter         int            `json:"tcc_idle_after_seconds"`
+	TCCQuietPollInterval int            `json:"tcc_quiet_poll_interval_seconds"`
+	TCCQuietHoursStart   string         `json:"tcc_quiet_hours_start"` // "HH:MM" local time, empty disables
+	TCCQuietHoursEnd     string         `json:"tcc_quiet_hours_end"`
+	TCCMaxBackoff        int            `json:"tcc_max_backoff_seconds"`
+	TCCDevicePriorities  map[int]string `json:"tcc_device_priorities,omitempty"`  // device ID -> "high", "normal" or "low"
+	TCCAllowFastPolling  bool           `json:"tcc_allow_fast_polling,omitempty"` // Permits a minimum interval below TCC's 10 minute budget
+
+	// Command provenance settings
+	CommandEchoWindow int    `json:"command_echo_window_seconds"` // How long a bridge command waits for its echo
+	ConflictPolicy    string `json:"conflict_policy"`             // "wall_wins" or "bridge_wins"
+
+	// Command policy settings
+	PolicyAction   string               `json:"policy_action"` // "reject" or "clamp" out-of-range setpoints
+	PolicyDefaults DeviceLimits         `json:"policy_defaults"`
+	PolicyDevices  map[int]DeviceLimits `json:"policy_devices,omitempty"` // device ID -> overrides
+
+	// Offline command queue settings
+	CommandQueueEnabled bool `json:"command_queue_enabled"`     // Queue commands while TCC is unreachable
+	CommandQueueTTL     int  `json:"command_queue_ttl_seconds"` // How long a queued command stays valid
+
+	// Reading history settings. Zero keeps data forever.
+	HistoryRawRetentionDays    int `json:"history_raw_retention_days"`    // Raw poll readings, at least 2 days
+	HistoryHourlyRetentionDays int `json:"history_hourly_retention_days"` // Hourly aggregates
+	HistoryDailyRetentionDays  int `json:"history_daily_retention_days"`  // Daily aggregates
+
+	// HVAC runtime settings
+	RuntimeMaxGap int `json:"runtime_max_gap_seconds"` // Longer gaps between polls are not counted
+
+	// Energy cost settings. Costs are estimated from HVAC runtime once a
+	// tariff or fuel price is set.
+	EnergyCurrency   string                  `json:"energy_currency"` // Shown with costs, e.g. "USD"
+	EnergyTariff     Tariff                  `json:"energy_tariff"`
+	EnergyFuelPrices FuelPrices              `json:"energy_fuel_prices"`
+	EnergyEquipment  EquipmentRating         `json:"energy_equipment"`
+	EnergyDevices    map[int]EquipmentRating `json:"energy_devices,omitempty"` // device ID -> replaces energy_equipment
+
+	// Event log retention settings. Zero ages and limits keep everything.
+	EventLogMaxAgeDays     int               `json:"event_log_max_age_days"`    // Events not matched by a rule
+	EventLogRules          []EventLogAgeRule `json:"event_log_rules,omitempty"` // Per source/type overrides
+	EventLogMaxRows        int               `json:"event_log_max_rows"`        // Oldest rows beyond this are pruned
+	EventLogPruneInterval  int               `json:"event_log_prune_interval_seconds"`
+	EventLogVacuum         string            `json:"event_log_vacuum"` // "", "incremental" or "full"
+	EventLogVacuumInterval int               `json:"event_log_vacuum_interval_seconds"`
+
 	// Encryption key path (for TCC credentials)
 	EncryptionKeyPath string `json:"encryption_key_path"`
+
+	// File holding a passphrase that protects the encryption key. The
+	// TCC_KEY_PASSPHRASE and TCC_KEY_PASSPHRASE_FILE environment variables
+	// take precedence.
+	EncryptionPassphraseFile string `json:"encryption_passphrase_file,omitempty"`
+
+	// File holding the bearer token for /api/admin. The TCC_ADMIN_TOKEN and
+	// TCC_ADMIN_TOKEN_FILE environment variables take precedence. The admin
+	// API is disabled while no token is configured.
+	AdminTokenFile string `json:"admin_token_file,omitempty"`
+}
+
+// DeviceLimits restricts what commands may set on a thermostat. Unset
+// fields of a per-device entry inherit the defaults; a setpoint of 0 or an
+// empty allowed_modes list removes the limit.
+type DeviceLimits struct {
+	MinHeatSetpoint    *float64 `json:"min_heat_setpoint,omitempty"`
+	MaxHeatSetpoint    *float64 `json:"max_heat_setpoint,omitempty"`
+	MinCoolSetpoint    *float64 `json:"min_cool_setpoint,omitempty"`
+	MaxCoolSetpoint    *float64 `json:"max_cool_setpoint,omitempty"`
+	AllowedModes       []string `json:"allowed_modes"`
+	FreezeProtectBelow *float64 `json:"freeze_protect_below,omitempty"` // Opt-in: refuse "off" below this outdoor °F or without an outdoor reading
+	FreezeProtectOff   bool     `json:"freeze_protect_off,omitempty"`   // Turns off freeze protection inherited from the defaults
+}
+
+// EventLogAgeRule sets the maximum age for events from a source and/or of
+// a type. Empty fields match anything; the most specific rule wins.
+type EventLogAgeRule struct {
+	Source     string `json:"source,omitempty"`
+	EventType  string `json:"event_type,omitempty"`
+	MaxAgeDays int    `json:"max_age_days"` // Zero keeps matching events forever
+}
+
+// Tariff is an electricity price plan. Rates are per kWh.
+type Tariff struct {
+	Type    string         `json:"type"`              // "flat", "tou" or "tiered"; empty prices no electricity
+	Rate    float64        `json:"rate"`              // Flat rate, and the time-of-use rate outside every period
+	Periods []TariffPeriod `json:"periods,omitempty"` // Time-of-use periods, first match wins
+	Tiers   []TariffTier   `json:"tiers,omitempty"`   // Tiers by monthly HVAC kWh, in order
+}
+
+// TariffPeriod is a time-of-use rate for part of the day
+type TariffPeriod struct {
+	Days  []string `json:"days,omitempty"` // "mon" to "sun"; empty means every day
+	Start string   `json:"start"`          // "HH:00" local time
+	End   string   `json:"end"`            // "HH:00", may wrap past midnight
+	Rate  float64  `json:"rate"`
+}
+
+// TariffTier is the rate for monthly usage up to a limit
+type TariffTier struct {
+	UpToKWh float64 `json:"up_to_kwh"` // Zero for the last, unbounded tier
+	Rate    float64 `json:"rate"`
+}
+
+// FuelPrices are the prices of heating fuels
+type FuelPrices struct {
+	GasPerTherm      float64 `json:"gas_per_therm,omitempty"`
+	PropanePerGallon float64 `json:"propane_per_gallon,omitempty"`
+	OilPerGallon     float64 `json:"oil_per_gallon,omitempty"`
+}
+
+// EquipmentRating describes how much energy a device's HVAC equipment uses
+// while it runs
+type EquipmentRating struct {
+	HeatingFuel string  `json:"heating_fuel"`           // "electric", "gas", "propane" or "oil"
+	HeatingKW   float64 `json:"heating_kw,omitempty"`   // Electric draw while heating
+	HeatingBTUH float64 `json:"heating_btuh,omitempty"` // Input rating, used when heating_kw is not set
+	CoolingKW   float64 `json:"cooling_kw,omitempty"`   // Electric draw while cooling
+	CoolingBTUH float64 `json:"cooling_btuh,omitempty"` // Capacity, used with cooling_eer when cooling_kw is not set
+	CoolingEER  float64 `json:"cooling_eer,omitempty"`  // BTU/h per watt
+	FanKW       float64 `json:"fan_kw,omitempty"`       // Blower draw whenever the fan runs
 }
 
 // DefaultConfig returns the default configuration
@@ -40,6 +164,9 @@ func DefaultConfig() *Config {
 		matterBridgeDir = "./matter-bridge"
 	}
 
+	minHeat, maxHeat := 50.0, 85.0
+	minCool, maxCool := 65.0, 90.0
+
 	return &Config{
 		ServerPort:        8080,
 		DataDir:           dataDir,
@@ -49,6 +176,47 @@ func DefaultConfig() *Config {
 		TCCBaseURL:        "https://mytotalconnectcomfort.com",
 		TCCPollInterval:   600, // 10 minutes
 		EncryptionKeyPath: filepath.Join(dataDir, "encryption.key"),
+
+		TCCMinPollInterval:   600,  // 10 minutes; lower needs TCCAllowFastPolling
+		TCCBoostPollInterval: 600,  // 10 minutes
+		TCCBoostWindow:       600,  // 10 minutes
+		TCCIdlePollInterval:  1200, // 20 minutes
+		TCCIdleAfter:         1800, // 30 minutes
+		TCCQuietPollInterval: 1800, // 30 minutes
+		TCCQuietHoursStart:   "23:00",
+		TCCQuietHoursEnd:     "06:00",
+		TCCMaxBackoff:        3600, // 1 hour
+
+		CommandEchoWindow: 900, // 15 minutes
+		ConflictPolicy:    "wall_wins",
+
+		CommandQueueEnabled: true,
+		CommandQueueTTL:     3600, // 1 hour
+
+		HistoryRawRetentionDays:    14,
+		HistoryHourlyRetentionDays: 180,
+		HistoryDailyRetentionDays:  0, // Keep forever
+
+		RuntimeMaxGap: 2400, // 40 minutes, covers quiet-hours polling
+
+		EnergyEquipment: EquipmentRating{HeatingFuel: "gas"},
+
+		EventLogMaxAgeDays: 90,
+		EventLogRules: []EventLogAgeRule{
+			{Source: "tcc", MaxAgeDays: 30}, // Poll changes are the bulk of the log
+		},
+		EventLogMaxRows:        100000,
+		EventLogPruneInterval:  3600, // 1 hour
+		EventLogVacuum:         "incremental",
+		EventLogVacuumInterval: 86400, // 1 day
+
+		PolicyAction: "reject",
+		PolicyDefaults: DeviceLimits{
+			MinHeatSetpoint: &minHeat,
+			MaxHeatSetpoint: &maxHeat,
+			MinCoolSetpoint: &minCool,
+			MaxCoolSetpoint: &maxCool,
+		},
 	}
 }
 
@@ -91,6 +259,44 @@ func (c *Config) EnsureDataDir() error {
 	return os.MkdirAll(c.DataDir, 0755)
 }
 
+// KeyPassphrase returns the passphrase protecting the encryption key, or
+// "" if none is configured
+func (c *Config) KeyPassphrase() (string, error) {
+	return readSecret("TCC_KEY_PASSPHRASE", c.EncryptionPassphraseFile, "key passphrase")
+}
+
+// AdminToken returns the token that authorizes the admin API, or "" if
+// none is configured
+func (c *Config) AdminToken() (string, error) {
+	return readSecret("TCC_ADMIN_TOKEN", c.AdminTokenFile, "admin token")
+}
+
+// readSecret returns a secret from the env environment variable, or else
+// from the file named by env+"_FILE" or by file
+func readSecret(env, file, what string) (string, error) {
+	if secret := os.Getenv(env); secret != "" {
+		return secret, nil
+	}
+
+	path := os.Getenv(env + "_FILE")
+	if path == "" {
+		path = file
+	}
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", what, err)
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s file %s is empty", what, path)
+	}
+	return secret, nil
+}
+
 // DatabasePath returns the path to the SQLite database
 func (c *Config) DatabasePath() string {
 	return filepath.Join(c.DataDir, "tcc-bridge.db")
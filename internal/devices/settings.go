@@ -0,0 +1,124 @@
+// Package devices holds local per-device settings that change how TCC
+// devices are named, calibrated and exposed.
+package devices
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// MaxTempOffset bounds the calibration offset, in degrees
+const MaxTempOffset = 10.0
+
+// maxNameLength bounds a display name
+const maxNameLength = 64
+
+// ChangedHandler is called after a device's settings are saved, with the
+// settings they replaced
+type ChangedHandler func(prev, settings storage.DeviceSettings)
+
+// Settings caches every device's settings so they can be applied on each
+// poll without a query
+type Settings struct {
+	db        storage.Store
+	mu        sync.RWMutex
+	byDevice  map[int]storage.DeviceSettings
+	onChanged ChangedHandler
+}
+
+// NewSettings loads the stored device settings
+func NewSettings(db storage.Store) (*Settings, error) {
+	all, err := db.GetAllDeviceSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Settings{db: db, byDevice: make(map[int]storage.DeviceSettings)}
+	for _, ds := range all {
+		s.byDevice[ds.DeviceID] = ds
+	}
+	return s, nil
+}
+
+// SetChangedHandler sets the handler called after settings are saved
+func (s *Settings) SetChangedHandler(handler ChangedHandler) {
+	s.onChanged = handler
+}
+
+// Get returns a device's settings, or the defaults if none are stored
+func (s *Settings) Get(deviceID int) storage.DeviceSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ds, ok := s.byDevice[deviceID]; ok {
+		return ds
+	}
+	return storage.DeviceSettings{DeviceID: deviceID}
+}
+
+// All returns the settings of every device that has any
+func (s *Settings) All() []storage.DeviceSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make([]storage.DeviceSettings, 0, len(s.byDevice))
+	for _, ds := range s.byDevice {
+		all = append(all, ds)
+	}
+	return all
+}
+
+// Save validates and stores a device's settings
+func (s *Settings) Save(ds *storage.DeviceSettings) error {
+	if err := Validate(ds); err != nil {
+		return err
+	}
+	if err := s.db.SaveDeviceSettings(ds); err != nil {
+		return err
+	}
+
+	prev := s.Get(ds.DeviceID)
+	s.mu.Lock()
+	s.byDevice[ds.DeviceID] = *ds
+	s.mu.Unlock()
+
+	if s.onChanged != nil {
+		s.onChanged(prev, *ds)
+	}
+	return nil
+}
+
+// Apply applies a device's name override and calibration offset to state.
+// It must be given a copy, not the TCC client's cached state.
+func (s *Settings) Apply(state *tcc.ThermostatState) {
+	ds := s.Get(state.DeviceID)
+	if ds.DisplayName != "" {
+		state.Name = ds.DisplayName
+	}
+	if ds.TempOffset != 0 {
+		state.CurrentTemp = math.Round((state.CurrentTemp+ds.TempOffset)*10) / 10
+	}
+}
+
+// Validate checks settings before they are stored
+func Validate(ds *storage.DeviceSettings) error {
+	ds.DisplayName = strings.TrimSpace(ds.DisplayName)
+	if len(ds.DisplayName) > maxNameLength {
+		return fmt.Errorf("display name must be at most %d characters", maxNameLength)
+	}
+	if math.IsNaN(ds.TempOffset) || math.Abs(ds.TempOffset) > MaxTempOffset {
+		return fmt.Errorf("temperature offset must be between -%g and %g", MaxTempOffset, MaxTempOffset)
+	}
+	ds.TemperatureUnit = strings.ToUpper(strings.TrimSpace(ds.TemperatureUnit))
+	switch ds.TemperatureUnit {
+	case "", "F", "C":
+	default:
+		return fmt.Errorf("invalid temperature unit %q, expected F or C", ds.TemperatureUnit)
+	}
+	return nil
+}
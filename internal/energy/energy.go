@@ -0,0 +1,479 @@
+// Package energy estimates what HVAC equipment costs to run from its
+// tracked runtime, its energy ratings and the configured tariff and fuel
+// prices.
+package energy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/hvac"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// Heating fuels
+const (
+	FuelElectric = "electric"
+	FuelGas      = "gas"
+	FuelPropane  = "propane"
+	FuelOil      = "oil"
+)
+
+// Energy content used to convert ratings
+const (
+	btuPerKWh           = 3412.14
+	btuPerTherm         = 100000.0
+	btuPerGallonPropane = 91452.0
+	btuPerGallonHeatOil = 138500.0
+)
+
+// defaultCoolingEER converts a cooling capacity when no EER is configured
+const defaultCoolingEER = 10.0
+
+// Layouts of the days and months in reports
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// summaryInterval is how often completed months are checked for summaries
+const summaryInterval = time.Hour
+
+// summaryLookback is how many completed months are summarised if missing
+const summaryLookback = 2
+
+// fuelUnits names the unit each fuel is bought in
+var fuelUnits = map[string]string{
+	FuelGas:     "therm",
+	FuelPropane: "gallon",
+	FuelOil:     "gallon",
+}
+
+// Options configures the estimator
+type Options struct {
+	Currency   string
+	Tariff     config.Tariff
+	FuelPrices config.FuelPrices
+	Equipment  config.EquipmentRating
+	Devices    map[int]config.EquipmentRating // Replace Equipment for a device
+}
+
+// OptionsFromConfig builds estimator options from the configuration
+func OptionsFromConfig(cfg *config.Config) Options {
+	return Options{
+		Currency:   cfg.EnergyCurrency,
+		Tariff:     cfg.EnergyTariff,
+		FuelPrices: cfg.EnergyFuelPrices,
+		Equipment:  cfg.EnergyEquipment,
+		Devices:    cfg.EnergyDevices,
+	}
+}
+
+// Cost is estimated energy use and cost over some period. Heating, cooling
+// and fan costs add up to Total.
+type Cost struct {
+	ElectricKWh float64 `json:"electric_kwh"`
+	FuelUsed    float64 `json:"fuel_used,omitempty"` // In the device's fuel unit
+	HeatingCost float64 `json:"heating_cost"`
+	CoolingCost float64 `json:"cooling_cost"`
+	FanCost     float64 `json:"fan_cost"`
+	Total       float64 `json:"total"`
+}
+
+// add sums another period into c
+func (c *Cost) add(o Cost) {
+	c.ElectricKWh += o.ElectricKWh
+	c.FuelUsed += o.FuelUsed
+	c.HeatingCost += o.HeatingCost
+	c.CoolingCost += o.CoolingCost
+	c.FanCost += o.FanCost
+	c.Total += o.Total
+}
+
+// rounded returns c rounded for display
+func (c Cost) rounded() Cost {
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+	return Cost{
+		ElectricKWh: round(c.ElectricKWh),
+		FuelUsed:    round(c.FuelUsed),
+		HeatingCost: round(c.HeatingCost),
+		CoolingCost: round(c.CoolingCost),
+		FanCost:     round(c.FanCost),
+		Total:       round(c.Total),
+	}
+}
+
+// DayCost is a device's estimate for one local day
+type DayCost struct {
+	Day string `json:"day"` // YYYY-MM-DD
+	Cost
+}
+
+// MonthCost is a device's estimate for the days of a month in the report
+type MonthCost struct {
+	Month string `json:"month"` // YYYY-MM
+	Cost
+}
+
+// DeviceReport is one device's estimate
+type DeviceReport struct {
+	DeviceID    int         `json:"device_id"`
+	HeatingFuel string      `json:"heating_fuel"`
+	FuelUnit    string      `json:"fuel_unit,omitempty"`
+	Days        []DayCost   `json:"days"`
+	Months      []MonthCost `json:"months"`
+	Totals      Cost        `json:"totals"`
+}
+
+// Report is the estimate for a range of days
+type Report struct {
+	From     string         `json:"from"`
+	To       string         `json:"to"`
+	Currency string         `json:"currency,omitempty"`
+	Priced   bool           `json:"priced"` // False until a tariff or fuel price is configured
+	Devices  []DeviceReport `json:"devices"`
+	Totals   Cost           `json:"totals"` // Fuel is left out, as devices may burn different fuels
+}
+
+// Estimator prices HVAC runtime
+type Estimator struct {
+	db     storage.Store
+	opts   Options
+	tariff *tariff
+}
+
+// New creates an estimator, checking the options
+func New(db storage.Store, opts Options) (*Estimator, error) {
+	t, err := parseTariff(opts.Tariff)
+	if err != nil {
+		return nil, fmt.Errorf("tariff: %w", err)
+	}
+	if opts.FuelPrices.GasPerTherm < 0 || opts.FuelPrices.PropanePerGallon < 0 || opts.FuelPrices.OilPerGallon < 0 {
+		return nil, fmt.Errorf("fuel prices must not be negative")
+	}
+	if err := validateRating(opts.Equipment); err != nil {
+		return nil, fmt.Errorf("equipment: %w", err)
+	}
+	for deviceID, rating := range opts.Devices {
+		if err := validateRating(rating); err != nil {
+			return nil, fmt.Errorf("device %d equipment: %w", deviceID, err)
+		}
+	}
+
+	return &Estimator{db: db, opts: opts, tariff: t}, nil
+}
+
+// validateRating checks an equipment rating
+func validateRating(r config.EquipmentRating) error {
+	switch r.HeatingFuel {
+	case FuelElectric, FuelGas, FuelPropane, FuelOil:
+	default:
+		return fmt.Errorf("invalid heating fuel %q", r.HeatingFuel)
+	}
+	for _, v := range []float64{r.HeatingKW, r.HeatingBTUH, r.CoolingKW, r.CoolingBTUH, r.CoolingEER, r.FanKW} {
+		if v < 0 {
+			return fmt.Errorf("ratings must not be negative")
+		}
+	}
+	if r.HeatingFuel != FuelElectric && r.HeatingKW > 0 {
+		return fmt.Errorf("heating_kw only applies to electric heat; use heating_btuh")
+	}
+	return nil
+}
+
+// Priced reports whether any energy has a price
+func (e *Estimator) Priced() bool {
+	p := e.opts.FuelPrices
+	return e.tariff.priced() || p.GasPerTherm > 0 || p.PropanePerGallon > 0 || p.OilPerGallon > 0
+}
+
+// rating returns a device's equipment rating
+func (e *Estimator) rating(deviceID int) config.EquipmentRating {
+	if r, ok := e.opts.Devices[deviceID]; ok {
+		return r
+	}
+	return e.opts.Equipment
+}
+
+// fuelPrice returns the price per unit of a heating fuel
+func (e *Estimator) fuelPrice(fuel string) float64 {
+	switch fuel {
+	case FuelGas:
+		return e.opts.FuelPrices.GasPerTherm
+	case FuelPropane:
+		return e.opts.FuelPrices.PropanePerGallon
+	case FuelOil:
+		return e.opts.FuelPrices.OilPerGallon
+	default:
+		return 0
+	}
+}
+
+// usage is the energy one hour of runtime used
+type usage struct {
+	heatingKWh, coolingKWh, fanKWh float64
+	fuel                           float64
+}
+
+// hourUsage converts an hour of a device's runtime to energy
+func (e *Estimator) hourUsage(h storage.RuntimeHour) usage {
+	r := e.rating(h.DeviceID)
+	heatingHours := h.HeatingMinutes / 60
+	coolingHours := h.CoolingMinutes / 60
+
+	var u usage
+	switch {
+	case r.HeatingFuel == FuelElectric && r.HeatingKW > 0:
+		u.heatingKWh = heatingHours * r.HeatingKW
+	case r.HeatingFuel == FuelElectric:
+		u.heatingKWh = heatingHours * r.HeatingBTUH / btuPerKWh
+	case r.HeatingFuel == FuelGas:
+		u.fuel = heatingHours * r.HeatingBTUH / btuPerTherm
+	case r.HeatingFuel == FuelPropane:
+		u.fuel = heatingHours * r.HeatingBTUH / btuPerGallonPropane
+	case r.HeatingFuel == FuelOil:
+		u.fuel = heatingHours * r.HeatingBTUH / btuPerGallonHeatOil
+	}
+
+	if r.CoolingKW > 0 {
+		u.coolingKWh = coolingHours * r.CoolingKW
+	} else if r.CoolingBTUH > 0 {
+		eer := r.CoolingEER
+		if eer == 0 {
+			eer = defaultCoolingEER
+		}
+		u.coolingKWh = coolingHours * r.CoolingBTUH / eer / 1000
+	}
+	u.fanKWh = h.FanMinutes / 60 * r.FanKW
+	return u
+}
+
+// Estimate prices the runtime of the days in [from, to] for one device, or
+// every device if deviceID is 0.
+//
+// Tiered tariffs are applied to the HVAC's own monthly usage across all
+// devices, hour by hour, so the estimate starts from the beginning of
+// from's month even if only later days are reported.
+func (e *Estimator) Estimate(deviceID int, from, to time.Time) (*Report, error) {
+	from, to = from.Local(), to.Local()
+	fromDay, toDay := from.Format(dayLayout), to.Format(dayLayout)
+	if toDay < fromDay {
+		return nil, fmt.Errorf("to must not be before from")
+	}
+
+	monthStart := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.Local)
+	hours, err := e.db.GetRuntimeHours(0, monthStart.Format(hvac.HourLayout), toDay+"T23")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		From:     fromDay,
+		To:       toDay,
+		Currency: e.opts.Currency,
+		Priced:   e.Priced(),
+		Devices:  []DeviceReport{},
+	}
+	type deviceCosts struct {
+		days   map[string]*Cost
+		months map[string]*Cost
+		totals Cost
+	}
+	devices := make(map[int]*deviceCosts)
+
+	month := ""
+	monthKWh := 0.0
+	for i := 0; i < len(hours); {
+		// Price each hour's combined usage, then share it out by kWh
+		j := i
+		for j < len(hours) && hours[j].Hour == hours[i].Hour {
+			j++
+		}
+		group := hours[i:j]
+		i = j
+
+		start, err := time.ParseInLocation(hvac.HourLayout, group[0].Hour, time.Local)
+		if err != nil {
+			log.Debug("Skipping runtime with invalid hour %q", group[0].Hour)
+			continue
+		}
+		if m := start.Format(monthLayout); m != month {
+			month, monthKWh = m, 0
+		}
+
+		usages := make([]usage, len(group))
+		groupKWh := 0.0
+		for k, h := range group {
+			usages[k] = e.hourUsage(h)
+			groupKWh += usages[k].heatingKWh + usages[k].coolingKWh + usages[k].fanKWh
+		}
+		electricCost := e.tariff.cost(start, monthKWh, groupKWh)
+		monthKWh += groupKWh
+
+		day := start.Format(dayLayout)
+		if day < fromDay {
+			continue
+		}
+		for k, h := range group {
+			if deviceID != 0 && h.DeviceID != deviceID {
+				continue
+			}
+
+			u := usages[k]
+			c := Cost{
+				ElectricKWh: u.heatingKWh + u.coolingKWh + u.fanKWh,
+				FuelUsed:    u.fuel,
+				HeatingCost: u.fuel * e.fuelPrice(e.rating(h.DeviceID).HeatingFuel),
+			}
+			if groupKWh > 0 {
+				perKWh := electricCost / groupKWh
+				c.HeatingCost += u.heatingKWh * perKWh
+				c.CoolingCost = u.coolingKWh * perKWh
+				c.FanCost = u.fanKWh * perKWh
+			}
+			c.Total = c.HeatingCost + c.CoolingCost + c.FanCost
+
+			dc := devices[h.DeviceID]
+			if dc == nil {
+				dc = &deviceCosts{days: make(map[string]*Cost), months: make(map[string]*Cost)}
+				devices[h.DeviceID] = dc
+			}
+			if dc.days[day] == nil {
+				dc.days[day] = &Cost{}
+			}
+			dc.days[day].add(c)
+			if dc.months[month] == nil {
+				dc.months[month] = &Cost{}
+			}
+			dc.months[month].add(c)
+			dc.totals.add(c)
+		}
+	}
+
+	ids := make([]int, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		dc := devices[id]
+		fuel := e.rating(id).HeatingFuel
+		dr := DeviceReport{
+			DeviceID:    id,
+			HeatingFuel: fuel,
+			FuelUnit:    fuelUnits[fuel],
+			Days:        make([]DayCost, 0, len(dc.days)),
+			Months:      make([]MonthCost, 0, len(dc.months)),
+			Totals:      dc.totals.rounded(),
+		}
+		for day, c := range dc.days {
+			dr.Days = append(dr.Days, DayCost{Day: day, Cost: c.rounded()})
+		}
+		sort.Slice(dr.Days, func(a, b int) bool { return dr.Days[a].Day < dr.Days[b].Day })
+		for m, c := range dc.months {
+			dr.Months = append(dr.Months, MonthCost{Month: m, Cost: c.rounded()})
+		}
+		sort.Slice(dr.Months, func(a, b int) bool { return dr.Months[a].Month < dr.Months[b].Month })
+
+		report.Devices = append(report.Devices, dr)
+		totals := dc.totals
+		totals.FuelUsed = 0
+		report.Totals.add(totals)
+	}
+	report.Totals = report.Totals.rounded()
+
+	return report, nil
+}
+
+// Run writes monthly cost summaries to the event log until ctx is cancelled
+func (e *Estimator) Run(ctx context.Context) {
+	if !e.Priced() {
+		log.Info("Energy cost summaries disabled: no tariff or fuel price configured")
+		return
+	}
+	log.Info("Starting monthly energy cost summaries")
+
+	ticker := time.NewTicker(summaryInterval)
+	defer ticker.Stop()
+
+	for {
+		e.summarize(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// summarize stores and logs a summary for each recently completed month
+// that does not have one yet
+func (e *Estimator) summarize(now time.Time) {
+	now = now.Local()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	for i := summaryLookback; i >= 1; i-- {
+		start := current.AddDate(0, -i, 0)
+		end := start.AddDate(0, 1, -1)
+
+		report, err := e.Estimate(0, start, end)
+		if err != nil {
+			log.Error("Failed to estimate energy cost: %v", err)
+			return
+		}
+
+		for _, d := range report.Devices {
+			created, err := e.db.SaveEnergyMonth(&storage.EnergyMonth{
+				DeviceID:    d.DeviceID,
+				Month:       start.Format(monthLayout),
+				ElectricKWh: d.Totals.ElectricKWh,
+				FuelUsed:    d.Totals.FuelUsed,
+				Cost:        d.Totals.Total,
+			})
+			if err != nil {
+				log.Error("%v", err)
+				continue
+			}
+			if !created {
+				continue
+			}
+
+			message := fmt.Sprintf("Estimated HVAC cost for device %d in %s: %.2f%s (heating %.2f, cooling %.2f, fan %.2f; %.2f kWh",
+				d.DeviceID, start.Format(monthLayout), d.Totals.Total, currencySuffix(report.Currency),
+				d.Totals.HeatingCost, d.Totals.CoolingCost, d.Totals.FanCost, d.Totals.ElectricKWh)
+			if d.FuelUnit != "" {
+				message += fmt.Sprintf(", %.2f %ss %s", d.Totals.FuelUsed, d.FuelUnit, d.HeatingFuel)
+			}
+			message += ")"
+
+			log.Info("%s", message)
+			e.db.LogEvent(storage.EventSourceSystem, storage.EventTypeEnergy, message, map[string]interface{}{
+				"device_id":    d.DeviceID,
+				"month":        start.Format(monthLayout),
+				"currency":     report.Currency,
+				"electric_kwh": d.Totals.ElectricKWh,
+				"heating_fuel": d.HeatingFuel,
+				"fuel_used":    d.Totals.FuelUsed,
+				"fuel_unit":    d.FuelUnit,
+				"heating_cost": d.Totals.HeatingCost,
+				"cooling_cost": d.Totals.CoolingCost,
+				"fan_cost":     d.Totals.FanCost,
+				"total_cost":   d.Totals.Total,
+			})
+		}
+	}
+}
+
+// currencySuffix formats a currency code to follow an amount
+func currencySuffix(currency string) string {
+	if currency == "" {
+		return ""
+	}
+	return " " + currency
+}
@@ -0,0 +1,176 @@
+package energy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+)
+
+// Tariff types
+const (
+	TariffNone      = ""
+	TariffFlat      = "flat"
+	TariffTimeOfUse = "tou"
+	TariffTiered    = "tiered"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// period is a parsed time-of-use period
+type period struct {
+	days       map[time.Weekday]bool // nil means every day
+	start, end int                   // Hours; end may be before start
+	rate       float64
+}
+
+// covers reports whether the hour starting at t falls in the period
+func (p period) covers(t time.Time) bool {
+	if p.days != nil && !p.days[t.Weekday()] {
+		return false
+	}
+	h := t.Hour()
+	switch {
+	case p.start == p.end:
+		return true
+	case p.start < p.end:
+		return h >= p.start && h < p.end
+	default:
+		return h >= p.start || h < p.end
+	}
+}
+
+// tariff prices electricity
+type tariff struct {
+	kind    string
+	rate    float64
+	periods []period
+	tiers   []config.TariffTier
+}
+
+// parseTariff checks a configured tariff
+func parseTariff(t config.Tariff) (*tariff, error) {
+	parsed := &tariff{kind: t.Type, rate: t.Rate, tiers: t.Tiers}
+	if t.Rate < 0 {
+		return nil, fmt.Errorf("tariff rate must not be negative")
+	}
+
+	switch t.Type {
+	case TariffNone, TariffFlat:
+	case TariffTimeOfUse:
+		for i, p := range t.Periods {
+			start, err := parseHour(p.Start)
+			if err != nil {
+				return nil, fmt.Errorf("period %d: %w", i+1, err)
+			}
+			end, err := parseHour(p.End)
+			if err != nil {
+				return nil, fmt.Errorf("period %d: %w", i+1, err)
+			}
+			if p.Rate < 0 {
+				return nil, fmt.Errorf("period %d: rate must not be negative", i+1)
+			}
+
+			pp := period{start: start, end: end, rate: p.Rate}
+			if len(p.Days) > 0 {
+				pp.days = make(map[time.Weekday]bool)
+				for _, d := range p.Days {
+					wd, ok := weekdays[strings.ToLower(d)]
+					if !ok {
+						return nil, fmt.Errorf("period %d: invalid day %q", i+1, d)
+					}
+					pp.days[wd] = true
+				}
+			}
+			parsed.periods = append(parsed.periods, pp)
+		}
+	case TariffTiered:
+		if len(t.Tiers) == 0 {
+			return nil, fmt.Errorf("tiered tariff needs at least one tier")
+		}
+		prev := 0.0
+		for i, tier := range t.Tiers {
+			if tier.Rate < 0 {
+				return nil, fmt.Errorf("tier %d: rate must not be negative", i+1)
+			}
+			last := i == len(t.Tiers)-1
+			if tier.UpToKWh == 0 && !last {
+				return nil, fmt.Errorf("tier %d: only the last tier may be unbounded", i+1)
+			}
+			if tier.UpToKWh != 0 && tier.UpToKWh <= prev {
+				return nil, fmt.Errorf("tier %d: up_to_kwh must increase", i+1)
+			}
+			prev = tier.UpToKWh
+		}
+	default:
+		return nil, fmt.Errorf("invalid tariff type %q", t.Type)
+	}
+
+	return parsed, nil
+}
+
+// parseHour parses an "HH:00" time
+func parseHour(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:00", s)
+	}
+	if t.Minute() != 0 {
+		return 0, fmt.Errorf("time %q must be on the hour", s)
+	}
+	return t.Hour(), nil
+}
+
+// priced reports whether the tariff prices electricity at all
+func (t *tariff) priced() bool {
+	return t.kind != TariffNone
+}
+
+// cost returns the cost of kwh used in the hour starting at hour, when
+// monthKWh had already been used that month
+func (t *tariff) cost(hour time.Time, monthKWh, kwh float64) float64 {
+	switch t.kind {
+	case TariffFlat:
+		return kwh * t.rate
+	case TariffTimeOfUse:
+		for _, p := range t.periods {
+			if p.covers(hour) {
+				return kwh * p.rate
+			}
+		}
+		return kwh * t.rate
+	case TariffTiered:
+		return t.tieredCost(monthKWh, monthKWh+kwh)
+	default:
+		return 0
+	}
+}
+
+// tieredCost prices usage between two points of the month's cumulative kWh
+func (t *tariff) tieredCost(from, to float64) float64 {
+	cost := 0.0
+	lower := 0.0
+	for i, tier := range t.tiers {
+		upper := tier.UpToKWh
+		if upper == 0 || i == len(t.tiers)-1 && to > upper {
+			upper = to // The last tier covers everything beyond it
+		}
+		if lo, hi := max(from, lower), min(to, upper); hi > lo {
+			cost += (hi - lo) * tier.Rate
+		}
+		lower = upper
+		if lower >= to {
+			break
+		}
+	}
+	return cost
+}
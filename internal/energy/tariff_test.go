@@ -0,0 +1,126 @@
+package energy
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+)
+
+func TestPeriodCovers(t *testing.T) {
+	// 2026-03-02 is a Monday
+	at := func(day, hour int) time.Time {
+		return time.Date(2026, 3, day, hour, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name   string
+		period config.TariffPeriod
+		hour   time.Time
+		want   bool
+	}{
+		{name: "peak start", period: config.TariffPeriod{Start: "16:00", End: "21:00"}, hour: at(2, 16), want: true},
+		{name: "peak last hour", period: config.TariffPeriod{Start: "16:00", End: "21:00"}, hour: at(2, 20), want: true},
+		{name: "peak end is exclusive", period: config.TariffPeriod{Start: "16:00", End: "21:00"}, hour: at(2, 21), want: false},
+		{name: "before peak", period: config.TariffPeriod{Start: "16:00", End: "21:00"}, hour: at(2, 15), want: false},
+		{name: "overnight before midnight", period: config.TariffPeriod{Start: "22:00", End: "06:00"}, hour: at(2, 23), want: true},
+		{name: "overnight at midnight", period: config.TariffPeriod{Start: "22:00", End: "06:00"}, hour: at(3, 0), want: true},
+		{name: "overnight last hour", period: config.TariffPeriod{Start: "22:00", End: "06:00"}, hour: at(3, 5), want: true},
+		{name: "overnight end is exclusive", period: config.TariffPeriod{Start: "22:00", End: "06:00"}, hour: at(3, 6), want: false},
+		{name: "outside overnight", period: config.TariffPeriod{Start: "22:00", End: "06:00"}, hour: at(2, 12), want: false},
+		{name: "same start and end is all day", period: config.TariffPeriod{Start: "00:00", End: "00:00"}, hour: at(2, 13), want: true},
+		{
+			name:   "listed day",
+			period: config.TariffPeriod{Days: []string{"mon", "tue"}, Start: "22:00", End: "06:00"},
+			hour:   at(2, 23), want: true,
+		},
+		{
+			name:   "unlisted day",
+			period: config.TariffPeriod{Days: []string{"mon", "tue"}, Start: "22:00", End: "06:00"},
+			hour:   at(7, 23), want: false,
+		},
+		{
+			name:   "days apply to the hour itself after wrapping",
+			period: config.TariffPeriod{Days: []string{"tue"}, Start: "22:00", End: "06:00"},
+			hour:   at(3, 1), want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parseTariff(config.Tariff{Type: TariffTimeOfUse, Periods: []config.TariffPeriod{tt.period}})
+			if err != nil {
+				t.Fatalf("parseTariff() error = %v", err)
+			}
+			if got := parsed.periods[0].covers(tt.hour); got != tt.want {
+				t.Errorf("covers(%s) = %v, want %v", tt.hour.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeOfUseCost(t *testing.T) {
+	parsed, err := parseTariff(config.Tariff{
+		Type: TariffTimeOfUse,
+		Rate: 0.15,
+		Periods: []config.TariffPeriod{
+			{Start: "16:00", End: "21:00", Rate: 0.40},
+			{Start: "22:00", End: "06:00", Rate: 0.08},
+			{Start: "00:00", End: "00:00", Rate: 1.00}, // never reached after the overnight period
+		},
+	})
+	if err != nil {
+		t.Fatalf("parseTariff() error = %v", err)
+	}
+
+	tests := []struct {
+		hour int
+		want float64
+	}{
+		{hour: 17, want: 0.40},
+		{hour: 23, want: 0.08},
+		{hour: 3, want: 0.08},
+		{hour: 12, want: 1.00},
+	}
+	for _, tt := range tests {
+		hour := time.Date(2026, 3, 2, tt.hour, 0, 0, 0, time.Local)
+		if got := parsed.cost(hour, 0, 1); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("cost(%02d:00) = %v, want %v", tt.hour, got, tt.want)
+		}
+	}
+}
+
+func TestTieredCost(t *testing.T) {
+	unbounded := []config.TariffTier{{UpToKWh: 100, Rate: 0.10}, {UpToKWh: 200, Rate: 0.20}, {Rate: 0.30}}
+	bounded := []config.TariffTier{{UpToKWh: 100, Rate: 0.10}, {UpToKWh: 200, Rate: 0.20}}
+
+	tests := []struct {
+		name     string
+		tiers    []config.TariffTier
+		from, to float64
+		want     float64
+	}{
+		{name: "within the first tier", tiers: unbounded, from: 0, to: 50, want: 5},
+		{name: "across the first boundary", tiers: unbounded, from: 90, to: 110, want: 1 + 2},
+		{name: "into the unbounded tier", tiers: unbounded, from: 150, to: 250, want: 10 + 15},
+		{name: "every tier", tiers: unbounded, from: 0, to: 300, want: 10 + 20 + 30},
+		{name: "starting on a boundary", tiers: unbounded, from: 100, to: 120, want: 4},
+		{name: "no usage", tiers: unbounded, from: 120, to: 120, want: 0},
+		{name: "bounded last tier covers the rest", tiers: bounded, from: 150, to: 250, want: 10 + 10},
+		{name: "beyond a bounded last tier", tiers: bounded, from: 250, to: 300, want: 10},
+		{name: "single tier", tiers: []config.TariffTier{{UpToKWh: 100, Rate: 0.10}}, from: 50, to: 150, want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parseTariff(config.Tariff{Type: TariffTiered, Tiers: tt.tiers})
+			if err != nil {
+				t.Fatalf("parseTariff() error = %v", err)
+			}
+			if got := parsed.tieredCost(tt.from, tt.to); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("tieredCost(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
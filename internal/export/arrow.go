@@ -0,0 +1,238 @@
+package export
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// arrowBatchRows is how many rows are buffered per record batch
+const arrowBatchRows = 4096
+
+// Arrow FlatBuffers enum values, from the format's Schema.fbs and
+// Message.fbs
+const (
+	arrowMetadataV5        = 4
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble = 2
+	arrowUnitMillisecond = 1
+)
+
+// arrowContinuation starts every encapsulated IPC message
+const arrowContinuation = 0xFFFFFFFF
+
+// arrowWriter writes the Arrow IPC stream format: a schema message, then a
+// record batch per arrowBatchRows rows, then an end-of-stream marker
+type arrowWriter struct {
+	w       io.Writer
+	columns []Column
+	builder []*arrowColumn
+	rows    int
+}
+
+// arrowColumn buffers one column of the current batch
+type arrowColumn struct {
+	typ      ColumnType
+	validity []byte
+	nulls    int
+	values   []byte  // fixed-width values, or bits for bool
+	offsets  []int32 // string offsets
+	data     []byte  // string bytes
+}
+
+func newArrowWriter(w io.Writer, schema Schema) (*arrowWriter, error) {
+	aw := &arrowWriter{w: w, columns: schema.Columns}
+	for _, col := range schema.Columns {
+		aw.builder = append(aw.builder, &arrowColumn{typ: col.Type})
+	}
+	aw.reset()
+
+	fields := make(fbTables, len(schema.Columns))
+	for i, col := range schema.Columns {
+		typeID, typ := arrowType(col.Type)
+		fields[i] = fbTable{
+			fbString(col.Name),
+			fbBool(col.Nullable),
+			fbByte(typeID),
+			typ,
+			nil,        // dictionary
+			fbTables{}, // children
+		}
+	}
+
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	message := fbTable{
+		fbShort(arrowMetadataV5),
+		fbByte(arrowHeaderSchema),
+		fbTable{
+			fbShort(0), // little endian
+			fields,
+			fbTables{{fbString("tcc_bridge.schema"), fbString(string(schemaJSON))}},
+		},
+		fbLong(0),
+	}
+	metadata, err := encodeFlatBuffer(message)
+	if err != nil {
+		return nil, err
+	}
+	return aw, aw.writeMessage(metadata, nil)
+}
+
+// arrowType returns the Type union member for a column type
+func arrowType(t ColumnType) (uint8, fbTable) {
+	switch t {
+	case TypeInt64:
+		return arrowTypeInt, fbTable{fbInt(64), fbBool(true)}
+	case TypeFloat64:
+		return arrowTypeFloatingPoint, fbTable{fbShort(arrowPrecisionDouble)}
+	case TypeBool:
+		return arrowTypeBool, fbTable{}
+	case TypeTimestamp:
+		return arrowTypeTimestamp, fbTable{fbShort(arrowUnitMillisecond), fbString("UTC")}
+	default:
+		return arrowTypeUtf8, fbTable{}
+	}
+}
+
+// reset empties the column buffers for the next batch
+func (aw *arrowWriter) reset() {
+	aw.rows = 0
+	for _, c := range aw.builder {
+		c.validity = c.validity[:0]
+		c.nulls = 0
+		c.values = c.values[:0]
+		c.offsets = append(c.offsets[:0], 0)
+		c.data = c.data[:0]
+	}
+}
+
+func (aw *arrowWriter) WriteRow(values []interface{}) error {
+	row := aw.rows
+	for i, v := range values {
+		c := aw.builder[i]
+		if row%8 == 0 {
+			c.validity = append(c.validity, 0)
+			if c.typ == TypeBool {
+				c.values = append(c.values, 0)
+			}
+		}
+		if v == nil {
+			c.nulls++
+		} else {
+			c.validity[row/8] |= 1 << (row % 8)
+		}
+
+		switch c.typ {
+		case TypeInt64:
+			n, _ := v.(int64)
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(n))
+		case TypeFloat64:
+			f, _ := v.(float64)
+			c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(f))
+		case TypeTimestamp:
+			var ms int64
+			if t, ok := v.(time.Time); ok {
+				ms = t.UnixMilli()
+			}
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(ms))
+		case TypeBool:
+			if b, _ := v.(bool); b {
+				c.values[row/8] |= 1 << (row % 8)
+			}
+		default:
+			s, _ := v.(string)
+			c.data = append(c.data, s...)
+			c.offsets = append(c.offsets, int32(len(c.data)))
+		}
+	}
+
+	aw.rows++
+	if aw.rows == arrowBatchRows {
+		return aw.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a record batch
+func (aw *arrowWriter) flush() error {
+	if aw.rows == 0 {
+		return nil
+	}
+
+	var body []byte
+	var nodes, buffers fbStructs
+	addBuffer := func(b []byte) {
+		buffers = append(buffers, []int64{int64(len(body)), int64(len(b))})
+		body = append(body, b...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+
+	for _, c := range aw.builder {
+		nodes = append(nodes, []int64{int64(aw.rows), int64(c.nulls)})
+		if c.nulls > 0 {
+			addBuffer(c.validity)
+		} else {
+			addBuffer(nil)
+		}
+		if c.typ == TypeString {
+			offsets := make([]byte, 0, 4*len(c.offsets))
+			for _, off := range c.offsets {
+				offsets = binary.LittleEndian.AppendUint32(offsets, uint32(off))
+			}
+			addBuffer(offsets)
+			addBuffer(c.data)
+		} else {
+			addBuffer(c.values)
+		}
+	}
+
+	message := fbTable{
+		fbShort(arrowMetadataV5),
+		fbByte(arrowHeaderRecordBatch),
+		fbTable{fbLong(int64(aw.rows)), nodes, buffers},
+		fbLong(int64(len(body))),
+	}
+	metadata, err := encodeFlatBuffer(message)
+	if err != nil {
+		return err
+	}
+	aw.reset()
+	return aw.writeMessage(metadata, body)
+}
+
+// writeMessage writes an encapsulated message: continuation marker,
+// metadata length, metadata and body, each 8-byte aligned
+func (aw *arrowWriter) writeMessage(metadata, body []byte) error {
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:4], arrowContinuation)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata)))
+	for _, b := range [][]byte{prefix[:], metadata, body} {
+		if _, err := aw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes any remaining rows and the end-of-stream marker
+func (aw *arrowWriter) Close() error {
+	if err := aw.flush(); err != nil {
+		return err
+	}
+	return aw.writeMessage(nil, nil)
+}
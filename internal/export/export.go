@@ -0,0 +1,306 @@
+// Package export streams event logs and thermostat readings out of the
+// database as CSV, NDJSON or Arrow IPC for analysis elsewhere.
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// SchemaVersion changes whenever a dataset's columns change
+const SchemaVersion = 1
+
+// Dataset names what is exported
+type Dataset string
+
+const (
+	DatasetEvents   Dataset = "events"
+	DatasetReadings Dataset = "readings"
+)
+
+// Format is an output encoding
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+	// FormatArrow is the Arrow IPC stream format, readable with
+	// pyarrow.ipc.open_stream, polars.read_ipc_stream and the like, and
+	// convertible to Parquet without a schema guess
+	FormatArrow Format = "arrow"
+)
+
+// ColumnType is the logical type of a column
+type ColumnType string
+
+const (
+	TypeInt64     ColumnType = "int64"
+	TypeFloat64   ColumnType = "float64"
+	TypeBool      ColumnType = "bool"
+	TypeString    ColumnType = "string"
+	TypeTimestamp ColumnType = "timestamp" // UTC, millisecond precision
+)
+
+// Column describes one exported column
+type Column struct {
+	Name     string     `json:"name"`
+	Type     ColumnType `json:"type"`
+	Nullable bool       `json:"nullable"`
+}
+
+// Schema describes an export. It leads every export: as the CSV header
+// row, the first NDJSON line and the Arrow schema message.
+type Schema struct {
+	Dataset string   `json:"dataset"`
+	Version int      `json:"version"`
+	Columns []Column `json:"columns"`
+}
+
+var eventColumns = []Column{
+	{"id", TypeInt64, false},
+	{"timestamp", TypeTimestamp, false},
+	{"source", TypeString, false},
+	{"event_type", TypeString, false},
+	{"device_id", TypeInt64, true},
+	{"message", TypeString, false},
+	{"details", TypeString, true},
+	{"correlation_id", TypeString, true},
+}
+
+var readingColumns = []Column{
+	{"device_id", TypeInt64, false},
+	{"recorded_at", TypeTimestamp, false},
+	{"current_temp", TypeFloat64, false},
+	{"heat_setpoint", TypeFloat64, false},
+	{"cool_setpoint", TypeFloat64, false},
+	{"system_mode", TypeString, false},
+	{"humidity", TypeInt64, true},
+	{"is_heating", TypeBool, false},
+	{"is_cooling", TypeBool, false},
+	{"outdoor_temp", TypeFloat64, true},
+	{"outdoor_humidity", TypeFloat64, true},
+}
+
+var aggregateColumns = []Column{
+	{"device_id", TypeInt64, false},
+	{"bucket_start", TypeTimestamp, false},
+	{"samples", TypeInt64, false},
+	{"temp_avg", TypeFloat64, false},
+	{"temp_min", TypeFloat64, false},
+	{"temp_max", TypeFloat64, false},
+	{"heat_setpoint_avg", TypeFloat64, true},
+	{"cool_setpoint_avg", TypeFloat64, true},
+	{"humidity_avg", TypeFloat64, true},
+	{"outdoor_temp_avg", TypeFloat64, true},
+	{"outdoor_humidity_avg", TypeFloat64, true},
+	{"heating_ratio", TypeFloat64, false},
+	{"cooling_ratio", TypeFloat64, false},
+	{"system_mode", TypeString, true},
+}
+
+// Request selects the rows and encoding of an export
+type Request struct {
+	Dataset  Dataset
+	Format   Format
+	Gzip     bool
+	From     time.Time
+	To       time.Time
+	DeviceID int // 0 exports every device
+
+	// Resolution picks raw readings or hourly/daily rollups; readings only
+	Resolution storage.Resolution
+
+	// Events only
+	Source    *storage.EventSource
+	EventType *storage.EventType
+}
+
+// Validate checks the request before anything is written
+func (r Request) Validate() error {
+	switch r.Dataset {
+	case DatasetEvents:
+	case DatasetReadings:
+		switch r.Resolution {
+		case "", storage.ResolutionRaw, storage.ResolutionHourly, storage.ResolutionDaily:
+		default:
+			return fmt.Errorf("invalid resolution %q", r.Resolution)
+		}
+	default:
+		return fmt.Errorf("unknown dataset %q", r.Dataset)
+	}
+	switch r.Format {
+	case FormatCSV, FormatNDJSON, FormatArrow:
+	default:
+		return fmt.Errorf("unknown format %q", r.Format)
+	}
+	if !r.To.After(r.From) {
+		return fmt.Errorf("to must be after from")
+	}
+	return nil
+}
+
+// Schema returns the schema of the requested dataset
+func (r Request) Schema() Schema {
+	switch {
+	case r.Dataset == DatasetEvents:
+		return Schema{Dataset: string(DatasetEvents), Version: SchemaVersion, Columns: eventColumns}
+	case r.Resolution == storage.ResolutionHourly || r.Resolution == storage.ResolutionDaily:
+		return Schema{Dataset: string(DatasetReadings) + "_" + string(r.Resolution), Version: SchemaVersion, Columns: aggregateColumns}
+	default:
+		return Schema{Dataset: string(DatasetReadings), Version: SchemaVersion, Columns: readingColumns}
+	}
+}
+
+// Filename suggests a file name for the export
+func (r Request) Filename() string {
+	ext := map[Format]string{FormatCSV: ".csv", FormatNDJSON: ".ndjson", FormatArrow: ".arrows"}[r.Format]
+	name := fmt.Sprintf("tcc-bridge-%s-%s-%s%s", r.Schema().Dataset,
+		r.From.Format("20060102"), r.To.Format("20060102"), ext)
+	if r.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// ContentType returns the MIME type of the export
+func (r Request) ContentType() string {
+	if r.Gzip {
+		return "application/gzip"
+	}
+	switch r.Format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.arrow.stream"
+	}
+}
+
+// rowWriter encodes rows of column values. Values are int64, float64,
+// bool, string, time.Time or nil for null.
+type rowWriter interface {
+	WriteRow(values []interface{}) error
+	// Close flushes buffered rows without closing the underlying writer
+	Close() error
+}
+
+// Export streams the requested rows to w and returns how many were written.
+// Rows are encoded as they are read, so memory use does not grow with the
+// size of the export.
+func Export(ctx context.Context, db storage.Store, req Request, w io.Writer) (int, error) {
+	if err := req.Validate(); err != nil {
+		return 0, err
+	}
+
+	var gz *gzip.Writer
+	if req.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	schema := req.Schema()
+	var rw rowWriter
+	var err error
+	switch req.Format {
+	case FormatCSV:
+		rw, err = newCSVWriter(w, schema)
+	case FormatNDJSON:
+		rw, err = newNDJSONWriter(w, schema)
+	default:
+		rw, err = newArrowWriter(w, schema)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	write := func(values ...interface{}) error {
+		count++
+		return rw.WriteRow(values)
+	}
+
+	switch {
+	case req.Dataset == DatasetEvents:
+		filter := storage.EventLogFilter{
+			Source:    req.Source,
+			EventType: req.EventType,
+			DeviceID:  req.DeviceID,
+			Since:     &req.From,
+			Until:     &req.To,
+		}
+		err = db.EachEventLog(ctx, filter, func(e *storage.EventLog) error {
+			return write(int64(e.ID), e.Timestamp, string(e.Source), string(e.EventType),
+				nullInt(e.DeviceID), e.Message, nullString(string(e.Details)), nullString(e.CorrelationID))
+		})
+	case req.Resolution == storage.ResolutionHourly || req.Resolution == storage.ResolutionDaily:
+		err = db.EachAggregate(ctx, req.Resolution, req.DeviceID, req.From, req.To, func(a *storage.ReadingAggregate) error {
+			return write(int64(a.DeviceID), a.BucketStart, int64(a.Samples), a.TempAvg, a.TempMin, a.TempMax,
+				nullFloat(a.HeatSetpoint), nullFloat(a.CoolSetpoint), nullFloat(a.Humidity),
+				nullFloat(a.OutdoorTemp), nullFloat(a.OutdoorHumidity), a.HeatingRatio, a.CoolingRatio,
+				nullString(a.SystemMode))
+		})
+	default:
+		err = db.EachReading(ctx, req.DeviceID, req.From, req.To, func(r *storage.Reading) error {
+			var humidity interface{}
+			if r.Humidity != nil {
+				humidity = int64(*r.Humidity)
+			}
+			return write(int64(r.DeviceID), r.RecordedAt, r.CurrentTemp, r.HeatSetpoint, r.CoolSetpoint,
+				r.SystemMode, humidity, r.IsHeating, r.IsCooling, nullFloat(r.OutdoorTemp), nullFloat(r.OutdoorHumidity))
+		})
+	}
+	if err != nil {
+		return count, fmt.Errorf("failed to export %s: %w", schema.Dataset, err)
+	}
+
+	if err := rw.Close(); err != nil {
+		return count, fmt.Errorf("failed to finish export: %w", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return count, fmt.Errorf("failed to finish export: %w", err)
+		}
+	}
+	return count, nil
+}
+
+// nullInt treats 0 as a missing device ID
+func nullInt(v int) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return int64(v)
+}
+
+func nullFloat(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func nullString(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+// ParseTime accepts RFC 3339 timestamps or YYYY-MM-DD dates, which are
+// taken as local midnight
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", s)
+	}
+	return t, nil
+}
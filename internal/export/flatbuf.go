@@ -0,0 +1,204 @@
+package export
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Arrow IPC metadata is FlatBuffers. The handful of messages written here
+// do not justify a code generator, so this is a minimal encoder: a message
+// is described as a tree of fbTable values and laid out front to back.
+// Every table is written before the strings, vectors and tables it
+// references, so all offsets point forward as the format requires.
+
+// fbValue is a table field: a scalar or a reference to another object
+type fbValue interface{}
+
+// fbScalar is an inline little-endian value of 1, 2, 4 or 8 bytes
+type fbScalar struct {
+	size int
+	bits uint64
+}
+
+func fbByte(v uint8) fbScalar  { return fbScalar{1, uint64(v)} }
+func fbShort(v int16) fbScalar { return fbScalar{2, uint64(uint16(v))} }
+func fbInt(v int32) fbScalar   { return fbScalar{4, uint64(uint32(v))} }
+func fbLong(v int64) fbScalar  { return fbScalar{8, uint64(v)} }
+func fbBool(v bool) fbScalar {
+	if v {
+		return fbByte(1)
+	}
+	return fbByte(0)
+}
+
+// fbTable holds fields by ID; nil fields are left out
+type fbTable []fbValue
+
+// fbString is a UTF-8 string
+type fbString string
+
+// fbTables is a vector of tables
+type fbTables []fbTable
+
+// fbStructs is a vector of structs whose fields are all 8-byte integers,
+// which is all Arrow's FieldNode and Buffer need
+type fbStructs [][]int64
+
+// fbBuilder accumulates the encoded buffer
+type fbBuilder struct {
+	buf []byte
+}
+
+// encodeFlatBuffer lays out root and returns the buffer, padded to 8 bytes
+func encodeFlatBuffer(root fbTable) ([]byte, error) {
+	b := &fbBuilder{}
+	b.pad(4)
+	pos, err := b.table(root)
+	if err != nil {
+		return nil, err
+	}
+	b.patch(0, pos)
+	b.align(8)
+	return b.buf, nil
+}
+
+// align pads with zeros until the buffer length is a multiple of n
+func (b *fbBuilder) align(n int) {
+	for len(b.buf)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// pad reserves n zero bytes and returns their position
+func (b *fbBuilder) pad(n int) int {
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, n)...)
+	return pos
+}
+
+// patch points the offset slot at pos to target
+func (b *fbBuilder) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+// put writes a scalar at pos
+func (b *fbBuilder) put(pos int, s fbScalar) {
+	switch s.size {
+	case 1:
+		b.buf[pos] = byte(s.bits)
+	case 2:
+		binary.LittleEndian.PutUint16(b.buf[pos:], uint16(s.bits))
+	case 4:
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(s.bits))
+	case 8:
+		binary.LittleEndian.PutUint64(b.buf[pos:], s.bits)
+	}
+}
+
+// object writes a referenced value and returns its position
+func (b *fbBuilder) object(v fbValue) (int, error) {
+	switch v := v.(type) {
+	case fbTable:
+		return b.table(v)
+	case fbString:
+		return b.string(string(v)), nil
+	case fbTables:
+		return b.tables(v)
+	case fbStructs:
+		return b.structs(v), nil
+	}
+	return 0, fmt.Errorf("flatbuffer: unsupported value of type %T", v)
+}
+
+// table writes a vtable followed by the table it describes, then the
+// objects the table references
+func (b *fbBuilder) table(t fbTable) (int, error) {
+	// Lay out inline fields after the 4-byte vtable offset, each aligned to
+	// its size; the table itself starts 8-byte aligned so relative and
+	// absolute alignment agree
+	offsets := make([]int, len(t))
+	size := 4
+	for i, v := range t {
+		n := 0
+		switch v := v.(type) {
+		case nil:
+			continue
+		case fbScalar:
+			n = v.size
+		default:
+			n = 4
+		}
+		for size%n != 0 {
+			size++
+		}
+		offsets[i] = size
+		size += n
+	}
+
+	b.align(2)
+	vtable := b.pad(4 + 2*len(t))
+	binary.LittleEndian.PutUint16(b.buf[vtable:], uint16(4+2*len(t)))
+	binary.LittleEndian.PutUint16(b.buf[vtable+2:], uint16(size))
+	for i, off := range offsets {
+		binary.LittleEndian.PutUint16(b.buf[vtable+4+2*i:], uint16(off))
+	}
+
+	b.align(8)
+	pos := b.pad(size)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(pos-vtable)))
+
+	for i, v := range t {
+		switch v := v.(type) {
+		case nil:
+		case fbScalar:
+			b.put(pos+offsets[i], v)
+		default:
+			obj, err := b.object(v)
+			if err != nil {
+				return 0, err
+			}
+			b.patch(pos+offsets[i], obj)
+		}
+	}
+	return pos, nil
+}
+
+// string writes a length-prefixed, NUL-terminated string
+func (b *fbBuilder) string(s string) int {
+	b.align(4)
+	pos := b.pad(4)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return pos
+}
+
+// tables writes a vector of offsets followed by the tables
+func (b *fbBuilder) tables(ts fbTables) (int, error) {
+	b.align(4)
+	pos := b.pad(4 + 4*len(ts))
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(ts)))
+	for i, t := range ts {
+		table, err := b.table(t)
+		if err != nil {
+			return 0, err
+		}
+		b.patch(pos+4+4*i, table)
+	}
+	return pos, nil
+}
+
+// structs writes a vector of structs with the elements 8-byte aligned
+func (b *fbBuilder) structs(ss fbStructs) int {
+	for (len(b.buf)+4)%8 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	pos := b.pad(4)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(ss)))
+	for _, s := range ss {
+		for _, v := range s {
+			b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(v))
+		}
+	}
+	return pos
+}
@@ -0,0 +1,47 @@
+package export
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestEncodeFlatBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    fbTable
+		wantErr bool
+	}{
+		{
+			name: "scalars and references",
+			root: fbTable{fbShort(4), fbString("x"), fbTables{{fbLong(1)}}, fbStructs{{1, 2}}},
+		},
+		{
+			name:    "unsupported field",
+			root:    fbTable{fbShort(4), 42},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported field in a nested table",
+			root:    fbTable{fbTables{{fbString("ok")}, {3.5}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := encodeFlatBuffer(tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encodeFlatBuffer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(buf)%8 != 0 {
+				t.Errorf("encodeFlatBuffer() length %d is not 8-byte aligned", len(buf))
+			}
+			if root := binary.LittleEndian.Uint32(buf); root == 0 || int(root) >= len(buf) {
+				t.Errorf("encodeFlatBuffer() root offset %d outside buffer of %d bytes", root, len(buf))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// formatTime renders timestamps the same way in every text format
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// csvWriter writes a header row of column names, then one record per row.
+// Nulls are empty fields.
+type csvWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVWriter(w io.Writer, schema Schema) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), record: make([]string, len(schema.Columns))}
+	for i, col := range schema.Columns {
+		cw.record[i] = col.Name
+	}
+	if err := cw.w.Write(cw.record); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) WriteRow(values []interface{}) error {
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+			cw.record[i] = ""
+		case int64:
+			cw.record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			cw.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			cw.record[i] = strconv.FormatBool(v)
+		case string:
+			cw.record[i] = v
+		case time.Time:
+			cw.record[i] = formatTime(v)
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// ndjsonWriter writes the schema as a {"schema": ...} line, then one JSON
+// object per row with keys in column order
+type ndjsonWriter struct {
+	w    *bufio.Writer
+	keys [][]byte
+	line []byte
+}
+
+func newNDJSONWriter(w io.Writer, schema Schema) (*ndjsonWriter, error) {
+	nw := &ndjsonWriter{w: bufio.NewWriter(w), keys: make([][]byte, len(schema.Columns))}
+	for i, col := range schema.Columns {
+		key, _ := json.Marshal(col.Name)
+		nw.keys[i] = append(key, ':')
+	}
+
+	header, err := json.Marshal(map[string]Schema{"schema": schema})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := nw.w.Write(append(header, '\n')); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+func (nw *ndjsonWriter) WriteRow(values []interface{}) error {
+	line := append(nw.line[:0], '{')
+	for i, v := range values {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = append(line, nw.keys[i]...)
+		switch v := v.(type) {
+		case nil:
+			line = append(line, "null"...)
+		case int64:
+			line = strconv.AppendInt(line, v, 10)
+		case float64:
+			line = strconv.AppendFloat(line, v, 'f', -1, 64)
+		case bool:
+			line = strconv.AppendBool(line, v)
+		case string:
+			s, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			line = append(line, s...)
+		case time.Time:
+			line = strconv.AppendQuote(line, formatTime(v))
+		}
+	}
+	line = append(line, '}', '\n')
+	nw.line = line
+
+	_, err := nw.w.Write(line)
+	return err
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nw.w.Flush()
+}
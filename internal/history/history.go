@@ -0,0 +1,342 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// maintenanceInterval is how often readings are downsampled and pruned
+const maintenanceInterval = time.Hour
+
+// minRawRetention keeps enough raw readings to rebuild recent aggregates
+const minRawRetention = 48 * time.Hour
+
+// Options configures how long each resolution is kept. Zero keeps forever.
+type Options struct {
+	RawRetention    time.Duration
+	HourlyRetention time.Duration
+	DailyRetention  time.Duration
+}
+
+// Series is a device's history at one resolution
+type Series struct {
+	DeviceID   int                        `json:"device_id"`
+	Resolution storage.Resolution         `json:"resolution"`
+	From       time.Time                  `json:"from"`
+	To         time.Time                  `json:"to"`
+	Points     []storage.ReadingAggregate `json:"points"`
+}
+
+// Recorder stores polled readings and maintains their aggregates
+type Recorder struct {
+	db   storage.Store
+	opts Options
+}
+
+// NewRecorder creates a reading history recorder
+func NewRecorder(db storage.Store, opts Options) *Recorder {
+	if opts.RawRetention > 0 && opts.RawRetention < minRawRetention {
+		opts.RawRetention = minRawRetention
+	}
+	return &Recorder{db: db, opts: opts}
+}
+
+// Record stores a polled thermostat state as a reading
+func (r *Recorder) Record(ctx context.Context, state tcc.ThermostatState) {
+	recordedAt := state.UpdatedAt
+	if recordedAt.IsZero() {
+		recordedAt = time.Now()
+	}
+
+	reading := &storage.Reading{
+		DeviceID:        state.DeviceID,
+		RecordedAt:      recordedAt.Truncate(time.Second),
+		CurrentTemp:     state.CurrentTemp,
+		HeatSetpoint:    state.HeatSetpoint,
+		CoolSetpoint:    state.CoolSetpoint,
+		SystemMode:      state.SystemMode,
+		IsHeating:       state.IsHeating,
+		IsCooling:       state.IsCooling,
+		OutdoorTemp:     state.OutdoorTemp,
+		Humidity:        state.Humidity,
+		OutdoorHumidity: state.OutdoorHumidity,
+	}
+
+	if err := r.db.SaveReading(reading); err != nil {
+		log.FromContext(ctx).Warn("Failed to record reading: %v", err)
+	}
+}
+
+// Run downsamples and prunes readings until ctx is cancelled
+func (r *Recorder) Run(ctx context.Context) {
+	log.Info("Starting reading history maintenance")
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		r.maintain(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maintain rebuilds recent aggregates and applies retention. Buckets are
+// rebuilt from scratch, so running it repeatedly is harmless.
+func (r *Recorder) maintain(now time.Time) {
+	// Hourly buckets for the last two days of raw readings. The current
+	// bucket is partial and gets completed by later runs.
+	hourStart := now.Truncate(time.Hour).Add(-minRawRetention)
+	readings, err := r.db.GetReadings(0, hourStart, now)
+	if err != nil {
+		log.Error("Failed to load readings for downsampling: %v", err)
+		return
+	}
+	hourly := aggregate(fromReadings(readings), hourBucket)
+	if err := r.db.SaveAggregates(storage.ResolutionHourly, hourly); err != nil {
+		log.Error("%v", err)
+		return
+	}
+
+	// Daily buckets (local days) from the hourly data of the last two days
+	dayStart := dayBucket(now).AddDate(0, 0, -2)
+	hours, err := r.db.GetAggregates(storage.ResolutionHourly, 0, dayStart, now)
+	if err != nil {
+		log.Error("Failed to load hourly aggregates for downsampling: %v", err)
+		return
+	}
+	daily := aggregate(hours, dayBucket)
+	if err := r.db.SaveAggregates(storage.ResolutionDaily, daily); err != nil {
+		log.Error("%v", err)
+		return
+	}
+
+	var pruned int64
+	if r.opts.RawRetention > 0 {
+		n, err := r.db.PruneReadings(now.Add(-r.opts.RawRetention))
+		if err != nil {
+			log.Error("%v", err)
+		}
+		pruned += n
+	}
+	if r.opts.HourlyRetention > 0 {
+		n, err := r.db.PruneAggregates(storage.ResolutionHourly, now.Add(-r.opts.HourlyRetention))
+		if err != nil {
+			log.Error("%v", err)
+		}
+		pruned += n
+	}
+	if r.opts.DailyRetention > 0 {
+		n, err := r.db.PruneAggregates(storage.ResolutionDaily, now.Add(-r.opts.DailyRetention))
+		if err != nil {
+			log.Error("%v", err)
+		}
+		pruned += n
+	}
+
+	log.Debug("Reading history: %d hourly and %d daily buckets updated, %d rows pruned",
+		len(hourly), len(daily), pruned)
+}
+
+// Query returns a device's history in [from, to). An empty resolution picks
+// one that suits the span.
+func (r *Recorder) Query(deviceID int, from, to time.Time, resolution storage.Resolution) (*Series, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("to must be after from")
+	}
+	if resolution == "" {
+		resolution = autoResolution(to.Sub(from))
+	}
+
+	var points []storage.ReadingAggregate
+	switch resolution {
+	case storage.ResolutionRaw:
+		readings, err := r.db.GetReadings(deviceID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		points = fromReadings(readings)
+	case storage.ResolutionHourly, storage.ResolutionDaily:
+		var err error
+		points, err = r.db.GetAggregates(resolution, deviceID, from, to)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid resolution %q", resolution)
+	}
+
+	if points == nil {
+		points = []storage.ReadingAggregate{}
+	}
+	return &Series{
+		DeviceID:   deviceID,
+		Resolution: resolution,
+		From:       from,
+		To:         to,
+		Points:     points,
+	}, nil
+}
+
+// autoResolution picks a resolution that keeps a chart readable
+func autoResolution(span time.Duration) storage.Resolution {
+	switch {
+	case span <= 2*24*time.Hour:
+		return storage.ResolutionRaw
+	case span <= 60*24*time.Hour:
+		return storage.ResolutionHourly
+	default:
+		return storage.ResolutionDaily
+	}
+}
+
+func hourBucket(t time.Time) time.Time {
+	return t.Truncate(time.Hour)
+}
+
+// dayBucket returns the start of t's day in local time
+func dayBucket(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// fromReadings turns raw readings into single-sample points
+func fromReadings(readings []storage.Reading) []storage.ReadingAggregate {
+	points := make([]storage.ReadingAggregate, 0, len(readings))
+	for _, r := range readings {
+		p := storage.ReadingAggregate{
+			DeviceID:        r.DeviceID,
+			BucketStart:     r.RecordedAt,
+			Samples:         1,
+			TempAvg:         r.CurrentTemp,
+			TempMin:         r.CurrentTemp,
+			TempMax:         r.CurrentTemp,
+			HeatSetpoint:    floatPtr(r.HeatSetpoint),
+			CoolSetpoint:    floatPtr(r.CoolSetpoint),
+			OutdoorTemp:     r.OutdoorTemp,
+			OutdoorHumidity: r.OutdoorHumidity,
+			SystemMode:      r.SystemMode,
+		}
+		if r.Humidity != nil {
+			p.Humidity = floatPtr(float64(*r.Humidity))
+		}
+		if r.IsHeating {
+			p.HeatingRatio = 1
+		}
+		if r.IsCooling {
+			p.CoolingRatio = 1
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// aggregate combines points into buckets, weighting each by its sample
+// count. Points must be ordered by device and time.
+func aggregate(points []storage.ReadingAggregate, bucket func(time.Time) time.Time) []storage.ReadingAggregate {
+	var out []storage.ReadingAggregate
+	var acc *accumulator
+
+	for _, p := range points {
+		start := bucket(p.BucketStart)
+		if acc == nil || acc.deviceID != p.DeviceID || !acc.start.Equal(start) {
+			if acc != nil {
+				out = append(out, acc.result())
+			}
+			acc = &accumulator{deviceID: p.DeviceID, start: start, min: p.TempMin, max: p.TempMax}
+		}
+		acc.add(p)
+	}
+	if acc != nil {
+		out = append(out, acc.result())
+	}
+
+	return out
+}
+
+// accumulator collects weighted sums for one bucket
+type accumulator struct {
+	deviceID int
+	start    time.Time
+	samples  int
+	min, max float64
+	mode     string
+
+	temp, heating, cooling                          float64
+	heat, cool, humidity, outdoorTemp, outdoorHumid weighted
+}
+
+// weighted is a sample-weighted sum of an optional value
+type weighted struct {
+	sum     float64
+	samples int
+}
+
+func (w *weighted) add(v *float64, samples int) {
+	if v != nil {
+		w.sum += *v * float64(samples)
+		w.samples += samples
+	}
+}
+
+func (w weighted) avg() *float64 {
+	if w.samples == 0 {
+		return nil
+	}
+	return floatPtr(w.sum / float64(w.samples))
+}
+
+func (a *accumulator) add(p storage.ReadingAggregate) {
+	n := float64(p.Samples)
+	a.samples += p.Samples
+	a.temp += p.TempAvg * n
+	a.heating += p.HeatingRatio * n
+	a.cooling += p.CoolingRatio * n
+	if p.TempMin < a.min {
+		a.min = p.TempMin
+	}
+	if p.TempMax > a.max {
+		a.max = p.TempMax
+	}
+	if p.SystemMode != "" {
+		a.mode = p.SystemMode
+	}
+	a.heat.add(p.HeatSetpoint, p.Samples)
+	a.cool.add(p.CoolSetpoint, p.Samples)
+	a.humidity.add(p.Humidity, p.Samples)
+	a.outdoorTemp.add(p.OutdoorTemp, p.Samples)
+	a.outdoorHumid.add(p.OutdoorHumidity, p.Samples)
+}
+
+func (a *accumulator) result() storage.ReadingAggregate {
+	n := float64(a.samples)
+	return storage.ReadingAggregate{
+		DeviceID:        a.deviceID,
+		BucketStart:     a.start,
+		Samples:         a.samples,
+		TempAvg:         a.temp / n,
+		TempMin:         a.min,
+		TempMax:         a.max,
+		HeatSetpoint:    a.heat.avg(),
+		CoolSetpoint:    a.cool.avg(),
+		Humidity:        a.humidity.avg(),
+		OutdoorTemp:     a.outdoorTemp.avg(),
+		OutdoorHumidity: a.outdoorHumid.avg(),
+		HeatingRatio:    a.heating / n,
+		CoolingRatio:    a.cooling / n,
+		SystemMode:      a.mode,
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
@@ -0,0 +1,162 @@
+package history
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+func TestAggregateReadings(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 3, 2, hour, minute, 0, 0, time.UTC)
+	}
+	reading := func(deviceID int, recordedAt time.Time, temp float64, heating bool, outdoor *float64) storage.Reading {
+		return storage.Reading{
+			DeviceID:     deviceID,
+			RecordedAt:   recordedAt,
+			CurrentTemp:  temp,
+			HeatSetpoint: 68,
+			SystemMode:   "heat",
+			IsHeating:    heating,
+			OutdoorTemp:  outdoor,
+		}
+	}
+
+	type bucket struct {
+		deviceID      int
+		start         time.Time
+		samples       int
+		avg, min, max float64
+		heatingRatio  float64
+		outdoor       *float64
+	}
+
+	tests := []struct {
+		name     string
+		readings []storage.Reading
+		want     []bucket
+	}{
+		{
+			name: "no readings",
+		},
+		{
+			name: "one hour",
+			readings: []storage.Reading{
+				reading(1, at(10, 0), 68, true, floatPtr(30)),
+				reading(1, at(10, 20), 70, false, floatPtr(32)),
+				reading(1, at(10, 40), 72, false, floatPtr(34)),
+			},
+			want: []bucket{{1, at(10, 0), 3, 70, 68, 72, 1.0 / 3, floatPtr(32)}},
+		},
+		{
+			name: "split at the hour",
+			readings: []storage.Reading{
+				reading(1, at(10, 50), 68, true, nil),
+				reading(1, at(11, 0), 70, true, nil),
+				reading(1, at(11, 10), 72, false, nil),
+			},
+			want: []bucket{
+				{1, at(10, 0), 1, 68, 68, 68, 1, nil},
+				{1, at(11, 0), 2, 71, 70, 72, 0.5, nil},
+			},
+		},
+		{
+			name: "split by device",
+			readings: []storage.Reading{
+				reading(1, at(10, 0), 68, false, nil),
+				reading(2, at(10, 0), 74, false, nil),
+			},
+			want: []bucket{
+				{1, at(10, 0), 1, 68, 68, 68, 0, nil},
+				{2, at(10, 0), 1, 74, 74, 74, 0, nil},
+			},
+		},
+		{
+			name: "missing outdoor readings are left out of the average",
+			readings: []storage.Reading{
+				reading(1, at(10, 0), 70, false, floatPtr(30)),
+				reading(1, at(10, 20), 70, false, nil),
+				reading(1, at(10, 40), 70, false, floatPtr(40)),
+			},
+			want: []bucket{{1, at(10, 0), 3, 70, 70, 70, 0, floatPtr(35)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregate(fromReadings(tt.readings), hourBucket)
+			if len(got) != len(tt.want) {
+				t.Fatalf("aggregate() = %d buckets, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, w := range tt.want {
+				g := got[i]
+				if g.DeviceID != w.deviceID || !g.BucketStart.Equal(w.start) || g.Samples != w.samples {
+					t.Errorf("bucket %d = device %d at %s with %d samples, want device %d at %s with %d",
+						i, g.DeviceID, g.BucketStart, g.Samples, w.deviceID, w.start, w.samples)
+				}
+				if !near(g.TempAvg, w.avg) || g.TempMin != w.min || g.TempMax != w.max {
+					t.Errorf("bucket %d temp = %v (%v-%v), want %v (%v-%v)", i, g.TempAvg, g.TempMin, g.TempMax, w.avg, w.min, w.max)
+				}
+				if !near(g.HeatingRatio, w.heatingRatio) {
+					t.Errorf("bucket %d heating ratio = %v, want %v", i, g.HeatingRatio, w.heatingRatio)
+				}
+				if (g.OutdoorTemp == nil) != (w.outdoor == nil) || g.OutdoorTemp != nil && !near(*g.OutdoorTemp, *w.outdoor) {
+					t.Errorf("bucket %d outdoor temp = %v, want %v", i, g.OutdoorTemp, w.outdoor)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateWeightsBySamples(t *testing.T) {
+	hours := []storage.ReadingAggregate{
+		{DeviceID: 1, BucketStart: time.Date(2026, 3, 2, 1, 0, 0, 0, time.Local), Samples: 1,
+			TempAvg: 60, TempMin: 60, TempMax: 60, HeatingRatio: 1, SystemMode: "heat"},
+		{DeviceID: 1, BucketStart: time.Date(2026, 3, 2, 13, 0, 0, 0, time.Local), Samples: 3,
+			TempAvg: 70, TempMin: 66, TempMax: 74, HeatingRatio: 0, SystemMode: "off"},
+	}
+
+	got := aggregate(hours, dayBucket)
+	if len(got) != 1 {
+		t.Fatalf("aggregate() = %d buckets, want 1", len(got))
+	}
+	day := got[0]
+	if !day.BucketStart.Equal(time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("bucket start = %s, want local midnight", day.BucketStart)
+	}
+	if day.Samples != 4 || !near(day.TempAvg, 67.5) || !near(day.HeatingRatio, 0.25) {
+		t.Errorf("day = %d samples, %v avg, %v heating, want 4, 67.5, 0.25", day.Samples, day.TempAvg, day.HeatingRatio)
+	}
+	if day.TempMin != 60 || day.TempMax != 74 {
+		t.Errorf("day range = %v-%v, want 60-74", day.TempMin, day.TempMax)
+	}
+	if day.SystemMode != "off" {
+		t.Errorf("day mode = %q, want the last hour's %q", day.SystemMode, "off")
+	}
+}
+
+func TestAutoResolution(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		span time.Duration
+		want storage.Resolution
+	}{
+		{span: time.Hour, want: storage.ResolutionRaw},
+		{span: 2 * day, want: storage.ResolutionRaw},
+		{span: 2*day + time.Hour, want: storage.ResolutionHourly},
+		{span: 60 * day, want: storage.ResolutionHourly},
+		{span: 61 * day, want: storage.ResolutionDaily},
+	}
+	for _, tt := range tests {
+		if got := autoResolution(tt.span); got != tt.want {
+			t.Errorf("autoResolution(%s) = %s, want %s", tt.span, got, tt.want)
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
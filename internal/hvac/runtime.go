@@ -0,0 +1,276 @@
+package hvac
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// dayLayout is how runtime days are keyed in storage
+const dayLayout = "2006-01-02"
+
+// HourLayout is how runtime hours are keyed in storage
+const HourLayout = "2006-01-02T15"
+
+// summaryInterval is how often completed weeks are checked for summaries
+const summaryInterval = time.Hour
+
+// summaryLookback is how many completed weeks are summarised if missing,
+// so a week is not skipped when the service was down at its end
+const summaryLookback = 4
+
+// sample is the equipment state seen by one poll
+type sample struct {
+	at      time.Time
+	heating bool
+	cooling bool
+	fan     bool
+}
+
+// Tracker turns polled heating, cooling and fan flags into runtime minutes.
+//
+// Polls only show the equipment state at one instant, so the time between
+// two polls is estimated: if both polls agree, the whole gap is counted in
+// that state; if they differ, the change is assumed to have happened half
+// way between them. Gaps longer than maxGap (missed polls, restarts) are not
+// counted at all, and ObservedMinutes shows how much of each day was covered.
+type Tracker struct {
+	db     storage.Store
+	maxGap time.Duration
+
+	mu   sync.Mutex
+	last map[int]sample
+}
+
+// Report is a device's runtime over a range of days
+type Report struct {
+	DeviceID int                   `json:"device_id"`
+	From     string                `json:"from"`
+	To       string                `json:"to"`
+	Days     []storage.RuntimeDay  `json:"days"`
+	Weeks    []storage.RuntimeWeek `json:"weeks"`
+	Totals   storage.RuntimeTotals `json:"totals"`
+}
+
+// NewTracker creates a runtime tracker
+func NewTracker(db storage.Store, maxGap time.Duration) *Tracker {
+	return &Tracker{
+		db:     db,
+		maxGap: maxGap,
+		last:   make(map[int]sample),
+	}
+}
+
+// Observe accounts for the time since the device's previous poll
+func (t *Tracker) Observe(ctx context.Context, state tcc.ThermostatState) {
+	cur := sample{
+		at:      state.UpdatedAt,
+		heating: state.IsHeating,
+		cooling: state.IsCooling,
+		fan:     state.IsFanRunning,
+	}
+	if cur.at.IsZero() {
+		cur.at = time.Now()
+	}
+
+	t.mu.Lock()
+	prev, ok := t.last[state.DeviceID]
+	if ok && !cur.at.After(prev.at) {
+		t.mu.Unlock()
+		return
+	}
+	t.last[state.DeviceID] = cur
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if gap := cur.at.Sub(prev.at); gap > t.maxGap {
+		log.FromContext(ctx).Debug("Runtime: %s since last poll of device %d, not counted", gap.Round(time.Second), state.DeviceID)
+		return
+	}
+
+	mid := prev.at.Add(cur.at.Sub(prev.at) / 2)
+	days := make(map[string]*storage.RuntimeDay)
+	hours := make(map[string]*storage.RuntimeHour)
+	accumulate(days, hours, state.DeviceID, prev.at, mid, prev)
+	accumulate(days, hours, state.DeviceID, mid, cur.at, cur)
+
+	dayRuntime := make([]storage.RuntimeDay, 0, len(days))
+	for _, d := range days {
+		dayRuntime = append(dayRuntime, *d)
+	}
+	hourRuntime := make([]storage.RuntimeHour, 0, len(hours))
+	for _, h := range hours {
+		hourRuntime = append(hourRuntime, *h)
+	}
+	if err := t.db.AddRuntime(dayRuntime, hourRuntime); err != nil {
+		log.FromContext(ctx).Warn("Failed to record runtime: %v", err)
+	}
+}
+
+// accumulate adds [from, to) in state s to the per-day and per-hour
+// totals, splitting at each local hour
+func accumulate(days map[string]*storage.RuntimeDay, hours map[string]*storage.RuntimeHour, deviceID int, from, to time.Time, s sample) {
+	for from.Before(to) {
+		from = from.Local()
+		next := time.Date(from.Year(), from.Month(), from.Day(), from.Hour()+1, 0, 0, 0, time.Local)
+		end := to
+		if next.Before(end) {
+			end = next
+		}
+
+		dayKey := from.Format(dayLayout)
+		d := days[dayKey]
+		if d == nil {
+			d = &storage.RuntimeDay{DeviceID: deviceID, Day: dayKey}
+			days[dayKey] = d
+		}
+		hourKey := from.Format(HourLayout)
+		h := hours[hourKey]
+		if h == nil {
+			h = &storage.RuntimeHour{DeviceID: deviceID, Hour: hourKey}
+			hours[hourKey] = h
+		}
+
+		minutes := end.Sub(from).Minutes()
+		var run storage.RuntimeTotals
+		run.ObservedMinutes = minutes
+		if s.heating {
+			run.HeatingMinutes = minutes
+		}
+		if s.cooling {
+			run.CoolingMinutes = minutes
+		}
+		if s.fan {
+			run.FanMinutes = minutes
+		}
+		d.Add(run)
+		h.Add(run)
+
+		from = end
+	}
+}
+
+// Run writes weekly summaries to the event log until ctx is cancelled
+func (t *Tracker) Run(ctx context.Context) {
+	log.Info("Starting HVAC runtime summaries")
+
+	ticker := time.NewTicker(summaryInterval)
+	defer ticker.Stop()
+
+	for {
+		t.summarize(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// summarize stores and logs a summary for each recently completed week that
+// does not have one yet
+func (t *Tracker) summarize(now time.Time) {
+	current := weekStart(now)
+	for i := summaryLookback; i >= 1; i-- {
+		start := current.AddDate(0, 0, -7*i)
+		end := start.AddDate(0, 0, 6)
+
+		days, err := t.db.GetRuntimeDays(0, start.Format(dayLayout), end.Format(dayLayout))
+		if err != nil {
+			log.Error("%v", err)
+			return
+		}
+
+		weeks := make(map[int]*storage.RuntimeWeek)
+		var order []int
+		for _, d := range days {
+			w := weeks[d.DeviceID]
+			if w == nil {
+				w = &storage.RuntimeWeek{DeviceID: d.DeviceID, WeekStart: start.Format(dayLayout)}
+				weeks[d.DeviceID] = w
+				order = append(order, d.DeviceID)
+			}
+			w.Add(d.RuntimeTotals)
+			if d.ObservedMinutes > 0 {
+				w.Days++
+			}
+		}
+
+		for _, deviceID := range order {
+			w := weeks[deviceID]
+			created, err := t.db.SaveRuntimeWeek(w)
+			if err != nil {
+				log.Error("%v", err)
+				continue
+			}
+			if !created {
+				continue
+			}
+
+			message := fmt.Sprintf("Weekly runtime for device %d (week of %s): heating %.1fh, cooling %.1fh, fan %.1fh over %.1fh observed",
+				deviceID, w.WeekStart, w.HeatingMinutes/60, w.CoolingMinutes/60, w.FanMinutes/60, w.ObservedMinutes/60)
+			log.Info("%s", message)
+			t.db.LogEvent(storage.EventSourceSystem, storage.EventTypeRuntime, message, map[string]interface{}{
+				"device_id":        deviceID,
+				"week_start":       w.WeekStart,
+				"days":             w.Days,
+				"heating_minutes":  w.HeatingMinutes,
+				"cooling_minutes":  w.CoolingMinutes,
+				"fan_minutes":      w.FanMinutes,
+				"observed_minutes": w.ObservedMinutes,
+			})
+		}
+	}
+}
+
+// Query returns a device's runtime for the days in [from, to], with the
+// weekly summaries that start in that range
+func (t *Tracker) Query(deviceID int, from, to time.Time) (*Report, error) {
+	fromDay, toDay := from.Format(dayLayout), to.Format(dayLayout)
+	if toDay < fromDay {
+		return nil, fmt.Errorf("to must not be before from")
+	}
+
+	days, err := t.db.GetRuntimeDays(deviceID, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	weeks, err := t.db.GetRuntimeWeeks(deviceID, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		DeviceID: deviceID,
+		From:     fromDay,
+		To:       toDay,
+		Days:     days,
+		Weeks:    weeks,
+	}
+	if report.Days == nil {
+		report.Days = []storage.RuntimeDay{}
+	}
+	if report.Weeks == nil {
+		report.Weeks = []storage.RuntimeWeek{}
+	}
+	for _, d := range days {
+		report.Totals.Add(d.RuntimeTotals)
+	}
+
+	return report, nil
+}
+
+// weekStart returns the local Monday that starts t's week
+func weekStart(t time.Time) time.Time {
+	t = t.Local()
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.Local)
+}
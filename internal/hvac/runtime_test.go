@@ -0,0 +1,151 @@
+package hvac
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+func TestObserveGapEstimation(t *testing.T) {
+	const deviceID = 1
+	const maxGap = 30 * time.Minute
+	noon := time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local)
+
+	heat := tcc.ThermostatState{IsHeating: true}
+	idle := tcc.ThermostatState{}
+	coolFan := tcc.ThermostatState{IsCooling: true, IsFanRunning: true}
+
+	tests := []struct {
+		name       string
+		prev, cur  tcc.ThermostatState
+		gap        time.Duration
+		want       storage.RuntimeTotals
+		wantNoDays bool
+	}{
+		{
+			name: "same state counts the whole gap",
+			prev: heat, cur: heat, gap: 10 * time.Minute,
+			want: storage.RuntimeTotals{HeatingMinutes: 10, ObservedMinutes: 10},
+		},
+		{
+			name: "change is assumed half way",
+			prev: heat, cur: idle, gap: 10 * time.Minute,
+			want: storage.RuntimeTotals{HeatingMinutes: 5, ObservedMinutes: 10},
+		},
+		{
+			name: "cooling and fan start half way",
+			prev: idle, cur: coolFan, gap: 20 * time.Minute,
+			want: storage.RuntimeTotals{CoolingMinutes: 10, FanMinutes: 10, ObservedMinutes: 20},
+		},
+		{
+			name: "gap of exactly maxGap is counted",
+			prev: heat, cur: heat, gap: maxGap,
+			want: storage.RuntimeTotals{HeatingMinutes: 30, ObservedMinutes: 30},
+		},
+		{
+			name: "longer gap is not counted",
+			prev: heat, cur: heat, gap: maxGap + time.Minute,
+			wantNoDays: true,
+		},
+		{
+			name: "poll out of order is ignored",
+			prev: heat, cur: heat, gap: -5 * time.Minute,
+			wantNoDays: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storage.NewMemoryStore()
+			tracker := NewTracker(db, maxGap)
+
+			prev, cur := tt.prev, tt.cur
+			prev.DeviceID, prev.UpdatedAt = deviceID, noon
+			cur.DeviceID, cur.UpdatedAt = deviceID, noon.Add(tt.gap)
+			tracker.Observe(context.Background(), prev)
+			tracker.Observe(context.Background(), cur)
+
+			report, err := tracker.Query(deviceID, noon, noon)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if tt.wantNoDays {
+				if len(report.Days) != 0 {
+					t.Errorf("Query() = %+v, want no runtime", report.Days)
+				}
+				return
+			}
+			if report.Totals != tt.want {
+				t.Errorf("Query() totals = %+v, want %+v", report.Totals, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccumulateSplitsHoursAndDays(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name      string
+		from, to  time.Time
+		wantHours map[string]float64
+		wantDays  map[string]float64
+	}{
+		{
+			name: "within an hour",
+			from: at(2, 10, 5), to: at(2, 10, 20),
+			wantHours: map[string]float64{"2026-03-02T10": 15},
+			wantDays:  map[string]float64{"2026-03-02": 15},
+		},
+		{
+			name: "across an hour",
+			from: at(2, 10, 50), to: at(2, 11, 20),
+			wantHours: map[string]float64{"2026-03-02T10": 10, "2026-03-02T11": 20},
+			wantDays:  map[string]float64{"2026-03-02": 30},
+		},
+		{
+			name: "across midnight",
+			from: at(2, 23, 45), to: at(3, 0, 10),
+			wantHours: map[string]float64{"2026-03-02T23": 15, "2026-03-03T00": 10},
+			wantDays:  map[string]float64{"2026-03-02": 15, "2026-03-03": 10},
+		},
+		{
+			name: "empty interval",
+			from: at(2, 10, 0), to: at(2, 10, 0),
+			wantHours: map[string]float64{},
+			wantDays:  map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days := make(map[string]*storage.RuntimeDay)
+			hours := make(map[string]*storage.RuntimeHour)
+			accumulate(days, hours, 1, tt.from, tt.to, sample{heating: true})
+
+			if len(hours) != len(tt.wantHours) {
+				t.Errorf("accumulate() = %d hours, want %d", len(hours), len(tt.wantHours))
+			}
+			for key, want := range tt.wantHours {
+				h := hours[key]
+				if h == nil || h.HeatingMinutes != want || h.ObservedMinutes != want {
+					t.Errorf("hour %s = %+v, want %.0f heating minutes", key, h, want)
+				}
+			}
+			if len(days) != len(tt.wantDays) {
+				t.Errorf("accumulate() = %d days, want %d", len(days), len(tt.wantDays))
+			}
+			for key, want := range tt.wantDays {
+				d := days[key]
+				if d == nil || d.HeatingMinutes != want || d.ObservedMinutes != want {
+					t.Errorf("day %s = %+v, want %.0f heating minutes", key, d, want)
+				}
+			}
+		})
+	}
+}
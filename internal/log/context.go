@@ -0,0 +1,48 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// CorrelationHeader is the HTTP header that carries a correlation ID
+const CorrelationHeader = "X-Correlation-ID"
+
+// correlationKey is the context key for correlation IDs
+type correlationKey struct{}
+
+// NewCorrelationID returns a random ID for tying together the log lines and
+// events caused by one request, command or poll cycle
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID returns a context carrying the given correlation ID
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, or ""
+func CorrelationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger, tagged with the correlation ID
+// carried by ctx if there is one
+func FromContext(ctx context.Context) *Logger {
+	if id := CorrelationID(ctx); id != "" {
+		return defaultLogger.WithField("correlation_id", id)
+	}
+	return defaultLogger
+}
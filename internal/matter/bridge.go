@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"sync"
 	"time"
@@ -16,35 +17,72 @@ import (
 
 // Bridge manages communication with the Matter.js service
 type Bridge struct {
-	baseURL    string
-	bridgeDir  string
-	process    *Process
-	wsConn     *websocket.Conn
-	wsMu       sync.Mutex
-	httpClient *http.Client
-	eventChan  chan Event
-	cmdHandler CommandHandler
+	baseURL     string
+	bridgeDir   string
+	process     *Process
+	wsConn      *websocket.Conn
+	wsMu        sync.Mutex
+	httpClient  *http.Client
+	eventChan   chan Event
+	cmdHandler  CommandHandler
+	resolver    DeviceResolver
+	commHandler CommissioningHandler
+	settingsMu  sync.RWMutex
+	settings    map[int]DeviceSettings // guarded by settingsMu
+	presets     map[int]devicePresets  // guarded by settingsMu
+	devicesMu   sync.Mutex
+	devices     map[int]BridgedDevice // Devices to expose, by device ID
+	commands    *dispatcher
+	stream      eventStream
+	wsOnce      sync.Once
 }
 
-// CommandHandler handles commands from HomeKit
-type CommandHandler func(cmd Command) error
+// devicePresets holds the presets last set for a device
+type devicePresets struct {
+	presets []Preset
+	active  string
+}
+
+// DeviceSettings change how a device is exposed to Matter
+type DeviceSettings struct {
+	Name            string // Replaces the TCC name when set
+	Hidden          bool   // Stops state updates for the device
+	TemperatureUnit string // "F" or "C" display preference; empty leaves the default
+}
+
+// CommandHandler handles commands from HomeKit, returning the device's
+// state once the command has been applied. Errors may be wrapped in a
+// CommandError to report a result code other than ResultFailed.
+type CommandHandler func(ctx context.Context, cmd Command) (*tcc.ThermostatState, error)
+
+// DeviceResolver picks the device for a command sent without a device ID
+type DeviceResolver func() (int, error)
+
+// CommissioningHandler handles commissioning and fabric changes reported
+// by the bridge
+type CommissioningHandler func(event Event)
 
 // NewBridge creates a new Matter bridge client
 func NewBridge(baseURL, bridgeDir string) *Bridge {
-	return &Bridge{
+	b := &Bridge{
 		baseURL:   baseURL,
 		bridgeDir: bridgeDir,
+		process:   NewProcess(bridgeDir),
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 		eventChan: make(chan Event, 100),
+		settings:  make(map[int]DeviceSettings),
+		presets:   make(map[int]devicePresets),
+		devices:   make(map[int]BridgedDevice),
 	}
+	b.commands = newDispatcher(b)
+	return b
 }
 
 // Start starts the Matter bridge process and connects
 func (b *Bridge) Start(ctx context.Context) error {
 	// Start the Node.js process
-	b.process = NewProcess(b.bridgeDir)
 	if err := b.process.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start process: %w", err)
 	}
@@ -55,12 +93,65 @@ func (b *Bridge) Start(ctx context.Context) error {
 		return fmt.Errorf("service not ready: %w", err)
 	}
 
-	// Connect WebSocket for events
-	go b.connectWebSocket(ctx)
+	// Connect WebSocket for events. The loop reconnects on its own, so
+	// it only needs starting once even if the process is restarted.
+	b.wsOnce.Do(func() {
+		go b.commands.run(ctx)
+		go b.connectWebSocket(ctx)
+	})
 
 	return nil
 }
 
+// Restart stops the Matter bridge process and starts it again
+func (b *Bridge) Restart(ctx context.Context) error {
+	b.process.Stop()
+	return b.Start(ctx)
+}
+
+// ProcessDone returns a channel closed when the bridge process exits
+func (b *Bridge) ProcessDone() <-chan struct{} {
+	return b.process.Done()
+}
+
+// ProcessExitErr returns the error the bridge process last exited with
+func (b *Bridge) ProcessExitErr() error {
+	return b.process.ExitErr()
+}
+
+// CheckHealth calls the Node service's health endpoint
+func (b *Bridge) CheckHealth(ctx context.Context) error {
+	req, err := b.newRequest(ctx, "GET", "/health", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// newRequest builds a request to the Matter.js service, passing along the
+// correlation ID carried by ctx
+func (b *Bridge) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if id := log.CorrelationID(ctx); id != "" {
+		req.Header.Set(log.CorrelationHeader, id)
+	}
+	return req, nil
+}
+
 // Stop stops the Matter bridge
 func (b *Bridge) Stop() {
 	b.wsMu.Lock()
@@ -79,14 +170,38 @@ func (b *Bridge) SetCommandHandler(handler CommandHandler) {
 	b.cmdHandler = handler
 }
 
-// Events returns the event channel
+// SetDeviceResolver sets how commands without a device ID find their
+// device. They are resolved before they are queued, so they run in order
+// with the device's other commands.
+func (b *Bridge) SetDeviceResolver(resolver DeviceResolver) {
+	b.resolver = resolver
+}
+
+// CommandStats returns counts and latency of commands from the bridge
+func (b *Bridge) CommandStats() CommandStats {
+	return b.commands.statsSnapshot()
+}
+
+// ConnectionStats returns the state of the event connection to the bridge
+func (b *Bridge) ConnectionStats() ConnectionStats {
+	return b.stream.snapshot()
+}
+
+// SetCommissioningHandler sets the handler for commissioning events
+func (b *Bridge) SetCommissioningHandler(handler CommissioningHandler) {
+	b.commHandler = handler
+}
+
+// Events returns the event channel. Events arrive in the order the bridge
+// sent them; while the channel is full the bridge waits rather than
+// dropping any.
 func (b *Bridge) Events() <-chan Event {
 	return b.eventChan
 }
 
 // GetStatus retrieves the current status
 func (b *Bridge) GetStatus(ctx context.Context) (*StatusResponse, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", b.baseURL+"/status", nil)
+	req, err := b.newRequest(ctx, "GET", "/status", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +226,7 @@ func (b *Bridge) GetStatus(ctx context.Context) (*StatusResponse, error) {
 
 // GetPairingInfo retrieves pairing information
 func (b *Bridge) GetPairingInfo(ctx context.Context) (*PairingInfo, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", b.baseURL+"/pairing", nil)
+	req, err := b.newRequest(ctx, "GET", "/pairing", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +254,57 @@ func fahrenheitToCelsius(f float64) float64 {
 	return (f - 32) * 5 / 9
 }
 
-// UpdateState sends updated thermostat state to the Matter bridge
-func (b *Bridge) UpdateState(ctx context.Context, state tcc.ThermostatState) error {
+// NewPreset builds a Matter preset from Fahrenheit setpoints
+func NewPreset(name, systemMode string, heatF, coolF *float64) Preset {
+	p := Preset{Name: name, SystemMode: systemMode}
+	if heatF != nil {
+		c := fahrenheitToCelsius(*heatF)
+		p.HeatSetpoint = &c
+	}
+	if coolF != nil {
+		c := fahrenheitToCelsius(*coolF)
+		p.CoolSetpoint = &c
+	}
+	return p
+}
+
+// SetPresets sets the presets and active preset sent with a device's state
+func (b *Bridge) SetPresets(deviceID int, presets []Preset, active string) {
+	b.settingsMu.Lock()
+	defer b.settingsMu.Unlock()
+	b.presets[deviceID] = devicePresets{presets: presets, active: active}
+}
+
+// SetActivePreset changes the active preset sent with a device's state
+func (b *Bridge) SetActivePreset(deviceID int, active string) {
+	b.settingsMu.Lock()
+	defer b.settingsMu.Unlock()
+	p := b.presets[deviceID]
+	p.active = active
+	b.presets[deviceID] = p
+}
+
+// SetDeviceSettings sets how a device is exposed by UpdateState
+func (b *Bridge) SetDeviceSettings(deviceID int, settings DeviceSettings) {
+	b.settingsMu.Lock()
+	defer b.settingsMu.Unlock()
+	b.settings[deviceID] = settings
+}
+
+// matterState converts TCC state to what is sent to the Matter bridge,
+// applying the device's settings. It returns false for a hidden device.
+func (b *Bridge) matterState(state tcc.ThermostatState) (ThermostatState, bool) {
+	b.settingsMu.RLock()
+	defer b.settingsMu.RUnlock()
+
+	settings := b.settings[state.DeviceID]
+	if settings.Hidden {
+		return ThermostatState{}, false
+	}
+	if settings.Name != "" {
+		state.Name = settings.Name
+	}
+
 	// Convert temperatures from Fahrenheit (TCC) to Celsius (Matter)
 	matterState := ThermostatState{
 		DeviceID:     state.DeviceID,
@@ -149,12 +313,42 @@ func (b *Bridge) UpdateState(ctx context.Context, state tcc.ThermostatState) err
 		HeatSetpoint: fahrenheitToCelsius(state.HeatSetpoint),
 		CoolSetpoint: fahrenheitToCelsius(state.CoolSetpoint),
 		SystemMode:   state.SystemMode,
-		Humidity:     state.Humidity,
 		IsHeating:    state.IsHeating,
 		IsCooling:    state.IsCooling,
 	}
+	if state.Humidity != nil {
+		humidity := *state.Humidity
+		matterState.Humidity = &humidity
+	}
+	switch settings.TemperatureUnit {
+	case "C":
+		matterState.TemperatureUnit = "celsius"
+	case "F":
+		matterState.TemperatureUnit = "fahrenheit"
+	}
+
+	if p, ok := b.presets[state.DeviceID]; ok {
+		matterState.Presets = p.presets
+		matterState.ActivePreset = p.active
+	}
+
+	return matterState, true
+}
+
+// UpdateState sends updated thermostat state for a bridged device to the
+// Matter bridge. State for a hidden or unbridged device is dropped.
+func (b *Bridge) UpdateState(ctx context.Context, state tcc.ThermostatState) error {
+	matterState, ok := b.matterState(state)
+	if !ok {
+		log.FromContext(ctx).Debug("Not sending state for device %d, which is hidden from Matter", state.DeviceID)
+		return nil
+	}
+	if !b.isBridged(state.DeviceID) {
+		log.FromContext(ctx).Debug("Not sending state for device %d, which is not bridged", state.DeviceID)
+		return nil
+	}
 
-	log.Debug("Sending to Matter bridge: temp=%.1f°F (%.1f°C), heat=%.1f°F (%.1f°C), cool=%.1f°F (%.1f°C), mode=%s",
+	log.FromContext(ctx).Debug("Sending to Matter bridge: temp=%.1f°F (%.1f°C), heat=%.1f°F (%.1f°C), cool=%.1f°F (%.1f°C), mode=%s",
 		state.CurrentTemp, matterState.CurrentTemp,
 		state.HeatSetpoint, matterState.HeatSetpoint,
 		state.CoolSetpoint, matterState.CoolSetpoint,
@@ -165,7 +359,7 @@ func (b *Bridge) UpdateState(ctx context.Context, state tcc.ThermostatState) err
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", b.baseURL+"/state", bytes.NewReader(jsonData))
+	req, err := b.newRequest(ctx, "POST", fmt.Sprintf("/devices/%d/state", state.DeviceID), bytes.NewReader(jsonData))
 	if err != nil {
 		return err
 	}
@@ -186,7 +380,7 @@ func (b *Bridge) UpdateState(ctx context.Context, state tcc.ThermostatState) err
 
 // Decommission decommissions the Matter device (factory reset)
 func (b *Bridge) Decommission(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "DELETE", b.baseURL+"/pairing", nil)
+	req, err := b.newRequest(ctx, "DELETE", "/pairing", nil)
 	if err != nil {
 		return err
 	}
@@ -234,72 +428,25 @@ func (b *Bridge) waitForReady(ctx context.Context) error {
 	}
 }
 
-// connectWebSocket connects to the WebSocket endpoint for events
-func (b *Bridge) connectWebSocket(ctx context.Context) {
-	wsURL := "ws" + b.baseURL[4:] + "/events"
+// sendResult writes a command result back over the WebSocket. Results are
+// dropped while disconnected; the bridge resends commands it has no result
+// for once it reconnects.
+func (b *Bridge) sendResult(result CommandResult) {
+	event := struct {
+		Type      string        `json:"type"`
+		Timestamp time.Time     `json:"timestamp"`
+		Data      CommandResult `json:"data"`
+	}{EventTypeCommandResult, time.Now(), result}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
-		if err != nil {
-			time.Sleep(5 * time.Second)
-			continue
-		}
-
-		b.wsMu.Lock()
-		b.wsConn = conn
-		b.wsMu.Unlock()
-
-		b.readWebSocket(ctx, conn)
-
-		b.wsMu.Lock()
-		b.wsConn = nil
-		b.wsMu.Unlock()
-
-		// Reconnect delay
-		time.Sleep(time.Second)
+	b.wsMu.Lock()
+	defer b.wsMu.Unlock()
+	if b.wsConn == nil {
+		log.Debug("Not connected to Matter bridge, dropping result for command %s", result.ID)
+		return
 	}
-}
 
-// readWebSocket reads events from the WebSocket
-func (b *Bridge) readWebSocket(ctx context.Context, conn *websocket.Conn) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			return
-		}
-
-		var event Event
-		if err := json.Unmarshal(message, &event); err != nil {
-			continue
-		}
-
-		// Handle commands
-		if event.Type == EventTypeCommand && b.cmdHandler != nil {
-			var cmd Command
-			if cmdData, err := json.Marshal(event.Data); err == nil {
-				if json.Unmarshal(cmdData, &cmd) == nil {
-					b.cmdHandler(cmd)
-				}
-			}
-		}
-
-		// Send to event channel
-		select {
-		case b.eventChan <- event:
-		default:
-			// Channel full, drop event
-		}
+	b.wsConn.SetWriteDeadline(time.Now().Add(resultWriteWait))
+	if err := b.wsConn.WriteJSON(event); err != nil {
+		log.Warn("Failed to send result for command %s: %v", result.ID, err)
 	}
 }
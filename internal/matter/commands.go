@@ -0,0 +1,313 @@
+package matter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// Command result codes
+const (
+	ResultOK          = "ok"
+	ResultQueued      = "queued"      // Accepted, but held until TCC is reachable again
+	ResultInvalid     = "invalid"     // Malformed command or value
+	ResultRejected    = "rejected"    // Refused by the command policy
+	ResultUnavailable = "unavailable" // TCC could not be reached
+	ResultTimeout     = "timeout"     // Not finished within the command timeout
+	ResultBusy        = "busy"        // Too many commands waiting for the device
+	ResultFailed      = "failed"      // Any other failure
+)
+
+// Command dispatch settings
+const (
+	commandWorkers    = 4
+	commandQueueSize  = 16
+	commandTimeout    = 30 * time.Second
+	commandResultTTL  = 5 * time.Minute // How long results are kept to answer duplicates
+	resultWriteWait   = 5 * time.Second
+	commandSweepEvery = time.Minute
+)
+
+// CommandError is a command failure with a result code
+type CommandError struct {
+	Code string
+	Err  error
+}
+
+func (e *CommandError) Error() string { return e.Err.Error() }
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// NewCommandError wraps err with a result code
+func NewCommandError(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CommandError{Code: code, Err: err}
+}
+
+// CommandResult answers a command over the WebSocket
+type CommandResult struct {
+	ID         string           `json:"id"`
+	Success    bool             `json:"success"`
+	Code       string           `json:"code"`
+	Error      string           `json:"error,omitempty"`
+	State      *ThermostatState `json:"state,omitempty"` // The device's state after the command
+	DurationMs int64            `json:"durationMs"`
+}
+
+// LatencyStats summarises command latency, from receipt to result
+type LatencyStats struct {
+	Last float64 `json:"last"`
+	Avg  float64 `json:"avg"`
+	Max  float64 `json:"max"`
+}
+
+// CommandStats counts commands handled since the service started
+type CommandStats struct {
+	Received   uint64            `json:"received"`
+	Succeeded  uint64            `json:"succeeded"`
+	Queued     uint64            `json:"queued"` // Succeeded, but not applied yet
+	Failed     uint64            `json:"failed"`
+	Duplicates uint64            `json:"duplicates"`
+	Failures   map[string]uint64 `json:"failures,omitempty"` // By result code
+	Pending    int               `json:"pending"`            // Queued or running
+	LatencyMs  LatencyStats      `json:"latency_ms"`
+}
+
+// pendingCommand is a command waiting for a worker
+type pendingCommand struct {
+	cmd      Command
+	received time.Time
+}
+
+// commandRecord tracks a command ID to recognise duplicates
+type commandRecord struct {
+	result *CommandResult // nil while the command runs
+	at     time.Time
+}
+
+// dispatcher runs commands from the bridge on a pool of workers so a slow
+// TCC call doesn't hold up the WebSocket read loop. Commands for the same
+// device always go to the same worker, so they run in the order received.
+type dispatcher struct {
+	bridge *Bridge
+	queues []chan pendingCommand
+
+	mu        sync.Mutex
+	seen      map[string]*commandRecord // By command ID
+	stats     CommandStats
+	latencyMs float64 // Sum, for the average
+}
+
+// newDispatcher creates a command dispatcher
+func newDispatcher(b *Bridge) *dispatcher {
+	d := &dispatcher{
+		bridge: b,
+		queues: make([]chan pendingCommand, commandWorkers),
+		seen:   make(map[string]*commandRecord),
+		stats:  CommandStats{Failures: make(map[string]uint64)},
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan pendingCommand, commandQueueSize)
+	}
+	return d
+}
+
+// run starts the workers, which stop when ctx is cancelled
+func (d *dispatcher) run(ctx context.Context) {
+	for _, queue := range d.queues {
+		go d.work(ctx, queue)
+	}
+
+	ticker := time.NewTicker(commandSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.sweep(now)
+		}
+	}
+}
+
+// dispatch queues a command, answering duplicates and overflow directly
+func (d *dispatcher) dispatch(cmd Command) {
+	now := time.Now()
+
+	d.mu.Lock()
+	if cmd.ID != "" {
+		if rec, ok := d.seen[cmd.ID]; ok {
+			d.stats.Duplicates++
+			result := rec.result
+			d.mu.Unlock()
+
+			if result != nil {
+				log.Debug("Duplicate Matter command %s, resending its result", cmd.ID)
+				d.bridge.sendResult(*result)
+			} else {
+				log.Debug("Duplicate Matter command %s is still running", cmd.ID)
+			}
+			return
+		}
+		d.seen[cmd.ID] = &commandRecord{at: now}
+	}
+	d.stats.Received++
+	d.stats.Pending++
+	d.mu.Unlock()
+
+	if cmd.DeviceID == 0 && d.bridge.resolver != nil {
+		deviceID, err := d.bridge.resolver()
+		if err != nil {
+			d.finish(cmd, now, nil, err)
+			return
+		}
+		cmd.DeviceID = deviceID
+	}
+
+	queue := d.queues[shard(cmd.DeviceID, len(d.queues))]
+	select {
+	case queue <- pendingCommand{cmd: cmd, received: now}:
+	default:
+		log.Warn("Matter command queue full, dropping %s", cmd.Action)
+		d.finish(cmd, now, nil, NewCommandError(ResultBusy, fmt.Errorf("too many commands waiting")))
+	}
+}
+
+// work runs queued commands one at a time
+func (d *dispatcher) work(ctx context.Context, queue chan pendingCommand) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-queue:
+			d.execute(ctx, p)
+		}
+	}
+}
+
+// execute runs one command and reports its result. The handler's context
+// is cancelled at the command timeout, which abandons any TCC call still in
+// progress; the command is only reported as timed out if that stopped it.
+// A command that finished anyway, or was queued, reports what happened.
+func (d *dispatcher) execute(ctx context.Context, p pendingCommand) {
+	handler := d.bridge.cmdHandler
+	if handler == nil {
+		d.finish(p.cmd, p.received, nil, fmt.Errorf("no command handler"))
+		return
+	}
+
+	cmdCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	state, err := handler(cmdCtx, p.cmd)
+	if errors.Is(err, context.DeadlineExceeded) && errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+		err = NewCommandError(ResultTimeout, fmt.Errorf("command did not finish within %s: %w", commandTimeout, err))
+	}
+	d.finish(p.cmd, p.received, state, err)
+}
+
+// finish records a command's outcome and sends its result
+func (d *dispatcher) finish(cmd Command, received time.Time, state *tcc.ThermostatState, err error) {
+	elapsed := time.Since(received)
+	result := CommandResult{
+		ID:         cmd.ID,
+		Success:    err == nil,
+		Code:       ResultOK,
+		DurationMs: elapsed.Milliseconds(),
+	}
+	if err != nil {
+		result.Code = ResultFailed
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			result.Code = cmdErr.Code
+		}
+		// A queued command was accepted; the bridge keeps the requested
+		// value pending rather than treating it as applied
+		result.Success = result.Code == ResultQueued
+		if !result.Success {
+			result.Error = err.Error()
+		}
+	}
+	if state != nil {
+		matterState, ok := d.bridge.matterState(*state)
+		if ok {
+			result.State = &matterState
+		}
+	}
+
+	d.mu.Lock()
+	d.stats.Pending--
+	if result.Success {
+		d.stats.Succeeded++
+		if result.Code == ResultQueued {
+			d.stats.Queued++
+		}
+	} else {
+		d.stats.Failed++
+		d.stats.Failures[result.Code]++
+	}
+	ms := float64(elapsed.Microseconds()) / 1000
+	d.latencyMs += ms
+	d.stats.LatencyMs.Last = ms
+	d.stats.LatencyMs.Avg = d.latencyMs / float64(d.stats.Succeeded+d.stats.Failed)
+	if ms > d.stats.LatencyMs.Max {
+		d.stats.LatencyMs.Max = ms
+	}
+	if rec, ok := d.seen[cmd.ID]; ok && cmd.ID != "" {
+		rec.result = &result
+		rec.at = time.Now()
+	}
+	d.mu.Unlock()
+
+	switch {
+	case result.Code == ResultQueued:
+		log.Info("Matter command %s (%s) queued until TCC is reachable", cmd.ID, cmd.Action)
+	case result.Success:
+		log.Debug("Matter command %s (%s) succeeded in %s", cmd.ID, cmd.Action, elapsed.Round(time.Millisecond))
+	default:
+		log.Warn("Matter command %s (%s) failed after %s: %s: %s", cmd.ID, cmd.Action, elapsed.Round(time.Millisecond), result.Code, result.Error)
+	}
+
+	// Bridges that don't send command IDs don't expect results
+	if cmd.ID != "" {
+		d.bridge.sendResult(result)
+	}
+}
+
+// sweep forgets results too old to be asked for again
+func (d *dispatcher) sweep(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, rec := range d.seen {
+		if rec.result != nil && now.Sub(rec.at) > commandResultTTL {
+			delete(d.seen, id)
+		}
+	}
+}
+
+// statsSnapshot returns a copy of the command stats
+func (d *dispatcher) statsSnapshot() CommandStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := d.stats
+	stats.Failures = make(map[string]uint64, len(d.stats.Failures))
+	for code, n := range d.stats.Failures {
+		stats.Failures[code] = n
+	}
+	return stats
+}
+
+// shard picks the worker for a device
+func shard(deviceID, n int) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d", deviceID)
+	return int(h.Sum32() % uint32(n))
+}
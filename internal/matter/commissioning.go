@@ -0,0 +1,269 @@
+package matter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// Commissioning state sources
+const (
+	StateSourceBridge = "bridge" // Reported by the running bridge
+	StateSourceStored = "stored" // Last state recorded before the bridge went down
+)
+
+// CommissioningState is the commissioning state served by the API
+type CommissioningState struct {
+	Commissioned     bool                   `json:"commissioned"`
+	FabricID         string                 `json:"fabric_id,omitempty"`
+	NodeID           string                 `json:"node_id,omitempty"`
+	Fabrics          []storage.MatterFabric `json:"fabrics,omitempty"`
+	CommissionedAt   *time.Time             `json:"commissioned_at,omitempty"`
+	DecommissionedAt *time.Time             `json:"decommissioned_at,omitempty"`
+	VerifiedAt       *time.Time             `json:"verified_at,omitempty"`
+	Source           string                 `json:"source"`
+	Mismatch         string                 `json:"mismatch,omitempty"` // How the bridge and the stored state disagree
+}
+
+// Commissioning keeps the bridge's commissioning state in the database so
+// it survives bridge restarts and can be served while the bridge is down.
+// The bridge is authoritative, since Matter.js persists its own fabrics;
+// the stored copy follows its events and is reconciled on every start.
+type Commissioning struct {
+	db storage.Store
+	mu sync.Mutex // Serializes updates to the stored state
+}
+
+// NewCommissioning creates a commissioning state keeper
+func NewCommissioning(db storage.Store) *Commissioning {
+	return &Commissioning{db: db}
+}
+
+// Stored returns the last recorded commissioning state
+func (c *Commissioning) Stored() (*storage.MatterState, error) {
+	state, err := c.db.GetMatterState()
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &storage.MatterState{ID: 1}
+	}
+	return state, nil
+}
+
+// HandleEvent records a commissioned event from the bridge
+func (c *Commissioning) HandleEvent(ctx context.Context, event Event) {
+	var data struct {
+		Commissioned bool     `json:"commissioned"`
+		FabricID     string   `json:"fabricId"`
+		NodeID       string   `json:"nodeId"`
+		Fabrics      []Fabric `json:"fabrics"`
+	}
+	raw, err := json.Marshal(event.Data)
+	if err == nil {
+		err = json.Unmarshal(raw, &data)
+	}
+	if err != nil {
+		log.Warn("Ignoring malformed commissioning event: %v", err)
+		return
+	}
+
+	fabrics := storageFabrics(data.Fabrics, data.FabricID, data.NodeID)
+	if err := c.Record(ctx, data.Commissioned, fabrics); err != nil {
+		log.Error("Failed to record Matter commissioning state: %v", err)
+	}
+}
+
+// Record stores a commissioning change confirmed by the bridge. A
+// commissioned bridge that reports no fabrics keeps the ones last stored.
+func (c *Commissioning) Record(ctx context.Context, commissioned bool, fabrics []storage.MatterFabric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, err := c.Stored()
+	if err != nil {
+		return err
+	}
+	applyCommissioning(state, commissioned, fabrics, time.Now())
+	return c.db.SaveMatterState(state)
+}
+
+// Reconcile compares the stored state with the running bridge and adopts
+// the bridge's view, logging a conflict if the two disagreed. It also
+// stores the pairing codes so they can be shown while the bridge is down.
+func (c *Commissioning) Reconcile(ctx context.Context, bridge *Bridge) error {
+	status, err := bridge.GetStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Matter bridge status: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, err := c.Stored()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to disagree with until the state has been recorded once
+	var mismatch string
+	if state.VerifiedAt != nil {
+		mismatch = commissioningMismatch(state, status)
+	}
+	details := map[string]interface{}{
+		"stored_commissioned": state.IsCommissioned,
+		"stored_fabrics":      fabricIDs(state.Fabrics),
+		"bridge_commissioned": status.Commissioned,
+		"bridge_fabrics":      fabricIDs(storageFabrics(status.Fabrics, status.FabricID, status.NodeID)),
+	}
+
+	applyCommissioning(state, status.Commissioned, storageFabrics(status.Fabrics, status.FabricID, status.NodeID), time.Now())
+	if info, err := bridge.GetPairingInfo(ctx); err == nil {
+		state.QRCode = info.QRCode
+		state.ManualPairCode = info.ManualPairCode
+	} else {
+		log.Debug("Failed to get Matter pairing info: %v", err)
+	}
+	if err := c.db.SaveMatterState(state); err != nil {
+		return err
+	}
+
+	if mismatch != "" {
+		log.Warn("Matter commissioning state disagreed with the bridge (%s); using the bridge's", mismatch)
+		c.db.LogEventContext(ctx, storage.EventSourceMatter, storage.EventTypeConflict,
+			"Stored Matter commissioning state disagreed with the bridge: "+mismatch, details)
+	}
+	return nil
+}
+
+// State returns the bridge's live commissioning state when it is running,
+// or the stored state otherwise. A disagreement between the two is
+// reported in Mismatch rather than stored; the next Reconcile settles it.
+func (c *Commissioning) State(ctx context.Context, bridge *Bridge) (*CommissioningState, error) {
+	stored, err := c.Stored()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &CommissioningState{
+		Commissioned:     stored.IsCommissioned,
+		FabricID:         stored.FabricID,
+		NodeID:           stored.NodeID,
+		Fabrics:          stored.Fabrics,
+		CommissionedAt:   stored.CommissionedAt,
+		DecommissionedAt: stored.DecommissionedAt,
+		VerifiedAt:       stored.VerifiedAt,
+		Source:           StateSourceStored,
+	}
+	if !bridge.IsRunning() {
+		return state, nil
+	}
+
+	status, err := bridge.GetStatus(ctx)
+	if err != nil {
+		log.Debug("Failed to get Matter bridge status, using stored state: %v", err)
+		return state, nil
+	}
+
+	state.Source = StateSourceBridge
+	if stored.VerifiedAt != nil {
+		state.Mismatch = commissioningMismatch(stored, status)
+	}
+	state.Commissioned = status.Commissioned
+	if fabrics := storageFabrics(status.Fabrics, status.FabricID, status.NodeID); len(fabrics) > 0 || !status.Commissioned {
+		state.Fabrics = fabrics
+		state.FabricID, state.NodeID = firstFabric(fabrics)
+	}
+	return state, nil
+}
+
+// applyCommissioning updates state with what the bridge reported at now
+func applyCommissioning(state *storage.MatterState, commissioned bool, fabrics []storage.MatterFabric, now time.Time) {
+	switch {
+	case commissioned && (!state.IsCommissioned || state.CommissionedAt == nil):
+		state.CommissionedAt = &now
+	case !commissioned && state.IsCommissioned:
+		state.DecommissionedAt = &now
+	}
+
+	state.IsCommissioned = commissioned
+	if !commissioned {
+		state.Fabrics = nil
+	} else if len(fabrics) > 0 {
+		state.Fabrics = fabrics
+	}
+	state.FabricID, state.NodeID = firstFabric(state.Fabrics)
+	state.VerifiedAt = &now
+}
+
+// commissioningMismatch describes how the stored state differs from the
+// bridge's, or returns "" if they agree
+func commissioningMismatch(stored *storage.MatterState, status *StatusResponse) string {
+	switch {
+	case status.Commissioned && !stored.IsCommissioned:
+		return "bridge is commissioned but stored state is not"
+	case !status.Commissioned && stored.IsCommissioned:
+		return "stored state is commissioned but bridge is not"
+	case !status.Commissioned:
+		return ""
+	}
+
+	live := fabricIDs(storageFabrics(status.Fabrics, status.FabricID, status.NodeID))
+	if len(live) == 0 {
+		return "" // An older bridge that doesn't report fabrics
+	}
+	known := fabricIDs(stored.Fabrics)
+	if strings.Join(live, ",") != strings.Join(known, ",") {
+		return fmt.Sprintf("stored fabrics [%s], bridge fabrics [%s]",
+			strings.Join(known, ", "), strings.Join(live, ", "))
+	}
+	return ""
+}
+
+// storageFabrics converts fabrics reported by the bridge, falling back to
+// the single fabric and node ID that older bridges report
+func storageFabrics(fabrics []Fabric, fabricID, nodeID string) []storage.MatterFabric {
+	if len(fabrics) == 0 {
+		if fabricID == "" {
+			return nil
+		}
+		return []storage.MatterFabric{{FabricID: fabricID, NodeID: nodeID}}
+	}
+
+	result := make([]storage.MatterFabric, len(fabrics))
+	for i, f := range fabrics {
+		result[i] = storage.MatterFabric{
+			FabricIndex: f.FabricIndex,
+			FabricID:    f.FabricID,
+			NodeID:      f.NodeID,
+			VendorID:    f.VendorID,
+			Label:       f.Label,
+		}
+	}
+	return result
+}
+
+// firstFabric returns the fabric and node ID of the first fabric
+func firstFabric(fabrics []storage.MatterFabric) (string, string) {
+	if len(fabrics) == 0 {
+		return "", ""
+	}
+	return fabrics[0].FabricID, fabrics[0].NodeID
+}
+
+// fabricIDs returns the sorted fabric IDs
+func fabricIDs(fabrics []storage.MatterFabric) []string {
+	ids := make([]string, 0, len(fabrics))
+	for _, f := range fabrics {
+		ids = append(ids, f.FabricID)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,268 @@
+package matter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// Reconnect backoff for the event WebSocket
+const (
+	reconnectMinWait = time.Second
+	reconnectMaxWait = 30 * time.Second
+)
+
+// Connection events, reported as matter_event events
+const (
+	connectionUp     = "bridge_connected"
+	connectionDown   = "bridge_disconnected"
+	connectionMissed = "events_missed"
+)
+
+// ConnectionStats describes the event connection to the bridge
+type ConnectionStats struct {
+	Connected  bool       `json:"connected"`
+	Since      *time.Time `json:"since,omitempty"` // When Connected last changed
+	Reconnects uint64     `json:"reconnects"`
+	LastSeq    uint64     `json:"last_seq"`
+	Duplicates uint64     `json:"duplicates"` // Replayed events already handled
+	Missed     uint64     `json:"missed"`     // Events the bridge no longer had to replay
+}
+
+// eventStream tracks how far through the bridge's events the service has
+// read, so a new connection resumes where the last one stopped
+type eventStream struct {
+	mu       sync.Mutex
+	boot     string // Identifies the bridge process; sequences restart with it
+	connects uint64
+	stats    ConnectionStats
+}
+
+// snapshot returns a copy of the connection stats
+func (s *eventStream) snapshot() ConnectionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// position returns the bridge process and sequence to resume from
+func (s *eventStream) position() (string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.boot, s.stats.LastSeq
+}
+
+// setConnected records the connection going up or down
+func (s *eventStream) setConnected(connected bool, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if connected {
+		s.connects++
+		s.stats.Reconnects = s.connects - 1
+	}
+	s.stats.Connected = connected
+	s.stats.Since = &at
+}
+
+// resume starts reading from the position in a hello event. A new bridge
+// process numbers its events from 1 again. It reports whether the bridge
+// restarted since the last connection.
+func (s *eventStream) resume(boot string, missed uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restarted := s.boot != "" && s.boot != boot
+	if s.boot != boot {
+		s.boot = boot
+		s.stats.LastSeq = 0
+	}
+	s.stats.Missed += missed
+	return restarted
+}
+
+// advance records an event's sequence number, returning false if the event
+// was already handled on an earlier connection
+func (s *eventStream) advance(seq uint64) bool {
+	if seq == 0 {
+		return true // Not sequenced
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq <= s.stats.LastSeq {
+		s.stats.Duplicates++
+		return false
+	}
+	s.stats.LastSeq = seq
+	return true
+}
+
+// connectWebSocket keeps a WebSocket connection to the bridge's events
+// open until ctx is done, waiting longer after each failed attempt
+func (b *Bridge) connectWebSocket(ctx context.Context) {
+	wait := reconnectMinWait
+
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, b.eventsURL(), nil)
+		if err == nil {
+			if b.runWebSocket(ctx, conn) {
+				wait = reconnectMinWait
+			}
+		} else if ctx.Err() == nil {
+			log.Debug("Failed to connect to Matter bridge events, retrying in %s: %v", wait, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, reconnectMaxWait)
+	}
+}
+
+// eventsURL returns the WebSocket URL, asking the bridge to replay the
+// events sent since the last one read
+func (b *Bridge) eventsURL() string {
+	boot, seq := b.stream.position()
+	query := url.Values{}
+	query.Set("since", strconv.FormatUint(seq, 10))
+	if boot != "" {
+		query.Set("boot", boot)
+	}
+	return "ws" + b.baseURL[4:] + "/events?" + query.Encode()
+}
+
+// runWebSocket reads events from a connection until it fails or ctx is
+// done. It reports whether the bridge said hello, so a connection the
+// bridge drops straight away still backs off.
+func (b *Bridge) runWebSocket(ctx context.Context, conn *websocket.Conn) bool {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	b.wsMu.Lock()
+	b.wsConn = conn
+	b.wsMu.Unlock()
+
+	b.setConnected(ctx, true, nil)
+	greeted, err := b.readWebSocket(ctx, conn)
+
+	b.wsMu.Lock()
+	b.wsConn = nil
+	b.wsMu.Unlock()
+	conn.Close()
+
+	if ctx.Err() == nil {
+		b.setConnected(ctx, false, err)
+	}
+	return greeted
+}
+
+// setConnected records and reports the connection going up or down
+func (b *Bridge) setConnected(ctx context.Context, connected bool, cause error) {
+	now := time.Now()
+	b.stream.setConnected(connected, now)
+
+	var data map[string]interface{}
+	if connected {
+		data = map[string]interface{}{"event": connectionUp, "message": "Connected to Matter bridge"}
+		log.Info("Connected to Matter bridge events")
+	} else {
+		data = map[string]interface{}{"event": connectionDown, "message": "Disconnected from Matter bridge"}
+		if cause != nil {
+			data["error"] = cause.Error()
+		}
+		log.Warn("Disconnected from Matter bridge events: %v", cause)
+	}
+	b.emit(ctx, Event{Type: EventTypeMatterEvent, Timestamp: now, Data: data})
+}
+
+// readWebSocket reads events from the WebSocket until it fails. It
+// reports whether the bridge said hello.
+func (b *Bridge) readWebSocket(ctx context.Context, conn *websocket.Conn) (bool, error) {
+	greeted := false
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return greeted, err
+		}
+
+		var event Event
+		if err := json.Unmarshal(message, &event); err != nil {
+			continue
+		}
+
+		if event.Type == EventTypeHello {
+			greeted = true
+			b.handleHello(ctx, event)
+			continue
+		}
+		if !b.stream.advance(event.Seq) {
+			continue
+		}
+
+		// Hand commands to the dispatcher so a slow TCC call doesn't
+		// hold up the events behind it
+		if event.Type == EventTypeCommand && b.cmdHandler != nil {
+			var cmd Command
+			if cmdData, err := json.Marshal(event.Data); err == nil {
+				if json.Unmarshal(cmdData, &cmd) == nil {
+					b.commands.dispatch(cmd)
+				}
+			}
+		}
+
+		// Handle commissioning changes
+		if event.Type == EventTypeCommissioned && b.commHandler != nil {
+			b.commHandler(event)
+		}
+
+		if !b.emit(ctx, event) {
+			return greeted, ctx.Err()
+		}
+	}
+}
+
+// handleHello resumes the event stream from the position the bridge
+// replays from, reporting events it could no longer replay
+func (b *Bridge) handleHello(ctx context.Context, event Event) {
+	boot, _ := event.Data["boot"].(string)
+	missed, _ := event.Data["missed"].(float64)
+
+	if b.stream.resume(boot, uint64(missed)) {
+		log.Info("Matter bridge restarted, reading its events from the start")
+	}
+	if missed < 1 {
+		return
+	}
+
+	message := fmt.Sprintf("Matter bridge could not replay %d events", uint64(missed))
+	log.Warn("%s", message)
+	b.emit(ctx, Event{
+		Type:      EventTypeMatterEvent,
+		Timestamp: event.Timestamp,
+		Data:      map[string]interface{}{"event": connectionMissed, "message": message, "missed": uint64(missed)},
+	})
+}
+
+// emit hands an event to the event channel. Rather than drop events when
+// the channel is full it waits, which stops the connection being read and
+// leaves the bridge holding the rest. It returns false if ctx is done.
+func (b *Bridge) emit(ctx context.Context, event Event) bool {
+	select {
+	case b.eventChan <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
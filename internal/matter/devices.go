@@ -0,0 +1,211 @@
+package matter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// BridgedDevice is a thermostat exposed on its own endpoint under the
+// bridge's aggregator. The bridge adds its humidity sensor endpoint once
+// the thermostat reports a valid humidity.
+type BridgedDevice struct {
+	DeviceID         int    `json:"deviceId"`
+	Endpoint         int    `json:"endpoint"`
+	HumidityEndpoint int    `json:"humidityEndpoint,omitempty"`
+	Name             string `json:"name"`
+}
+
+// Devices returns the devices the bridge should expose, by endpoint
+func (b *Bridge) Devices() []BridgedDevice {
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+
+	devices := make([]BridgedDevice, 0, len(b.devices))
+	for _, dev := range b.devices {
+		devices = append(devices, dev)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Endpoint < devices[j].Endpoint })
+	return devices
+}
+
+// isBridged reports whether a device is exposed by the bridge
+func (b *Bridge) isBridged(deviceID int) bool {
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+	_, ok := b.devices[deviceID]
+	return ok
+}
+
+// AddDevice exposes a device on its endpoint, or updates it if it is
+// already bridged
+func (b *Bridge) AddDevice(ctx context.Context, dev BridgedDevice) error {
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+
+	b.devices[dev.DeviceID] = dev
+	return b.putDevice(ctx, dev)
+}
+
+// RemoveDevice stops exposing a device
+func (b *Bridge) RemoveDevice(ctx context.Context, deviceID int) error {
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+
+	delete(b.devices, deviceID)
+	return b.deleteDevice(ctx, deviceID)
+}
+
+// RenameDevice changes the name a bridged device is shown with
+func (b *Bridge) RenameDevice(ctx context.Context, deviceID int, name string) error {
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+
+	dev, ok := b.devices[deviceID]
+	if !ok {
+		return fmt.Errorf("device %d is not bridged", deviceID)
+	}
+	dev.Name = name
+	b.devices[deviceID] = dev
+	return b.putDevice(ctx, dev)
+}
+
+// SyncDevices makes devices the set the bridge exposes, adding, updating
+// and removing endpoints on the running bridge to match. It returns the
+// IDs of devices that were added, which have no state on the bridge yet.
+// While the bridge is down only the set is recorded.
+func (b *Bridge) SyncDevices(ctx context.Context, devices []BridgedDevice) ([]int, error) {
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+
+	b.devices = make(map[int]BridgedDevice, len(devices))
+	for _, dev := range devices {
+		b.devices[dev.DeviceID] = dev
+	}
+	if !b.IsRunning() {
+		return nil, nil
+	}
+
+	current, err := b.listDevices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridged devices: %w", err)
+	}
+	have := make(map[int]BridgedDevice, len(current))
+	for _, dev := range current {
+		have[dev.DeviceID] = dev
+	}
+
+	var added []int
+	var errs []error
+	for id := range have {
+		if _, ok := b.devices[id]; !ok {
+			if err := b.deleteDevice(ctx, id); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, dev := range devices {
+		prev, ok := have[dev.DeviceID]
+		if ok && prev == dev {
+			continue
+		}
+		if err := b.putDevice(ctx, dev); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			added = append(added, dev.DeviceID)
+		}
+	}
+
+	return added, errors.Join(errs...)
+}
+
+// listDevices returns the devices the running bridge exposes
+func (b *Bridge) listDevices(ctx context.Context) ([]BridgedDevice, error) {
+	req, err := b.newRequest(ctx, "GET", "/devices", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var devices []BridgedDevice
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// putDevice adds or updates a device's endpoint on the running bridge.
+// Callers hold devicesMu.
+func (b *Bridge) putDevice(ctx context.Context, dev BridgedDevice) error {
+	if !b.IsRunning() {
+		return nil // Added when the bridge next starts
+	}
+
+	jsonData, err := json.Marshal(dev)
+	if err != nil {
+		return err
+	}
+
+	req, err := b.newRequest(ctx, "PUT", fmt.Sprintf("/devices/%d", dev.DeviceID), bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to bridge device %d: unexpected status: %d", dev.DeviceID, resp.StatusCode)
+	}
+
+	log.FromContext(ctx).Debug("Bridged device %d on endpoint %d as %q", dev.DeviceID, dev.Endpoint, dev.Name)
+	return nil
+}
+
+// deleteDevice removes a device's endpoint from the running bridge.
+// Callers hold devicesMu.
+func (b *Bridge) deleteDevice(ctx context.Context, deviceID int) error {
+	if !b.IsRunning() {
+		return nil
+	}
+
+	req, err := b.newRequest(ctx, "DELETE", fmt.Sprintf("/devices/%d", deviceID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to remove device %d: unexpected status: %d", deviceID, resp.StatusCode)
+	}
+
+	log.FromContext(ctx).Debug("Removed device %d from the Matter bridge", deviceID)
+	return nil
+}
@@ -0,0 +1,79 @@
+package matter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// FirstBridgedEndpoint is the first endpoint number given to a device. The
+// root node is endpoint 0 and the aggregator endpoint 1.
+const FirstBridgedEndpoint = 2
+
+// Endpoints assigns each device Matter endpoint numbers for its thermostat
+// and companion humidity sensor and keeps them in the database. A device
+// always comes back on the same endpoints, even after being hidden or
+// missing from TCC for a while, so controllers keep its rooms and names.
+type Endpoints struct {
+	db       storage.Store
+	mu       sync.Mutex
+	byDevice map[int]storage.MatterEndpoint // nil until loaded
+	next     int
+}
+
+// NewEndpoints creates an endpoint registry
+func NewEndpoints(db storage.Store) *Endpoints {
+	return &Endpoints{db: db}
+}
+
+// load reads the stored endpoints. Callers hold mu.
+func (e *Endpoints) load() error {
+	if e.byDevice != nil {
+		return nil
+	}
+
+	stored, err := e.db.GetMatterEndpoints()
+	if err != nil {
+		return err
+	}
+
+	e.byDevice = make(map[int]storage.MatterEndpoint, len(stored))
+	e.next = FirstBridgedEndpoint
+	for _, ep := range stored {
+		e.byDevice[ep.DeviceID] = ep
+		e.next = max(e.next, ep.Endpoint+1, ep.HumidityEndpoint+1)
+	}
+	return nil
+}
+
+// Assign returns a device's endpoints, giving it the next unused ones the
+// first time it is seen. Devices bridged before humidity sensors were
+// added keep their thermostat endpoint and get a new humidity endpoint.
+func (e *Endpoints) Assign(deviceID int) (storage.MatterEndpoint, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return storage.MatterEndpoint{}, err
+	}
+	ep, ok := e.byDevice[deviceID]
+	if ok && ep.HumidityEndpoint != 0 {
+		return ep, nil
+	}
+
+	next := e.next
+	if !ok {
+		ep = storage.MatterEndpoint{DeviceID: deviceID, Endpoint: next}
+		next++
+	}
+	ep.HumidityEndpoint = next
+	next++
+
+	if err := e.db.SaveMatterEndpoint(&ep); err != nil {
+		return storage.MatterEndpoint{}, fmt.Errorf("failed to assign Matter endpoint: %w", err)
+	}
+	e.byDevice[deviceID] = ep
+	e.next = next
+	return ep, nil
+}
@@ -7,15 +7,21 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"time"
 
 	"github.com/stephens/tcc-bridge/internal/log"
 )
 
+// stopTimeout is how long Stop waits for a graceful exit before killing
+const stopTimeout = 10 * time.Second
+
 // Process manages the Node.js Matter bridge subprocess
 type Process struct {
 	dir     string
 	cmd     *exec.Cmd
 	running bool
+	done    chan struct{}
+	exitErr error
 	mu      sync.RWMutex
 }
 
@@ -71,6 +77,9 @@ func (p *Process) Start(ctx context.Context) error {
 	}
 
 	p.running = true
+	p.exitErr = nil
+	done := make(chan struct{})
+	p.done = done
 
 	// Log output in goroutines
 	go func() {
@@ -88,11 +97,14 @@ func (p *Process) Start(ctx context.Context) error {
 	}()
 
 	// Monitor process exit
+	cmd := p.cmd
 	go func() {
-		err := p.cmd.Wait()
+		err := cmd.Wait()
 		p.mu.Lock()
 		p.running = false
+		p.exitErr = err
 		p.mu.Unlock()
+		close(done)
 		if err != nil {
 			log.Error("Matter bridge exited with error: %v", err)
 		} else {
@@ -104,26 +116,49 @@ func (p *Process) Start(ctx context.Context) error {
 	return nil
 }
 
-// Stop stops the Node.js process
+// Stop stops the Node.js process and waits for it to exit
 func (p *Process) Stop() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	if !p.running || p.cmd == nil || p.cmd.Process == nil {
+		p.mu.Unlock()
 		return nil
 	}
+	proc, done := p.cmd.Process, p.done
+	p.mu.Unlock()
 
 	// Send SIGTERM
-	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+	if err := proc.Signal(os.Interrupt); err != nil {
 		// Force kill if SIGTERM fails
-		p.cmd.Process.Kill()
+		proc.Kill()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Warn("Matter bridge did not exit within %s, killing it", stopTimeout)
+		proc.Kill()
+		<-done
 	}
 
-	p.running = false
 	log.Info("Stopped Matter bridge process")
 	return nil
 }
 
+// Done returns a channel closed when the current process exits, or nil if
+// it was never started
+func (p *Process) Done() <-chan struct{} {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.done
+}
+
+// ExitErr returns the error the last process exited with
+func (p *Process) ExitErr() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.exitErr
+}
+
 // IsRunning returns true if the process is running
 func (p *Process) IsRunning() bool {
 	p.mu.RLock()
@@ -0,0 +1,281 @@
+package matter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// SupervisorState describes what the supervisor is currently doing
+type SupervisorState string
+
+const (
+	SupervisorStarting  SupervisorState = "starting"
+	SupervisorRunning   SupervisorState = "running"
+	SupervisorBackoff   SupervisorState = "backoff"
+	SupervisorCrashLoop SupervisorState = "crash_loop"
+	SupervisorStopped   SupervisorState = "stopped"
+)
+
+// SupervisorOptions configures the Matter bridge supervisor
+type SupervisorOptions struct {
+	HealthInterval     time.Duration // How often to call /health
+	HealthFailures     int           // Consecutive failed checks before restarting
+	MinBackoff         time.Duration // Delay before the first restart
+	MaxBackoff         time.Duration // Upper bound for the restart delay
+	StableAfter        time.Duration // Uptime after which the backoff resets
+	CrashLoopWindow    time.Duration // Window used to detect crash loops
+	CrashLoopThreshold int           // Restarts within the window that count as a crash loop
+}
+
+// SupervisorStatus is a snapshot of the supervisor state
+type SupervisorStatus struct {
+	State       SupervisorState `json:"state"`
+	Restarts    int             `json:"restarts"`
+	LastRestart time.Time       `json:"last_restart,omitempty"`
+	LastReason  string          `json:"last_reason,omitempty"`
+	NextAttempt time.Time       `json:"next_attempt,omitempty"`
+	StartedAt   time.Time       `json:"started_at,omitempty"`
+}
+
+// RestartHandler is called whenever the supervisor restarts the bridge.
+// crashLoop is set when restarts are happening too often.
+type RestartHandler func(reason string, delay time.Duration, crashLoop bool)
+
+// StartedHandler is called each time the bridge is up and ready
+type StartedHandler func(ctx context.Context)
+
+// Supervisor keeps the Matter bridge process running
+type Supervisor struct {
+	bridge    *Bridge
+	opts      SupervisorOptions
+	restartCh chan string
+	onRestart RestartHandler
+	onStarted StartedHandler
+
+	mu       sync.Mutex
+	status   SupervisorStatus
+	restarts []time.Time
+}
+
+// NewSupervisor creates a supervisor for the given bridge
+func NewSupervisor(bridge *Bridge, opts SupervisorOptions) *Supervisor {
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = 15 * time.Second
+	}
+	if opts.HealthFailures <= 0 {
+		opts.HealthFailures = 3
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 2 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	if opts.StableAfter <= 0 {
+		opts.StableAfter = 5 * time.Minute
+	}
+	if opts.CrashLoopWindow <= 0 {
+		opts.CrashLoopWindow = 10 * time.Minute
+	}
+	if opts.CrashLoopThreshold <= 0 {
+		opts.CrashLoopThreshold = 5
+	}
+
+	return &Supervisor{
+		bridge:    bridge,
+		opts:      opts,
+		restartCh: make(chan string, 1),
+		status:    SupervisorStatus{State: SupervisorStopped},
+	}
+}
+
+// SetRestartHandler sets a callback for restarts
+func (s *Supervisor) SetRestartHandler(handler RestartHandler) {
+	s.onRestart = handler
+}
+
+// SetStartedHandler sets a callback for when the bridge becomes ready
+func (s *Supervisor) SetStartedHandler(handler StartedHandler) {
+	s.onStarted = handler
+}
+
+// Restart asks the supervisor to restart the bridge immediately
+func (s *Supervisor) Restart(reason string) {
+	select {
+	case s.restartCh <- reason:
+	default:
+		// A restart is already pending
+	}
+}
+
+// Status returns a snapshot of the supervisor state
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Run starts the bridge and keeps it running until ctx is cancelled
+func (s *Supervisor) Run(ctx context.Context) {
+	attempt := 0
+
+	for {
+		s.setState(SupervisorStarting, time.Time{})
+
+		var reason string
+		manual := false
+		startedAt := time.Now()
+
+		if err := s.bridge.Start(ctx); err != nil {
+			reason = fmt.Sprintf("start failed: %v", err)
+		} else {
+			s.mu.Lock()
+			s.status.State = SupervisorRunning
+			s.status.StartedAt = startedAt
+			s.status.NextAttempt = time.Time{}
+			s.mu.Unlock()
+
+			if s.onStarted != nil {
+				s.onStarted(ctx)
+			}
+			reason, manual = s.watch(ctx)
+		}
+
+		if ctx.Err() != nil {
+			s.setState(SupervisorStopped, time.Time{})
+			return
+		}
+
+		// Stop whatever is left before starting again
+		s.bridge.process.Stop()
+
+		now := time.Now()
+		if manual || now.Sub(startedAt) >= s.opts.StableAfter {
+			attempt = 0
+		}
+
+		delay := time.Duration(0)
+		crashLoop := false
+		if !manual {
+			delay = s.backoff(attempt)
+			attempt++
+			if s.noteCrash(now) {
+				crashLoop = true
+				delay = s.opts.MaxBackoff
+			}
+		}
+
+		s.mu.Lock()
+		s.status.Restarts++
+		s.status.LastRestart = now
+		s.status.LastReason = reason
+		s.mu.Unlock()
+
+		state := SupervisorBackoff
+		if crashLoop {
+			state = SupervisorCrashLoop
+			log.Error("Matter bridge is crash looping (%s), next restart in %s", reason, delay)
+		} else {
+			log.Warn("Restarting Matter bridge in %s: %s", delay, reason)
+		}
+		s.setState(state, now.Add(delay))
+
+		if s.onRestart != nil {
+			s.onRestart(reason, delay, crashLoop)
+		}
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				s.setState(SupervisorStopped, time.Time{})
+				return
+			case <-timer.C:
+			case r := <-s.restartCh:
+				// A manual restart skips the remaining backoff
+				timer.Stop()
+				log.Info("Matter bridge restart requested during backoff: %s", r)
+				attempt = 0
+			}
+		}
+	}
+}
+
+// watch waits until the bridge needs restarting and returns why.
+// manual is set for restarts requested through Restart.
+func (s *Supervisor) watch(ctx context.Context) (reason string, manual bool) {
+	ticker := time.NewTicker(s.opts.HealthInterval)
+	defer ticker.Stop()
+
+	done := s.bridge.ProcessDone()
+	failures := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "shutdown", false
+		case <-done:
+			if err := s.bridge.ProcessExitErr(); err != nil {
+				return fmt.Sprintf("process exited: %v", err), false
+			}
+			return "process exited", false
+		case r := <-s.restartCh:
+			return r, true
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, s.opts.HealthInterval)
+			err := s.bridge.CheckHealth(checkCtx)
+			cancel()
+			if err == nil {
+				failures = 0
+				continue
+			}
+			failures++
+			log.Warn("Matter bridge health check failed (%d/%d): %v", failures, s.opts.HealthFailures, err)
+			if failures >= s.opts.HealthFailures {
+				return fmt.Sprintf("health check failed %d times: %v", failures, err), false
+			}
+		}
+	}
+}
+
+// backoff returns the restart delay for the given attempt
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	delay := s.opts.MinBackoff
+	for i := 0; i < attempt && delay < s.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.opts.MaxBackoff {
+		delay = s.opts.MaxBackoff
+	}
+	return delay
+}
+
+// noteCrash records an unplanned restart and reports whether the bridge is
+// crash looping
+func (s *Supervisor) noteCrash(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-s.opts.CrashLoopWindow)
+	recent := s.restarts[:0]
+	for _, t := range s.restarts {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	s.restarts = append(recent, now)
+
+	return len(s.restarts) >= s.opts.CrashLoopThreshold
+}
+
+func (s *Supervisor) setState(state SupervisorState, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+	s.status.NextAttempt = next
+}
@@ -4,33 +4,58 @@ import "time"
 
 // ThermostatState represents thermostat state to send to Matter bridge
 type ThermostatState struct {
-	DeviceID     int     `json:"deviceId"`
-	Name         string  `json:"name"`
-	CurrentTemp  float64 `json:"currentTemp"`
-	HeatSetpoint float64 `json:"heatSetpoint"`
-	CoolSetpoint float64 `json:"coolSetpoint"`
-	SystemMode   string  `json:"systemMode"`
-	Humidity     int     `json:"humidity"`
-	IsHeating    bool    `json:"isHeating"`
-	IsCooling    bool    `json:"isCooling"`
+	DeviceID     int      `json:"deviceId"`
+	Name         string   `json:"name"`
+	CurrentTemp  float64  `json:"currentTemp"`
+	HeatSetpoint float64  `json:"heatSetpoint"`
+	CoolSetpoint float64  `json:"coolSetpoint"`
+	SystemMode   string   `json:"systemMode"`
+	Humidity     *int     `json:"humidity"` // nil when TCC had no valid reading
+	IsHeating    bool     `json:"isHeating"`
+	IsCooling    bool     `json:"isCooling"`
+	Presets      []Preset `json:"presets,omitempty"`
+	ActivePreset string   `json:"activePreset,omitempty"`
+	// TemperatureUnit is the display unit, "celsius" or "fahrenheit"
+	TemperatureUnit string `json:"temperatureUnit,omitempty"`
+}
+
+// Preset is a comfort preset exposed to Matter controllers
+type Preset struct {
+	Name         string   `json:"name"`
+	SystemMode   string   `json:"systemMode,omitempty"`
+	HeatSetpoint *float64 `json:"heatSetpoint,omitempty"` // Celsius
+	CoolSetpoint *float64 `json:"coolSetpoint,omitempty"` // Celsius
 }
 
 // Command represents a command from HomeKit via Matter
 type Command struct {
-	Type   string      `json:"type"`
-	Action string      `json:"action"`
-	Value  interface{} `json:"value"`
+	ID       string      `json:"id,omitempty"` // Echoed in the command's result
+	DeviceID int         `json:"deviceId,omitempty"`
+	Type     string      `json:"type"`
+	Action   string      `json:"action"`
+	Value    interface{} `json:"value"`
 }
 
 // StatusResponse represents the Matter bridge status
 type StatusResponse struct {
 	Running        bool      `json:"running"`
 	Commissioned   bool      `json:"commissioned"`
-	FabricID       string    `json:"fabric_id,omitempty"`
-	NodeID         string    `json:"node_id,omitempty"`
-	ConnectedPeers int       `json:"connected_peers"`
+	FabricID       string    `json:"fabricId,omitempty"`
+	NodeID         string    `json:"nodeId,omitempty"`
+	Fabrics        []Fabric  `json:"fabrics,omitempty"`
+	ConnectedPeers int       `json:"connectedPeers"`
 	Uptime         int64     `json:"uptime"`
-	LastUpdate     time.Time `json:"last_update"`
+	LastUpdate     time.Time `json:"lastUpdate"`
+}
+
+// Fabric is a controller the bridge is commissioned into, as reported by
+// the bridge
+type Fabric struct {
+	FabricIndex int    `json:"fabricIndex"`
+	FabricID    string `json:"fabricId"`
+	NodeID      string `json:"nodeId"`
+	VendorID    int    `json:"vendorId,omitempty"`
+	Label       string `json:"label,omitempty"`
 }
 
 // PairingInfo represents Matter pairing information
@@ -45,13 +70,16 @@ type Event struct {
 	Type      string                 `json:"type"`
 	Timestamp time.Time              `json:"timestamp"`
 	Data      map[string]interface{} `json:"data,omitempty"`
+	Seq       uint64                 `json:"seq,omitempty"` // Set by the bridge, counting from 1 per process
 }
 
 // EventType constants
 const (
-	EventTypeCommand      = "command"
-	EventTypeCommissioned = "commissioned"
-	EventTypeConnection   = "connection"
-	EventTypeError        = "error"
-	EventTypeMatterEvent  = "matter_event"
+	EventTypeCommand       = "command"
+	EventTypeCommandResult = "command_result"
+	EventTypeCommissioned  = "commissioned"
+	EventTypeConnection    = "connection"
+	EventTypeError         = "error"
+	EventTypeHello         = "hello"
+	EventTypeMatterEvent   = "matter_event"
 )
@@ -0,0 +1,306 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// retryInterval is how often pending commands are retried without a kick
+const retryInterval = time.Minute
+
+// ErrDisabled is returned by Enqueue when command queueing is turned off
+var ErrDisabled = errors.New("command queue is disabled")
+
+// ErrInFlight is returned by Cancel for a command already being sent to TCC
+var ErrInFlight = errors.New("command is already being sent to TCC")
+
+// controller is the part of the TCC client that replays commands
+type controller interface {
+	SetHeatSetpoint(ctx context.Context, deviceID int, temp float64) error
+	SetCoolSetpoint(ctx context.Context, deviceID int, temp float64) error
+	SetSystemMode(ctx context.Context, deviceID int, mode string) error
+}
+
+// AppliedHandler is called after a queued command was sent to TCC
+type AppliedHandler func(ctx context.Context, cmd *storage.QueuedCommand)
+
+// Outbox buffers user commands while TCC is unreachable and replays them
+// in order once it is back
+type Outbox struct {
+	db        storage.Store
+	tccClient controller
+	guard     *policy.Enforcer
+	enabled   bool
+	ttl       time.Duration
+	onApplied AppliedHandler
+	wake      chan struct{}
+}
+
+// New creates a command outbox. Commands expire ttl after they are queued.
+func New(db storage.Store, tccClient *tcc.Client, guard *policy.Enforcer, enabled bool, ttl time.Duration) *Outbox {
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return &Outbox{
+		db:        db,
+		tccClient: tccClient,
+		guard:     guard,
+		enabled:   enabled,
+		ttl:       ttl,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// SetAppliedHandler sets a callback for successfully replayed commands
+func (o *Outbox) SetAppliedHandler(handler AppliedHandler) {
+	o.onApplied = handler
+}
+
+// Enabled reports whether failed commands should be queued
+func (o *Outbox) Enabled() bool {
+	return o.enabled
+}
+
+// EnqueueSetpoint queues a heat or cool setpoint change
+func (o *Outbox) EnqueueSetpoint(ctx context.Context, source storage.EventSource, deviceID int, field provenance.Field, value float64, cause error) (*storage.QueuedCommand, error) {
+	return o.enqueue(ctx, &storage.QueuedCommand{
+		DeviceID: deviceID,
+		Field:    string(field),
+		Setpoint: &value,
+		Source:   source,
+	}, fmt.Sprintf("%s %.1f°F", field, value), cause)
+}
+
+// EnqueueMode queues a system mode change
+func (o *Outbox) EnqueueMode(ctx context.Context, source storage.EventSource, deviceID int, mode string, cause error) (*storage.QueuedCommand, error) {
+	return o.enqueue(ctx, &storage.QueuedCommand{
+		DeviceID:   deviceID,
+		Field:      string(provenance.FieldSystemMode),
+		SystemMode: mode,
+		Source:     source,
+	}, fmt.Sprintf("mode %s", mode), cause)
+}
+
+func (o *Outbox) enqueue(ctx context.Context, cmd *storage.QueuedCommand, desc string, cause error) (*storage.QueuedCommand, error) {
+	if !o.enabled {
+		return nil, ErrDisabled
+	}
+
+	cmd.ExpiresAt = time.Now().Add(o.ttl)
+	cmd.CorrelationID = log.CorrelationID(ctx)
+	if err := o.db.EnqueueCommand(cmd); err != nil {
+		return nil, err
+	}
+
+	log.FromContext(ctx).Info("TCC unavailable, queued command %d for device %d: %s (%v)", cmd.ID, cmd.DeviceID, desc, cause)
+	o.db.LogEventContext(ctx, cmd.Source, storage.EventTypeCommand,
+		fmt.Sprintf("TCC unavailable, queued %s for device %d", desc, cmd.DeviceID),
+		map[string]interface{}{
+			"command_id": cmd.ID,
+			"device_id":  cmd.DeviceID,
+			"field":      cmd.Field,
+			"expires_at": cmd.ExpiresAt,
+			"error":      cause.Error(),
+		})
+
+	return cmd, nil
+}
+
+// Cancel cancels a pending command. It returns ErrInFlight if the command
+// is being sent to TCC, or sql.ErrNoRows if it doesn't exist or is no
+// longer pending.
+func (o *Outbox) Cancel(ctx context.Context, id int) error {
+	err := o.db.CompleteCommand(id, storage.CommandPending, storage.CommandCancelled, "")
+	if err == sql.ErrNoRows {
+		if cmd, _ := o.db.GetCommand(id); cmd != nil && cmd.Status == storage.CommandInFlight {
+			return ErrInFlight
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	o.db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypeCommand,
+		fmt.Sprintf("Queued command %d cancelled", id),
+		map[string]interface{}{"command_id": id})
+
+	return nil
+}
+
+// Kick asks the outbox to replay pending commands now, e.g. after a
+// successful poll shows TCC is reachable again
+func (o *Outbox) Kick() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run replays pending commands until ctx is cancelled
+func (o *Outbox) Run(ctx context.Context) {
+	log.Info("Starting command outbox (ttl: %s)", o.ttl)
+	o.requeueInterrupted()
+
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		o.flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// requeueInterrupted returns commands left in flight by a previous run to
+// the queue. TCC may have applied them already, which resending repeats
+// harmlessly since each command sets an absolute value.
+func (o *Outbox) requeueInterrupted() {
+	commands, err := o.db.GetCommands(storage.CommandInFlight, 0)
+	if err != nil {
+		log.Error("Failed to load interrupted commands: %v", err)
+		return
+	}
+	for _, cmd := range commands {
+		log.Warn("Requeueing command %d for device %d, interrupted while being sent to TCC", cmd.ID, cmd.DeviceID)
+		if err := o.db.NoteCommandAttempt(cmd.ID, "interrupted before TCC answered"); err != nil {
+			log.Error("%v", err)
+		}
+	}
+}
+
+// flush replays pending commands in the order they were queued. It stops
+// at the first command that fails because TCC is still unavailable, so
+// later commands never overtake earlier ones. Each command is claimed
+// before it is sent, so one cancelled after the pending list was loaded is
+// skipped and one being sent can't be cancelled.
+func (o *Outbox) flush(ctx context.Context) {
+	commands, err := o.db.GetPendingCommands()
+	if err != nil {
+		log.Error("Failed to load queued commands: %v", err)
+		return
+	}
+
+	for i := range commands {
+		if ctx.Err() != nil {
+			return
+		}
+		cmd := &commands[i]
+
+		// Continue the chain of the request that queued the command
+		id := cmd.CorrelationID
+		if id == "" {
+			id = log.NewCorrelationID()
+		}
+		ctx := log.WithCorrelationID(ctx, id)
+
+		if time.Now().After(cmd.ExpiresAt) {
+			o.complete(ctx, cmd, storage.CommandPending, storage.CommandExpired, "expired before TCC was reachable")
+			continue
+		}
+
+		if err := o.db.ClaimCommand(cmd.ID); err != nil {
+			if err != sql.ErrNoRows {
+				log.FromContext(ctx).Error("Failed to claim queued command %d: %v", cmd.ID, err)
+				return
+			}
+			// Cancelled or superseded since the list was loaded
+			continue
+		}
+
+		err := o.apply(ctx, cmd)
+		if err == nil {
+			if o.complete(ctx, cmd, storage.CommandInFlight, storage.CommandApplied, "") && o.onApplied != nil {
+				o.onApplied(ctx, cmd)
+			}
+			continue
+		}
+
+		if tcc.IsUnavailable(err) {
+			log.FromContext(ctx).Debug("TCC still unavailable, keeping %d queued commands: %v", len(commands)-i, err)
+			if err := o.db.NoteCommandAttempt(cmd.ID, err.Error()); err != nil {
+				log.Warn("%v", err)
+			}
+			return
+		}
+
+		o.complete(ctx, cmd, storage.CommandInFlight, storage.CommandFailed, err.Error())
+	}
+}
+
+// apply re-checks a queued command against policy and sends it to TCC
+func (o *Outbox) apply(ctx context.Context, cmd *storage.QueuedCommand) error {
+	switch provenance.Field(cmd.Field) {
+	case provenance.FieldHeatSetpoint, provenance.FieldCoolSetpoint:
+		if cmd.Setpoint == nil {
+			return fmt.Errorf("missing setpoint")
+		}
+		kind := "heat"
+		if provenance.Field(cmd.Field) == provenance.FieldCoolSetpoint {
+			kind = "cool"
+		}
+		value, err := o.guard.CheckSetpoint(ctx, cmd.Source, cmd.DeviceID, kind, *cmd.Setpoint)
+		if err != nil {
+			return err
+		}
+		*cmd.Setpoint = value
+		if kind == "heat" {
+			return o.tccClient.SetHeatSetpoint(ctx, cmd.DeviceID, value)
+		}
+		return o.tccClient.SetCoolSetpoint(ctx, cmd.DeviceID, value)
+	case provenance.FieldSystemMode:
+		if err := o.guard.CheckMode(ctx, cmd.Source, cmd.DeviceID, cmd.SystemMode); err != nil {
+			return err
+		}
+		return o.tccClient.SetSystemMode(ctx, cmd.DeviceID, cmd.SystemMode)
+	default:
+		return fmt.Errorf("unknown field %q", cmd.Field)
+	}
+}
+
+// complete records the outcome of a queued command, moving it from status
+// from. It reports whether the command was still in that status.
+func (o *Outbox) complete(ctx context.Context, cmd *storage.QueuedCommand, from, status storage.CommandStatus, errMsg string) bool {
+	if err := o.db.CompleteCommand(cmd.ID, from, status, errMsg); err != nil {
+		if err != sql.ErrNoRows {
+			log.FromContext(ctx).Error("Failed to update queued command %d: %v", cmd.ID, err)
+		}
+		// Cancelled in the meantime
+		return false
+	}
+	cmd.Status = status
+	cmd.Error = errMsg
+
+	eventType := storage.EventTypeCommand
+	if status == storage.CommandFailed {
+		eventType = storage.EventTypeError
+	}
+
+	msg := fmt.Sprintf("Queued command %d (%s) for device %d %s", cmd.ID, cmd.Field, cmd.DeviceID, status)
+	if errMsg != "" {
+		msg += ": " + errMsg
+	}
+	log.FromContext(ctx).Info("%s", msg)
+	o.db.LogEventContext(ctx, cmd.Source, eventType, msg, map[string]interface{}{
+		"command_id": cmd.ID,
+		"device_id":  cmd.DeviceID,
+		"field":      cmd.Field,
+		"status":     status,
+		"attempts":   cmd.Attempts,
+	})
+
+	return true
+}
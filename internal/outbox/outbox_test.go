@@ -0,0 +1,111 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// fakeTCC records the setpoints sent to it and runs onSend during each call
+type fakeTCC struct {
+	sent   []float64
+	onSend func(temp float64)
+}
+
+func (f *fakeTCC) SetHeatSetpoint(ctx context.Context, deviceID int, temp float64) error {
+	if f.onSend != nil {
+		f.onSend(temp)
+	}
+	f.sent = append(f.sent, temp)
+	return nil
+}
+
+func (f *fakeTCC) SetCoolSetpoint(ctx context.Context, deviceID int, temp float64) error {
+	return f.SetHeatSetpoint(ctx, deviceID, temp)
+}
+
+func (f *fakeTCC) SetSystemMode(ctx context.Context, deviceID int, mode string) error {
+	return nil
+}
+
+func TestCancelDuringFlush(t *testing.T) {
+	ctx := context.Background()
+	db := storage.NewMemoryStore()
+	guard, err := policy.NewEnforcer(&config.Config{}, db)
+	if err != nil {
+		t.Fatalf("NewEnforcer() error = %v", err)
+	}
+	fake := &fakeTCC{}
+	o := &Outbox{db: db, tccClient: fake, guard: guard, enabled: true, ttl: time.Hour}
+	var applied []int
+	o.SetAppliedHandler(func(ctx context.Context, cmd *storage.QueuedCommand) {
+		applied = append(applied, cmd.ID)
+	})
+
+	unavailable := errors.New("connection refused")
+	first, err := o.EnqueueSetpoint(ctx, storage.EventSourceUser, 1, provenance.FieldHeatSetpoint, 68, unavailable)
+	if err != nil {
+		t.Fatalf("EnqueueSetpoint() error = %v", err)
+	}
+	second, err := o.EnqueueSetpoint(ctx, storage.EventSourceUser, 2, provenance.FieldHeatSetpoint, 70, unavailable)
+	if err != nil {
+		t.Fatalf("EnqueueSetpoint() error = %v", err)
+	}
+
+	// While the first command is with TCC, try to cancel both
+	var cancelFirst, cancelSecond error
+	fake.onSend = func(temp float64) {
+		if temp == 68 {
+			cancelFirst = o.Cancel(ctx, first.ID)
+			cancelSecond = o.Cancel(ctx, second.ID)
+		}
+	}
+	o.flush(ctx)
+
+	if !errors.Is(cancelFirst, ErrInFlight) {
+		t.Errorf("Cancel() of the command being sent = %v, want ErrInFlight", cancelFirst)
+	}
+	if cancelSecond != nil {
+		t.Errorf("Cancel() of a command still pending = %v, want nil", cancelSecond)
+	}
+	if len(fake.sent) != 1 || fake.sent[0] != 68 {
+		t.Errorf("sent %v to TCC, want only the first command", fake.sent)
+	}
+	if len(applied) != 1 || applied[0] != first.ID {
+		t.Errorf("applied handler ran for %v, want [%d]", applied, first.ID)
+	}
+
+	want := map[int]storage.CommandStatus{first.ID: storage.CommandApplied, second.ID: storage.CommandCancelled}
+	for id, status := range want {
+		cmd, _ := db.GetCommand(id)
+		if cmd == nil || cmd.Status != status {
+			t.Errorf("command %d = %+v, want status %s", id, cmd, status)
+		}
+	}
+}
+
+func TestRequeueInterrupted(t *testing.T) {
+	db := storage.NewMemoryStore()
+	o := &Outbox{db: db}
+
+	cmd := &storage.QueuedCommand{DeviceID: 1, Field: string(provenance.FieldSystemMode), SystemMode: "heat", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.EnqueueCommand(cmd); err != nil {
+		t.Fatalf("EnqueueCommand() error = %v", err)
+	}
+	if err := db.ClaimCommand(cmd.ID); err != nil {
+		t.Fatalf("ClaimCommand() error = %v", err)
+	}
+
+	o.requeueInterrupted()
+
+	got, _ := db.GetCommand(cmd.ID)
+	if got.Status != storage.CommandPending || got.Attempts != 1 {
+		t.Errorf("command = %s after %d attempts, want pending after 1", got.Status, got.Attempts)
+	}
+}
@@ -0,0 +1,298 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// Action decides what happens to an out-of-range setpoint
+type Action string
+
+const (
+	ActionReject Action = "reject"
+	ActionClamp  Action = "clamp"
+)
+
+// ParseAction converts a config string to an Action
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case "", ActionReject:
+		return ActionReject, nil
+	case ActionClamp:
+		return ActionClamp, nil
+	default:
+		return "", fmt.Errorf("invalid policy action %q", s)
+	}
+}
+
+// Rule names reported in violations
+const (
+	RuleHeatLimit        = "heat_limit"
+	RuleCoolLimit        = "cool_limit"
+	RuleModeNotAllowed   = "mode_not_allowed"
+	RuleFreezeProtection = "freeze_protection"
+)
+
+// Violation describes a command that broke the policy
+type Violation struct {
+	DeviceID int
+	Rule     string
+	Message  string
+	// Clamped is set when the command went ahead with an adjusted value
+	Clamped bool
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// Enforcer checks commands against the configured limits before they
+// reach TCC and logs every violation
+type Enforcer struct {
+	action   Action
+	defaults config.DeviceLimits
+	devices  map[int]config.DeviceLimits
+	db       storage.Store
+}
+
+// NewEnforcer creates a policy enforcer from configuration
+func NewEnforcer(cfg *config.Config, db storage.Store) (*Enforcer, error) {
+	action, err := ParseAction(cfg.PolicyAction)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mode := range cfg.PolicyDefaults.AllowedModes {
+		if tcc.SystemModeFromTCC(tcc.SystemModeToTCC(mode)) != mode {
+			return nil, fmt.Errorf("invalid allowed mode %q", mode)
+		}
+	}
+	for id, limits := range cfg.PolicyDevices {
+		for _, mode := range limits.AllowedModes {
+			if tcc.SystemModeFromTCC(tcc.SystemModeToTCC(mode)) != mode {
+				return nil, fmt.Errorf("device %d: invalid allowed mode %q", id, mode)
+			}
+		}
+	}
+
+	return &Enforcer{
+		action:   action,
+		defaults: cfg.PolicyDefaults,
+		devices:  cfg.PolicyDevices,
+		db:       db,
+	}, nil
+}
+
+// Limits returns the effective limits for a device. Per-device settings
+// override the defaults field by field; fields they leave unset inherit.
+func (e *Enforcer) Limits(deviceID int) config.DeviceLimits {
+	limits := e.defaults
+	if limits.FreezeProtectOff {
+		limits.FreezeProtectBelow = nil
+	}
+	override, ok := e.devices[deviceID]
+	if !ok {
+		return limits
+	}
+
+	if override.MinHeatSetpoint != nil {
+		limits.MinHeatSetpoint = override.MinHeatSetpoint
+	}
+	if override.MaxHeatSetpoint != nil {
+		limits.MaxHeatSetpoint = override.MaxHeatSetpoint
+	}
+	if override.MinCoolSetpoint != nil {
+		limits.MinCoolSetpoint = override.MinCoolSetpoint
+	}
+	if override.MaxCoolSetpoint != nil {
+		limits.MaxCoolSetpoint = override.MaxCoolSetpoint
+	}
+	if override.AllowedModes != nil {
+		limits.AllowedModes = override.AllowedModes
+	}
+	if override.FreezeProtectBelow != nil {
+		limits.FreezeProtectBelow = override.FreezeProtectBelow
+	}
+	if override.FreezeProtectOff {
+		limits.FreezeProtectBelow = nil
+	}
+	return limits
+}
+
+// CheckSetpoint checks a heat or cool setpoint. It returns the value to
+// send, which differs from value when the policy clamps, or a *Violation
+// when the command must be rejected.
+func (e *Enforcer) CheckSetpoint(ctx context.Context, source storage.EventSource, deviceID int, kind string, value float64) (float64, error) {
+	limits := e.Limits(deviceID)
+
+	rule, min, max := RuleHeatLimit, bound(limits.MinHeatSetpoint), bound(limits.MaxHeatSetpoint)
+	if kind == "cool" {
+		rule, min, max = RuleCoolLimit, bound(limits.MinCoolSetpoint), bound(limits.MaxCoolSetpoint)
+	}
+
+	allowed := value
+	if min != 0 && allowed < min {
+		allowed = min
+	}
+	if max != 0 && allowed > max {
+		allowed = max
+	}
+	if allowed == value {
+		return value, nil
+	}
+
+	v := &Violation{DeviceID: deviceID, Rule: rule}
+	if e.action == ActionClamp {
+		v.Clamped = true
+		v.Message = fmt.Sprintf("%s setpoint %.1f°F outside allowed range %s, clamped to %.1f°F",
+			kind, value, describeRange(min, max), allowed)
+		e.report(ctx, source, v, map[string]interface{}{"requested": value, "applied": allowed})
+		return allowed, nil
+	}
+
+	v.Message = fmt.Sprintf("%s setpoint %.1f°F outside allowed range %s", kind, value, describeRange(min, max))
+	e.report(ctx, source, v, map[string]interface{}{"requested": value})
+	return value, v
+}
+
+// CheckMode checks a system mode change. Modes can't be clamped, so a
+// violation is always a rejection.
+func (e *Enforcer) CheckMode(ctx context.Context, source storage.EventSource, deviceID int, mode string) error {
+	limits := e.Limits(deviceID)
+
+	if len(limits.AllowedModes) > 0 && !contains(limits.AllowedModes, mode) {
+		v := &Violation{
+			DeviceID: deviceID,
+			Rule:     RuleModeNotAllowed,
+			Message:  fmt.Sprintf("mode %q is not allowed on this thermostat", mode),
+		}
+		e.report(ctx, source, v, map[string]interface{}{"requested": mode, "allowed_modes": limits.AllowedModes})
+		return v
+	}
+
+	if mode != "off" || limits.FreezeProtectBelow == nil {
+		return nil
+	}
+
+	// Without an outdoor reading it may be freezing, so refuse rather
+	// than risk it
+	outdoor, err := e.outdoorTemp(deviceID)
+	if err != nil || outdoor == nil {
+		if err != nil {
+			log.FromContext(ctx).Warn("Freeze protection: could not read polled state of device %d: %v", deviceID, err)
+		}
+		v := &Violation{
+			DeviceID: deviceID,
+			Rule:     RuleFreezeProtection,
+			Message: fmt.Sprintf("cannot turn system off: no outdoor temperature has been polled to check against %.0f°F",
+				*limits.FreezeProtectBelow),
+		}
+		e.report(ctx, source, v, map[string]interface{}{
+			"requested":            mode,
+			"freeze_protect_below": *limits.FreezeProtectBelow,
+		})
+		return v
+	}
+	if *outdoor < *limits.FreezeProtectBelow {
+		v := &Violation{
+			DeviceID: deviceID,
+			Rule:     RuleFreezeProtection,
+			Message: fmt.Sprintf("cannot turn system off while outdoor temperature %.0f°F is below %.0f°F",
+				*outdoor, *limits.FreezeProtectBelow),
+		}
+		e.report(ctx, source, v, map[string]interface{}{
+			"requested":            mode,
+			"outdoor_temp":         *outdoor,
+			"freeze_protect_below": *limits.FreezeProtectBelow,
+		})
+		return v
+	}
+	return nil
+}
+
+// CheckSettings checks a combined change such as a preset. Setpoints may
+// be clamped in the returned settings.
+func (e *Enforcer) CheckSettings(ctx context.Context, source storage.EventSource, deviceID int, settings tcc.Settings) (tcc.Settings, error) {
+	if settings.SystemMode != "" {
+		if err := e.CheckMode(ctx, source, deviceID, settings.SystemMode); err != nil {
+			return settings, err
+		}
+	}
+	if settings.HeatSetpoint != nil {
+		heat, err := e.CheckSetpoint(ctx, source, deviceID, "heat", *settings.HeatSetpoint)
+		if err != nil {
+			return settings, err
+		}
+		settings.HeatSetpoint = &heat
+	}
+	if settings.CoolSetpoint != nil {
+		cool, err := e.CheckSetpoint(ctx, source, deviceID, "cool", *settings.CoolSetpoint)
+		if err != nil {
+			return settings, err
+		}
+		settings.CoolSetpoint = &cool
+	}
+	return settings, nil
+}
+
+// outdoorTemp returns the outdoor temperature from the device's last
+// polled state, or nil if it has no outdoor sensor or was never polled
+func (e *Enforcer) outdoorTemp(deviceID int) (*float64, error) {
+	state, err := e.db.GetThermostatStateByDeviceID(deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state.OutdoorTemp, nil
+}
+
+// report logs a violation as an error event attributed to its source
+func (e *Enforcer) report(ctx context.Context, source storage.EventSource, v *Violation, details map[string]interface{}) {
+	log.FromContext(ctx).Warn("Policy violation from %s on device %d: %s", source, v.DeviceID, v.Message)
+
+	details["device_id"] = v.DeviceID
+	details["rule"] = v.Rule
+	details["source"] = source
+	details["clamped"] = v.Clamped
+	e.db.LogEventContext(ctx, source, storage.EventTypeError, "Policy: "+v.Message, details)
+}
+
+// bound returns a configured limit, with 0 meaning unbounded
+func bound(limit *float64) float64 {
+	if limit == nil {
+		return 0
+	}
+	return *limit
+}
+
+// describeRange formats a min/max pair where zero means unbounded
+func describeRange(min, max float64) string {
+	switch {
+	case min != 0 && max != 0:
+		return fmt.Sprintf("%.0f-%.0f°F", min, max)
+	case min != 0:
+		return fmt.Sprintf(">= %.0f°F", min)
+	case max != 0:
+		return fmt.Sprintf("<= %.0f°F", max)
+	default:
+		return "unbounded"
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
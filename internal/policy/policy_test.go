@@ -0,0 +1,155 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+func TestCheckModeFreezeProtection(t *testing.T) {
+	const deviceID = 1234
+	below := 40.0
+
+	tests := []struct {
+		name     string
+		mode     string
+		polled   bool     // the device has a saved state
+		outdoor  *float64 // outdoor temperature in that state
+		protect  *float64
+		wantRule string // empty when the mode change is allowed
+	}{
+		{name: "warm outside", mode: "off", polled: true, outdoor: f(55), protect: &below},
+		{name: "freezing outside", mode: "off", polled: true, outdoor: f(28), protect: &below, wantRule: RuleFreezeProtection},
+		{name: "no outdoor sensor", mode: "off", polled: true, protect: &below, wantRule: RuleFreezeProtection},
+		{name: "never polled", mode: "off", protect: &below, wantRule: RuleFreezeProtection},
+		{name: "protection disabled", mode: "off", polled: true, outdoor: f(28)},
+		{name: "other mode while freezing", mode: "heat", polled: true, outdoor: f(28), protect: &below},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storage.NewMemoryStore()
+			if tt.polled {
+				db.SaveThermostatState(&storage.ThermostatState{DeviceID: deviceID, OutdoorTemp: tt.outdoor})
+			}
+			cfg := &config.Config{PolicyDefaults: config.DeviceLimits{FreezeProtectBelow: tt.protect}}
+			guard, err := NewEnforcer(cfg, db)
+			if err != nil {
+				t.Fatalf("NewEnforcer() error = %v", err)
+			}
+
+			err = guard.CheckMode(context.Background(), storage.EventSourceUser, deviceID, tt.mode)
+			checkRule(t, "CheckMode("+tt.mode+")", err, tt.wantRule)
+		})
+	}
+}
+
+func f(v float64) *float64 { return &v }
+
+func TestDefaultConfigAllowsOffWithoutOutdoorReading(t *testing.T) {
+	guard, err := NewEnforcer(config.DefaultConfig(), storage.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("NewEnforcer() error = %v", err)
+	}
+
+	// Freeze protection is opt-in, so installs without an outdoor sensor
+	// can still turn the system off
+	if err := guard.CheckMode(context.Background(), storage.EventSourceUser, 1, "off"); err != nil {
+		t.Errorf("CheckMode(off) error = %v, want nil", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	const deviceID = 1234
+	defaults := config.DeviceLimits{
+		MinHeatSetpoint:    f(50),
+		MaxHeatSetpoint:    f(85),
+		AllowedModes:       []string{"heat", "off"},
+		FreezeProtectBelow: f(35),
+	}
+
+	tests := []struct {
+		name       string
+		override   *config.DeviceLimits
+		heat       float64
+		mode       string
+		wantHeat   string // rule that rejects the heat setpoint, if any
+		wantMode   string // rule that rejects the mode, if any
+		wantFreeze bool
+	}{
+		{
+			name: "defaults apply",
+			heat: 90, mode: "cool",
+			wantHeat: RuleHeatLimit, wantMode: RuleModeNotAllowed, wantFreeze: true,
+		},
+		{
+			name:     "unset fields inherit",
+			override: &config.DeviceLimits{MinHeatSetpoint: f(55)},
+			heat:     90, mode: "cool",
+			wantHeat: RuleHeatLimit, wantMode: RuleModeNotAllowed, wantFreeze: true,
+		},
+		{
+			name:     "override replaces a limit",
+			override: &config.DeviceLimits{MaxHeatSetpoint: f(95)},
+			heat:     90, mode: "heat",
+			wantFreeze: true,
+		},
+		{
+			name:     "zero removes a limit",
+			override: &config.DeviceLimits{MaxHeatSetpoint: f(0)},
+			heat:     90, mode: "heat",
+			wantFreeze: true,
+		},
+		{
+			name:     "empty mode list allows every mode",
+			override: &config.DeviceLimits{AllowedModes: []string{}},
+			heat:     70, mode: "cool",
+			wantFreeze: true,
+		},
+		{
+			name:     "freeze protection turned off",
+			override: &config.DeviceLimits{FreezeProtectOff: true},
+			heat:     70, mode: "heat",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{PolicyDefaults: defaults}
+			if tt.override != nil {
+				cfg.PolicyDevices = map[int]config.DeviceLimits{deviceID: *tt.override}
+			}
+			guard, err := NewEnforcer(cfg, storage.NewMemoryStore())
+			if err != nil {
+				t.Fatalf("NewEnforcer() error = %v", err)
+			}
+			ctx := context.Background()
+
+			_, err = guard.CheckSetpoint(ctx, storage.EventSourceUser, deviceID, "heat", tt.heat)
+			checkRule(t, "CheckSetpoint()", err, tt.wantHeat)
+			err = guard.CheckMode(ctx, storage.EventSourceUser, deviceID, tt.mode)
+			checkRule(t, "CheckMode()", err, tt.wantMode)
+
+			if got := guard.Limits(deviceID).FreezeProtectBelow != nil; got != tt.wantFreeze {
+				t.Errorf("Limits() freeze protection = %v, want %v", got, tt.wantFreeze)
+			}
+		})
+	}
+}
+
+// checkRule fails unless err is a violation of rule, or nil when rule is empty
+func checkRule(t *testing.T, call string, err error, rule string) {
+	t.Helper()
+	var v *Violation
+	switch {
+	case rule == "" && err != nil:
+		t.Errorf("%s error = %v, want nil", call, err)
+	case rule != "" && !errors.As(err, &v):
+		t.Errorf("%s error = %v, want a %s violation", call, err, rule)
+	case rule != "" && v.Rule != rule:
+		t.Errorf("%s rule = %s, want %s", call, v.Rule, rule)
+	}
+}
@@ -0,0 +1,290 @@
+package polling
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Mode describes why the scheduler chose the current interval
+type Mode string
+
+const (
+	ModeNormal  Mode = "normal"
+	ModeBoost   Mode = "boost"
+	ModeIdle    Mode = "idle"
+	ModeQuiet   Mode = "quiet"
+	ModeBackoff Mode = "backoff"
+)
+
+// Priority scales how often a device wants to be polled
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// factor returns the interval multiplier for a priority
+func (p Priority) factor() float64 {
+	switch p {
+	case PriorityHigh:
+		return 0.5
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Options configures the polling scheduler
+type Options struct {
+	BaseInterval  time.Duration // Normal polling interval
+	MinInterval   time.Duration // Floor that keeps us within TCC's request budget
+	BoostInterval time.Duration // Interval used right after a command
+	BoostWindow   time.Duration // How long to keep boosting after a command
+	IdleInterval  time.Duration // Interval used when nobody is using the bridge
+	IdleAfter     time.Duration // Inactivity before switching to the idle interval
+	QuietInterval time.Duration // Interval used during quiet hours
+	QuietStart    int           // Quiet hours start, minutes after local midnight (-1 disables)
+	QuietEnd      int           // Quiet hours end, minutes after local midnight
+	MaxBackoff    time.Duration // Upper bound for error backoff
+	Priorities    map[int]Priority
+}
+
+// Status is a snapshot of the scheduler state
+type Status struct {
+	Mode                Mode      `json:"mode"`
+	IntervalSeconds     int       `json:"interval_seconds"`
+	LastPoll            time.Time `json:"last_poll,omitempty"`
+	NextPoll            time.Time `json:"next_poll,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	BoostUntil          time.Time `json:"boost_until,omitempty"`
+}
+
+// Scheduler decides when the next TCC poll should run
+type Scheduler struct {
+	mu           sync.Mutex
+	opts         Options
+	lastPoll     time.Time
+	nextPoll     time.Time
+	mode         Mode
+	interval     time.Duration
+	failures     int
+	boostUntil   time.Time
+	lastActivity time.Time
+	devices      []int
+	activeProbe  func() bool
+	wake         chan struct{}
+}
+
+// NewScheduler creates a new polling scheduler
+func NewScheduler(opts Options) *Scheduler {
+	if opts.BaseInterval <= 0 {
+		opts.BaseInterval = 10 * time.Minute
+	}
+	if opts.MinInterval <= 0 {
+		opts.MinInterval = time.Minute
+	}
+	if opts.MaxBackoff < opts.BaseInterval {
+		opts.MaxBackoff = opts.BaseInterval
+	}
+
+	now := time.Now()
+	return &Scheduler{
+		opts:         opts,
+		nextPoll:     now,
+		mode:         ModeNormal,
+		interval:     opts.BaseInterval,
+		lastActivity: now,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// SetActivityProbe sets a function reporting whether someone is actively
+// watching the bridge (e.g. connected web UI clients)
+func (s *Scheduler) SetActivityProbe(probe func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activeProbe = probe
+}
+
+// NoteActivity records that someone used the web UI or HomeKit
+func (s *Scheduler) NoteActivity() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+}
+
+// NoteCommand records that a command was sent and starts a boost window
+func (s *Scheduler) NoteCommand() {
+	s.mu.Lock()
+	now := time.Now()
+	s.lastActivity = now
+	if s.opts.BoostWindow > 0 {
+		s.boostUntil = now.Add(s.opts.BoostWindow)
+		s.reschedule(now)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wake returns a channel signalled when the next poll time moved
+func (s *Scheduler) Wake() <-chan struct{} {
+	return s.wake
+}
+
+// Next returns when the next poll should run
+func (s *Scheduler) Next() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextPoll
+}
+
+// Done records the outcome of a poll and schedules the next one
+func (s *Scheduler) Done(deviceIDs []int, err error) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.lastPoll = now
+	if err != nil {
+		s.failures++
+	} else {
+		s.failures = 0
+		s.devices = append(s.devices[:0], deviceIDs...)
+	}
+
+	s.reschedule(now)
+	return s.nextPoll
+}
+
+// Status returns a snapshot of the scheduler state
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := Status{
+		Mode:                s.mode,
+		IntervalSeconds:     int(s.interval.Seconds()),
+		LastPoll:            s.lastPoll,
+		NextPoll:            s.nextPoll,
+		ConsecutiveFailures: s.failures,
+	}
+	if s.boostUntil.After(time.Now()) {
+		status.BoostUntil = s.boostUntil
+	}
+	return status
+}
+
+// reschedule recomputes the mode, interval and next poll time (caller holds mu)
+func (s *Scheduler) reschedule(now time.Time) {
+	s.mode, s.interval = s.pickInterval(now)
+
+	base := s.lastPoll
+	if base.IsZero() {
+		base = now
+	}
+	next := base.Add(s.interval)
+
+	// A boost should never postpone a poll that was already due sooner
+	if s.mode == ModeBoost && !s.nextPoll.IsZero() && s.nextPoll.Before(next) && s.nextPoll.After(now) {
+		next = s.nextPoll
+	}
+	s.nextPoll = next
+}
+
+// pickInterval selects the polling mode and interval for the given time
+func (s *Scheduler) pickInterval(now time.Time) (Mode, time.Duration) {
+	opts := s.opts
+
+	if s.failures > 0 {
+		backoff := opts.BaseInterval
+		for i := 1; i < s.failures && backoff < opts.MaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+		return ModeBackoff, s.floor(backoff)
+	}
+
+	if now.Before(s.boostUntil) && opts.BoostInterval > 0 {
+		return ModeBoost, s.floor(opts.BoostInterval)
+	}
+
+	mode, interval := ModeNormal, opts.BaseInterval
+	if opts.QuietInterval > 0 && inQuietHours(now, opts.QuietStart, opts.QuietEnd) {
+		mode, interval = ModeQuiet, opts.QuietInterval
+	} else if opts.IdleInterval > 0 && opts.IdleAfter > 0 && s.isIdle(now) {
+		mode, interval = ModeIdle, opts.IdleInterval
+	}
+
+	return mode, s.floor(time.Duration(float64(interval) * s.priorityFactor()))
+}
+
+// isIdle reports whether nobody has used the bridge recently (caller holds mu)
+func (s *Scheduler) isIdle(now time.Time) bool {
+	if s.activeProbe != nil && s.activeProbe() {
+		s.lastActivity = now
+		return false
+	}
+	return now.Sub(s.lastActivity) >= s.opts.IdleAfter
+}
+
+// priorityFactor returns the multiplier for the most urgent known device.
+// TCC returns every device from one request, so the highest priority
+// device sets the pace for all of them.
+func (s *Scheduler) priorityFactor() float64 {
+	if len(s.devices) == 0 || len(s.opts.Priorities) == 0 {
+		return 1
+	}
+
+	factor := 0.0
+	for _, id := range s.devices {
+		f := s.opts.Priorities[id].factor()
+		if factor == 0 || f < factor {
+			factor = f
+		}
+	}
+	return factor
+}
+
+// floor clamps an interval to the configured minimum
+func (s *Scheduler) floor(d time.Duration) time.Duration {
+	if d < s.opts.MinInterval {
+		return s.opts.MinInterval
+	}
+	return d
+}
+
+// inQuietHours reports whether now falls in the [start, end) window,
+// which may wrap past midnight
+func inQuietHours(now time.Time, start, end int) bool {
+	if start < 0 || end < 0 || start == end {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// ParseClock parses "HH:MM" into minutes after midnight.
+// An empty string returns -1 (disabled).
+func ParseClock(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return -1, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,139 @@
+package presets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// Default preset names
+const (
+	Home     = "Home"
+	Away     = "Away"
+	Sleep    = "Sleep"
+	Vacation = "Vacation"
+)
+
+var (
+	// ErrNotFound is returned when applying a preset that doesn't exist
+	ErrNotFound = errors.New("preset not found")
+	// ErrUnknownDevice is returned for a device TCC has never reported
+	ErrUnknownDevice = errors.New("device not found")
+)
+
+func f(v float64) *float64 { return &v }
+
+// Defaults are created for a device that has no presets yet
+var Defaults = []storage.Preset{
+	{Name: Home, HeatSetpoint: f(68), CoolSetpoint: f(76)},
+	{Name: Away, HeatSetpoint: f(62), CoolSetpoint: f(82)},
+	{Name: Sleep, HeatSetpoint: f(64), CoolSetpoint: f(78)},
+	{Name: Vacation, HeatSetpoint: f(55), CoolSetpoint: f(85)},
+}
+
+// validModes are the system modes a preset may set
+var validModes = map[string]bool{
+	"off":       true,
+	"heat":      true,
+	"cool":      true,
+	"auto":      true,
+	"emergency": true,
+}
+
+// Validate checks a preset before it is stored
+func Validate(p *storage.Preset) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if p.SystemMode == "" && p.HeatSetpoint == nil && p.CoolSetpoint == nil {
+		return fmt.Errorf("must set a mode or at least one setpoint")
+	}
+	if p.SystemMode != "" && !validModes[p.SystemMode] {
+		return fmt.Errorf("invalid mode %q", p.SystemMode)
+	}
+	if p.HeatSetpoint != nil && p.CoolSetpoint != nil && *p.HeatSetpoint > *p.CoolSetpoint {
+		return fmt.Errorf("heat setpoint must not exceed cool setpoint")
+	}
+	return nil
+}
+
+// List returns a device's presets, creating the defaults if it has none
+func List(db storage.Store, deviceID int) ([]storage.Preset, error) {
+	if _, err := db.GetThermostatStateByDeviceID(deviceID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %d", ErrUnknownDevice, deviceID)
+		}
+		return nil, err
+	}
+
+	presets, err := db.GetPresets(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(presets) > 0 {
+		return presets, nil
+	}
+
+	for _, p := range Defaults {
+		p.DeviceID = deviceID
+		if err := db.SavePreset(&p); err != nil {
+			return nil, err
+		}
+	}
+	return db.GetPresets(deviceID)
+}
+
+// Apply checks a preset against the command policy, sends it to TCC in one
+// control request and marks it active. The returned preset holds the values
+// actually sent, which differ from the stored ones if the policy clamped them.
+func Apply(ctx context.Context, db storage.Store, client *tcc.Client, guard *policy.Enforcer, source storage.EventSource, deviceID int, name string) (*storage.Preset, error) {
+	if _, err := List(db, deviceID); err != nil {
+		return nil, err
+	}
+
+	preset, err := db.GetPreset(deviceID, name)
+	if err != nil {
+		return nil, err
+	}
+	if preset == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+
+	settings, err := guard.CheckSettings(ctx, source, deviceID, tcc.Settings{
+		SystemMode:   preset.SystemMode,
+		HeatSetpoint: preset.HeatSetpoint,
+		CoolSetpoint: preset.CoolSetpoint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.ApplySettings(ctx, deviceID, settings); err != nil {
+		return nil, err
+	}
+	preset.HeatSetpoint = settings.HeatSetpoint
+	preset.CoolSetpoint = settings.CoolSetpoint
+
+	if err := db.SetActivePreset(deviceID, preset.Name); err != nil {
+		return preset, err
+	}
+
+	return preset, nil
+}
+
+// ToMatter converts stored presets to the form sent to the Matter bridge
+func ToMatter(list []storage.Preset) []matter.Preset {
+	out := make([]matter.Preset, 0, len(list))
+	for _, p := range list {
+		out = append(out, matter.NewPreset(p.Name, p.SystemMode, p.HeatSetpoint, p.CoolSetpoint))
+	}
+	return out
+}
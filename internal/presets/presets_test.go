@@ -0,0 +1,85 @@
+package presets
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+func TestList(t *testing.T) {
+	const deviceID = 1234
+
+	tests := []struct {
+		name      string
+		known     bool // TCC has reported the device
+		saved     []storage.Preset
+		wantNames []string
+		wantErr   error
+	}{
+		{
+			name:    "unknown device",
+			wantErr: ErrUnknownDevice,
+		},
+		{
+			name:      "known device without presets gets the defaults",
+			known:     true,
+			wantNames: []string{Home, Away, Sleep, Vacation},
+		},
+		{
+			name:      "known device keeps its own presets",
+			known:     true,
+			saved:     []storage.Preset{{Name: "Guests", HeatSetpoint: f(70)}},
+			wantNames: []string{"Guests"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storage.NewMemoryStore()
+			if tt.known {
+				db.SaveThermostatState(&storage.ThermostatState{DeviceID: deviceID})
+			}
+			for _, p := range tt.saved {
+				p.DeviceID = deviceID
+				db.SavePreset(&p)
+			}
+
+			got, err := List(db, deviceID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("List() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.wantNames) {
+				t.Fatalf("List() = %d presets, want %d: %+v", len(got), len(tt.wantNames), got)
+			}
+			for i, p := range got {
+				if p.Name != tt.wantNames[i] || p.DeviceID != deviceID {
+					t.Errorf("List()[%d] = %q on device %d, want %q on device %d",
+						i, p.Name, p.DeviceID, tt.wantNames[i], deviceID)
+				}
+			}
+
+			// Nothing may be created for a device that doesn't exist
+			if stored, _ := db.GetPresets(deviceID); !tt.known && len(stored) > 0 {
+				t.Errorf("List() stored %d presets for an unknown device", len(stored))
+			}
+		})
+	}
+}
+
+func TestListIsIdempotent(t *testing.T) {
+	db := storage.NewMemoryStore()
+	db.SaveThermostatState(&storage.ThermostatState{DeviceID: 1})
+
+	first, err := List(db, 1)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	second, err := List(db, 1)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(second) != len(first) {
+		t.Errorf("second List() = %d presets, want %d", len(second), len(first))
+	}
+}
@@ -0,0 +1,215 @@
+package provenance
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// Field identifies a thermostat setting changed by a command
+type Field string
+
+const (
+	FieldHeatSetpoint Field = "heat_setpoint"
+	FieldCoolSetpoint Field = "cool_setpoint"
+	FieldSystemMode   Field = "system_mode"
+)
+
+// Class describes where a polled change came from
+type Class string
+
+const (
+	ClassEcho     Class = "echo"
+	ClassExternal Class = "external_edit"
+	ClassSchedule Class = "schedule_transition"
+)
+
+// Policy decides who wins when the wall unit overrides a recent bridge command
+type Policy string
+
+const (
+	PolicyWallWins   Policy = "wall_wins"
+	PolicyBridgeWins Policy = "bridge_wins"
+)
+
+// ParsePolicy converts a config string to a Policy
+func ParsePolicy(s string) (Policy, error) {
+	switch Policy(s) {
+	case "", PolicyWallWins:
+		return PolicyWallWins, nil
+	case PolicyBridgeWins:
+		return PolicyBridgeWins, nil
+	default:
+		return "", fmt.Errorf("invalid conflict policy %q", s)
+	}
+}
+
+// setpointEpsilon is how close a polled setpoint must be to count as an echo
+const setpointEpsilon = 0.05
+
+// Command is a change the bridge asked TCC to make
+type Command struct {
+	DeviceID int                 `json:"device_id"`
+	Field    Field               `json:"field"`
+	Setpoint float64             `json:"setpoint,omitempty"`
+	Mode     string              `json:"mode,omitempty"`
+	Source   storage.EventSource `json:"source"`
+	IssuedAt time.Time           `json:"issued_at"`
+}
+
+// matches reports whether a polled value is the one this command requested
+func (c Command) matches(setpoint float64, mode string) bool {
+	if c.Field == FieldSystemMode {
+		return c.Mode == mode
+	}
+	return math.Abs(c.Setpoint-setpoint) < setpointEpsilon
+}
+
+// Result is the classification of a polled change
+type Result struct {
+	Class Class
+	// Conflict is set when an external edit overrode a pending bridge command
+	Conflict bool
+	// Command is the pending bridge command involved, if any
+	Command *Command
+}
+
+// Describe returns a short human-readable description of the result
+func (r Result) Describe() string {
+	switch {
+	case r.Class == ClassEcho && r.Command != nil:
+		return fmt.Sprintf("echo of %s command", r.Command.Source)
+	case r.Conflict:
+		return fmt.Sprintf("external edit overriding %s command", r.Command.Source)
+	case r.Class == ClassSchedule:
+		return "schedule transition"
+	default:
+		return "external edit"
+	}
+}
+
+type key struct {
+	deviceID int
+	field    Field
+}
+
+// Tracker remembers bridge-issued commands so polled changes can be
+// attributed to the bridge, the wall unit or the TCC schedule
+type Tracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[key]Command
+}
+
+// NewTracker creates a tracker that keeps commands pending for window
+func NewTracker(window time.Duration) *Tracker {
+	return &Tracker{
+		window:  window,
+		pending: make(map[key]Command),
+	}
+}
+
+// Record remembers a command sent to TCC. A newer command for the same
+// device and field replaces the older one.
+func (t *Tracker) Record(cmd Command) {
+	if cmd.IssuedAt.IsZero() {
+		cmd.IssuedAt = time.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[key{cmd.DeviceID, cmd.Field}] = cmd
+}
+
+// RecordSetpoint is a convenience wrapper for setpoint commands
+func (t *Tracker) RecordSetpoint(deviceID int, field Field, value float64, source storage.EventSource) {
+	t.Record(Command{DeviceID: deviceID, Field: field, Setpoint: value, Source: source})
+}
+
+// RecordMode is a convenience wrapper for system mode commands
+func (t *Tracker) RecordMode(deviceID int, mode string, source storage.EventSource) {
+	t.Record(Command{DeviceID: deviceID, Field: FieldSystemMode, Mode: mode, Source: source})
+}
+
+// Confirm drops a device's pending commands that a read straight after
+// sending them shows TCC has applied. That read is saved as the device's
+// state, so the next poll sees no change and would never clear them;
+// left pending, they would turn a later wall edit into a conflict.
+func (t *Tracker) Confirm(deviceID int, heatSetpoint, coolSetpoint float64, mode string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, field := range []Field{FieldHeatSetpoint, FieldCoolSetpoint, FieldSystemMode} {
+		k := key{deviceID, field}
+		cmd, ok := t.pending[k]
+		if !ok {
+			continue
+		}
+		setpoint := heatSetpoint
+		if field == FieldCoolSetpoint {
+			setpoint = coolSetpoint
+		}
+		if cmd.matches(setpoint, mode) {
+			delete(t.pending, k)
+		}
+	}
+}
+
+// ClassifySetpoint classifies a polled setpoint change. scheduled should be
+// true when TCC reports the thermostat is following its own schedule.
+func (t *Tracker) ClassifySetpoint(deviceID int, field Field, value float64, scheduled bool) Result {
+	return t.classify(key{deviceID, field}, value, "", scheduled)
+}
+
+// ClassifyMode classifies a polled system mode change. The TCC schedule
+// never changes the mode, so anything unexplained is an external edit.
+func (t *Tracker) ClassifyMode(deviceID int, mode string) Result {
+	return t.classify(key{deviceID, FieldSystemMode}, 0, mode, false)
+}
+
+// Pending returns the commands still waiting to be seen in a poll
+func (t *Tracker) Pending() []Command {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(time.Now())
+	cmds := make([]Command, 0, len(t.pending))
+	for _, cmd := range t.pending {
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+func (t *Tracker) classify(k key, setpoint float64, mode string, scheduled bool) Result {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(time.Now())
+
+	cmd, ok := t.pending[k]
+	if ok {
+		delete(t.pending, k)
+		if cmd.matches(setpoint, mode) {
+			return Result{Class: ClassEcho, Command: &cmd}
+		}
+		// Someone changed the value after we did
+		return Result{Class: ClassExternal, Conflict: true, Command: &cmd}
+	}
+
+	if scheduled {
+		return Result{Class: ClassSchedule}
+	}
+	return Result{Class: ClassExternal}
+}
+
+// expire drops commands older than the tracking window (caller holds mu)
+func (t *Tracker) expire(now time.Time) {
+	for k, cmd := range t.pending {
+		if now.Sub(cmd.IssuedAt) > t.window {
+			delete(t.pending, k)
+		}
+	}
+}
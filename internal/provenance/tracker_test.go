@@ -0,0 +1,89 @@
+package provenance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// readBack is the state read from TCC straight after a command
+type readBack struct {
+	heat, cool float64
+	mode       string
+}
+
+func TestTrackerConfirm(t *testing.T) {
+	const deviceID = 1234
+
+	tests := []struct {
+		name     string
+		verified *readBack // nil when the read failed
+		// polled is the heat setpoint the next poll sees changed to
+		polled       float64
+		wantClass    Class
+		wantConflict bool
+	}{
+		{
+			name:      "confirmed command then wall edit",
+			verified:  &readBack{70, 76, "heat"},
+			polled:    66,
+			wantClass: ClassExternal,
+		},
+		{
+			name:      "command not applied yet then echo",
+			verified:  &readBack{68, 76, "heat"},
+			polled:    70,
+			wantClass: ClassEcho,
+		},
+		{
+			name:      "no verified read then echo",
+			polled:    70,
+			wantClass: ClassEcho,
+		},
+		{
+			name:         "no verified read then wall edit",
+			polled:       66,
+			wantClass:    ClassExternal,
+			wantConflict: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewTracker(15 * time.Minute)
+			tracker.RecordSetpoint(deviceID, FieldHeatSetpoint, 70, storage.EventSourceHomeKit)
+			if tt.verified != nil {
+				tracker.Confirm(deviceID, tt.verified.heat, tt.verified.cool, tt.verified.mode)
+			}
+
+			// A poll that matches the saved state classifies nothing; the
+			// next change is the one under test
+			got := tracker.ClassifySetpoint(deviceID, FieldHeatSetpoint, tt.polled, false)
+			if got.Class != tt.wantClass || got.Conflict != tt.wantConflict {
+				t.Errorf("ClassifySetpoint() = %s (conflict %v), want %s (conflict %v)",
+					got.Class, got.Conflict, tt.wantClass, tt.wantConflict)
+			}
+		})
+	}
+}
+
+func TestTrackerConfirmLeavesOtherFields(t *testing.T) {
+	tracker := NewTracker(15 * time.Minute)
+	tracker.RecordSetpoint(1, FieldHeatSetpoint, 70, storage.EventSourceUser)
+	tracker.RecordMode(1, "cool", storage.EventSourceUser)
+	tracker.RecordSetpoint(2, FieldHeatSetpoint, 70, storage.EventSourceUser)
+
+	// Only the heat setpoint has been applied on device 1
+	tracker.Confirm(1, 70, 76, "heat")
+
+	pending := tracker.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("Pending() = %d commands, want 2: %+v", len(pending), pending)
+	}
+	for _, cmd := range pending {
+		if cmd.DeviceID == 1 && cmd.Field != FieldSystemMode {
+			t.Errorf("Confirm() kept %s on device 1", cmd.Field)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// VacuumMode selects how freed database pages are returned to the filesystem
+type VacuumMode string
+
+const (
+	VacuumOff         VacuumMode = ""
+	VacuumIncremental VacuumMode = "incremental"
+	VacuumFull        VacuumMode = "full"
+)
+
+// Options configures the retention job
+type Options struct {
+	MaxAge         time.Duration // Events not matched by a rule, zero keeps forever
+	Rules          []Rule
+	MaxRows        int // Zero is unlimited
+	Interval       time.Duration
+	Vacuum         VacuumMode
+	VacuumInterval time.Duration
+}
+
+// Rule sets the maximum age for events matching a source and/or type
+type Rule struct {
+	Match  storage.EventLogMatch
+	MaxAge time.Duration // Zero keeps matching events forever
+}
+
+// specificity ranks rules so that source+type beats either alone
+func (r Rule) specificity() int {
+	n := 0
+	if r.Match.Source != "" {
+		n++
+	}
+	if r.Match.EventType != "" {
+		n++
+	}
+	return n
+}
+
+// Status reports the outcome of pruning runs
+type Status struct {
+	LastRun      *time.Time      `json:"last_run,omitempty"`
+	LastPruned   int64           `json:"last_pruned"`
+	TotalPruned  int64           `json:"total_pruned"`
+	EventLogRows int64           `json:"event_log_rows"`
+	DatabaseSize *storage.DBSize `json:"database_size,omitempty"`
+	LastVacuum   *time.Time      `json:"last_vacuum,omitempty"`
+	VacuumMode   VacuumMode      `json:"vacuum_mode,omitempty"`
+	LastRunError string          `json:"last_run_error,omitempty"`
+}
+
+// fileStore is a Store kept in a database file, which can report its size
+// and be vacuumed
+type fileStore interface {
+	Size() (*storage.DBSize, error)
+	Vacuum() error
+	EnableIncrementalVacuum() (bool, error)
+	IncrementalVacuum() error
+}
+
+// Job prunes the event log and keeps the database file compact
+type Job struct {
+	db         storage.Store
+	file       fileStore // Nil if db is not kept in a file
+	opts       Options
+	nextVacuum time.Time
+
+	mu     sync.Mutex
+	status Status
+}
+
+// OptionsFromConfig builds retention options from the service configuration
+func OptionsFromConfig(cfg *config.Config) Options {
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+
+	opts := Options{
+		MaxAge:         days(cfg.EventLogMaxAgeDays),
+		MaxRows:        cfg.EventLogMaxRows,
+		Interval:       time.Duration(cfg.EventLogPruneInterval) * time.Second,
+		Vacuum:         VacuumMode(cfg.EventLogVacuum),
+		VacuumInterval: time.Duration(cfg.EventLogVacuumInterval) * time.Second,
+	}
+	for _, r := range cfg.EventLogRules {
+		opts.Rules = append(opts.Rules, Rule{
+			Match: storage.EventLogMatch{
+				Source:    storage.EventSource(r.Source),
+				EventType: storage.EventType(r.EventType),
+			},
+			MaxAge: days(r.MaxAgeDays),
+		})
+	}
+	return opts
+}
+
+// New creates a retention job
+func New(db storage.Store, opts Options) (*Job, error) {
+	file, _ := db.(fileStore)
+	switch opts.Vacuum {
+	case VacuumOff:
+	case VacuumIncremental, VacuumFull:
+		if file == nil {
+			return nil, fmt.Errorf("vacuum mode %q needs a database file", opts.Vacuum)
+		}
+	default:
+		return nil, fmt.Errorf("invalid vacuum mode %q", opts.Vacuum)
+	}
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("prune interval must be positive")
+	}
+	if opts.MaxRows < 0 {
+		return nil, fmt.Errorf("max rows must not be negative")
+	}
+	for _, r := range opts.Rules {
+		if r.specificity() == 0 {
+			return nil, fmt.Errorf("rule needs a source or event type")
+		}
+		if r.MaxAge < 0 {
+			return nil, fmt.Errorf("rule max age must not be negative")
+		}
+	}
+
+	// Most specific rules first; stable so config order breaks ties
+	rules := append([]Rule(nil), opts.Rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].specificity() > rules[j].specificity()
+	})
+	opts.Rules = rules
+
+	return &Job{
+		db:     db,
+		file:   file,
+		opts:   opts,
+		status: Status{VacuumMode: opts.Vacuum},
+	}, nil
+}
+
+// Status returns the outcome of the latest runs
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Run prunes on the configured interval until ctx is cancelled
+func (j *Job) Run(ctx context.Context) {
+	log.Info("Starting event log retention (every %s)", j.opts.Interval)
+
+	if j.opts.Vacuum == VacuumIncremental {
+		switched, err := j.file.EnableIncrementalVacuum()
+		if err != nil {
+			log.Error("%v", err)
+		} else if switched {
+			log.Info("Switched database to incremental auto-vacuum")
+		}
+	}
+	// A full VACUUM rewrites the whole file, so don't run one on every start
+	if j.opts.Vacuum == VacuumFull {
+		j.nextVacuum = time.Now().Add(j.opts.VacuumInterval)
+	}
+
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		j.run(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run applies the age rules and row limit, then vacuums if one is due
+func (j *Job) run(now time.Time) {
+	var byAge, byRows int64
+	var runErr error
+
+	// Each rule skips events that a more specific rule already covers
+	var covered []storage.EventLogMatch
+	for _, r := range j.opts.Rules {
+		if r.MaxAge > 0 {
+			n, err := j.db.PruneEventLogsMatching(r.Match, now.Add(-r.MaxAge), covered)
+			if err != nil {
+				runErr = err
+			}
+			byAge += n
+		}
+		covered = append(covered, r.Match)
+	}
+	if j.opts.MaxAge > 0 {
+		n, err := j.db.PruneEventLogsMatching(storage.EventLogMatch{}, now.Add(-j.opts.MaxAge), covered)
+		if err != nil {
+			runErr = err
+		}
+		byAge += n
+	}
+	if j.opts.MaxRows > 0 {
+		n, err := j.db.TrimEventLogs(j.opts.MaxRows)
+		if err != nil {
+			runErr = err
+		}
+		byRows += n
+	}
+
+	vacuumed := j.vacuumIfDue(now)
+
+	rows, err := j.db.CountEventLogs()
+	if err != nil {
+		runErr = err
+	}
+	var size *storage.DBSize
+	if j.file != nil {
+		if size, err = j.file.Size(); err != nil {
+			runErr = err
+		}
+	}
+
+	j.mu.Lock()
+	j.status.LastRun = &now
+	j.status.LastPruned = byAge + byRows
+	j.status.TotalPruned += byAge + byRows
+	j.status.EventLogRows = rows
+	j.status.DatabaseSize = size
+	j.status.LastRunError = ""
+	if runErr != nil {
+		j.status.LastRunError = runErr.Error()
+	}
+	if vacuumed {
+		j.status.LastVacuum = &now
+	}
+	j.mu.Unlock()
+
+	if runErr != nil {
+		log.Error("Event log retention: %v", runErr)
+	}
+
+	var sizeBytes int64
+	message := fmt.Sprintf("Event log retention: pruned %d rows (%d by age, %d over row limit), %d rows kept",
+		byAge+byRows, byAge, byRows, rows)
+	if size != nil {
+		sizeBytes = size.Bytes
+		message += fmt.Sprintf(", database %.1f MB", float64(sizeBytes)/(1024*1024))
+	}
+	log.Info("%s", message)
+	if byAge+byRows > 0 {
+		j.db.LogEvent(storage.EventSourceSystem, storage.EventTypeInfo, message, map[string]interface{}{
+			"pruned_by_age":  byAge,
+			"pruned_by_rows": byRows,
+			"rows":           rows,
+			"database_bytes": sizeBytes,
+			"vacuumed":       vacuumed,
+		})
+	}
+}
+
+// vacuumIfDue reclaims free pages when the vacuum interval has passed
+func (j *Job) vacuumIfDue(now time.Time) bool {
+	if j.opts.Vacuum == VacuumOff || now.Before(j.nextVacuum) {
+		return false
+	}
+	j.nextVacuum = now.Add(j.opts.VacuumInterval)
+
+	var err error
+	if j.opts.Vacuum == VacuumFull {
+		err = j.file.Vacuum()
+	} else {
+		err = j.file.IncrementalVacuum()
+	}
+	if err != nil {
+		log.Error("%v", err)
+		return false
+	}
+	return true
+}
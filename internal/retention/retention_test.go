@@ -0,0 +1,114 @@
+package retention
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+func TestRunRuleMatching(t *testing.T) {
+	const day = 24 * time.Hour
+
+	// One event per source and type; the message names both
+	events := []storage.EventLogMatch{
+		{Source: storage.EventSourceSystem, EventType: storage.EventTypeInfo},
+		{Source: storage.EventSourceSystem, EventType: storage.EventTypeError},
+		{Source: storage.EventSourceUser, EventType: storage.EventTypeInfo},
+		{Source: storage.EventSourceUser, EventType: storage.EventTypeError},
+	}
+	rule := func(source storage.EventSource, eventType storage.EventType, maxAge time.Duration) Rule {
+		return Rule{Match: storage.EventLogMatch{Source: source, EventType: eventType}, MaxAge: maxAge}
+	}
+
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		rules  []Rule
+		want   []string // events left after a run ten days later
+	}{
+		{
+			name:   "default age only",
+			maxAge: 5 * day,
+			want:   nil,
+		},
+		{
+			name: "nothing expires without an age",
+			want: []string{"system/error", "system/info", "user/error", "user/info"},
+		},
+		{
+			name:   "source rule keeps its events longer",
+			maxAge: 5 * day,
+			rules:  []Rule{rule(storage.EventSourceUser, "", 30*day)},
+			want:   []string{"user/error", "user/info"},
+		},
+		{
+			name:   "type rule with zero age keeps its events forever",
+			maxAge: 5 * day,
+			rules:  []Rule{rule("", storage.EventTypeError, 0)},
+			want:   []string{"system/error", "user/error"},
+		},
+		{
+			name: "source and type beats either alone, whatever the order",
+			rules: []Rule{
+				rule(storage.EventSourceSystem, "", 30*day),
+				rule(storage.EventSourceSystem, storage.EventTypeInfo, 5*day),
+			},
+			want: []string{"system/error", "user/error", "user/info"},
+		},
+		{
+			name: "equally specific rules apply in config order",
+			rules: []Rule{
+				rule("", storage.EventTypeError, 30*day),
+				rule(storage.EventSourceSystem, "", 5*day),
+			},
+			want: []string{"system/error", "user/error", "user/info"},
+		},
+		{
+			name:   "events under a rule skip the default age",
+			maxAge: 5 * day,
+			rules:  []Rule{rule(storage.EventSourceSystem, storage.EventTypeError, 30*day)},
+			want:   []string{"system/error"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storage.NewMemoryStore()
+			for _, e := range events {
+				db.LogEvent(e.Source, e.EventType, string(e.Source)+"/"+string(e.EventType), nil)
+			}
+
+			job, err := New(db, Options{MaxAge: tt.maxAge, Rules: tt.rules, Interval: time.Hour})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			job.run(time.Now().Add(10 * day))
+
+			logs, err := db.GetEventLogs(storage.EventLogFilter{})
+			if err != nil {
+				t.Fatalf("GetEventLogs() error = %v", err)
+			}
+			var got []string
+			for _, e := range logs {
+				// Skip the job's own summary
+				if !strings.HasPrefix(e.Message, "Event log retention") {
+					got = append(got, e.Message)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRejectsRuleWithoutMatch(t *testing.T) {
+	_, err := New(nil, Options{Interval: time.Hour, Rules: []Rule{{MaxAge: time.Hour}}})
+	if err == nil {
+		t.Error("New() accepted a rule matching every event")
+	}
+}
@@ -0,0 +1,193 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
+)
+
+// checkInterval is how often schedules are evaluated
+const checkInterval = time.Minute
+
+// AppliedHandler is called after a scheduled change was sent to TCC
+type AppliedHandler func(ctx context.Context, sched *storage.Schedule, target *Target)
+
+// Engine runs stored schedules against TCC
+type Engine struct {
+	db        storage.Store
+	tccClient *tcc.Client
+	guard     *policy.Enforcer
+	onApplied AppliedHandler
+	wake      chan struct{}
+}
+
+// NewEngine creates a new schedule engine
+func NewEngine(db storage.Store, tccClient *tcc.Client, guard *policy.Enforcer) *Engine {
+	return &Engine{
+		db:        db,
+		tccClient: tccClient,
+		guard:     guard,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// SetAppliedHandler sets a callback for successfully applied changes
+func (e *Engine) SetAppliedHandler(handler AppliedHandler) {
+	e.onApplied = handler
+}
+
+// Reload asks the engine to re-evaluate schedules immediately
+func (e *Engine) Reload() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run evaluates schedules until ctx is cancelled
+func (e *Engine) Run(ctx context.Context) {
+	log.Info("Starting schedule engine")
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		e.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+	}
+}
+
+// check applies any schedule whose target changed since it was last applied
+func (e *Engine) check(ctx context.Context) {
+	schedules, err := e.db.GetSchedules(0)
+	if err != nil {
+		log.Error("Failed to load schedules: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range schedules {
+		sched := &schedules[i]
+		if !sched.Enabled {
+			continue
+		}
+
+		target, err := Evaluate(sched, now)
+		if err != nil {
+			log.Warn("Failed to evaluate schedule %d (%s): %v", sched.ID, sched.Name, err)
+			continue
+		}
+		if target == nil || target.Key == sched.LastAppliedKey {
+			continue
+		}
+		ctx := log.WithCorrelationID(ctx, log.NewCorrelationID())
+
+		if target.Skip {
+			log.FromContext(ctx).Info("Schedule %q: skipping scheduled changes (%s)", sched.Name, target.Description)
+			e.db.LogEventContext(ctx, storage.EventSourceSchedule, storage.EventTypeSchedule,
+				fmt.Sprintf("Schedule %q skipped (%s)", sched.Name, target.Description),
+				map[string]interface{}{
+					"schedule_id": sched.ID,
+					"device_id":   sched.DeviceID,
+					"key":         target.Key,
+				})
+			e.db.MarkScheduleApplied(sched.ID, target.Key)
+			continue
+		}
+
+		if err := e.apply(ctx, sched, target); err != nil {
+			var violation *policy.Violation
+			if errors.As(err, &violation) {
+				// Already logged by the enforcer; retrying won't help
+				log.FromContext(ctx).Warn("Schedule %q: %s blocked by policy", sched.Name, target.Description)
+				e.db.MarkScheduleApplied(sched.ID, target.Key)
+				continue
+			}
+			log.FromContext(ctx).Error("Schedule %q failed to apply %s: %v", sched.Name, target.Description, err)
+			e.db.LogEventContext(ctx, storage.EventSourceSchedule, storage.EventTypeError,
+				fmt.Sprintf("Schedule %q failed to apply %s: %v", sched.Name, target.Description, err),
+				map[string]interface{}{
+					"schedule_id": sched.ID,
+					"device_id":   sched.DeviceID,
+					"key":         target.Key,
+					"error":       err.Error(),
+				})
+			// Leave the key unmarked so the next check retries
+			continue
+		}
+
+		if err := e.db.MarkScheduleApplied(sched.ID, target.Key); err != nil {
+			log.FromContext(ctx).Error("%v", err)
+		}
+	}
+}
+
+// apply sends a schedule target to TCC and logs each change
+func (e *Engine) apply(ctx context.Context, sched *storage.Schedule, target *Target) error {
+	var changes []string
+
+	settings, err := e.guard.CheckSettings(ctx, storage.EventSourceSchedule, sched.DeviceID, tcc.Settings{
+		SystemMode:   target.SystemMode,
+		HeatSetpoint: target.HeatSetpoint,
+		CoolSetpoint: target.CoolSetpoint,
+	})
+	if err != nil {
+		return err
+	}
+	// Clamping may have adjusted the setpoints
+	applied := *target
+	applied.HeatSetpoint = settings.HeatSetpoint
+	applied.CoolSetpoint = settings.CoolSetpoint
+	target = &applied
+
+	if target.SystemMode != "" {
+		if err := e.tccClient.SetSystemMode(ctx, sched.DeviceID, target.SystemMode); err != nil {
+			return fmt.Errorf("set mode: %w", err)
+		}
+		changes = append(changes, "mode="+target.SystemMode)
+	}
+	if target.HeatSetpoint != nil {
+		if err := e.tccClient.SetHeatSetpoint(ctx, sched.DeviceID, *target.HeatSetpoint); err != nil {
+			return fmt.Errorf("set heat setpoint: %w", err)
+		}
+		changes = append(changes, fmt.Sprintf("heat=%.1f°F", *target.HeatSetpoint))
+	}
+	if target.CoolSetpoint != nil {
+		if err := e.tccClient.SetCoolSetpoint(ctx, sched.DeviceID, *target.CoolSetpoint); err != nil {
+			return fmt.Errorf("set cool setpoint: %w", err)
+		}
+		changes = append(changes, fmt.Sprintf("cool=%.1f°F", *target.CoolSetpoint))
+	}
+
+	log.FromContext(ctx).Info("Schedule %q applied %s: %s", sched.Name, target.Description, strings.Join(changes, ", "))
+	e.db.LogEventContext(ctx, storage.EventSourceSchedule, storage.EventTypeSchedule,
+		fmt.Sprintf("Schedule %q applied %s: %s", sched.Name, target.Description, strings.Join(changes, ", ")),
+		map[string]interface{}{
+			"schedule_id":   sched.ID,
+			"device_id":     sched.DeviceID,
+			"key":           target.Key,
+			"since":         target.Since,
+			"system_mode":   target.SystemMode,
+			"heat_setpoint": target.HeatSetpoint,
+			"cool_setpoint": target.CoolSetpoint,
+		})
+
+	if e.onApplied != nil {
+		e.onApplied(ctx, sched, target)
+	}
+
+	return nil
+}
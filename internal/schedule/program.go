@@ -0,0 +1,231 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// weekdays maps day names used in schedules to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// validModes are the system modes a schedule may set
+var validModes = map[string]bool{
+	"off":       true,
+	"heat":      true,
+	"cool":      true,
+	"auto":      true,
+	"emergency": true,
+}
+
+// Target is the mode and setpoints a schedule wants at a point in time
+type Target struct {
+	Key          string    `json:"key"`
+	Description  string    `json:"description"`
+	Skip         bool      `json:"skip,omitempty"`
+	SystemMode   string    `json:"system_mode,omitempty"`
+	HeatSetpoint *float64  `json:"heat_setpoint,omitempty"`
+	CoolSetpoint *float64  `json:"cool_setpoint,omitempty"`
+	Since        time.Time `json:"since"`
+}
+
+// Validate checks a schedule for errors before it is stored
+func Validate(sched *storage.Schedule) error {
+	if sched.DeviceID <= 0 {
+		return fmt.Errorf("device_id is required")
+	}
+	if strings.TrimSpace(sched.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if sched.Timezone == "" {
+		sched.Timezone = "Local"
+	}
+	if _, err := time.LoadLocation(sched.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", sched.Timezone)
+	}
+	if len(sched.Periods) == 0 {
+		return fmt.Errorf("at least one period is required")
+	}
+
+	for i, p := range sched.Periods {
+		if len(p.Days) == 0 {
+			return fmt.Errorf("period %d: days are required", i+1)
+		}
+		for _, d := range p.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("period %d: invalid day %q", i+1, d)
+			}
+		}
+		if _, err := parseClock(p.Start); err != nil {
+			return fmt.Errorf("period %d: %w", i+1, err)
+		}
+		if err := validateSettings(p.SystemMode, p.HeatSetpoint, p.CoolSetpoint); err != nil {
+			return fmt.Errorf("period %d: %w", i+1, err)
+		}
+	}
+
+	for i, e := range sched.Exceptions {
+		if _, err := time.Parse("2006-01-02", e.Date); err != nil {
+			return fmt.Errorf("exception %d: invalid date %q", i+1, e.Date)
+		}
+		start, end := 0, 24*60
+		var err error
+		if e.Start != "" {
+			if start, err = parseClock(e.Start); err != nil {
+				return fmt.Errorf("exception %d: %w", i+1, err)
+			}
+		}
+		if e.End != "" {
+			if end, err = parseClock(e.End); err != nil {
+				return fmt.Errorf("exception %d: %w", i+1, err)
+			}
+		}
+		if end <= start {
+			return fmt.Errorf("exception %d: end must be after start", i+1)
+		}
+		if e.Skip {
+			continue
+		}
+		if err := validateSettings(e.SystemMode, e.HeatSetpoint, e.CoolSetpoint); err != nil {
+			return fmt.Errorf("exception %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// validateSettings checks the mode and setpoints of a period or exception
+func validateSettings(mode string, heat, cool *float64) error {
+	if mode == "" && heat == nil && cool == nil {
+		return fmt.Errorf("must set a mode or at least one setpoint")
+	}
+	if mode != "" && !validModes[mode] {
+		return fmt.Errorf("invalid mode %q", mode)
+	}
+	if heat != nil && (*heat < 40 || *heat > 90) {
+		return fmt.Errorf("heat setpoint %.1f°F out of range", *heat)
+	}
+	if cool != nil && (*cool < 50 || *cool > 99) {
+		return fmt.Errorf("cool setpoint %.1f°F out of range", *cool)
+	}
+	if heat != nil && cool != nil && *heat > *cool {
+		return fmt.Errorf("heat setpoint must not exceed cool setpoint")
+	}
+	return nil
+}
+
+// Evaluate returns what the schedule wants at time now. Wall-clock times are
+// interpreted in the schedule timezone, so DST changes shift the instants
+// rather than the local times.
+func Evaluate(sched *storage.Schedule, now time.Time) (*Target, error) {
+	loc, err := time.LoadLocation(sched.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", sched.Timezone, err)
+	}
+	local := now.In(loc)
+
+	// One-off exceptions take precedence over the weekly program
+	for i, e := range sched.Exceptions {
+		start, end, err := exceptionWindow(e, loc)
+		if err != nil {
+			return nil, err
+		}
+		if local.Before(start) || !local.Before(end) {
+			continue
+		}
+		return &Target{
+			Key:          fmt.Sprintf("exception:%d:%d", i, start.Unix()),
+			Description:  fmt.Sprintf("exception on %s", e.Date),
+			Skip:         e.Skip,
+			SystemMode:   e.SystemMode,
+			HeatSetpoint: e.HeatSetpoint,
+			CoolSetpoint: e.CoolSetpoint,
+			Since:        start,
+		}, nil
+	}
+
+	// Find the most recent period start, looking back up to a week
+	var best *Target
+	for i, p := range sched.Periods {
+		minutes, err := parseClock(p.Start)
+		if err != nil {
+			return nil, err
+		}
+		for back := 0; back <= 7; back++ {
+			day := local.AddDate(0, 0, -back)
+			if !periodRunsOn(p, day.Weekday()) {
+				continue
+			}
+			at := time.Date(day.Year(), day.Month(), day.Day(), minutes/60, minutes%60, 0, 0, loc)
+			if at.After(local) {
+				continue
+			}
+			if best == nil || at.After(best.Since) {
+				best = &Target{
+					Key:          fmt.Sprintf("period:%d:%d", i, at.Unix()),
+					Description:  fmt.Sprintf("%s period", p.Start),
+					SystemMode:   p.SystemMode,
+					HeatSetpoint: p.HeatSetpoint,
+					CoolSetpoint: p.CoolSetpoint,
+					Since:        at,
+				}
+			}
+			break
+		}
+	}
+
+	return best, nil
+}
+
+// exceptionWindow returns the start and end of an exception in loc
+func exceptionWindow(e storage.ScheduleException, loc *time.Location) (time.Time, time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", e.Date, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid exception date %q", e.Date)
+	}
+
+	start, end := 0, 24*60
+	if e.Start != "" {
+		if start, err = parseClock(e.Start); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if e.End != "" {
+		if end, err = parseClock(e.End); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	y, m, d := date.Date()
+	return time.Date(y, m, d, start/60, start%60, 0, 0, loc),
+		time.Date(y, m, d, end/60, end%60, 0, 0, loc), nil
+}
+
+// periodRunsOn reports whether a period is active on the given weekday
+func periodRunsOn(p storage.SchedulePeriod, day time.Weekday) bool {
+	for _, d := range p.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
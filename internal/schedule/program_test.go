@@ -0,0 +1,163 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+func TestEvaluate(t *testing.T) {
+	weekly := []storage.SchedulePeriod{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "06:00", HeatSetpoint: f(68)},
+		{Days: []string{"sat", "sun"}, Start: "08:00", HeatSetpoint: f(70)},
+		{Days: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}, Start: "22:00", HeatSetpoint: f(62)},
+	}
+	allDay := storage.ScheduleException{Date: "2026-03-02", HeatSetpoint: f(72)}
+	midday := storage.ScheduleException{Date: "2026-03-02", Start: "09:00", End: "17:00", HeatSetpoint: f(72)}
+	skipped := storage.ScheduleException{Date: "2026-03-02", Skip: true}
+
+	tests := []struct {
+		name       string
+		timezone   string
+		exceptions []storage.ScheduleException
+		now        string // RFC 3339
+		wantDesc   string
+		wantSince  string // RFC 3339, in UTC
+		wantSkip   bool
+	}{
+		{
+			name:     "weekday morning",
+			timezone: "America/New_York", now: "2026-03-02T12:00:00Z", // Mon 07:00 EST
+			wantDesc: "06:00 period", wantSince: "2026-03-02T11:00:00Z",
+		},
+		{
+			name:     "before the first period of the day",
+			timezone: "America/New_York", now: "2026-03-02T09:00:00Z", // Mon 04:00 EST
+			wantDesc: "22:00 period", wantSince: "2026-03-02T03:00:00Z",
+		},
+		{
+			name:     "weekend",
+			timezone: "America/New_York", now: "2026-03-01T14:00:00Z", // Sun 09:00 EST
+			wantDesc: "08:00 period", wantSince: "2026-03-01T13:00:00Z",
+		},
+		{
+			name:     "same instant in another timezone",
+			timezone: "Europe/London", now: "2026-03-02T12:00:00Z", // Mon 12:00 GMT
+			wantDesc: "06:00 period", wantSince: "2026-03-02T06:00:00Z",
+		},
+		{
+			name:     "weekday is taken from the schedule timezone",
+			timezone: "Asia/Tokyo", now: "2026-03-01T22:00:00Z", // Mon 07:00 JST, still Sunday in UTC
+			wantDesc: "06:00 period", wantSince: "2026-03-01T21:00:00Z",
+		},
+		{
+			name:     "after the spring DST change",
+			timezone: "America/New_York", now: "2026-03-09T10:30:00Z", // Mon 06:30 EDT
+			wantDesc: "06:00 period", wantSince: "2026-03-09T10:00:00Z",
+		},
+		{
+			name:     "after the autumn DST change",
+			timezone: "America/New_York", now: "2026-11-02T11:30:00Z", // Mon 06:30 EST
+			wantDesc: "06:00 period", wantSince: "2026-11-02T11:00:00Z",
+		},
+		{
+			name:     "all-day exception",
+			timezone: "America/New_York", exceptions: []storage.ScheduleException{allDay},
+			now:      "2026-03-02T12:00:00Z",
+			wantDesc: "exception on 2026-03-02", wantSince: "2026-03-02T05:00:00Z",
+		},
+		{
+			name:     "exception date is in the schedule timezone",
+			timezone: "America/New_York", exceptions: []storage.ScheduleException{allDay},
+			now:      "2026-03-03T03:00:00Z", // Mon 22:00 EST
+			wantDesc: "exception on 2026-03-02", wantSince: "2026-03-02T05:00:00Z",
+		},
+		{
+			name:     "exception date has passed in another timezone",
+			timezone: "Europe/London", exceptions: []storage.ScheduleException{allDay},
+			now:      "2026-03-03T03:00:00Z", // Tue 03:00 GMT
+			wantDesc: "22:00 period", wantSince: "2026-03-02T22:00:00Z",
+		},
+		{
+			name:     "before an exception window",
+			timezone: "America/New_York", exceptions: []storage.ScheduleException{midday},
+			now:      "2026-03-02T13:00:00Z", // Mon 08:00 EST
+			wantDesc: "06:00 period", wantSince: "2026-03-02T11:00:00Z",
+		},
+		{
+			name:     "inside an exception window",
+			timezone: "America/New_York", exceptions: []storage.ScheduleException{midday},
+			now:      "2026-03-02T17:00:00Z", // Mon 12:00 EST
+			wantDesc: "exception on 2026-03-02", wantSince: "2026-03-02T14:00:00Z",
+		},
+		{
+			name:     "exception window end is exclusive",
+			timezone: "America/New_York", exceptions: []storage.ScheduleException{midday},
+			now:      "2026-03-02T22:00:00Z", // Mon 17:00 EST
+			wantDesc: "06:00 period", wantSince: "2026-03-02T11:00:00Z",
+		},
+		{
+			name:     "skipped day",
+			timezone: "America/New_York", exceptions: []storage.ScheduleException{skipped},
+			now:      "2026-03-02T12:00:00Z",
+			wantDesc: "exception on 2026-03-02", wantSince: "2026-03-02T05:00:00Z", wantSkip: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched := &storage.Schedule{Timezone: tt.timezone, Periods: weekly, Exceptions: tt.exceptions}
+			now, err := time.Parse(time.RFC3339, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Evaluate(sched, now)
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if got == nil {
+				t.Fatal("Evaluate() = nil, want a target")
+			}
+			if got.Description != tt.wantDesc {
+				t.Errorf("Evaluate() description = %q, want %q", got.Description, tt.wantDesc)
+			}
+			if since := got.Since.UTC().Format(time.RFC3339); since != tt.wantSince {
+				t.Errorf("Evaluate() since = %s, want %s", since, tt.wantSince)
+			}
+			if got.Skip != tt.wantSkip {
+				t.Errorf("Evaluate() skip = %v, want %v", got.Skip, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestEvaluateKeyIsStable(t *testing.T) {
+	sched := &storage.Schedule{
+		Timezone: "America/New_York",
+		Periods:  []storage.SchedulePeriod{{Days: []string{"mon"}, Start: "06:00", HeatSetpoint: f(68)}},
+	}
+	first, err := Evaluate(sched, time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	later, err := Evaluate(sched, time.Date(2026, 3, 2, 20, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	nextWeek, err := Evaluate(sched, time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+
+	// The engine applies a target once per key
+	if first.Key != later.Key {
+		t.Errorf("keys within one period differ: %q and %q", first.Key, later.Key)
+	}
+	if first.Key == nextWeek.Key {
+		t.Errorf("key %q repeats a week later", first.Key)
+	}
+}
+
+func f(v float64) *float64 { return &v }
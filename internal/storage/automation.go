@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const ruleColumns = `id, device_id, name, enabled, dry_run, trigger_spec, conditions, actions,
+	cooldown_seconds, last_fired_at, created_at, updated_at`
+
+// scanRule reads an automation rule row
+func scanRule(row scanner) (*AutomationRule, error) {
+	var rule AutomationRule
+	var trigger, actions string
+	var conditions sql.NullString
+	var lastFired sql.NullTime
+	err := row.Scan(&rule.ID, &rule.DeviceID, &rule.Name, &rule.Enabled, &rule.DryRun,
+		&trigger, &conditions, &actions, &rule.CooldownSeconds, &lastFired, &rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(trigger), &rule.Trigger); err != nil {
+		return nil, fmt.Errorf("failed to decode trigger for rule %d: %w", rule.ID, err)
+	}
+	if conditions.Valid && conditions.String != "" {
+		if err := json.Unmarshal([]byte(conditions.String), &rule.Conditions); err != nil {
+			return nil, fmt.Errorf("failed to decode conditions for rule %d: %w", rule.ID, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(actions), &rule.Actions); err != nil {
+		return nil, fmt.Errorf("failed to decode actions for rule %d: %w", rule.ID, err)
+	}
+	if lastFired.Valid {
+		rule.LastFiredAt = &lastFired.Time
+	}
+
+	return &rule, nil
+}
+
+// marshalRule encodes the JSON columns of a rule
+func marshalRule(rule *AutomationRule) (trigger, conditions, actions string, err error) {
+	t, err := json.Marshal(rule.Trigger)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to marshal trigger: %w", err)
+	}
+	c, err := json.Marshal(rule.Conditions)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to marshal conditions: %w", err)
+	}
+	a, err := json.Marshal(rule.Actions)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to marshal actions: %w", err)
+	}
+	return string(t), string(c), string(a), nil
+}
+
+// CreateRule stores a new automation rule and sets its ID
+func (db *DB) CreateRule(rule *AutomationRule) error {
+	trigger, conditions, actions, err := marshalRule(rule)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	result, err := db.conn.Exec(`
+		INSERT INTO automation_rules (device_id, name, enabled, dry_run, trigger_spec, conditions, actions,
+			cooldown_seconds, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rule.DeviceID, rule.Name, rule.Enabled, rule.DryRun, trigger, conditions, actions,
+		rule.CooldownSeconds, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to create rule: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get rule id: %w", err)
+	}
+	rule.ID = int(id)
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+
+	return nil
+}
+
+// UpdateRule replaces an automation rule
+func (db *DB) UpdateRule(rule *AutomationRule) error {
+	trigger, conditions, actions, err := marshalRule(rule)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	result, err := db.conn.Exec(`
+		UPDATE automation_rules SET
+			device_id = ?,
+			name = ?,
+			enabled = ?,
+			dry_run = ?,
+			trigger_spec = ?,
+			conditions = ?,
+			actions = ?,
+			cooldown_seconds = ?,
+			updated_at = ?
+		WHERE id = ?
+	`, rule.DeviceID, rule.Name, rule.Enabled, rule.DryRun, trigger, conditions, actions,
+		rule.CooldownSeconds, now, rule.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update rule %d: %w", rule.ID, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	rule.UpdatedAt = now
+
+	return nil
+}
+
+// GetRule retrieves an automation rule by ID, returning nil if it doesn't exist
+func (db *DB) GetRule(id int) (*AutomationRule, error) {
+	row := db.conn.QueryRow("SELECT "+ruleColumns+" FROM automation_rules WHERE id = ?", id)
+
+	rule, err := scanRule(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rule %d: %w", id, err)
+	}
+
+	return rule, nil
+}
+
+// GetRules retrieves all automation rules
+func (db *DB) GetRules() ([]AutomationRule, error) {
+	rows, err := db.conn.Query("SELECT " + ruleColumns + " FROM automation_rules ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []AutomationRule
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan rule: %w", err)
+		}
+		rules = append(rules, *rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// DeleteRule removes an automation rule
+func (db *DB) DeleteRule(id int) error {
+	result, err := db.conn.Exec("DELETE FROM automation_rules WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete rule %d: %w", id, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// MarkRuleFired records when a rule last fired
+func (db *DB) MarkRuleFired(id int, at time.Time) error {
+	_, err := db.conn.Exec("UPDATE automation_rules SET last_fired_at = ? WHERE id = ?", at, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark rule %d fired: %w", id, err)
+	}
+
+	return nil
+}
+
+// GetEventLogsAfter retrieves events with an ID greater than afterID, oldest first
+func (db *DB) GetEventLogsAfter(afterID, limit int) ([]EventLog, error) {
+	rows, err := db.conn.Query(`
+		SELECT `+eventLogColumns+`
+		FROM event_log
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?
+	`, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query event logs: %w", err)
+	}
+	defer rows.Close()
+
+	var logs []EventLog
+	for rows.Next() {
+		event, err := scanEventLog(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan event log: %w", err)
+		}
+		logs = append(logs, *event)
+	}
+
+	return logs, rows.Err()
+}
+
+// GetLatestEventLogID returns the ID of the newest event, or 0 if there are none
+func (db *DB) GetLatestEventLogID() (int, error) {
+	var id int
+	if err := db.conn.QueryRow("SELECT COALESCE(MAX(id), 0) FROM event_log").Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get latest event id: %w", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,24 @@
+package storage
+
+import "fmt"
+
+// ReadMigrationVersion returns the schema version of a database file that
+// is not in use, such as a backup copy, without migrating it
+func ReadMigrationVersion(path string) (int, error) {
+	conn, err := openReadOnly(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer conn.Close()
+
+	version, err := GetMigrationVersion(conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// LatestMigrationVersion returns the schema version this build migrates to
+func LatestMigrationVersion() int {
+	return migrations[len(migrations)-1].version
+}
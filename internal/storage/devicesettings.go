@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// scanDeviceSettings reads a device settings row
+func scanDeviceSettings(row scanner) (*DeviceSettings, error) {
+	var ds DeviceSettings
+	var name, unit sql.NullString
+	err := row.Scan(&ds.DeviceID, &name, &ds.HideFromMatter, &ds.TempOffset, &unit, &ds.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.DisplayName = name.String
+	ds.TemperatureUnit = unit.String
+
+	return &ds, nil
+}
+
+// GetDeviceSettings retrieves a device's settings, returning nil if none
+// have been saved
+func (db *DB) GetDeviceSettings(deviceID int) (*DeviceSettings, error) {
+	row := db.conn.QueryRow(`
+		SELECT device_id, display_name, hide_from_matter, temp_offset, temperature_unit, updated_at
+		FROM device_settings WHERE device_id = ?
+	`, deviceID)
+
+	ds, err := scanDeviceSettings(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get settings for device %d: %w", deviceID, err)
+	}
+
+	return ds, nil
+}
+
+// GetAllDeviceSettings retrieves the settings of every device that has any
+func (db *DB) GetAllDeviceSettings() ([]DeviceSettings, error) {
+	rows, err := db.conn.Query(`
+		SELECT device_id, display_name, hide_from_matter, temp_offset, temperature_unit, updated_at
+		FROM device_settings ORDER BY device_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device settings: %w", err)
+	}
+	defer rows.Close()
+
+	var settings []DeviceSettings
+	for rows.Next() {
+		ds, err := scanDeviceSettings(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan device settings: %w", err)
+		}
+		settings = append(settings, *ds)
+	}
+
+	return settings, rows.Err()
+}
+
+// SaveDeviceSettings creates or replaces a device's settings
+func (db *DB) SaveDeviceSettings(ds *DeviceSettings) error {
+	var name, unit interface{}
+	if ds.DisplayName != "" {
+		name = ds.DisplayName
+	}
+	if ds.TemperatureUnit != "" {
+		unit = ds.TemperatureUnit
+	}
+
+	ds.UpdatedAt = time.Now()
+	_, err := db.conn.Exec(`
+		INSERT INTO device_settings (device_id, display_name, hide_from_matter, temp_offset, temperature_unit, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_id) DO UPDATE SET
+			display_name = excluded.display_name,
+			hide_from_matter = excluded.hide_from_matter,
+			temp_offset = excluded.temp_offset,
+			temperature_unit = excluded.temperature_unit,
+			updated_at = excluded.updated_at
+	`, ds.DeviceID, name, ds.HideFromMatter, ds.TempOffset, unit, ds.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save settings for device %d: %w", ds.DeviceID, err)
+	}
+
+	return nil
+}
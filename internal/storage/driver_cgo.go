@@ -0,0 +1,95 @@
+//go:build cgo && !sqlite_purego
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The default driver is mattn/go-sqlite3, which links the SQLite C library
+// through CGO. Builds without CGO, or with the sqlite_purego tag, use the
+// pure-Go driver in driver_purego.go instead.
+
+const driverName = "sqlite3"
+
+// openConn opens the database at path for normal use
+func openConn(path string) (*sql.DB, error) {
+	return sql.Open(driverName, path+"?_journal_mode=WAL&_busy_timeout=5000")
+}
+
+// openReadOnly opens a database file that is not in use without creating
+// or modifying it
+func openReadOnly(path string) (*sql.DB, error) {
+	return sql.Open(driverName, "file:"+path+"?mode=ro&immutable=1")
+}
+
+// backupStepPages is how many pages are copied per backup step, so writers
+// are not locked out for the whole copy
+const backupStepPages = 256
+
+// BackupTo writes a consistent copy of the live database to path using
+// SQLite's online backup API. path must not already hold a database.
+func (db *DB) BackupTo(ctx context.Context, path string) error {
+	dest, err := sql.Open(driverName, path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup database: %w", err)
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to backup database: %w", err)
+	}
+	defer destConn.Close()
+
+	srcConn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			destSQLite, ok := destDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup database is not SQLite")
+			}
+			srcSQLite, ok := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("database is not SQLite")
+			}
+
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Close()
+					return fmt.Errorf("failed to copy database: %w", err)
+				}
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					backup.Close()
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			if err := backup.Finish(); err != nil {
+				return fmt.Errorf("failed to finish backup: %w", err)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,41 @@
+//go:build !cgo || sqlite_purego
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// modernc.org/sqlite is SQLite translated to Go. It is slower than the CGO
+// driver but cross-compiles anywhere, e.g. CGO_ENABLED=0 GOARCH=arm64.
+// FTS5 is always compiled in.
+
+const driverName = "sqlite"
+
+// openConn opens the database at path for normal use. _time_format=sqlite
+// writes times in the same layout as go-sqlite3 so databases move freely
+// between builds.
+func openConn(path string) (*sql.DB, error) {
+	return sql.Open(driverName, path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_time_format=sqlite")
+}
+
+// openReadOnly opens a database file that is not in use without creating
+// or modifying it
+func openReadOnly(path string) (*sql.DB, error) {
+	return sql.Open(driverName, "file:"+path+"?mode=ro&immutable=1")
+}
+
+// BackupTo writes a consistent copy of the live database to path. The
+// pure-Go driver does not expose the online backup API, so this uses
+// VACUUM INTO, which also produces a transactionally consistent copy.
+// path must not already hold a database.
+func (db *DB) BackupTo(ctx context.Context, path string) error {
+	if _, err := db.conn.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	return nil
+}
@@ -1,64 +1,391 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// keyFileFormat is the keyring layout written to the key file. Older
+// installs have a bare 32-byte key, which is read as version 1.
+const keyFileFormat = 1
+
+// keySize is the AES-256 key length
+const keySize = 32
+
+// scrypt parameters for deriving the key-encryption key from a passphrase
+const (
+	kekN        = 1 << 15
+	kekR        = 8
+	kekP        = 1
+	kekSaltSize = 16
 )
 
-// EncryptionKey manages the device-specific encryption key
+// ErrWrongPassphrase is returned when the passphrase does not unwrap the keys
+var ErrWrongPassphrase = errors.New("wrong encryption key passphrase")
+
+// keyFile is the on-disk keyring
+type keyFile struct {
+	Format  int        `json:"format"`
+	Current int        `json:"current"`
+	KDF     *kdfParams `json:"kdf,omitempty"` // Set when keys are passphrase-wrapped
+	Keys    []keyEntry `json:"keys"`
+}
+
+// kdfParams describes how the key-encryption key is derived
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// keyEntry is one key version, stored in the clear or wrapped
+type keyEntry struct {
+	Version int    `json:"version"`
+	Key     []byte `json:"key,omitempty"`
+	Wrapped []byte `json:"wrapped,omitempty"`
+}
+
+// EncryptionKey manages the device-specific encryption keys. Data is
+// encrypted with the current version; older versions are kept until
+// everything encrypted with them has been rotated.
 type EncryptionKey struct {
-	key []byte
+	path string
+
+	mu      sync.RWMutex
+	keys    map[int][]byte
+	current int
+	kek     []byte // Key-encryption key, nil when keys are stored in the clear
+	kdf     *kdfParams
 }
 
-// LoadOrCreateKey loads an existing key or creates a new one
-func LoadOrCreateKey(path string) (*EncryptionKey, error) {
-	key, err := os.ReadFile(path)
-	if err == nil && len(key) == 32 {
-		return &EncryptionKey{key: key}, nil
+// LoadOrCreateKey loads the keyring at path, unwrapping it with passphrase
+// if it is protected. A new key is only created when the file does not
+// exist; an existing file that cannot be read is an error, never replaced.
+// A non-empty passphrase protects a keyring that was stored in the clear.
+func LoadOrCreateKey(path, passphrase string) (*EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createKey(path, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", path, err)
 	}
 
-	// Generate new key
-	key = make([]byte, 32)
+	e := &EncryptionKey{path: path, keys: make(map[int][]byte)}
+
+	var kf keyFile
+	if jsonErr := json.Unmarshal(data, &kf); jsonErr != nil {
+		if len(data) != keySize {
+			return nil, fmt.Errorf("key file %s is unreadable (%d bytes); refusing to replace it", path, len(data))
+		}
+		// Bare key from before key versioning
+		e.keys[1] = data
+		e.current = 1
+	} else if err := e.load(&kf, passphrase); err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+
+	if passphrase != "" && e.kek == nil {
+		if err := e.setPassphrase(passphrase); err != nil {
+			return nil, err
+		}
+		if err := e.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// createKey generates the first key version and saves it
+func createKey(path, passphrase string) (*EncryptionKey, error) {
+	key := make([]byte, keySize)
 	if _, err := rand.Read(key); err != nil {
 		return nil, fmt.Errorf("failed to generate key: %w", err)
 	}
 
-	// Save key with restricted permissions
-	if err := os.WriteFile(path, key, 0600); err != nil {
-		return nil, fmt.Errorf("failed to save key: %w", err)
+	e := &EncryptionKey{path: path, keys: map[int][]byte{1: key}, current: 1}
+	if passphrase != "" {
+		if err := e.setPassphrase(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.save(); err != nil {
+		return nil, err
 	}
 
-	return &EncryptionKey{key: key}, nil
+	return e, nil
 }
 
-// Encrypt encrypts plaintext using AES-GCM
-func (e *EncryptionKey) Encrypt(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(e.key)
+// load fills the keyring from a parsed key file
+func (e *EncryptionKey) load(kf *keyFile, passphrase string) error {
+	if kf.Format > keyFileFormat {
+		return fmt.Errorf("format %d is newer than this build supports", kf.Format)
+	}
+
+	if kf.KDF != nil {
+		if passphrase == "" {
+			return fmt.Errorf("keys are passphrase-protected but no passphrase is configured")
+		}
+		if kf.KDF.Name != "scrypt" {
+			return fmt.Errorf("unsupported key derivation %q", kf.KDF.Name)
+		}
+		kek, err := scrypt.Key([]byte(passphrase), kf.KDF.Salt, kf.KDF.N, kf.KDF.R, kf.KDF.P, keySize)
+		if err != nil {
+			return fmt.Errorf("failed to derive key-encryption key: %w", err)
+		}
+		e.kek = kek
+		e.kdf = kf.KDF
+	}
+
+	for _, k := range kf.Keys {
+		key := k.Key
+		if e.kek != nil {
+			var err error
+			key, err = gcmKey(e.kek).open(k.Wrapped)
+			if err != nil {
+				return ErrWrongPassphrase
+			}
+		}
+		if len(key) != keySize {
+			return fmt.Errorf("key version %d is invalid", k.Version)
+		}
+		e.keys[k.Version] = key
+	}
+	if _, ok := e.keys[kf.Current]; !ok {
+		return fmt.Errorf("current key version %d is missing", kf.Current)
+	}
+	e.current = kf.Current
+
+	return nil
+}
+
+// setPassphrase derives a new key-encryption key. The caller saves.
+func (e *EncryptionKey) setPassphrase(passphrase string) error {
+	salt := make([]byte, kekSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	kek, err := scrypt.Key([]byte(passphrase), salt, kekN, kekR, kekP, keySize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return fmt.Errorf("failed to derive key-encryption key: %w", err)
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	e.kek = kek
+	e.kdf = &kdfParams{Name: "scrypt", Salt: salt, N: kekN, R: kekR, P: kekP}
+	return nil
+}
+
+// SetPassphrase re-wraps the keyring with a new passphrase and saves it
+func (e *EncryptionKey) SetPassphrase(passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.setPassphrase(passphrase); err != nil {
+		return err
+	}
+	return e.save()
+}
+
+// save writes the keyring atomically with restricted permissions
+func (e *EncryptionKey) save() error {
+	versions := make([]int, 0, len(e.keys))
+	for v := range e.keys {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+
+	kf := keyFile{Format: keyFileFormat, Current: e.current, KDF: e.kdf}
+	for _, version := range versions {
+		key := e.keys[version]
+		entry := keyEntry{Version: version}
+		if e.kek != nil {
+			wrapped, err := gcmKey(e.kek).seal(key)
+			if err != nil {
+				return err
+			}
+			entry.Wrapped = wrapped
+		} else {
+			entry.Key = key
+		}
+		kf.Keys = append(kf.Keys, entry)
+	}
+
+	data, err := json.MarshalIndent(kf, "", "  ")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return fmt.Errorf("failed to encode key file: %w", err)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	tmp, err := os.CreateTemp(filepath.Dir(e.path), ".encryption.key-")
+	if err != nil {
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save key: %w", err)
 	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), e.path); err != nil {
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+
+	return nil
+}
+
+// Version returns the key version new data is encrypted with
+func (e *EncryptionKey) Version() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+// Protected reports whether the keys are wrapped with a passphrase
+func (e *EncryptionKey) Protected() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.kek != nil
 }
 
-// Decrypt decrypts ciphertext using AES-GCM
-func (e *EncryptionKey) Decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(e.key)
+// HasVersion reports whether the keyring holds the given key version
+func (e *EncryptionKey) HasVersion(version int) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	_, ok := e.keys[version]
+	return ok
+}
+
+// Encrypt encrypts plaintext using AES-GCM with the current key and
+// returns the key version used
+func (e *EncryptionKey) Encrypt(plaintext []byte) ([]byte, int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	ciphertext, err := gcmKey(e.keys[e.current]).seal(plaintext)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ciphertext, e.current, nil
+}
+
+// Decrypt decrypts ciphertext using AES-GCM with the given key version
+func (e *EncryptionKey) Decrypt(version int, ciphertext []byte) ([]byte, error) {
+	e.mu.RLock()
+	key, ok := e.keys[version]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key version %d is not available", version)
+	}
+
+	return gcmKey(key).open(ciphertext)
+}
+
+// EncryptString encrypts a string
+func (e *EncryptionKey) EncryptString(s string) ([]byte, int, error) {
+	return e.Encrypt([]byte(s))
+}
+
+// DecryptString decrypts to a string
+func (e *EncryptionKey) DecryptString(version int, ciphertext []byte) (string, error) {
+	plaintext, err := e.Decrypt(version, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rotate adds a new key version and re-encrypts every stored credential
+// with it in one transaction. The new key is saved before the database is
+// touched, and the previous version is kept, so a failure at any step
+// leaves everything decryptable. It returns the new version and the number
+// of credentials re-encrypted.
+func (e *EncryptionKey) Rotate(db *DB) (int, int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return 0, 0, fmt.Errorf("failed to generate key: %w", err)
+	}
+	previous := e.current
+	version := previous
+	for v := range e.keys {
+		if v > version {
+			version = v
+		}
+	}
+	version++
+
+	e.keys[version] = key
+	if err := e.save(); err != nil {
+		delete(e.keys, version)
+		return 0, 0, err
+	}
+
+	count, err := db.reencryptCredentials(func(oldVersion int, ciphertext []byte) ([]byte, error) {
+		oldKey, ok := e.keys[oldVersion]
+		if !ok {
+			return nil, fmt.Errorf("key version %d is not available", oldVersion)
+		}
+		plaintext, err := gcmKey(oldKey).open(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		return gcmKey(key).seal(plaintext)
+	}, version)
+	if err != nil {
+		delete(e.keys, version)
+		e.save()
+		return 0, 0, err
+	}
+
+	// Retire everything but the new key and the one before it
+	e.current = version
+	for v := range e.keys {
+		if v != version && v != previous {
+			delete(e.keys, v)
+		}
+	}
+	if err := e.save(); err != nil {
+		return 0, 0, fmt.Errorf("credentials were re-encrypted but the key file was not updated: %w", err)
+	}
+
+	return version, count, nil
+}
+
+// gcmKey is an AES-256-GCM key
+type gcmKey []byte
+
+func (k gcmKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
 	}
@@ -67,6 +394,30 @@ func (e *EncryptionKey) Decrypt(ciphertext []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCM: %w", err)
 	}
+	return gcm, nil
+}
+
+// seal encrypts plaintext, prefixing the random nonce
+func (k gcmKey) seal(plaintext []byte) ([]byte, error) {
+	gcm, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open reverses seal
+func (k gcmKey) open(ciphertext []byte) ([]byte, error) {
+	gcm, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
 
 	nonceSize := gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
@@ -82,16 +433,11 @@ func (e *EncryptionKey) Decrypt(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// EncryptString encrypts a string
-func (e *EncryptionKey) EncryptString(s string) ([]byte, error) {
-	return e.Encrypt([]byte(s))
-}
-
-// DecryptString decrypts to a string
-func (e *EncryptionKey) DecryptString(ciphertext []byte) (string, error) {
-	plaintext, err := e.Decrypt(ciphertext)
-	if err != nil {
-		return "", err
+// IsKeyFile reports whether data looks like an encryption key file
+func IsKeyFile(data []byte) bool {
+	if len(data) == keySize {
+		return true
 	}
-	return string(plaintext), nil
+	var kf keyFile
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) && json.Unmarshal(data, &kf) == nil && len(kf.Keys) > 0
 }
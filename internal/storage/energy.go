@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// SaveEnergyMonth records a monthly energy summary. It returns false if the
+// month was already summarised for the device.
+func (db *DB) SaveEnergyMonth(m *EnergyMonth) (bool, error) {
+	result, err := db.conn.Exec(`
+		INSERT OR IGNORE INTO energy_monthly (device_id, month, electric_kwh, fuel_used, cost)
+		VALUES (?, ?, ?, ?, ?)
+	`, m.DeviceID, m.Month, m.ElectricKWh, m.FuelUsed, m.Cost)
+	if err != nil {
+		return false, fmt.Errorf("failed to save energy summary for device %d: %w", m.DeviceID, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
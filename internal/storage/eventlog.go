@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// eventSearchTriggers keep the full-text index in step with event_log
+var eventSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS event_log_fts_insert AFTER INSERT ON event_log BEGIN
+		INSERT INTO event_log_fts (rowid, message, details) VALUES (new.id, new.message, new.details);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS event_log_fts_delete AFTER DELETE ON event_log BEGIN
+		INSERT INTO event_log_fts (event_log_fts, rowid, message, details) VALUES ('delete', old.id, old.message, old.details);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS event_log_fts_update AFTER UPDATE OF message, details ON event_log BEGIN
+		INSERT INTO event_log_fts (event_log_fts, rowid, message, details) VALUES ('delete', old.id, old.message, old.details);
+		INSERT INTO event_log_fts (rowid, message, details) VALUES (new.id, new.message, new.details);
+	END`,
+}
+
+// ensureEventSearch sets up the FTS5 index over event messages and details.
+// SQLite builds without FTS5 (go-sqlite3 needs the sqlite_fts5 build tag)
+// fall back to LIKE matching; the triggers are dropped so inserts keep
+// working, and the index is rebuilt when a build with FTS5 next opens the
+// database.
+func (db *DB) ensureEventSearch() error {
+	var sourceID string
+	if err := db.conn.QueryRow("SELECT fts5_source_id()").Scan(&sourceID); err != nil {
+		log.Debug("FTS5 unavailable, event search will use LIKE: %v", err)
+		for _, name := range []string{"event_log_fts_insert", "event_log_fts_delete", "event_log_fts_update"} {
+			if _, err := db.conn.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return fmt.Errorf("failed to drop event search trigger: %w", err)
+			}
+		}
+		return nil
+	}
+
+	var triggers int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'event_log_fts_%'").Scan(&triggers)
+	if err != nil {
+		return fmt.Errorf("failed to inspect event search triggers: %w", err)
+	}
+	if triggers == len(eventSearchTriggers) {
+		db.eventSearch = true
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS event_log_fts USING fts5(message, details, content='event_log', content_rowid='id')")
+	if err != nil {
+		return fmt.Errorf("failed to create event search index: %w", err)
+	}
+	for _, trigger := range eventSearchTriggers {
+		if _, err := tx.Exec(trigger); err != nil {
+			return fmt.Errorf("failed to create event search trigger: %w", err)
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO event_log_fts (event_log_fts) VALUES ('rebuild')"); err != nil {
+		return fmt.Errorf("failed to build event search index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit event search index: %w", err)
+	}
+
+	log.Info("Built event log search index")
+	db.eventSearch = true
+	return nil
+}
+
+// eventDeviceID extracts the device_id most event details carry, so events
+// can be filtered by device
+func eventDeviceID(detailsJSON []byte) interface{} {
+	if len(detailsJSON) == 0 {
+		return nil
+	}
+	var details struct {
+		DeviceID *int `json:"device_id"`
+	}
+	if err := json.Unmarshal(detailsJSON, &details); err != nil || details.DeviceID == nil {
+		return nil
+	}
+	return *details.DeviceID
+}
+
+// eventLogWhere builds the WHERE clause shared by event queries and counts.
+// Paging fields are left to the caller.
+func (db *DB) eventLogWhere(filter EventLogFilter) (string, []interface{}) {
+	where := "1=1"
+	args := []interface{}{}
+
+	if filter.Source != nil {
+		where += " AND source = ?"
+		args = append(args, *filter.Source)
+	}
+	if filter.EventType != nil {
+		where += " AND event_type = ?"
+		args = append(args, *filter.EventType)
+	}
+	if filter.CorrelationID != "" {
+		where += " AND correlation_id = ?"
+		args = append(args, filter.CorrelationID)
+	}
+	if filter.DeviceID > 0 {
+		where += " AND device_id = ?"
+		args = append(args, filter.DeviceID)
+	}
+	// Timestamps are stored as UTC text, so bounds must be UTC too for
+	// the comparison to hold
+	if filter.Since != nil {
+		where += " AND timestamp >= ?"
+		args = append(args, filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		where += " AND timestamp <= ?"
+		args = append(args, filter.Until.UTC())
+	}
+
+	terms := strings.Fields(filter.Search)
+	if len(terms) > 0 && db.eventSearch {
+		// Quote every term so user input cannot form FTS syntax; each
+		// term matches as a prefix and all terms must match
+		quoted := make([]string, len(terms))
+		for i, term := range terms {
+			quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+		}
+		where += " AND id IN (SELECT rowid FROM event_log_fts WHERE event_log_fts MATCH ?)"
+		args = append(args, strings.Join(quoted, " "))
+	} else {
+		escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		for _, term := range terms {
+			pattern := "%" + escaper.Replace(term) + "%"
+			where += ` AND (message LIKE ? ESCAPE '\' OR CAST(details AS TEXT) LIKE ? ESCAPE '\')`
+			args = append(args, pattern, pattern)
+		}
+	}
+
+	return where, args
+}
+
+// CountMatchingEventLogs returns how many events match filter, ignoring
+// its paging fields
+func (db *DB) CountMatchingEventLogs(filter EventLogFilter) (int, error) {
+	where, args := db.eventLogWhere(filter)
+
+	var count int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM event_log WHERE "+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count event logs: %w", err)
+	}
+	return count, nil
+}
+
+// EachEventLog calls fn for every event matching filter, oldest first,
+// without holding them all in memory. Paging fields are ignored. An error
+// from fn stops the query.
+func (db *DB) EachEventLog(ctx context.Context, filter EventLogFilter, fn func(*EventLog) error) error {
+	where, args := db.eventLogWhere(filter)
+
+	rows, err := db.conn.QueryContext(ctx, "SELECT "+eventLogColumns+" FROM event_log WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return fmt.Errorf("failed to query event logs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanEventLog(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan event log: %w", err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventLogTimeFilter(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer db.Close()
+
+	// Rows from before the UTC migration carry whatever offset the host
+	// had when they were written, so text order isn't time order
+	if err := db.Migrate(context.Background(), 21); err != nil {
+		t.Fatalf("Migrate(21) error = %v", err)
+	}
+	tokyo := time.FixedZone("JST", 9*60*60)
+	newYork := time.FixedZone("EST", -5*60*60)
+	legacy := []struct {
+		message string
+		at      time.Time
+	}{
+		{"early", time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC).In(tokyo)},  // 19:00+09:00
+		{"late", time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC).In(newYork)}, // 07:00-05:00
+	}
+	for _, e := range legacy {
+		_, err := db.conn.Exec("INSERT INTO event_log (timestamp, source, event_type, message) VALUES (?, ?, ?, ?)",
+			e.at, EventSourceSystem, EventTypeStateChange, e.message)
+		if err != nil {
+			t.Fatalf("failed to insert %s: %v", e.message, err)
+		}
+	}
+	if err := db.Migrate(context.Background(), LatestMigrationVersion()); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	at := func(hour int, loc *time.Location) *time.Time {
+		v := time.Date(2026, 3, 1, hour, 0, 0, 0, time.UTC).In(loc)
+		return &v
+	}
+
+	tests := []struct {
+		name   string
+		filter EventLogFilter
+		want   []string // newest first
+	}{
+		{name: "no bounds", want: []string{"late", "early"}},
+		{name: "since in UTC", filter: EventLogFilter{Since: at(11, time.UTC)}, want: []string{"late"}},
+		{name: "since in another zone", filter: EventLogFilter{Since: at(11, tokyo)}, want: []string{"late"}},
+		{name: "until in another zone", filter: EventLogFilter{Until: at(11, newYork)}, want: []string{"early"}},
+		{name: "window covering both", filter: EventLogFilter{Since: at(9, newYork), Until: at(13, tokyo)}, want: []string{"late", "early"}},
+		{name: "window between them", filter: EventLogFilter{Since: at(10, tokyo), Until: at(11, tokyo)}, want: []string{"early"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.GetEventLogs(tt.filter)
+			if err != nil {
+				t.Fatalf("GetEventLogs() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetEventLogs() = %d events, want %v", len(got), tt.want)
+			}
+			for i, e := range got {
+				if e.Message != tt.want[i] {
+					t.Errorf("GetEventLogs()[%d] = %q, want %q", i, e.Message, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTrimEventLogsKeepsNewest(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxRows int
+		want    int64 // rows removed from five
+	}{
+		{name: "over the limit", maxRows: 2, want: 3},
+		{name: "at the limit", maxRows: 5, want: 0},
+		{name: "under the limit", maxRows: 10, want: 0},
+	}
+
+	for storeName, open := range testStores {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				db := open(t)
+				for _, message := range []string{"1", "2", "3", "4", "5"} {
+					db.LogEvent(EventSourceSystem, EventTypeInfo, message, nil)
+				}
+
+				n, err := db.TrimEventLogs(tt.maxRows)
+				if err != nil {
+					t.Fatalf("TrimEventLogs() error = %v", err)
+				}
+				if n != tt.want {
+					t.Errorf("TrimEventLogs() = %d, want %d", n, tt.want)
+				}
+
+				logs, err := db.GetEventLogs(EventLogFilter{})
+				if err != nil {
+					t.Fatalf("GetEventLogs() error = %v", err)
+				}
+				if len(logs) == 0 || logs[0].Message != "5" {
+					t.Errorf("GetEventLogs() = %+v, want the newest event kept", logs)
+				}
+			})
+		}
+	}
+}
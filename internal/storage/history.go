@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// aggregateTables maps aggregate resolutions to their tables
+var aggregateTables = map[Resolution]string{
+	ResolutionHourly: "thermostat_readings_hourly",
+	ResolutionDaily:  "thermostat_readings_daily",
+}
+
+const aggregateColumns = `device_id, bucket_start, samples, temp_avg, temp_min, temp_max,
+	heat_setpoint_avg, cool_setpoint_avg, humidity_avg, outdoor_temp_avg, outdoor_humidity_avg,
+	heating_ratio, cooling_ratio, system_mode`
+
+// SaveReading records a polled sample. A sample with the same device and
+// timestamp as an existing one (e.g. cached poll data) is ignored.
+func (db *DB) SaveReading(r *Reading) error {
+	_, err := db.conn.Exec(`
+		INSERT OR IGNORE INTO thermostat_readings (device_id, recorded_at, current_temp, heat_setpoint, cool_setpoint,
+			system_mode, humidity, is_heating, is_cooling, outdoor_temp, outdoor_humidity)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, r.DeviceID, r.RecordedAt.UTC(), r.CurrentTemp, r.HeatSetpoint, r.CoolSetpoint,
+		r.SystemMode, r.Humidity, r.IsHeating, r.IsCooling, r.OutdoorTemp, r.OutdoorHumidity)
+	if err != nil {
+		return fmt.Errorf("failed to save reading for device %d: %w", r.DeviceID, err)
+	}
+
+	return nil
+}
+
+// GetReadings retrieves raw readings for a device in [from, to), oldest
+// first. A deviceID of 0 returns readings for every device.
+func (db *DB) GetReadings(deviceID int, from, to time.Time) ([]Reading, error) {
+	var readings []Reading
+	err := db.EachReading(context.Background(), deviceID, from, to, func(r *Reading) error {
+		readings = append(readings, *r)
+		return nil
+	})
+	return readings, err
+}
+
+// EachReading calls fn for each raw reading GetReadings would return,
+// without holding them all in memory. An error from fn stops the query.
+func (db *DB) EachReading(ctx context.Context, deviceID int, from, to time.Time, fn func(*Reading) error) error {
+	query := `
+		SELECT id, device_id, recorded_at, current_temp, heat_setpoint, cool_setpoint, system_mode,
+			humidity, is_heating, is_cooling, outdoor_temp, outdoor_humidity
+		FROM thermostat_readings
+		WHERE recorded_at >= ? AND recorded_at < ?`
+	args := []interface{}{from.UTC(), to.UTC()}
+	if deviceID != 0 {
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+	query += " ORDER BY device_id, recorded_at"
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query readings: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Reading
+		var heat, cool, outdoorTemp, outdoorHumidity sql.NullFloat64
+		var mode sql.NullString
+		var humidity sql.NullInt64
+		err := rows.Scan(&r.ID, &r.DeviceID, &r.RecordedAt, &r.CurrentTemp, &heat, &cool, &mode,
+			&humidity, &r.IsHeating, &r.IsCooling, &outdoorTemp, &outdoorHumidity)
+		if err != nil {
+			return fmt.Errorf("failed to scan reading: %w", err)
+		}
+
+		r.HeatSetpoint = heat.Float64
+		r.CoolSetpoint = cool.Float64
+		r.SystemMode = mode.String
+		if humidity.Valid {
+			h := int(humidity.Int64)
+			r.Humidity = &h
+		}
+		if outdoorTemp.Valid {
+			r.OutdoorTemp = &outdoorTemp.Float64
+		}
+		if outdoorHumidity.Valid {
+			r.OutdoorHumidity = &outdoorHumidity.Float64
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// SaveAggregates creates or replaces aggregate buckets in one transaction
+func (db *DB) SaveAggregates(resolution Resolution, aggregates []ReadingAggregate) error {
+	table, ok := aggregateTables[resolution]
+	if !ok {
+		return fmt.Errorf("invalid aggregate resolution %q", resolution)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO ` + table + ` (` + aggregateColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare %s aggregates: %w", resolution, err)
+	}
+	defer stmt.Close()
+
+	for _, a := range aggregates {
+		_, err := stmt.Exec(a.DeviceID, a.BucketStart.UTC(), a.Samples, a.TempAvg, a.TempMin, a.TempMax,
+			a.HeatSetpoint, a.CoolSetpoint, a.Humidity, a.OutdoorTemp, a.OutdoorHumidity,
+			a.HeatingRatio, a.CoolingRatio, a.SystemMode)
+		if err != nil {
+			return fmt.Errorf("failed to save %s aggregate: %w", resolution, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %s aggregates: %w", resolution, err)
+	}
+
+	return nil
+}
+
+// GetAggregates retrieves aggregate buckets starting in [from, to), oldest
+// first. A deviceID of 0 returns buckets for every device.
+func (db *DB) GetAggregates(resolution Resolution, deviceID int, from, to time.Time) ([]ReadingAggregate, error) {
+	var aggregates []ReadingAggregate
+	err := db.EachAggregate(context.Background(), resolution, deviceID, from, to, func(a *ReadingAggregate) error {
+		aggregates = append(aggregates, *a)
+		return nil
+	})
+	return aggregates, err
+}
+
+// EachAggregate calls fn for each bucket GetAggregates would return,
+// without holding them all in memory. An error from fn stops the query.
+func (db *DB) EachAggregate(ctx context.Context, resolution Resolution, deviceID int, from, to time.Time, fn func(*ReadingAggregate) error) error {
+	table, ok := aggregateTables[resolution]
+	if !ok {
+		return fmt.Errorf("invalid aggregate resolution %q", resolution)
+	}
+
+	query := "SELECT " + aggregateColumns + " FROM " + table + " WHERE bucket_start >= ? AND bucket_start < ?"
+	args := []interface{}{from.UTC(), to.UTC()}
+	if deviceID != 0 {
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+	query += " ORDER BY device_id, bucket_start"
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query %s aggregates: %w", resolution, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a ReadingAggregate
+		var heat, cool, humidity, outdoorTemp, outdoorHumidity sql.NullFloat64
+		var mode sql.NullString
+		err := rows.Scan(&a.DeviceID, &a.BucketStart, &a.Samples, &a.TempAvg, &a.TempMin, &a.TempMax,
+			&heat, &cool, &humidity, &outdoorTemp, &outdoorHumidity, &a.HeatingRatio, &a.CoolingRatio, &mode)
+		if err != nil {
+			return fmt.Errorf("failed to scan %s aggregate: %w", resolution, err)
+		}
+
+		a.HeatSetpoint = nullFloat(heat)
+		a.CoolSetpoint = nullFloat(cool)
+		a.Humidity = nullFloat(humidity)
+		a.OutdoorTemp = nullFloat(outdoorTemp)
+		a.OutdoorHumidity = nullFloat(outdoorHumidity)
+		a.SystemMode = mode.String
+		if err := fn(&a); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// PruneReadings deletes raw readings older than the given time
+func (db *DB) PruneReadings(olderThan time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM thermostat_readings WHERE recorded_at < ?", olderThan.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune readings: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// PruneAggregates deletes aggregate buckets that started before the given time
+func (db *DB) PruneAggregates(resolution Resolution, olderThan time.Time) (int64, error) {
+	table, ok := aggregateTables[resolution]
+	if !ok {
+		return 0, fmt.Errorf("invalid aggregate resolution %q", resolution)
+	}
+
+	result, err := db.conn.Exec("DELETE FROM "+table+" WHERE bucket_start < ?", olderThan.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune %s aggregates: %w", resolution, err)
+	}
+	return result.RowsAffected()
+}
+
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// GetMatterEndpoints retrieves every device's Matter endpoints, by endpoint
+func (db *DB) GetMatterEndpoints() ([]MatterEndpoint, error) {
+	rows, err := db.conn.Query(`
+		SELECT device_id, endpoint, humidity_endpoint, created_at FROM matter_endpoints ORDER BY endpoint
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matter endpoints: %w", err)
+	}
+	defer rows.Close()
+
+	var endpoints []MatterEndpoint
+	for rows.Next() {
+		var ep MatterEndpoint
+		var humidity sql.NullInt64
+		if err := rows.Scan(&ep.DeviceID, &ep.Endpoint, &humidity, &ep.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan matter endpoint: %w", err)
+		}
+		ep.HumidityEndpoint = int(humidity.Int64)
+		endpoints = append(endpoints, ep)
+	}
+
+	return endpoints, rows.Err()
+}
+
+// SaveMatterEndpoint records a device's Matter endpoints. A device's
+// thermostat endpoint is never reassigned; saving it again only fills in
+// a humidity endpoint it didn't have.
+func (db *DB) SaveMatterEndpoint(ep *MatterEndpoint) error {
+	var humidity interface{}
+	if ep.HumidityEndpoint != 0 {
+		humidity = ep.HumidityEndpoint
+	}
+
+	if ep.CreatedAt.IsZero() {
+		ep.CreatedAt = time.Now()
+	}
+	res, err := db.conn.Exec(`
+		INSERT INTO matter_endpoints (device_id, endpoint, humidity_endpoint, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(device_id) DO UPDATE SET humidity_endpoint = excluded.humidity_endpoint
+			WHERE matter_endpoints.endpoint = excluded.endpoint AND matter_endpoints.humidity_endpoint IS NULL
+	`, ep.DeviceID, ep.Endpoint, humidity, ep.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save matter endpoint for device %d: %w", ep.DeviceID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to save matter endpoint for device %d: endpoints already assigned", ep.DeviceID)
+	}
+
+	return nil
+}
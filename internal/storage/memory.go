@@ -0,0 +1,1233 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// MemoryStore is a Store held entirely in memory, for tests and tools that
+// should not touch a database file. It mirrors DB's behaviour, except that
+// event search is a case-insensitive substring match on every term.
+type MemoryStore struct {
+	mu          sync.Mutex
+	credentials *Credentials
+	states      map[int]*ThermostatState // by device ID
+	nextStateID int
+	events      []EventLog // oldest first
+	nextEventID int
+	matter      MatterState
+	endpoints   map[int]MatterEndpoint // by device ID
+	settings    map[int]DeviceSettings // by device ID
+	schedules   []Schedule             // by ID
+	nextSchedID int
+	rules       []AutomationRule // by ID
+	nextRuleID  int
+	presets     []Preset // by ID
+	nextPreset  int
+	commands    []QueuedCommand // by ID
+	nextCmdID   int
+	readings    []Reading
+	nextReading int
+	aggregates  map[Resolution]map[aggregateKey]ReadingAggregate
+	runtimeDays map[periodKey]RuntimeDay
+	runtimeHrs  map[periodKey]RuntimeHour
+	runtimeWks  map[periodKey]RuntimeWeek
+	energy      map[periodKey]EnergyMonth
+}
+
+// aggregateKey identifies an aggregate bucket
+type aggregateKey struct {
+	deviceID int
+	start    time.Time
+}
+
+// periodKey identifies a device's runtime or energy total for a day, hour,
+// week or month
+type periodKey struct {
+	deviceID int
+	period   string
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states:    make(map[int]*ThermostatState),
+		matter:    MatterState{ID: 1, UpdatedAt: time.Now()},
+		endpoints: make(map[int]MatterEndpoint),
+		settings:  make(map[int]DeviceSettings),
+		aggregates: map[Resolution]map[aggregateKey]ReadingAggregate{
+			ResolutionHourly: {},
+			ResolutionDaily:  {},
+		},
+		runtimeDays: make(map[periodKey]RuntimeDay),
+		runtimeHrs:  make(map[periodKey]RuntimeHour),
+		runtimeWks:  make(map[periodKey]RuntimeWeek),
+		energy:      make(map[periodKey]EnergyMonth),
+	}
+}
+
+// Close is a no-op
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// --- Credentials ---
+
+// SaveCredentials replaces the stored credentials
+func (m *MemoryStore) SaveCredentials(username string, passwordEncrypted []byte, keyVersion int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.credentials = &Credentials{
+		ID:                1,
+		Username:          username,
+		PasswordEncrypted: append([]byte(nil), passwordEncrypted...),
+		KeyVersion:        keyVersion,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	return nil
+}
+
+// GetCredentials returns the stored credentials, or nil if there are none
+func (m *MemoryStore) GetCredentials() (*Credentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.credentials == nil {
+		return nil, nil
+	}
+	creds := *m.credentials
+	creds.PasswordEncrypted = append([]byte(nil), creds.PasswordEncrypted...)
+	return &creds, nil
+}
+
+// DeleteCredentials removes the stored credentials
+func (m *MemoryStore) DeleteCredentials() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.credentials = nil
+	return nil
+}
+
+// --- Thermostat State ---
+
+// SaveThermostatState saves or updates thermostat state. As with DB, the
+// active preset is left unchanged.
+func (m *MemoryStore) SaveThermostatState(state *ThermostatState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *state
+	saved.UpdatedAt = time.Now()
+	if existing, ok := m.states[state.DeviceID]; ok {
+		saved.ID = existing.ID
+		saved.ActivePreset = existing.ActivePreset
+	} else {
+		m.nextStateID++
+		saved.ID = m.nextStateID
+		saved.ActivePreset = ""
+	}
+	m.states[state.DeviceID] = &saved
+	return nil
+}
+
+// GetThermostatState returns the first stored thermostat state, or nil if
+// there is none
+func (m *MemoryStore) GetThermostatState() (*ThermostatState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var first *ThermostatState
+	for _, state := range m.states {
+		if first == nil || state.ID < first.ID {
+			first = state
+		}
+	}
+	if first == nil {
+		return nil, nil
+	}
+	state := *first
+	return &state, nil
+}
+
+// GetAllThermostatStates returns every thermostat state by device ID
+func (m *MemoryStore) GetAllThermostatStates() ([]ThermostatState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var states []ThermostatState
+	for _, state := range m.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].DeviceID < states[j].DeviceID })
+	return states, nil
+}
+
+// GetThermostatStateByDeviceID returns the state of one device. Like DB it
+// fails with sql.ErrNoRows when the device is unknown.
+func (m *MemoryStore) GetThermostatStateByDeviceID(deviceID int) (*ThermostatState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.states[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get thermostat state for device %d: %w", deviceID, sql.ErrNoRows)
+	}
+	state := *existing
+	return &state, nil
+}
+
+// --- Event Log ---
+
+// LogEvent records an event in the log
+func (m *MemoryStore) LogEvent(source EventSource, eventType EventType, message string, details interface{}) error {
+	return m.LogEventContext(context.Background(), source, eventType, message, details)
+}
+
+// LogEventContext records an event in the log, tagged with the correlation
+// ID carried by ctx
+func (m *MemoryStore) LogEventContext(ctx context.Context, source EventSource, eventType EventType, message string, details interface{}) error {
+	var detailsJSON []byte
+	if details != nil {
+		var err error
+		detailsJSON, err = json.Marshal(details)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event details: %w", err)
+		}
+	}
+
+	event := EventLog{
+		Timestamp:     time.Now(),
+		Source:        source,
+		EventType:     eventType,
+		Message:       message,
+		CorrelationID: log.CorrelationID(ctx),
+	}
+	if len(detailsJSON) > 0 {
+		event.Details = json.RawMessage(detailsJSON)
+	}
+	if id, ok := eventDeviceID(detailsJSON).(int); ok {
+		event.DeviceID = id
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextEventID++
+	event.ID = m.nextEventID
+	m.events = append(m.events, event)
+	return nil
+}
+
+// matchEvent applies the non-paging fields of filter, as eventLogWhere does
+func matchEvent(e *EventLog, filter EventLogFilter) bool {
+	if filter.Source != nil && e.Source != *filter.Source {
+		return false
+	}
+	if filter.EventType != nil && e.EventType != *filter.EventType {
+		return false
+	}
+	if filter.CorrelationID != "" && e.CorrelationID != filter.CorrelationID {
+		return false
+	}
+	if filter.DeviceID > 0 && e.DeviceID != filter.DeviceID {
+		return false
+	}
+	if filter.Since != nil && e.Timestamp.Before(*filter.Since) {
+		return false
+	}
+	if filter.Until != nil && e.Timestamp.After(*filter.Until) {
+		return false
+	}
+	message := strings.ToLower(e.Message)
+	details := strings.ToLower(string(e.Details))
+	for _, term := range strings.Fields(strings.ToLower(filter.Search)) {
+		if !strings.Contains(message, term) && !strings.Contains(details, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetEventLogs retrieves events with optional filtering, newest first
+func (m *MemoryStore) GetEventLogs(filter EventLogFilter) ([]EventLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var logs []EventLog
+	skipped := 0
+	for i := len(m.events) - 1; i >= 0; i-- {
+		e := &m.events[i]
+		if filter.BeforeID > 0 && e.ID >= filter.BeforeID {
+			continue
+		}
+		if !matchEvent(e, filter) {
+			continue
+		}
+		if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		logs = append(logs, *e)
+		if filter.Limit > 0 && len(logs) == filter.Limit {
+			break
+		}
+	}
+	return logs, nil
+}
+
+// CountMatchingEventLogs returns how many events match filter, ignoring
+// its paging fields
+func (m *MemoryStore) CountMatchingEventLogs(filter EventLogFilter) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for i := range m.events {
+		if matchEvent(&m.events[i], filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// EachEventLog calls fn for every event matching filter, oldest first.
+// Paging fields are ignored. An error from fn stops the iteration.
+func (m *MemoryStore) EachEventLog(ctx context.Context, filter EventLogFilter, fn func(*EventLog) error) error {
+	// Copy the matches first so fn may log events without deadlocking
+	m.mu.Lock()
+	var matched []EventLog
+	for i := range m.events {
+		if matchEvent(&m.events[i], filter) {
+			matched = append(matched, m.events[i])
+		}
+	}
+	m.mu.Unlock()
+
+	for i := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(&matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetEventLogsAfter retrieves events with an ID greater than afterID, oldest first
+func (m *MemoryStore) GetEventLogsAfter(afterID, limit int) ([]EventLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var logs []EventLog
+	for _, e := range m.events {
+		if e.ID <= afterID {
+			continue
+		}
+		logs = append(logs, e)
+		if len(logs) == limit {
+			break
+		}
+	}
+	return logs, nil
+}
+
+// GetLatestEventLogID returns the ID of the newest event, or 0 if there are none
+func (m *MemoryStore) GetLatestEventLogID() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.events) == 0 {
+		return 0, nil
+	}
+	return m.events[len(m.events)-1].ID, nil
+}
+
+// --- Matter State ---
+
+// GetMatterState returns the Matter commissioning state
+func (m *MemoryStore) GetMatterState() (*MatterState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.matter
+	state.Fabrics = append([]MatterFabric(nil), state.Fabrics...)
+	return &state, nil
+}
+
+// SaveMatterState saves the Matter commissioning state
+func (m *MemoryStore) SaveMatterState(state *MatterState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.matter = *state
+	m.matter.ID = 1
+	m.matter.Fabrics = append([]MatterFabric(nil), state.Fabrics...)
+	m.matter.UpdatedAt = time.Now()
+	return nil
+}
+
+// GetMatterEndpoints returns every device's Matter endpoint, by endpoint
+func (m *MemoryStore) GetMatterEndpoints() ([]MatterEndpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	endpoints := make([]MatterEndpoint, 0, len(m.endpoints))
+	for _, ep := range m.endpoints {
+		endpoints = append(endpoints, ep)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Endpoint < endpoints[j].Endpoint })
+	return endpoints, nil
+}
+
+// SaveMatterEndpoint records a device's Matter endpoints. As with DB, a
+// device's thermostat endpoint is never reassigned; saving it again only
+// fills in a missing humidity endpoint.
+func (m *MemoryStore) SaveMatterEndpoint(ep *MatterEndpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, exists := m.endpoints[ep.DeviceID]
+	if exists && (prev.Endpoint != ep.Endpoint || prev.HumidityEndpoint != 0) {
+		return fmt.Errorf("device %d already has Matter endpoints", ep.DeviceID)
+	}
+	for id, other := range m.endpoints {
+		if id == ep.DeviceID {
+			continue
+		}
+		if other.Endpoint == ep.Endpoint || ep.HumidityEndpoint != 0 && other.HumidityEndpoint == ep.HumidityEndpoint {
+			return fmt.Errorf("endpoint is already used by device %d", other.DeviceID)
+		}
+	}
+
+	ep.CreatedAt = time.Now()
+	if exists {
+		ep.CreatedAt = prev.CreatedAt
+	}
+	m.endpoints[ep.DeviceID] = *ep
+	return nil
+}
+
+// --- Device Settings ---
+
+// GetDeviceSettings returns a device's settings, or nil if none have been saved
+func (m *MemoryStore) GetDeviceSettings(deviceID int) (*DeviceSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ds, ok := m.settings[deviceID]
+	if !ok {
+		return nil, nil
+	}
+	return &ds, nil
+}
+
+// GetAllDeviceSettings returns the settings of every device that has any
+func (m *MemoryStore) GetAllDeviceSettings() ([]DeviceSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var settings []DeviceSettings
+	for _, ds := range m.settings {
+		settings = append(settings, ds)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].DeviceID < settings[j].DeviceID })
+	return settings, nil
+}
+
+// SaveDeviceSettings creates or replaces a device's settings
+func (m *MemoryStore) SaveDeviceSettings(ds *DeviceSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ds.UpdatedAt = time.Now()
+	m.settings[ds.DeviceID] = *ds
+	return nil
+}
+
+// --- Schedules ---
+
+// copySchedule returns a schedule that shares no slices with sched
+func copySchedule(sched Schedule) Schedule {
+	sched.Periods = append([]SchedulePeriod(nil), sched.Periods...)
+	sched.Exceptions = append([]ScheduleException(nil), sched.Exceptions...)
+	return sched
+}
+
+// findSchedule returns the index of a schedule, or -1 (caller holds mu)
+func (m *MemoryStore) findSchedule(id int) int {
+	for i := range m.schedules {
+		if m.schedules[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// CreateSchedule stores a new schedule and sets its ID
+func (m *MemoryStore) CreateSchedule(sched *Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextSchedID++
+	now := time.Now()
+	sched.ID = m.nextSchedID
+	sched.CreatedAt = now
+	sched.UpdatedAt = now
+	sched.LastAppliedKey = ""
+	sched.LastAppliedAt = nil
+	m.schedules = append(m.schedules, copySchedule(*sched))
+	return nil
+}
+
+// UpdateSchedule replaces a schedule's program and clears its last applied
+// marker. It returns sql.ErrNoRows if the schedule doesn't exist.
+func (m *MemoryStore) UpdateSchedule(sched *Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(sched.ID)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	prev := m.schedules[i]
+	sched.UpdatedAt = time.Now()
+
+	saved := copySchedule(*sched)
+	saved.CreatedAt = prev.CreatedAt
+	saved.LastAppliedKey = ""
+	saved.LastAppliedAt = prev.LastAppliedAt
+	m.schedules[i] = saved
+	return nil
+}
+
+// GetSchedule returns a schedule by ID, or nil if it doesn't exist
+func (m *MemoryStore) GetSchedule(id int) (*Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(id)
+	if i < 0 {
+		return nil, nil
+	}
+	sched := copySchedule(m.schedules[i])
+	return &sched, nil
+}
+
+// GetSchedules returns all schedules, optionally for a single device
+// (deviceID > 0), by device and ID
+func (m *MemoryStore) GetSchedules(deviceID int) ([]Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var schedules []Schedule
+	for _, sched := range m.schedules {
+		if deviceID > 0 && sched.DeviceID != deviceID {
+			continue
+		}
+		schedules = append(schedules, copySchedule(sched))
+	}
+	sort.SliceStable(schedules, func(i, j int) bool { return schedules[i].DeviceID < schedules[j].DeviceID })
+	return schedules, nil
+}
+
+// DeleteSchedule removes a schedule, returning sql.ErrNoRows if it doesn't exist
+func (m *MemoryStore) DeleteSchedule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(id)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	m.schedules = append(m.schedules[:i], m.schedules[i+1:]...)
+	return nil
+}
+
+// MarkScheduleApplied records the last program step applied by a schedule
+func (m *MemoryStore) MarkScheduleApplied(id int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.findSchedule(id); i >= 0 {
+		now := time.Now()
+		m.schedules[i].LastAppliedKey = key
+		m.schedules[i].LastAppliedAt = &now
+	}
+	return nil
+}
+
+// --- Automation Rules ---
+
+// copyRule returns a rule that shares no slices with rule
+func copyRule(rule AutomationRule) AutomationRule {
+	rule.Conditions = append([]RuleCondition(nil), rule.Conditions...)
+	rule.Actions = append([]RuleAction(nil), rule.Actions...)
+	return rule
+}
+
+// findRule returns the index of a rule, or -1 (caller holds mu)
+func (m *MemoryStore) findRule(id int) int {
+	for i := range m.rules {
+		if m.rules[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// CreateRule stores a new automation rule and sets its ID
+func (m *MemoryStore) CreateRule(rule *AutomationRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextRuleID++
+	now := time.Now()
+	rule.ID = m.nextRuleID
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+	rule.LastFiredAt = nil
+	m.rules = append(m.rules, copyRule(*rule))
+	return nil
+}
+
+// UpdateRule replaces an automation rule, returning sql.ErrNoRows if it
+// doesn't exist
+func (m *MemoryStore) UpdateRule(rule *AutomationRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findRule(rule.ID)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	prev := m.rules[i]
+	rule.UpdatedAt = time.Now()
+
+	saved := copyRule(*rule)
+	saved.CreatedAt = prev.CreatedAt
+	saved.LastFiredAt = prev.LastFiredAt
+	m.rules[i] = saved
+	return nil
+}
+
+// GetRule returns an automation rule by ID, or nil if it doesn't exist
+func (m *MemoryStore) GetRule(id int) (*AutomationRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findRule(id)
+	if i < 0 {
+		return nil, nil
+	}
+	rule := copyRule(m.rules[i])
+	return &rule, nil
+}
+
+// GetRules returns all automation rules by ID
+func (m *MemoryStore) GetRules() ([]AutomationRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rules []AutomationRule
+	for _, rule := range m.rules {
+		rules = append(rules, copyRule(rule))
+	}
+	return rules, nil
+}
+
+// DeleteRule removes an automation rule, returning sql.ErrNoRows if it
+// doesn't exist
+func (m *MemoryStore) DeleteRule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findRule(id)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	m.rules = append(m.rules[:i], m.rules[i+1:]...)
+	return nil
+}
+
+// MarkRuleFired records when a rule last fired
+func (m *MemoryStore) MarkRuleFired(id int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.findRule(id); i >= 0 {
+		m.rules[i].LastFiredAt = &at
+	}
+	return nil
+}
+
+// --- Presets ---
+
+// findPreset returns the index of a device's preset, or -1. As with DB,
+// lookups ignore case but saving matches the name exactly (caller holds mu).
+func (m *MemoryStore) findPreset(deviceID int, name string, exact bool) int {
+	for i, p := range m.presets {
+		if p.DeviceID != deviceID {
+			continue
+		}
+		if p.Name == name || !exact && strings.EqualFold(p.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetPresets returns all presets for a device by ID
+func (m *MemoryStore) GetPresets(deviceID int) ([]Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var presets []Preset
+	for _, p := range m.presets {
+		if p.DeviceID == deviceID {
+			presets = append(presets, p)
+		}
+	}
+	return presets, nil
+}
+
+// GetPreset returns a preset by device and name, or nil if it doesn't exist
+func (m *MemoryStore) GetPreset(deviceID int, name string) (*Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findPreset(deviceID, name, false)
+	if i < 0 {
+		return nil, nil
+	}
+	p := m.presets[i]
+	return &p, nil
+}
+
+// SavePreset creates or replaces a preset by device and name
+func (m *MemoryStore) SavePreset(p *Preset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	saved := *p
+	saved.UpdatedAt = now
+	if i := m.findPreset(p.DeviceID, p.Name, true); i >= 0 {
+		saved.ID = m.presets[i].ID
+		saved.CreatedAt = m.presets[i].CreatedAt
+		m.presets[i] = saved
+		return nil
+	}
+
+	m.nextPreset++
+	saved.ID = m.nextPreset
+	saved.CreatedAt = now
+	m.presets = append(m.presets, saved)
+	return nil
+}
+
+// DeletePreset removes a preset by device and name, returning sql.ErrNoRows
+// if it doesn't exist
+func (m *MemoryStore) DeletePreset(deviceID int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findPreset(deviceID, name, false)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	m.presets = append(m.presets[:i], m.presets[i+1:]...)
+	return nil
+}
+
+// SetActivePreset records the preset a device is running, or clears it
+// when name is empty
+func (m *MemoryStore) SetActivePreset(deviceID int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.states[deviceID]; ok {
+		state.ActivePreset = name
+	}
+	return nil
+}
+
+// --- Command Outbox ---
+
+// EnqueueCommand stores a pending command and sets its ID, superseding any
+// pending command for the same device and field
+func (m *MemoryStore) EnqueueCommand(cmd *QueuedCommand) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i := range m.commands {
+		c := &m.commands[i]
+		if c.DeviceID == cmd.DeviceID && c.Field == cmd.Field && c.Status == CommandPending {
+			c.Status = CommandSuperseded
+			c.CompletedAt = &now
+		}
+	}
+
+	m.nextCmdID++
+	cmd.ID = m.nextCmdID
+	cmd.Status = CommandPending
+	cmd.CreatedAt = now
+	m.commands = append(m.commands, *cmd)
+	return nil
+}
+
+// findCommand returns the index of a command, or -1 (caller holds mu)
+func (m *MemoryStore) findCommand(id int) int {
+	for i := range m.commands {
+		if m.commands[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetCommand returns a queued command by ID, or nil if it doesn't exist
+func (m *MemoryStore) GetCommand(id int) (*QueuedCommand, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCommand(id)
+	if i < 0 {
+		return nil, nil
+	}
+	cmd := m.commands[i]
+	return &cmd, nil
+}
+
+// GetCommands returns queued commands, newest first. An empty status
+// returns commands in any state.
+func (m *MemoryStore) GetCommands(status CommandStatus, limit int) ([]QueuedCommand, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var commands []QueuedCommand
+	for i := len(m.commands) - 1; i >= 0 && len(commands) < limit; i-- {
+		if status == "" || m.commands[i].Status == status {
+			commands = append(commands, m.commands[i])
+		}
+	}
+	return commands, nil
+}
+
+// GetPendingCommands returns pending commands in the order they were queued
+func (m *MemoryStore) GetPendingCommands() ([]QueuedCommand, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var commands []QueuedCommand
+	for _, cmd := range m.commands {
+		if cmd.Status == CommandPending {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands, nil
+}
+
+// ClaimCommand marks a pending command as in flight. It returns
+// sql.ErrNoRows if the command doesn't exist or is no longer pending.
+func (m *MemoryStore) ClaimCommand(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCommand(id)
+	if i < 0 || m.commands[i].Status != CommandPending {
+		return sql.ErrNoRows
+	}
+	m.commands[i].Status = CommandInFlight
+	return nil
+}
+
+// CompleteCommand moves a command from status from to a final status. It
+// returns sql.ErrNoRows if the command doesn't exist or is no longer in from.
+func (m *MemoryStore) CompleteCommand(id int, from, to CommandStatus, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCommand(id)
+	if i < 0 || m.commands[i].Status != from {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	m.commands[i].Status = to
+	m.commands[i].Error = errMsg
+	m.commands[i].CompletedAt = &now
+	return nil
+}
+
+// NoteCommandAttempt records a failed replay attempt of an in-flight
+// command and returns it to pending
+func (m *MemoryStore) NoteCommandAttempt(id int, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.findCommand(id); i >= 0 && m.commands[i].Status == CommandInFlight {
+		m.commands[i].Attempts++
+		m.commands[i].Error = errMsg
+		m.commands[i].Status = CommandPending
+	}
+	return nil
+}
+
+// --- Reading History ---
+
+// SaveReading records a polled sample, ignoring one with the same device
+// and timestamp as an existing sample
+func (m *MemoryStore) SaveReading(r *Reading) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.readings {
+		if existing.DeviceID == r.DeviceID && existing.RecordedAt.Equal(r.RecordedAt) {
+			return nil
+		}
+	}
+	m.nextReading++
+	saved := *r
+	saved.ID = m.nextReading
+	m.readings = append(m.readings, saved)
+	return nil
+}
+
+// GetReadings returns raw readings for a device in [from, to), oldest
+// first. A deviceID of 0 returns readings for every device.
+func (m *MemoryStore) GetReadings(deviceID int, from, to time.Time) ([]Reading, error) {
+	var readings []Reading
+	err := m.EachReading(context.Background(), deviceID, from, to, func(r *Reading) error {
+		readings = append(readings, *r)
+		return nil
+	})
+	return readings, err
+}
+
+// EachReading calls fn for each raw reading GetReadings would return. An
+// error from fn stops the iteration.
+func (m *MemoryStore) EachReading(ctx context.Context, deviceID int, from, to time.Time, fn func(*Reading) error) error {
+	m.mu.Lock()
+	var matched []Reading
+	for _, r := range m.readings {
+		if deviceID != 0 && r.DeviceID != deviceID {
+			continue
+		}
+		if r.RecordedAt.Before(from) || !r.RecordedAt.Before(to) {
+			continue
+		}
+		matched = append(matched, r)
+	}
+	m.mu.Unlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].DeviceID != matched[j].DeviceID {
+			return matched[i].DeviceID < matched[j].DeviceID
+		}
+		return matched[i].RecordedAt.Before(matched[j].RecordedAt)
+	})
+	for i := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(&matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveAggregates creates or replaces aggregate buckets
+func (m *MemoryStore) SaveAggregates(resolution Resolution, aggregates []ReadingAggregate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buckets, ok := m.aggregates[resolution]
+	if !ok {
+		return fmt.Errorf("invalid aggregate resolution %q", resolution)
+	}
+	for _, a := range aggregates {
+		buckets[aggregateKey{a.DeviceID, a.BucketStart.UTC()}] = a
+	}
+	return nil
+}
+
+// GetAggregates returns aggregate buckets starting in [from, to), oldest
+// first. A deviceID of 0 returns buckets for every device.
+func (m *MemoryStore) GetAggregates(resolution Resolution, deviceID int, from, to time.Time) ([]ReadingAggregate, error) {
+	var aggregates []ReadingAggregate
+	err := m.EachAggregate(context.Background(), resolution, deviceID, from, to, func(a *ReadingAggregate) error {
+		aggregates = append(aggregates, *a)
+		return nil
+	})
+	return aggregates, err
+}
+
+// EachAggregate calls fn for each bucket GetAggregates would return. An
+// error from fn stops the iteration.
+func (m *MemoryStore) EachAggregate(ctx context.Context, resolution Resolution, deviceID int, from, to time.Time, fn func(*ReadingAggregate) error) error {
+	m.mu.Lock()
+	buckets, ok := m.aggregates[resolution]
+	var matched []ReadingAggregate
+	for _, a := range buckets {
+		if deviceID != 0 && a.DeviceID != deviceID {
+			continue
+		}
+		if a.BucketStart.Before(from) || !a.BucketStart.Before(to) {
+			continue
+		}
+		matched = append(matched, a)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("invalid aggregate resolution %q", resolution)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].DeviceID != matched[j].DeviceID {
+			return matched[i].DeviceID < matched[j].DeviceID
+		}
+		return matched[i].BucketStart.Before(matched[j].BucketStart)
+	})
+	for i := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(&matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneReadings deletes raw readings recorded before the given time
+func (m *MemoryStore) PruneReadings(olderThan time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.readings[:0]
+	for _, r := range m.readings {
+		if !r.RecordedAt.Before(olderThan) {
+			kept = append(kept, r)
+		}
+	}
+	pruned := int64(len(m.readings) - len(kept))
+	m.readings = kept
+	return pruned, nil
+}
+
+// PruneAggregates deletes aggregate buckets that started before the given time
+func (m *MemoryStore) PruneAggregates(resolution Resolution, olderThan time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buckets, ok := m.aggregates[resolution]
+	if !ok {
+		return 0, fmt.Errorf("invalid aggregate resolution %q", resolution)
+	}
+	var pruned int64
+	for key := range buckets {
+		if key.start.Before(olderThan) {
+			delete(buckets, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// --- HVAC Runtime ---
+
+// AddRuntime adds run minutes to the daily and hourly totals
+func (m *MemoryStore) AddRuntime(days []RuntimeDay, hours []RuntimeHour) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range days {
+		key := periodKey{d.DeviceID, d.Day}
+		total, ok := m.runtimeDays[key]
+		if !ok {
+			total = RuntimeDay{DeviceID: d.DeviceID, Day: d.Day}
+		}
+		total.Add(d.RuntimeTotals)
+		m.runtimeDays[key] = total
+	}
+	for _, h := range hours {
+		key := periodKey{h.DeviceID, h.Hour}
+		total, ok := m.runtimeHrs[key]
+		if !ok {
+			total = RuntimeHour{DeviceID: h.DeviceID, Hour: h.Hour}
+		}
+		total.Add(h.RuntimeTotals)
+		m.runtimeHrs[key] = total
+	}
+	return nil
+}
+
+// GetRuntimeDays retrieves daily runtime for days in [from, to], both
+// YYYY-MM-DD. A deviceID of 0 returns days for every device.
+func (m *MemoryStore) GetRuntimeDays(deviceID int, from, to string) ([]RuntimeDay, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var days []RuntimeDay
+	for key, d := range m.runtimeDays {
+		if inPeriod(key, deviceID, from, to) {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool {
+		if days[i].DeviceID != days[j].DeviceID {
+			return days[i].DeviceID < days[j].DeviceID
+		}
+		return days[i].Day < days[j].Day
+	})
+	return days, nil
+}
+
+// GetRuntimeHours retrieves hourly runtime for hours in [from, to], both
+// YYYY-MM-DDTHH, ordered by hour. A deviceID of 0 returns hours for every
+// device.
+func (m *MemoryStore) GetRuntimeHours(deviceID int, from, to string) ([]RuntimeHour, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hours []RuntimeHour
+	for key, h := range m.runtimeHrs {
+		if inPeriod(key, deviceID, from, to) {
+			hours = append(hours, h)
+		}
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		if hours[i].Hour != hours[j].Hour {
+			return hours[i].Hour < hours[j].Hour
+		}
+		return hours[i].DeviceID < hours[j].DeviceID
+	})
+	return hours, nil
+}
+
+// SaveRuntimeWeek stores a weekly summary. It returns false if the week was
+// already summarised for the device.
+func (m *MemoryStore) SaveRuntimeWeek(w *RuntimeWeek) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := periodKey{w.DeviceID, w.WeekStart}
+	if _, ok := m.runtimeWks[key]; ok {
+		return false, nil
+	}
+	saved := *w
+	saved.CreatedAt = time.Now().UTC()
+	m.runtimeWks[key] = saved
+	return true, nil
+}
+
+// GetRuntimeWeeks retrieves weekly summaries whose week starts in [from, to]
+func (m *MemoryStore) GetRuntimeWeeks(deviceID int, from, to string) ([]RuntimeWeek, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var weeks []RuntimeWeek
+	for key, w := range m.runtimeWks {
+		if key.deviceID == deviceID && inPeriod(key, deviceID, from, to) {
+			weeks = append(weeks, w)
+		}
+	}
+	sort.Slice(weeks, func(i, j int) bool { return weeks[i].WeekStart < weeks[j].WeekStart })
+	return weeks, nil
+}
+
+// inPeriod reports whether key is for deviceID, or any device if it is 0,
+// and falls in [from, to]
+func inPeriod(key periodKey, deviceID int, from, to string) bool {
+	if deviceID != 0 && key.deviceID != deviceID {
+		return false
+	}
+	return key.period >= from && key.period <= to
+}
+
+// --- Energy ---
+
+// SaveEnergyMonth records a monthly energy summary. It returns false if the
+// month was already summarised for the device.
+func (m *MemoryStore) SaveEnergyMonth(month *EnergyMonth) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := periodKey{month.DeviceID, month.Month}
+	if _, ok := m.energy[key]; ok {
+		return false, nil
+	}
+	saved := *month
+	saved.CreatedAt = time.Now().UTC()
+	m.energy[key] = saved
+	return true, nil
+}
+
+// --- Event Log Retention ---
+
+// PruneEventLogsMatching removes events matching match that are older than
+// the given time, leaving alone any that also match one of except
+func (m *MemoryStore) PruneEventLogsMatching(match EventLogMatch, olderThan time.Time, except []EventLogMatch) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prune := func(e *EventLog) bool {
+		if !e.Timestamp.Before(olderThan) || !match.matches(e) {
+			return false
+		}
+		for _, x := range except {
+			if x.matches(e) {
+				return false
+			}
+		}
+		return true
+	}
+
+	kept := m.events[:0]
+	for i := range m.events {
+		if !prune(&m.events[i]) {
+			kept = append(kept, m.events[i])
+		}
+	}
+	pruned := int64(len(m.events) - len(kept))
+	m.events = kept
+	return pruned, nil
+}
+
+// TrimEventLogs removes the oldest events beyond maxRows
+func (m *MemoryStore) TrimEventLogs(maxRows int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	excess := len(m.events) - max(maxRows, 0)
+	if excess <= 0 {
+		return 0, nil
+	}
+	m.events = append([]EventLog(nil), m.events[excess:]...)
+	return int64(excess), nil
+}
+
+// CountEventLogs returns the number of events in the log
+func (m *MemoryStore) CountEventLogs() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.events)), nil
+}
@@ -1,16 +1,37 @@
 package storage
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
 )
 
-// migrations holds all database migrations in order
-var migrations = []struct {
+// migration is one schema change. down reverts sql; an empty down marks
+// the migration as irreversible.
+type migration struct {
 	version int
 	name    string
 	sql     string
-}{
+	down    string
+}
+
+// checksum identifies the SQL a migration was applied with, so edits to
+// an already applied migration are caught
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.sql))
+	return hex.EncodeToString(sum[:])
+}
+
+// migrations holds all database migrations in order
+var migrations = []migration{
 	{
 		version: 1,
 		name:    "create_credentials_table",
@@ -23,6 +44,9 @@ var migrations = []struct {
 				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 			);
 		`,
+		down: `
+			DROP TABLE IF EXISTS credentials;
+		`,
 	},
 	{
 		version: 2,
@@ -43,6 +67,9 @@ var migrations = []struct {
 			);
 			CREATE INDEX IF NOT EXISTS idx_thermostat_device_id ON thermostat_state(device_id);
 		`,
+		down: `
+			DROP TABLE IF EXISTS thermostat_state;
+		`,
 	},
 	{
 		version: 3,
@@ -60,6 +87,9 @@ var migrations = []struct {
 			CREATE INDEX IF NOT EXISTS idx_event_log_source ON event_log(source);
 			CREATE INDEX IF NOT EXISTS idx_event_log_type ON event_log(event_type);
 		`,
+		down: `
+			DROP TABLE IF EXISTS event_log;
+		`,
 	},
 	{
 		version: 4,
@@ -76,6 +106,9 @@ var migrations = []struct {
 			);
 			INSERT OR IGNORE INTO matter_state (id) VALUES (1);
 		`,
+		down: `
+			DROP TABLE IF EXISTS matter_state;
+		`,
 	},
 	{
 		version: 5,
@@ -87,72 +120,623 @@ var migrations = []struct {
 				applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
 			);
 		`,
+		// The bookkeeping table itself is never dropped
+		down: "",
+	},
+	{
+		version: 6,
+		name:    "create_schedules_table",
+		sql: `
+			CREATE TABLE IF NOT EXISTS schedules (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				timezone TEXT NOT NULL DEFAULT 'Local',
+				enabled BOOLEAN DEFAULT TRUE,
+				periods JSON NOT NULL,
+				exceptions JSON,
+				last_applied_key TEXT,
+				last_applied_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_schedules_device_id ON schedules(device_id);
+		`,
+		down: `
+			DROP TABLE IF EXISTS schedules;
+		`,
+	},
+	{
+		version: 7,
+		name:    "create_presets_table",
+		sql: `
+			CREATE TABLE IF NOT EXISTS presets (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				system_mode TEXT,
+				heat_setpoint REAL,
+				cool_setpoint REAL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(device_id, name)
+			);
+			ALTER TABLE thermostat_state ADD COLUMN active_preset TEXT;
+		`,
+		down: `
+			ALTER TABLE thermostat_state DROP COLUMN active_preset;
+			DROP TABLE IF EXISTS presets;
+		`,
 	},
+	{
+		version: 8,
+		name:    "create_automation_rules_table",
+		sql: `
+			CREATE TABLE IF NOT EXISTS automation_rules (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id INTEGER NOT NULL DEFAULT 0,
+				name TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL DEFAULT 1,
+				dry_run BOOLEAN NOT NULL DEFAULT 0,
+				trigger_spec TEXT NOT NULL,
+				conditions TEXT,
+				actions TEXT NOT NULL,
+				cooldown_seconds INTEGER NOT NULL DEFAULT 0,
+				last_fired_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		down: `
+			DROP TABLE IF EXISTS automation_rules;
+		`,
+	},
+	{
+		version: 9,
+		name:    "create_command_outbox_table",
+		sql: `
+			CREATE TABLE IF NOT EXISTS command_outbox (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id INTEGER NOT NULL,
+				field TEXT NOT NULL,
+				setpoint REAL,
+				system_mode TEXT,
+				source TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				error TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				expires_at DATETIME NOT NULL,
+				completed_at DATETIME
+			);
+			CREATE INDEX IF NOT EXISTS idx_command_outbox_status ON command_outbox(status);
+		`,
+		down: `
+			DROP TABLE IF EXISTS command_outbox;
+		`,
+	},
+	{
+		version: 10,
+		name:    "add_event_log_correlation_id",
+		sql: `
+			ALTER TABLE event_log ADD COLUMN correlation_id TEXT;
+			CREATE INDEX IF NOT EXISTS idx_event_log_correlation_id ON event_log(correlation_id);
+			ALTER TABLE command_outbox ADD COLUMN correlation_id TEXT;
+		`,
+		down: `
+			ALTER TABLE command_outbox DROP COLUMN correlation_id;
+			DROP INDEX IF EXISTS idx_event_log_correlation_id;
+			ALTER TABLE event_log DROP COLUMN correlation_id;
+		`,
+	},
+	{
+		version: 11,
+		name:    "create_thermostat_readings_tables",
+		sql: `
+			CREATE TABLE IF NOT EXISTS thermostat_readings (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id INTEGER NOT NULL,
+				recorded_at DATETIME NOT NULL,
+				current_temp REAL NOT NULL,
+				heat_setpoint REAL,
+				cool_setpoint REAL,
+				system_mode TEXT,
+				humidity INTEGER,
+				is_heating BOOLEAN NOT NULL DEFAULT 0,
+				is_cooling BOOLEAN NOT NULL DEFAULT 0,
+				outdoor_temp REAL,
+				outdoor_humidity REAL,
+				UNIQUE(device_id, recorded_at)
+			);
+			CREATE TABLE IF NOT EXISTS thermostat_readings_hourly (
+				device_id INTEGER NOT NULL,
+				bucket_start DATETIME NOT NULL,
+				samples INTEGER NOT NULL,
+				temp_avg REAL NOT NULL,
+				temp_min REAL NOT NULL,
+				temp_max REAL NOT NULL,
+				heat_setpoint_avg REAL,
+				cool_setpoint_avg REAL,
+				humidity_avg REAL,
+				outdoor_temp_avg REAL,
+				outdoor_humidity_avg REAL,
+				heating_ratio REAL NOT NULL DEFAULT 0,
+				cooling_ratio REAL NOT NULL DEFAULT 0,
+				system_mode TEXT,
+				PRIMARY KEY (device_id, bucket_start)
+			);
+			CREATE TABLE IF NOT EXISTS thermostat_readings_daily (
+				device_id INTEGER NOT NULL,
+				bucket_start DATETIME NOT NULL,
+				samples INTEGER NOT NULL,
+				temp_avg REAL NOT NULL,
+				temp_min REAL NOT NULL,
+				temp_max REAL NOT NULL,
+				heat_setpoint_avg REAL,
+				cool_setpoint_avg REAL,
+				humidity_avg REAL,
+				outdoor_temp_avg REAL,
+				outdoor_humidity_avg REAL,
+				heating_ratio REAL NOT NULL DEFAULT 0,
+				cooling_ratio REAL NOT NULL DEFAULT 0,
+				system_mode TEXT,
+				PRIMARY KEY (device_id, bucket_start)
+			);
+		`,
+		down: `
+			DROP TABLE IF EXISTS thermostat_readings_daily;
+			DROP TABLE IF EXISTS thermostat_readings_hourly;
+			DROP TABLE IF EXISTS thermostat_readings;
+		`,
+	},
+	{
+		version: 12,
+		name:    "create_hvac_runtime_tables",
+		sql: `
+			CREATE TABLE IF NOT EXISTS hvac_runtime_daily (
+				device_id INTEGER NOT NULL,
+				day TEXT NOT NULL,
+				heating_minutes REAL NOT NULL DEFAULT 0,
+				cooling_minutes REAL NOT NULL DEFAULT 0,
+				fan_minutes REAL NOT NULL DEFAULT 0,
+				observed_minutes REAL NOT NULL DEFAULT 0,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (device_id, day)
+			);
+			CREATE TABLE IF NOT EXISTS hvac_runtime_weekly (
+				device_id INTEGER NOT NULL,
+				week_start TEXT NOT NULL,
+				days INTEGER NOT NULL,
+				heating_minutes REAL NOT NULL,
+				cooling_minutes REAL NOT NULL,
+				fan_minutes REAL NOT NULL,
+				observed_minutes REAL NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (device_id, week_start)
+			);
+		`,
+		down: `
+			DROP TABLE IF EXISTS hvac_runtime_weekly;
+			DROP TABLE IF EXISTS hvac_runtime_daily;
+		`,
+	},
+	{
+		version: 13,
+		name:    "add_credentials_key_version",
+		sql: `
+			ALTER TABLE credentials ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1;
+		`,
+		down: `
+			ALTER TABLE credentials DROP COLUMN key_version;
+		`,
+	},
+	{
+		version: 14,
+		name:    "add_event_log_device_id",
+		sql: `
+			ALTER TABLE event_log ADD COLUMN device_id INTEGER;
+			UPDATE event_log SET device_id = json_extract(CAST(details AS TEXT), '$.device_id')
+				WHERE details IS NOT NULL AND json_valid(CAST(details AS TEXT));
+			CREATE INDEX IF NOT EXISTS idx_event_log_device_id ON event_log(device_id);
+		`,
+		down: `
+			DROP INDEX IF EXISTS idx_event_log_device_id;
+			ALTER TABLE event_log DROP COLUMN device_id;
+		`,
+	},
+	{
+		version: 15,
+		name:    "add_matter_state_commissioning",
+		sql: `
+			ALTER TABLE matter_state ADD COLUMN fabrics TEXT;
+			ALTER TABLE matter_state ADD COLUMN commissioned_at DATETIME;
+			ALTER TABLE matter_state ADD COLUMN decommissioned_at DATETIME;
+			ALTER TABLE matter_state ADD COLUMN verified_at DATETIME;
+		`,
+		down: `
+			ALTER TABLE matter_state DROP COLUMN verified_at;
+			ALTER TABLE matter_state DROP COLUMN decommissioned_at;
+			ALTER TABLE matter_state DROP COLUMN commissioned_at;
+			ALTER TABLE matter_state DROP COLUMN fabrics;
+		`,
+	},
+	{
+		version: 16,
+		name:    "create_device_settings_table",
+		sql: `
+			CREATE TABLE IF NOT EXISTS device_settings (
+				device_id INTEGER PRIMARY KEY,
+				display_name TEXT,
+				hide_from_matter BOOLEAN NOT NULL DEFAULT FALSE,
+				temp_offset REAL NOT NULL DEFAULT 0,
+				temperature_unit TEXT,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		down: `
+			DROP TABLE IF EXISTS device_settings;
+		`,
+	},
+	{
+		version: 17,
+		name:    "create_energy_tables",
+		sql: `
+			CREATE TABLE IF NOT EXISTS hvac_runtime_hourly (
+				device_id INTEGER NOT NULL,
+				hour TEXT NOT NULL,
+				heating_minutes REAL NOT NULL DEFAULT 0,
+				cooling_minutes REAL NOT NULL DEFAULT 0,
+				fan_minutes REAL NOT NULL DEFAULT 0,
+				observed_minutes REAL NOT NULL DEFAULT 0,
+				PRIMARY KEY (device_id, hour)
+			);
+			CREATE INDEX IF NOT EXISTS idx_hvac_runtime_hourly_hour ON hvac_runtime_hourly(hour);
+			CREATE TABLE IF NOT EXISTS energy_monthly (
+				device_id INTEGER NOT NULL,
+				month TEXT NOT NULL,
+				electric_kwh REAL NOT NULL,
+				fuel_used REAL NOT NULL,
+				cost REAL NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (device_id, month)
+			);
+		`,
+		down: `
+			DROP TABLE IF EXISTS energy_monthly;
+			DROP TABLE IF EXISTS hvac_runtime_hourly;
+		`,
+	},
+	{
+		version: 18,
+		name:    "create_matter_endpoints_table",
+		sql: `
+			CREATE TABLE IF NOT EXISTS matter_endpoints (
+				device_id INTEGER PRIMARY KEY,
+				endpoint INTEGER NOT NULL UNIQUE,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		down: `
+			DROP TABLE IF EXISTS matter_endpoints;
+		`,
+	},
+	{
+		version: 19,
+		name:    "add_matter_humidity_endpoints",
+		sql: `
+			ALTER TABLE matter_endpoints ADD COLUMN humidity_endpoint INTEGER;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_matter_endpoints_humidity ON matter_endpoints(humidity_endpoint);
+		`,
+		down: `
+			DROP INDEX IF EXISTS idx_matter_endpoints_humidity;
+			ALTER TABLE matter_endpoints DROP COLUMN humidity_endpoint;
+		`,
+	},
+	{
+		// TCC reports readings above 100% (and sometimes 0) when it has no
+		// humidity sensor value; those become NULL. Writing 0 back on the
+		// way down would invent readings TCC never made, and earlier
+		// versions overwrite the value on their next poll, so going back
+		// only needs the version.
+		version: 20,
+		name:    "clear_invalid_humidity",
+		sql: `
+			UPDATE thermostat_state SET humidity = NULL WHERE humidity = 0 OR humidity > 100;
+		`,
+		down: `
+			SELECT 1;
+		`,
+	},
+	{
+		version: 21,
+		name:    "add_thermostat_outdoor_temp",
+		sql: `
+			ALTER TABLE thermostat_state ADD COLUMN outdoor_temp REAL;
+		`,
+		down: `
+			ALTER TABLE thermostat_state DROP COLUMN outdoor_temp;
+		`,
+	},
+	{
+		// Event times were written in local time with its offset, which
+		// doesn't sort as text across offset changes. Rows written without
+		// an offset by CURRENT_TIMESTAMP are already UTC. Earlier versions
+		// read the UTC times too, so going back only needs the version.
+		version: 22,
+		name:    "event_log_utc_timestamps",
+		sql: `
+			UPDATE event_log SET timestamp = strftime('%Y-%m-%d %H:%M:%f+00:00', timestamp)
+			WHERE timestamp LIKE '%+__:__' OR timestamp LIKE '%-__:__';
+		`,
+		down: `
+			SELECT 1;
+		`,
+	},
+}
+
+// Migration directions
+const (
+	MigrationUp   = "up"
+	MigrationDown = "down"
+)
+
+// MigrationStep is one migration to apply or revert
+type MigrationStep struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	SQL       string `json:"sql"`
+}
+
+// MigrationStatus describes a migration known to this build or recorded in
+// the database
+type MigrationStatus struct {
+	Version    int        `json:"version"`
+	Name       string     `json:"name"`
+	Applied    bool       `json:"applied"`
+	AppliedAt  *time.Time `json:"applied_at,omitempty"`
+	Reversible bool       `json:"reversible"`
+	// Unknown is set for applied migrations this build does not know,
+	// left behind by a newer release
+	Unknown bool `json:"unknown"`
+	// ChecksumMismatch is set when an applied migration's SQL differs
+	// from this build's
+	ChecksumMismatch bool `json:"checksum_mismatch"`
 }
 
-// RunMigrations applies all pending migrations
-func RunMigrations(db *sql.DB) error {
-	// Ensure migrations table exists
+// preMigrateBackupsKept is how many automatic pre-migration backups are
+// kept beside the database
+const preMigrateBackupsKept = 3
+
+// ensureMigrationsTable creates the bookkeeping table, adding the checksum
+// column to databases created before it existed
+func ensureMigrationsTable(db *sql.DB) error {
 	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS schema_migrations (
 			version INTEGER PRIMARY KEY,
 			name TEXT NOT NULL,
-			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			checksum TEXT
 		);
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to create migrations table: %w", err)
 	}
 
-	// Get current version
-	var currentVersion int
-	row := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
-	if err := row.Scan(&currentVersion); err != nil {
-		return fmt.Errorf("failed to get current version: %w", err)
+	rows, err := db.Query("SELECT name FROM pragma_table_info('schema_migrations') WHERE name = 'checksum'")
+	if err != nil {
+		return fmt.Errorf("failed to inspect migrations table: %w", err)
+	}
+	hasChecksum := rows.Next()
+	rows.Close()
+
+	if !hasChecksum {
+		if _, err := db.Exec("ALTER TABLE schema_migrations ADD COLUMN checksum TEXT"); err != nil {
+			return fmt.Errorf("failed to add migration checksums: %w", err)
+		}
+	}
+	return nil
+}
+
+// VerifyMigrations checks applied migrations against this build's SQL.
+// Migrations recorded before checksums existed are trusted and have their
+// checksum filled in.
+func VerifyMigrations(db *sql.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
 	}
 
-	// Apply pending migrations
 	for _, m := range migrations {
-		if m.version <= currentVersion {
+		a, ok := applied[m.version]
+		if !ok {
 			continue
 		}
-
-		// Skip the migrations table creation since we already did it
-		if m.name == "create_migrations_table" {
-			_, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+		if !a.checksum.Valid {
+			_, err := db.Exec("UPDATE schema_migrations SET checksum = ? WHERE version = ?", m.checksum(), m.version)
 			if err != nil {
-				return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+				return fmt.Errorf("failed to record checksum for migration %d: %w", m.version, err)
+			}
+			continue
+		}
+		if a.checksum.String != m.checksum() {
+			return fmt.Errorf("migration %d (%s) was applied with different SQL than this build has", m.version, m.name)
+		}
+	}
+	return nil
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	name      string
+	appliedAt sql.NullTime
+	checksum  sql.NullString
+}
+
+// appliedMigrations returns the recorded migrations by version
+func appliedMigrations(db *sql.DB) (map[int]appliedMigration, error) {
+	rows, err := db.Query("SELECT version, name, applied_at, checksum FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.name, &a.appliedAt, &a.checksum); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = a
+	}
+	return applied, rows.Err()
+}
+
+// GetMigrationStatus lists every migration this build knows, followed by
+// any applied migrations it does not
+func GetMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{Version: m.version, Name: m.name, Reversible: m.down != ""}
+		if a, ok := applied[m.version]; ok {
+			st.Applied = true
+			if a.appliedAt.Valid {
+				st.AppliedAt = &a.appliedAt.Time
+			}
+			st.ChecksumMismatch = a.checksum.Valid && a.checksum.String != m.checksum()
+			delete(applied, m.version)
+		}
+		statuses = append(statuses, st)
+	}
+
+	var unknown []int
+	for version := range applied {
+		unknown = append(unknown, version)
+	}
+	sort.Ints(unknown)
+	for _, version := range unknown {
+		a := applied[version]
+		st := MigrationStatus{Version: version, Name: a.name, Applied: true, Unknown: true}
+		if a.appliedAt.Valid {
+			st.AppliedAt = &a.appliedAt.Time
+		}
+		statuses = append(statuses, st)
+	}
+
+	return statuses, nil
+}
+
+// PlanMigrations returns the steps that move the schema from its current
+// version to target: pending migrations in order when going up, applied
+// ones in reverse when going down
+func PlanMigrations(db *sql.DB, target int) ([]MigrationStep, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	current, err := GetMigrationVersion(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current version: %w", err)
+	}
+	if target < 0 || target > LatestMigrationVersion() {
+		return nil, fmt.Errorf("unknown migration version %d (latest is %d)", target, LatestMigrationVersion())
+	}
+
+	var steps []MigrationStep
+	if target >= current {
+		for _, m := range migrations {
+			if m.version > current && m.version <= target {
+				steps = append(steps, MigrationStep{Version: m.version, Name: m.name, Direction: MigrationUp, SQL: m.sql})
 			}
+		}
+		return steps, nil
+	}
+
+	if current > LatestMigrationVersion() {
+		return nil, fmt.Errorf("database is at version %d, which this build does not know how to revert", current)
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
 			continue
 		}
+		if m.down == "" {
+			return nil, fmt.Errorf("migration %d (%s) cannot be reverted", m.version, m.name)
+		}
+		steps = append(steps, MigrationStep{Version: m.version, Name: m.name, Direction: MigrationDown, SQL: m.down})
+	}
+	return steps, nil
+}
 
+// ApplyMigrations runs planned steps, each in its own transaction
+func ApplyMigrations(db *sql.DB, steps []MigrationStep) error {
+	for _, step := range steps {
 		tx, err := db.Begin()
 		if err != nil {
-			return fmt.Errorf("failed to begin transaction for migration %d: %w", m.version, err)
+			return fmt.Errorf("failed to begin transaction for migration %d: %w", step.Version, err)
 		}
 
-		_, err = tx.Exec(m.sql)
-		if err != nil {
+		if _, err := tx.Exec(step.SQL); err != nil {
 			tx.Rollback()
-			return fmt.Errorf("failed to execute migration %d (%s): %w", m.version, m.name, err)
+			return fmt.Errorf("failed to %s migration %d (%s): %w", directionVerb(step.Direction), step.Version, step.Name, err)
 		}
 
-		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+		if step.Direction == MigrationDown {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", step.Version)
+		} else {
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)",
+				step.Version, step.Name, checksumFor(step.Version))
+		}
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+			return fmt.Errorf("failed to record migration %d: %w", step.Version, err)
 		}
 
 		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
+			return fmt.Errorf("failed to commit migration %d: %w", step.Version, err)
 		}
 
-		fmt.Printf("Applied migration %d: %s\n", m.version, m.name)
+		if step.Direction == MigrationDown {
+			log.Info("Reverted migration %d: %s", step.Version, step.Name)
+		} else {
+			log.Info("Applied migration %d: %s", step.Version, step.Name)
+		}
 	}
-
 	return nil
 }
 
+// directionVerb names a direction for error messages
+func directionVerb(direction string) string {
+	if direction == MigrationDown {
+		return "revert"
+	}
+	return "execute"
+}
+
+// checksumFor returns the checksum of a known migration
+func checksumFor(version int) string {
+	for _, m := range migrations {
+		if m.version == version {
+			return m.checksum()
+		}
+	}
+	return ""
+}
+
 // GetMigrationVersion returns the current schema version
 func GetMigrationVersion(db *sql.DB) (int, error) {
 	var version int
@@ -162,3 +746,93 @@ func GetMigrationVersion(db *sql.DB) (int, error) {
 	}
 	return version, nil
 }
+
+// Migrate moves the schema to target. Unless the database is new, a copy
+// is taken beside it first, named <db>.pre-migrate-v<version>-<time>.
+func (db *DB) Migrate(ctx context.Context, target int) error {
+	if err := VerifyMigrations(db.conn); err != nil {
+		return err
+	}
+
+	current, err := GetMigrationVersion(db.conn)
+	if err != nil {
+		return fmt.Errorf("failed to get current version: %w", err)
+	}
+	steps, err := PlanMigrations(db.conn, target)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+
+	log.Info("Migrating database from version %d to %d (%d step(s))", current, target, len(steps))
+	if current > 0 {
+		path := fmt.Sprintf("%s.pre-migrate-v%d-%s", db.path, current, time.Now().Format("20060102-150405"))
+		if err := db.BackupTo(ctx, path); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("failed to back up database before migrating: %w", err)
+		}
+		log.Info("Backed up database to %s", path)
+		db.prunePreMigrateBackups()
+	}
+
+	return ApplyMigrations(db.conn, steps)
+}
+
+// upgrade applies pending migrations as the database is opened. A schema
+// newer than this build is left alone so a rollback to an older release
+// still starts.
+func (db *DB) upgrade() error {
+	if err := ensureMigrationsTable(db.conn); err != nil {
+		return err
+	}
+
+	current, err := GetMigrationVersion(db.conn)
+	if err != nil {
+		return fmt.Errorf("failed to get current version: %w", err)
+	}
+	if latest := LatestMigrationVersion(); current > latest {
+		log.Warn("Database schema version %d is newer than this build supports (%d); run \"tcc-bridge migrate down --to %d\" with the newer release to downgrade it", current, latest, latest)
+		return nil
+	}
+
+	return db.Migrate(context.Background(), LatestMigrationVersion())
+}
+
+// prunePreMigrateBackups removes all but the newest automatic backups
+func (db *DB) prunePreMigrateBackups() {
+	paths, err := filepath.Glob(db.path + ".pre-migrate-v*")
+	if err != nil || len(paths) <= preMigrateBackupsKept {
+		return
+	}
+
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			modTimes[p] = info.ModTime()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modTimes[paths[i]].After(modTimes[paths[j]]) })
+
+	for _, p := range paths[preMigrateBackupsKept:] {
+		if err := os.Remove(p); err != nil {
+			log.Warn("Failed to remove old migration backup %s: %v", p, err)
+		}
+	}
+}
+
+// MigrationStatus lists the state of every migration
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	return GetMigrationStatus(db.conn)
+}
+
+// PlanMigrations returns the steps Migrate would run for target
+func (db *DB) PlanMigrations(target int) ([]MigrationStep, error) {
+	return PlanMigrations(db.conn, target)
+}
+
+// MigrationVersion returns the current schema version
+func (db *DB) MigrationVersion() (int, error) {
+	return GetMigrationVersion(db.conn)
+}
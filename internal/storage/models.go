@@ -10,6 +10,7 @@ type Credentials struct {
 	ID                int       `json:"id"`
 	Username          string    `json:"username"`
 	PasswordEncrypted []byte    `json:"-"`
+	KeyVersion        int       `json:"key_version"` // Encryption key version of PasswordEncrypted
 	CreatedAt         time.Time `json:"created_at"`
 	UpdatedAt         time.Time `json:"updated_at"`
 }
@@ -69,9 +70,11 @@ type ThermostatState struct {
 	HeatSetpoint  float64    `json:"heat_setpoint"`
 	CoolSetpoint  float64    `json:"cool_setpoint"`
 	SystemMode    SystemMode `json:"system_mode"`
-	Humidity      int        `json:"humidity"`
+	Humidity      *int       `json:"humidity"` // nil when TCC had no valid reading
 	IsHeating     bool       `json:"is_heating"`
 	IsCooling     bool       `json:"is_cooling"`
+	OutdoorTemp   *float64   `json:"outdoor_temp,omitempty"` // nil without an outdoor sensor
+	ActivePreset  string     `json:"active_preset,omitempty"`
 	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
@@ -79,11 +82,13 @@ type ThermostatState struct {
 type EventSource string
 
 const (
-	EventSourceTCC     EventSource = "tcc"
-	EventSourceMatter  EventSource = "matter"
-	EventSourceHomeKit EventSource = "homekit"
-	EventSourceUser    EventSource = "user"
-	EventSourceSystem  EventSource = "system"
+	EventSourceTCC        EventSource = "tcc"
+	EventSourceMatter     EventSource = "matter"
+	EventSourceHomeKit    EventSource = "homekit"
+	EventSourceUser       EventSource = "user"
+	EventSourceSystem     EventSource = "system"
+	EventSourceSchedule   EventSource = "schedule"
+	EventSourceAutomation EventSource = "automation"
 )
 
 // EventType represents the type of event
@@ -98,35 +103,304 @@ const (
 	EventTypeError         EventType = "error"
 	EventTypeInfo          EventType = "info"
 	EventTypeStateChange   EventType = "state_change"
+	EventTypeConflict      EventType = "conflict"
+	EventTypeSchedule      EventType = "schedule"
+	EventTypePreset        EventType = "preset"
+	EventTypeAutomation    EventType = "automation"
+	EventTypeCommand       EventType = "command"
+	EventTypeRuntime       EventType = "runtime"
+	EventTypeSettings      EventType = "settings"
+	EventTypeEnergy        EventType = "energy"
 )
 
 // EventLog represents a log entry
 type EventLog struct {
-	ID        int             `json:"id"`
-	Timestamp time.Time       `json:"timestamp"`
-	Source    EventSource     `json:"source"`
-	EventType EventType       `json:"event_type"`
-	Message   string          `json:"message"`
-	Details   json.RawMessage `json:"details,omitempty"`
+	ID            int             `json:"id"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Source        EventSource     `json:"source"`
+	EventType     EventType       `json:"event_type"`
+	Message       string          `json:"message"`
+	Details       json.RawMessage `json:"details,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	DeviceID      int             `json:"device_id,omitempty"`
 }
 
 // EventLogFilter for querying events
 type EventLogFilter struct {
-	Source    *EventSource
-	EventType *EventType
-	Since     *time.Time
-	Until     *time.Time
-	Limit     int
-	Offset    int
+	Source        *EventSource
+	EventType     *EventType
+	CorrelationID string
+	DeviceID      int    // 0 matches all devices
+	Search        string // free text matched against message and details
+	Since         *time.Time
+	Until         *time.Time
+	BeforeID      int // cursor: only events older than this ID
+	Limit         int
+	Offset        int
 }
 
 // MatterState stores Matter commissioning state
 type MatterState struct {
-	ID              int       `json:"id"`
-	IsCommissioned  bool      `json:"is_commissioned"`
-	FabricID        string    `json:"fabric_id,omitempty"`
-	NodeID          string    `json:"node_id,omitempty"`
-	QRCode          string    `json:"qr_code,omitempty"`
-	ManualPairCode  string    `json:"manual_pair_code,omitempty"`
+	ID               int            `json:"id"`
+	IsCommissioned   bool           `json:"is_commissioned"`
+	FabricID         string         `json:"fabric_id,omitempty"` // First fabric, kept for older clients
+	NodeID           string         `json:"node_id,omitempty"`
+	Fabrics          []MatterFabric `json:"fabrics,omitempty"`
+	QRCode           string         `json:"qr_code,omitempty"`
+	ManualPairCode   string         `json:"manual_pair_code,omitempty"`
+	CommissionedAt   *time.Time     `json:"commissioned_at,omitempty"`
+	DecommissionedAt *time.Time     `json:"decommissioned_at,omitempty"`
+	VerifiedAt       *time.Time     `json:"verified_at,omitempty"` // Last time the running bridge confirmed this state
+	UpdatedAt        time.Time      `json:"updated_at"`
+}
+
+// MatterFabric is a controller (HomeKit, Google Home, ...) the bridge is
+// commissioned into
+type MatterFabric struct {
+	FabricIndex int    `json:"fabric_index"`
+	FabricID    string `json:"fabric_id"`
+	NodeID      string `json:"node_id"`
+	VendorID    int    `json:"vendor_id,omitempty"`
+	Label       string `json:"label,omitempty"`
+}
+
+// MatterEndpoint is the Matter endpoint numbers a device is bridged on.
+// Numbers are never reused, so controllers keep a device's room and name.
+type MatterEndpoint struct {
+	DeviceID         int       `json:"device_id"`
+	Endpoint         int       `json:"endpoint"`                    // Thermostat
+	HumidityEndpoint int       `json:"humidity_endpoint,omitempty"` // Companion humidity sensor; 0 until assigned
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// DeviceSettings are local overrides for how a TCC device is presented
+type DeviceSettings struct {
+	DeviceID        int       `json:"device_id"`
+	DisplayName     string    `json:"display_name,omitempty"`     // Replaces the TCC name when set
+	HideFromMatter  bool      `json:"hide_from_matter"`           // Keeps the device out of Matter/HomeKit
+	TempOffset      float64   `json:"temp_offset"`                // Added to temperature readings, in the device's units
+	TemperatureUnit string    `json:"temperature_unit,omitempty"` // "F" or "C" for display; empty follows TCC
 	UpdatedAt       time.Time `json:"updated_at"`
 }
+
+// Schedule is a weekly thermostat program for one device
+type Schedule struct {
+	ID             int                 `json:"id"`
+	DeviceID       int                 `json:"device_id"`
+	Name           string              `json:"name"`
+	Timezone       string              `json:"timezone"`
+	Enabled        bool                `json:"enabled"`
+	Periods        []SchedulePeriod    `json:"periods"`
+	Exceptions     []ScheduleException `json:"exceptions,omitempty"`
+	LastAppliedKey string              `json:"-"`
+	LastAppliedAt  *time.Time          `json:"last_applied_at,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+	UpdatedAt      time.Time           `json:"updated_at"`
+}
+
+// SchedulePeriod sets mode and setpoints from a time of day on given weekdays
+type SchedulePeriod struct {
+	Days         []string `json:"days"`  // "sun".."sat"
+	Start        string   `json:"start"` // "HH:MM" in the schedule timezone
+	SystemMode   string   `json:"system_mode,omitempty"`
+	HeatSetpoint *float64 `json:"heat_setpoint,omitempty"`
+	CoolSetpoint *float64 `json:"cool_setpoint,omitempty"`
+}
+
+// ScheduleException overrides the weekly program on a single date
+type ScheduleException struct {
+	Date         string   `json:"date"`            // "YYYY-MM-DD" in the schedule timezone
+	Start        string   `json:"start,omitempty"` // "HH:MM", defaults to start of day
+	End          string   `json:"end,omitempty"`   // "HH:MM", defaults to end of day
+	Skip         bool     `json:"skip,omitempty"`  // Suppress scheduled changes instead of overriding them
+	SystemMode   string   `json:"system_mode,omitempty"`
+	HeatSetpoint *float64 `json:"heat_setpoint,omitempty"`
+	CoolSetpoint *float64 `json:"cool_setpoint,omitempty"`
+}
+
+// Preset is a named comfort setting for a device
+type Preset struct {
+	ID           int       `json:"id"`
+	DeviceID     int       `json:"device_id"`
+	Name         string    `json:"name"`
+	SystemMode   string    `json:"system_mode,omitempty"` // Empty keeps the current mode
+	HeatSetpoint *float64  `json:"heat_setpoint,omitempty"`
+	CoolSetpoint *float64  `json:"cool_setpoint,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// AutomationRule runs actions when a trigger fires and all conditions hold
+type AutomationRule struct {
+	ID              int             `json:"id"`
+	DeviceID        int             `json:"device_id"` // 0 applies to every device
+	Name            string          `json:"name"`
+	Enabled         bool            `json:"enabled"`
+	DryRun          bool            `json:"dry_run"` // Record what would fire without acting
+	Trigger         RuleTrigger     `json:"trigger"`
+	Conditions      []RuleCondition `json:"conditions,omitempty"`
+	Actions         []RuleAction    `json:"actions"`
+	CooldownSeconds int             `json:"cooldown_seconds"` // Minimum time between firings per device
+	LastFiredAt     *time.Time      `json:"last_fired_at,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// RuleTrigger decides when a rule is evaluated
+type RuleTrigger struct {
+	Type string `json:"type"` // "state_change", "time" or "event"
+
+	// state_change: field that must change, empty for any
+	Field string `json:"field,omitempty"`
+
+	// time: "HH:MM" local time, optionally limited to weekdays ("sun".."sat")
+	At   string   `json:"at,omitempty"`
+	Days []string `json:"days,omitempty"`
+
+	// event: event log entries to match, empty fields match anything
+	EventSource     EventSource `json:"event_source,omitempty"`
+	EventType       EventType   `json:"event_type,omitempty"`
+	MessageContains string      `json:"message_contains,omitempty"`
+}
+
+// RuleCondition must hold for a triggered rule to fire
+type RuleCondition struct {
+	Type  string  `json:"type"`            // "indoor_temp", "outdoor_temp", "humidity", "mode" or "time_window"
+	Op    string  `json:"op,omitempty"`    // "<", "<=", ">", ">=", "==", "!=" for numeric conditions
+	Value float64 `json:"value,omitempty"` // Compared against numeric conditions
+	Mode  string  `json:"mode,omitempty"`  // mode condition: required system mode
+	Start string  `json:"start,omitempty"` // time_window: "HH:MM" local time
+	End   string  `json:"end,omitempty"`   // time_window: "HH:MM", may wrap past midnight
+}
+
+// RuleAction is something a rule does when it fires
+type RuleAction struct {
+	Type    string   `json:"type"` // "set_heat_setpoint", "set_cool_setpoint", "set_mode", "webhook" or "log"
+	Value   *float64 `json:"value,omitempty"`
+	Mode    string   `json:"mode,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// CommandStatus is the state of a queued command
+type CommandStatus string
+
+const (
+	CommandPending    CommandStatus = "pending"
+	CommandInFlight   CommandStatus = "in_flight" // Being sent to TCC by a replay
+	CommandApplied    CommandStatus = "applied"
+	CommandFailed     CommandStatus = "failed"
+	CommandExpired    CommandStatus = "expired"
+	CommandCancelled  CommandStatus = "cancelled"
+	CommandSuperseded CommandStatus = "superseded"
+)
+
+// QueuedCommand is a user command waiting for TCC to become reachable
+type QueuedCommand struct {
+	ID            int           `json:"id"`
+	DeviceID      int           `json:"device_id"`
+	Field         string        `json:"field"` // "heat_setpoint", "cool_setpoint" or "system_mode"
+	Setpoint      *float64      `json:"setpoint,omitempty"`
+	SystemMode    string        `json:"system_mode,omitempty"`
+	Source        EventSource   `json:"source"`
+	Status        CommandStatus `json:"status"`
+	Attempts      int           `json:"attempts"`
+	Error         string        `json:"error,omitempty"`
+	CorrelationID string        `json:"correlation_id,omitempty"` // Request that queued the command
+	CreatedAt     time.Time     `json:"created_at"`
+	ExpiresAt     time.Time     `json:"expires_at"`
+	CompletedAt   *time.Time    `json:"completed_at,omitempty"`
+}
+
+// Reading is a single polled thermostat sample
+type Reading struct {
+	ID              int       `json:"id"`
+	DeviceID        int       `json:"device_id"`
+	RecordedAt      time.Time `json:"recorded_at"`
+	CurrentTemp     float64   `json:"current_temp"`
+	HeatSetpoint    float64   `json:"heat_setpoint"`
+	CoolSetpoint    float64   `json:"cool_setpoint"`
+	SystemMode      string    `json:"system_mode"`
+	Humidity        *int      `json:"humidity,omitempty"` // nil when TCC had no valid reading
+	IsHeating       bool      `json:"is_heating"`
+	IsCooling       bool      `json:"is_cooling"`
+	OutdoorTemp     *float64  `json:"outdoor_temp,omitempty"`
+	OutdoorHumidity *float64  `json:"outdoor_humidity,omitempty"`
+}
+
+// Resolution selects raw readings or one of the aggregate tables
+type Resolution string
+
+const (
+	ResolutionRaw    Resolution = "raw"
+	ResolutionHourly Resolution = "hourly"
+	ResolutionDaily  Resolution = "daily"
+)
+
+// ReadingAggregate summarises the readings of one device over a bucket
+type ReadingAggregate struct {
+	DeviceID        int       `json:"-"`
+	BucketStart     time.Time `json:"time"`
+	Samples         int       `json:"samples"`
+	TempAvg         float64   `json:"current_temp"`
+	TempMin         float64   `json:"min_temp"`
+	TempMax         float64   `json:"max_temp"`
+	HeatSetpoint    *float64  `json:"heat_setpoint,omitempty"`
+	CoolSetpoint    *float64  `json:"cool_setpoint,omitempty"`
+	Humidity        *float64  `json:"humidity,omitempty"`
+	OutdoorTemp     *float64  `json:"outdoor_temp,omitempty"`
+	OutdoorHumidity *float64  `json:"outdoor_humidity,omitempty"`
+	HeatingRatio    float64   `json:"heating_ratio"`         // Share of samples with heat running
+	CoolingRatio    float64   `json:"cooling_ratio"`         // Share of samples with cooling running
+	SystemMode      string    `json:"system_mode,omitempty"` // Mode at the end of the bucket
+}
+
+// RuntimeTotals are equipment run minutes over some period. Observed is how
+// much of the period was covered by polls close enough together to count.
+type RuntimeTotals struct {
+	HeatingMinutes  float64 `json:"heating_minutes"`
+	CoolingMinutes  float64 `json:"cooling_minutes"`
+	FanMinutes      float64 `json:"fan_minutes"`
+	ObservedMinutes float64 `json:"observed_minutes"`
+}
+
+// Add sums another period into t
+func (t *RuntimeTotals) Add(o RuntimeTotals) {
+	t.HeatingMinutes += o.HeatingMinutes
+	t.CoolingMinutes += o.CoolingMinutes
+	t.FanMinutes += o.FanMinutes
+	t.ObservedMinutes += o.ObservedMinutes
+}
+
+// RuntimeDay is a device's equipment runtime for one local day
+type RuntimeDay struct {
+	DeviceID int    `json:"-"`
+	Day      string `json:"day"` // YYYY-MM-DD
+	RuntimeTotals
+}
+
+// RuntimeHour is a device's equipment runtime for one local hour
+type RuntimeHour struct {
+	DeviceID int    `json:"-"`
+	Hour     string `json:"hour"` // YYYY-MM-DDTHH
+	RuntimeTotals
+}
+
+// RuntimeWeek is a device's runtime summary for a Monday-to-Sunday week
+type RuntimeWeek struct {
+	DeviceID  int       `json:"-"`
+	WeekStart string    `json:"week_start"` // YYYY-MM-DD of the Monday
+	Days      int       `json:"days"`       // Days with any observed time
+	CreatedAt time.Time `json:"created_at"`
+	RuntimeTotals
+}
+
+// EnergyMonth records that a device's monthly energy cost summary was logged
+type EnergyMonth struct {
+	DeviceID    int       `json:"device_id"`
+	Month       string    `json:"month"` // YYYY-MM
+	ElectricKWh float64   `json:"electric_kwh"`
+	FuelUsed    float64   `json:"fuel_used"`
+	Cost        float64   `json:"cost"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const commandColumns = `id, device_id, field, setpoint, system_mode, source, status, attempts, error,
+	created_at, expires_at, completed_at, correlation_id`
+
+// scanCommand reads a command outbox row
+func scanCommand(row scanner) (*QueuedCommand, error) {
+	var cmd QueuedCommand
+	var setpoint sql.NullFloat64
+	var mode, errMsg, correlationID sql.NullString
+	var completed sql.NullTime
+	err := row.Scan(&cmd.ID, &cmd.DeviceID, &cmd.Field, &setpoint, &mode, &cmd.Source, &cmd.Status,
+		&cmd.Attempts, &errMsg, &cmd.CreatedAt, &cmd.ExpiresAt, &completed, &correlationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if setpoint.Valid {
+		cmd.Setpoint = &setpoint.Float64
+	}
+	cmd.SystemMode = mode.String
+	cmd.Error = errMsg.String
+	cmd.CorrelationID = correlationID.String
+	if completed.Valid {
+		cmd.CompletedAt = &completed.Time
+	}
+
+	return &cmd, nil
+}
+
+// EnqueueCommand stores a pending command and sets its ID. Any pending
+// command for the same device and field is superseded, so the latest wins.
+func (db *DB) EnqueueCommand(cmd *QueuedCommand) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE command_outbox SET status = ?, completed_at = ?
+		WHERE device_id = ? AND field = ? AND status = ?
+	`, CommandSuperseded, now, cmd.DeviceID, cmd.Field, CommandPending)
+	if err != nil {
+		return fmt.Errorf("failed to supersede queued commands: %w", err)
+	}
+
+	var mode, correlationID interface{}
+	if cmd.SystemMode != "" {
+		mode = cmd.SystemMode
+	}
+	if cmd.CorrelationID != "" {
+		correlationID = cmd.CorrelationID
+	}
+	result, err := tx.Exec(`
+		INSERT INTO command_outbox (device_id, field, setpoint, system_mode, source, status, created_at, expires_at,
+			correlation_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, cmd.DeviceID, cmd.Field, cmd.Setpoint, mode, cmd.Source, CommandPending, now, cmd.ExpiresAt, correlationID)
+	if err != nil {
+		return fmt.Errorf("failed to queue command: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get command id: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit queued command: %w", err)
+	}
+
+	cmd.ID = int(id)
+	cmd.Status = CommandPending
+	cmd.CreatedAt = now
+
+	return nil
+}
+
+// GetCommand retrieves a queued command by ID, returning nil if it doesn't exist
+func (db *DB) GetCommand(id int) (*QueuedCommand, error) {
+	row := db.conn.QueryRow("SELECT "+commandColumns+" FROM command_outbox WHERE id = ?", id)
+
+	cmd, err := scanCommand(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get command %d: %w", id, err)
+	}
+
+	return cmd, nil
+}
+
+// GetCommands retrieves queued commands, newest first. An empty status
+// returns commands in any state.
+func (db *DB) GetCommands(status CommandStatus, limit int) ([]QueuedCommand, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := "SELECT " + commandColumns + " FROM command_outbox"
+	args := []interface{}{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	return db.queryCommands(query, args...)
+}
+
+// GetPendingCommands retrieves pending commands in the order they were queued
+func (db *DB) GetPendingCommands() ([]QueuedCommand, error) {
+	return db.queryCommands("SELECT "+commandColumns+" FROM command_outbox WHERE status = ? ORDER BY id", CommandPending)
+}
+
+func (db *DB) queryCommands(query string, args ...interface{}) ([]QueuedCommand, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query commands: %w", err)
+	}
+	defer rows.Close()
+
+	var commands []QueuedCommand
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan command: %w", err)
+		}
+		commands = append(commands, *cmd)
+	}
+
+	return commands, rows.Err()
+}
+
+// ClaimCommand marks a pending command as in flight before it is sent to
+// TCC, so it can no longer be cancelled or superseded. It returns
+// sql.ErrNoRows if the command doesn't exist or is no longer pending.
+func (db *DB) ClaimCommand(id int) error {
+	result, err := db.conn.Exec(`
+		UPDATE command_outbox SET status = ?
+		WHERE id = ? AND status = ?
+	`, CommandInFlight, id, CommandPending)
+	if err != nil {
+		return fmt.Errorf("failed to claim command %d: %w", id, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// CompleteCommand moves a command from status from to a final status. It
+// returns sql.ErrNoRows if the command doesn't exist or is no longer in from.
+func (db *DB) CompleteCommand(id int, from, to CommandStatus, errMsg string) error {
+	var msg interface{}
+	if errMsg != "" {
+		msg = errMsg
+	}
+
+	result, err := db.conn.Exec(`
+		UPDATE command_outbox SET status = ?, error = ?, completed_at = ?
+		WHERE id = ? AND status = ?
+	`, to, msg, time.Now(), id, from)
+	if err != nil {
+		return fmt.Errorf("failed to update command %d: %w", id, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// NoteCommandAttempt records a failed replay attempt of an in-flight
+// command and returns it to pending for the next retry
+func (db *DB) NoteCommandAttempt(id int, errMsg string) error {
+	_, err := db.conn.Exec(`
+		UPDATE command_outbox SET attempts = attempts + 1, error = ?, status = ?
+		WHERE id = ? AND status = ?
+	`, errMsg, CommandPending, id, CommandInFlight)
+	if err != nil {
+		return fmt.Errorf("failed to update command %d: %w", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores open each Store implementation for a test
+var testStores = map[string]func(t *testing.T) Store{
+	"sqlite": func(t *testing.T) Store {
+		db, err := Open(filepath.Join(t.TempDir(), "outbox.db"))
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	},
+	"memory": func(t *testing.T) Store { return NewMemoryStore() },
+}
+
+func TestEnqueueCommandSupersedes(t *testing.T) {
+	type queued struct {
+		device int
+		field  string
+	}
+
+	tests := []struct {
+		name     string
+		queue    []queued
+		complete int             // index of a command applied before the last is queued, or -1
+		want     []CommandStatus // final status of each queued command
+	}{
+		{
+			name:     "latest wins for the same field",
+			queue:    []queued{{1, "heat_setpoint"}, {1, "heat_setpoint"}, {1, "heat_setpoint"}},
+			complete: -1,
+			want:     []CommandStatus{CommandSuperseded, CommandSuperseded, CommandPending},
+		},
+		{
+			name:     "other fields are kept",
+			queue:    []queued{{1, "heat_setpoint"}, {1, "cool_setpoint"}, {1, "system_mode"}},
+			complete: -1,
+			want:     []CommandStatus{CommandPending, CommandPending, CommandPending},
+		},
+		{
+			name:     "other devices are kept",
+			queue:    []queued{{1, "heat_setpoint"}, {2, "heat_setpoint"}},
+			complete: -1,
+			want:     []CommandStatus{CommandPending, CommandPending},
+		},
+		{
+			name:     "finished commands are left alone",
+			queue:    []queued{{1, "heat_setpoint"}, {1, "heat_setpoint"}},
+			complete: 0,
+			want:     []CommandStatus{CommandApplied, CommandPending},
+		},
+	}
+
+	for storeName, open := range testStores {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				db := open(t)
+
+				ids := make([]int, len(tt.queue))
+				for i, q := range tt.queue {
+					if i == len(tt.queue)-1 && tt.complete >= 0 {
+						if err := db.CompleteCommand(ids[tt.complete], CommandPending, CommandApplied, ""); err != nil {
+							t.Fatalf("CompleteCommand() error = %v", err)
+						}
+					}
+					setpoint := float64(60 + i)
+					cmd := &QueuedCommand{
+						DeviceID:  q.device,
+						Field:     q.field,
+						Setpoint:  &setpoint,
+						Source:    EventSourceUser,
+						ExpiresAt: time.Now().Add(time.Hour),
+					}
+					if err := db.EnqueueCommand(cmd); err != nil {
+						t.Fatalf("EnqueueCommand() error = %v", err)
+					}
+					ids[i] = cmd.ID
+				}
+
+				for i, id := range ids {
+					cmd, err := db.GetCommand(id)
+					if err != nil || cmd == nil {
+						t.Fatalf("GetCommand(%d) = %v, %v", id, cmd, err)
+					}
+					if cmd.Status != tt.want[i] {
+						t.Errorf("command %d status = %s, want %s", i, cmd.Status, tt.want[i])
+					}
+					if (cmd.CompletedAt != nil) != (tt.want[i] != CommandPending) {
+						t.Errorf("command %d completed_at = %v with status %s", i, cmd.CompletedAt, cmd.Status)
+					}
+				}
+
+				// Superseded commands can no longer be completed by a replay
+				for i, id := range ids {
+					if tt.want[i] == CommandSuperseded {
+						if err := db.CompleteCommand(id, CommandPending, CommandApplied, ""); err == nil {
+							t.Errorf("CompleteCommand() on superseded command %d succeeded", i)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestClaimCommand(t *testing.T) {
+	for storeName, open := range testStores {
+		t.Run(storeName, func(t *testing.T) {
+			db := open(t)
+			cmd := &QueuedCommand{DeviceID: 1, Field: "system_mode", SystemMode: "heat", Source: EventSourceUser,
+				ExpiresAt: time.Now().Add(time.Hour)}
+			if err := db.EnqueueCommand(cmd); err != nil {
+				t.Fatalf("EnqueueCommand() error = %v", err)
+			}
+
+			steps := []struct {
+				name    string
+				do      func() error
+				wantErr bool
+				want    CommandStatus
+			}{
+				{"claim", func() error { return db.ClaimCommand(cmd.ID) }, false, CommandInFlight},
+				{"claim twice", func() error { return db.ClaimCommand(cmd.ID) }, true, CommandInFlight},
+				{"cancel in flight", func() error { return db.CompleteCommand(cmd.ID, CommandPending, CommandCancelled, "") }, true, CommandInFlight},
+				{"retry later", func() error { return db.NoteCommandAttempt(cmd.ID, "unavailable") }, false, CommandPending},
+				{"claim again", func() error { return db.ClaimCommand(cmd.ID) }, false, CommandInFlight},
+				{"apply", func() error { return db.CompleteCommand(cmd.ID, CommandInFlight, CommandApplied, "") }, false, CommandApplied},
+				{"claim applied", func() error { return db.ClaimCommand(cmd.ID) }, true, CommandApplied},
+			}
+			for _, step := range steps {
+				if err := step.do(); (err != nil) != step.wantErr {
+					t.Fatalf("%s: error = %v, wantErr %v", step.name, err, step.wantErr)
+				}
+				got, err := db.GetCommand(cmd.ID)
+				if err != nil || got == nil {
+					t.Fatalf("%s: GetCommand() = %v, %v", step.name, got, err)
+				}
+				if got.Status != step.want {
+					t.Fatalf("%s: status = %s, want %s", step.name, got.Status, step.want)
+				}
+			}
+		})
+	}
+}
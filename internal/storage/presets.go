@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// scanPreset reads a preset row
+func scanPreset(row scanner) (*Preset, error) {
+	var p Preset
+	var mode sql.NullString
+	var heat, cool sql.NullFloat64
+	err := row.Scan(&p.ID, &p.DeviceID, &p.Name, &mode, &heat, &cool, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	p.SystemMode = mode.String
+	if heat.Valid {
+		p.HeatSetpoint = &heat.Float64
+	}
+	if cool.Valid {
+		p.CoolSetpoint = &cool.Float64
+	}
+
+	return &p, nil
+}
+
+// GetPresets retrieves all presets for a device
+func (db *DB) GetPresets(deviceID int) ([]Preset, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, device_id, name, system_mode, heat_setpoint, cool_setpoint, created_at, updated_at
+		FROM presets WHERE device_id = ? ORDER BY id
+	`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query presets: %w", err)
+	}
+	defer rows.Close()
+
+	var presets []Preset
+	for rows.Next() {
+		p, err := scanPreset(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan preset: %w", err)
+		}
+		presets = append(presets, *p)
+	}
+
+	return presets, rows.Err()
+}
+
+// GetPreset retrieves a preset by device and name, returning nil if it doesn't exist
+func (db *DB) GetPreset(deviceID int, name string) (*Preset, error) {
+	row := db.conn.QueryRow(`
+		SELECT id, device_id, name, system_mode, heat_setpoint, cool_setpoint, created_at, updated_at
+		FROM presets WHERE device_id = ? AND name = ? COLLATE NOCASE
+	`, deviceID, name)
+
+	p, err := scanPreset(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get preset %q: %w", name, err)
+	}
+
+	return p, nil
+}
+
+// SavePreset creates or replaces a preset by device and name
+func (db *DB) SavePreset(p *Preset) error {
+	now := time.Now()
+	_, err := db.conn.Exec(`
+		INSERT INTO presets (device_id, name, system_mode, heat_setpoint, cool_setpoint, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_id, name) DO UPDATE SET
+			system_mode = excluded.system_mode,
+			heat_setpoint = excluded.heat_setpoint,
+			cool_setpoint = excluded.cool_setpoint,
+			updated_at = excluded.updated_at
+	`, p.DeviceID, p.Name, p.SystemMode, p.HeatSetpoint, p.CoolSetpoint, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to save preset %q: %w", p.Name, err)
+	}
+
+	return nil
+}
+
+// DeletePreset removes a preset by device and name
+func (db *DB) DeletePreset(deviceID int, name string) error {
+	result, err := db.conn.Exec("DELETE FROM presets WHERE device_id = ? AND name = ? COLLATE NOCASE", deviceID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete preset %q: %w", name, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// SetActivePreset records the preset a device is running, or clears it
+// when name is empty
+func (db *DB) SetActivePreset(deviceID int, name string) error {
+	var value interface{}
+	if name != "" {
+		value = name
+	}
+
+	_, err := db.conn.Exec("UPDATE thermostat_state SET active_preset = ? WHERE device_id = ?", value, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to set active preset for device %d: %w", deviceID, err)
+	}
+
+	return nil
+}
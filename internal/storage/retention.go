@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventLogMatch selects event log rows by source and type. Empty fields
+// match anything.
+type EventLogMatch struct {
+	Source    EventSource
+	EventType EventType
+}
+
+// where returns the SQL condition for the match and its arguments
+func (m EventLogMatch) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if m.Source != "" {
+		conds = append(conds, "source = ?")
+		args = append(args, m.Source)
+	}
+	if m.EventType != "" {
+		conds = append(conds, "event_type = ?")
+		args = append(args, m.EventType)
+	}
+	if len(conds) == 0 {
+		return "1=1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// matches reports whether e has the source and type m selects
+func (m EventLogMatch) matches(e *EventLog) bool {
+	if m.Source != "" && e.Source != m.Source {
+		return false
+	}
+	return m.EventType == "" || e.EventType == m.EventType
+}
+
+// DBSize describes the database file's space use
+type DBSize struct {
+	Bytes     int64 `json:"bytes"`
+	FreeBytes int64 `json:"free_bytes"` // Unused pages a vacuum would reclaim
+}
+
+// PruneEventLogsMatching removes events matching m that are older than the
+// given time, leaving alone any that also match one of except
+func (db *DB) PruneEventLogsMatching(m EventLogMatch, olderThan time.Time, except []EventLogMatch) (int64, error) {
+	cond, args := m.where()
+	query := "DELETE FROM event_log WHERE timestamp < ? AND " + cond
+	args = append([]interface{}{olderThan.UTC()}, args...)
+	for _, e := range except {
+		exceptCond, exceptArgs := e.where()
+		query += " AND NOT (" + exceptCond + ")"
+		args = append(args, exceptArgs...)
+	}
+
+	result, err := db.conn.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune event logs: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// TrimEventLogs removes the oldest events beyond maxRows
+func (db *DB) TrimEventLogs(maxRows int) (int64, error) {
+	result, err := db.conn.Exec(`
+		DELETE FROM event_log WHERE id <= (
+			SELECT id FROM event_log ORDER BY id DESC LIMIT 1 OFFSET ?
+		)
+	`, maxRows)
+	if err != nil {
+		return 0, fmt.Errorf("failed to trim event logs: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// CountEventLogs returns the number of events in the log
+func (db *DB) CountEventLogs() (int64, error) {
+	var count int64
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM event_log").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count event logs: %w", err)
+	}
+	return count, nil
+}
+
+// Size returns how much space the database uses
+func (db *DB) Size() (*DBSize, error) {
+	var pageSize, pageCount, freePages int64
+	if err := db.conn.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return nil, fmt.Errorf("failed to get page size: %w", err)
+	}
+	if err := db.conn.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return nil, fmt.Errorf("failed to get page count: %w", err)
+	}
+	if err := db.conn.QueryRow("PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return nil, fmt.Errorf("failed to get freelist count: %w", err)
+	}
+
+	return &DBSize{
+		Bytes:     pageSize * pageCount,
+		FreeBytes: pageSize * freePages,
+	}, nil
+}
+
+// Vacuum rebuilds the database file to reclaim free pages
+func (db *DB) Vacuum() error {
+	if _, err := db.conn.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// EnableIncrementalVacuum switches the database to incremental auto-vacuum.
+// The switch needs a full VACUUM, so it returns true when one was run.
+func (db *DB) EnableIncrementalVacuum() (bool, error) {
+	var mode int
+	if err := db.conn.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return false, fmt.Errorf("failed to get auto_vacuum mode: %w", err)
+	}
+	if mode == 2 { // INCREMENTAL
+		return false, nil
+	}
+
+	if _, err := db.conn.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return false, fmt.Errorf("failed to set auto_vacuum mode: %w", err)
+	}
+	if err := db.Vacuum(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IncrementalVacuum returns free pages to the filesystem
+func (db *DB) IncrementalVacuum() error {
+	// The pragma frees pages one step at a time, so step it to completion
+	rows, err := db.conn.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("failed to run incremental vacuum: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to run incremental vacuum: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// AddRuntime adds run minutes to the daily and hourly totals in one
+// transaction
+func (db *DB) AddRuntime(days []RuntimeDay, hours []RuntimeHour) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, d := range days {
+		_, err := tx.Exec(`
+			INSERT INTO hvac_runtime_daily (device_id, day, heating_minutes, cooling_minutes, fan_minutes, observed_minutes)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(device_id, day) DO UPDATE SET
+				heating_minutes = heating_minutes + excluded.heating_minutes,
+				cooling_minutes = cooling_minutes + excluded.cooling_minutes,
+				fan_minutes = fan_minutes + excluded.fan_minutes,
+				observed_minutes = observed_minutes + excluded.observed_minutes,
+				updated_at = CURRENT_TIMESTAMP
+		`, d.DeviceID, d.Day, d.HeatingMinutes, d.CoolingMinutes, d.FanMinutes, d.ObservedMinutes)
+		if err != nil {
+			return fmt.Errorf("failed to add runtime for device %d on %s: %w", d.DeviceID, d.Day, err)
+		}
+	}
+	for _, h := range hours {
+		_, err := tx.Exec(`
+			INSERT INTO hvac_runtime_hourly (device_id, hour, heating_minutes, cooling_minutes, fan_minutes, observed_minutes)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(device_id, hour) DO UPDATE SET
+				heating_minutes = heating_minutes + excluded.heating_minutes,
+				cooling_minutes = cooling_minutes + excluded.cooling_minutes,
+				fan_minutes = fan_minutes + excluded.fan_minutes,
+				observed_minutes = observed_minutes + excluded.observed_minutes
+		`, h.DeviceID, h.Hour, h.HeatingMinutes, h.CoolingMinutes, h.FanMinutes, h.ObservedMinutes)
+		if err != nil {
+			return fmt.Errorf("failed to add runtime for device %d at %s: %w", h.DeviceID, h.Hour, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit runtime: %w", err)
+	}
+
+	return nil
+}
+
+// GetRuntimeDays retrieves daily runtime for days in [from, to], both
+// YYYY-MM-DD. A deviceID of 0 returns days for every device.
+func (db *DB) GetRuntimeDays(deviceID int, from, to string) ([]RuntimeDay, error) {
+	query := `
+		SELECT device_id, day, heating_minutes, cooling_minutes, fan_minutes, observed_minutes
+		FROM hvac_runtime_daily
+		WHERE day >= ? AND day <= ?`
+	args := []interface{}{from, to}
+	if deviceID != 0 {
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+	query += " ORDER BY device_id, day"
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query runtime: %w", err)
+	}
+	defer rows.Close()
+
+	var days []RuntimeDay
+	for rows.Next() {
+		var d RuntimeDay
+		err := rows.Scan(&d.DeviceID, &d.Day, &d.HeatingMinutes, &d.CoolingMinutes, &d.FanMinutes, &d.ObservedMinutes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan runtime: %w", err)
+		}
+		days = append(days, d)
+	}
+
+	return days, rows.Err()
+}
+
+// GetRuntimeHours retrieves hourly runtime for hours in [from, to], both
+// YYYY-MM-DDTHH, ordered by hour. A deviceID of 0 returns hours for every
+// device.
+func (db *DB) GetRuntimeHours(deviceID int, from, to string) ([]RuntimeHour, error) {
+	query := `
+		SELECT device_id, hour, heating_minutes, cooling_minutes, fan_minutes, observed_minutes
+		FROM hvac_runtime_hourly
+		WHERE hour >= ? AND hour <= ?`
+	args := []interface{}{from, to}
+	if deviceID != 0 {
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+	query += " ORDER BY hour, device_id"
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query hourly runtime: %w", err)
+	}
+	defer rows.Close()
+
+	var hours []RuntimeHour
+	for rows.Next() {
+		var h RuntimeHour
+		err := rows.Scan(&h.DeviceID, &h.Hour, &h.HeatingMinutes, &h.CoolingMinutes, &h.FanMinutes, &h.ObservedMinutes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan hourly runtime: %w", err)
+		}
+		hours = append(hours, h)
+	}
+
+	return hours, rows.Err()
+}
+
+// SaveRuntimeWeek stores a weekly summary. It returns false if the week was
+// already summarised for the device.
+func (db *DB) SaveRuntimeWeek(w *RuntimeWeek) (bool, error) {
+	result, err := db.conn.Exec(`
+		INSERT OR IGNORE INTO hvac_runtime_weekly (device_id, week_start, days, heating_minutes, cooling_minutes,
+			fan_minutes, observed_minutes)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, w.DeviceID, w.WeekStart, w.Days, w.HeatingMinutes, w.CoolingMinutes, w.FanMinutes, w.ObservedMinutes)
+	if err != nil {
+		return false, fmt.Errorf("failed to save runtime week for device %d: %w", w.DeviceID, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetRuntimeWeeks retrieves weekly summaries whose week starts in [from, to]
+func (db *DB) GetRuntimeWeeks(deviceID int, from, to string) ([]RuntimeWeek, error) {
+	rows, err := db.conn.Query(`
+		SELECT device_id, week_start, days, heating_minutes, cooling_minutes, fan_minutes, observed_minutes, created_at
+		FROM hvac_runtime_weekly
+		WHERE device_id = ? AND week_start >= ? AND week_start <= ?
+		ORDER BY week_start
+	`, deviceID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query runtime weeks: %w", err)
+	}
+	defer rows.Close()
+
+	var weeks []RuntimeWeek
+	for rows.Next() {
+		var w RuntimeWeek
+		err := rows.Scan(&w.DeviceID, &w.WeekStart, &w.Days, &w.HeatingMinutes, &w.CoolingMinutes,
+			&w.FanMinutes, &w.ObservedMinutes, &w.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan runtime week: %w", err)
+		}
+		weeks = append(weeks, w)
+	}
+
+	return weeks, rows.Err()
+}
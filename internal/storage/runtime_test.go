@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestAddRuntimeAccumulates(t *testing.T) {
+	totals := func(heat, observed float64) RuntimeTotals {
+		return RuntimeTotals{HeatingMinutes: heat, ObservedMinutes: observed}
+	}
+
+	for storeName, open := range testStores {
+		t.Run(storeName, func(t *testing.T) {
+			db := open(t)
+
+			adds := [][]RuntimeDay{
+				{{DeviceID: 1, Day: "2026-03-02", RuntimeTotals: totals(5, 10)}},
+				{{DeviceID: 1, Day: "2026-03-02", RuntimeTotals: totals(3, 10)}, {DeviceID: 2, Day: "2026-03-02", RuntimeTotals: totals(1, 1)}},
+				{{DeviceID: 1, Day: "2026-03-04", RuntimeTotals: totals(2, 2)}},
+			}
+			for _, days := range adds {
+				if err := db.AddRuntime(days, nil); err != nil {
+					t.Fatalf("AddRuntime() error = %v", err)
+				}
+			}
+
+			got, err := db.GetRuntimeDays(0, "2026-03-01", "2026-03-03")
+			if err != nil {
+				t.Fatalf("GetRuntimeDays() error = %v", err)
+			}
+			want := []RuntimeDay{
+				{DeviceID: 1, Day: "2026-03-02", RuntimeTotals: totals(8, 20)},
+				{DeviceID: 2, Day: "2026-03-02", RuntimeTotals: totals(1, 1)},
+			}
+			if len(got) != len(want) {
+				t.Fatalf("GetRuntimeDays() = %+v, want %+v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("GetRuntimeDays()[%d] = %+v, want %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSaveRuntimeWeekOnce(t *testing.T) {
+	for storeName, open := range testStores {
+		t.Run(storeName, func(t *testing.T) {
+			db := open(t)
+
+			week := &RuntimeWeek{DeviceID: 1, WeekStart: "2026-03-02", Days: 7}
+			for i, want := range []bool{true, false} {
+				created, err := db.SaveRuntimeWeek(week)
+				if err != nil {
+					t.Fatalf("SaveRuntimeWeek() error = %v", err)
+				}
+				if created != want {
+					t.Errorf("SaveRuntimeWeek() call %d = %v, want %v", i+1, created, want)
+				}
+			}
+
+			weeks, err := db.GetRuntimeWeeks(1, "2026-03-01", "2026-03-31")
+			if err != nil {
+				t.Fatalf("GetRuntimeWeeks() error = %v", err)
+			}
+			if len(weeks) != 1 || weeks[0].Days != 7 || weeks[0].CreatedAt.IsZero() {
+				t.Errorf("GetRuntimeWeeks() = %+v, want the saved week", weeks)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const scheduleColumns = `id, device_id, name, timezone, enabled, periods, exceptions,
+	last_applied_key, last_applied_at, created_at, updated_at`
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSchedule reads a schedule row
+func scanSchedule(row scanner) (*Schedule, error) {
+	var sched Schedule
+	var periods string
+	var exceptions, lastKey sql.NullString
+	var lastAt sql.NullTime
+	err := row.Scan(&sched.ID, &sched.DeviceID, &sched.Name, &sched.Timezone, &sched.Enabled,
+		&periods, &exceptions, &lastKey, &lastAt, &sched.CreatedAt, &sched.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(periods), &sched.Periods); err != nil {
+		return nil, fmt.Errorf("failed to decode periods for schedule %d: %w", sched.ID, err)
+	}
+	if exceptions.Valid && exceptions.String != "" {
+		if err := json.Unmarshal([]byte(exceptions.String), &sched.Exceptions); err != nil {
+			return nil, fmt.Errorf("failed to decode exceptions for schedule %d: %w", sched.ID, err)
+		}
+	}
+	sched.LastAppliedKey = lastKey.String
+	if lastAt.Valid {
+		sched.LastAppliedAt = &lastAt.Time
+	}
+
+	return &sched, nil
+}
+
+// CreateSchedule stores a new schedule and sets its ID
+func (db *DB) CreateSchedule(sched *Schedule) error {
+	periods, err := json.Marshal(sched.Periods)
+	if err != nil {
+		return fmt.Errorf("failed to marshal periods: %w", err)
+	}
+	exceptions, err := json.Marshal(sched.Exceptions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exceptions: %w", err)
+	}
+
+	now := time.Now()
+	result, err := db.conn.Exec(`
+		INSERT INTO schedules (device_id, name, timezone, enabled, periods, exceptions, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, sched.DeviceID, sched.Name, sched.Timezone, sched.Enabled, string(periods), string(exceptions), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to create schedule: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get schedule id: %w", err)
+	}
+	sched.ID = int(id)
+	sched.CreatedAt = now
+	sched.UpdatedAt = now
+
+	return nil
+}
+
+// UpdateSchedule replaces a schedule's program. The last applied marker is
+// cleared so the engine re-evaluates the new program.
+func (db *DB) UpdateSchedule(sched *Schedule) error {
+	periods, err := json.Marshal(sched.Periods)
+	if err != nil {
+		return fmt.Errorf("failed to marshal periods: %w", err)
+	}
+	exceptions, err := json.Marshal(sched.Exceptions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exceptions: %w", err)
+	}
+
+	now := time.Now()
+	result, err := db.conn.Exec(`
+		UPDATE schedules SET
+			device_id = ?,
+			name = ?,
+			timezone = ?,
+			enabled = ?,
+			periods = ?,
+			exceptions = ?,
+			last_applied_key = NULL,
+			updated_at = ?
+		WHERE id = ?
+	`, sched.DeviceID, sched.Name, sched.Timezone, sched.Enabled, string(periods), string(exceptions), now, sched.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule %d: %w", sched.ID, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	sched.UpdatedAt = now
+
+	return nil
+}
+
+// GetSchedule retrieves a schedule by ID, returning nil if it doesn't exist
+func (db *DB) GetSchedule(id int) (*Schedule, error) {
+	row := db.conn.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE id = ?", id)
+
+	sched, err := scanSchedule(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule %d: %w", id, err)
+	}
+
+	return sched, nil
+}
+
+// GetSchedules retrieves all schedules, optionally for a single device (deviceID > 0)
+func (db *DB) GetSchedules(deviceID int) ([]Schedule, error) {
+	query := "SELECT " + scheduleColumns + " FROM schedules"
+	args := []interface{}{}
+	if deviceID > 0 {
+		query += " WHERE device_id = ?"
+		args = append(args, deviceID)
+	}
+	query += " ORDER BY device_id, id"
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		sched, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, *sched)
+	}
+
+	return schedules, rows.Err()
+}
+
+// DeleteSchedule removes a schedule
+func (db *DB) DeleteSchedule(id int) error {
+	result, err := db.conn.Exec("DELETE FROM schedules WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule %d: %w", id, err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// MarkScheduleApplied records the last program step applied by a schedule
+func (db *DB) MarkScheduleApplied(id int, key string) error {
+	_, err := db.conn.Exec(
+		"UPDATE schedules SET last_applied_key = ?, last_applied_at = ? WHERE id = ?",
+		key, time.Now(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark schedule %d applied: %w", id, err)
+	}
+
+	return nil
+}
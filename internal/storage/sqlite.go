@@ -1,37 +1,58 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/stephens/tcc-bridge/internal/log"
 )
 
 // DB wraps the SQLite database connection
 type DB struct {
-	conn *sql.DB
+	conn        *sql.DB
+	path        string
+	eventSearch bool // event_log_fts is available and maintained
 }
 
 // Open creates a new database connection and runs migrations
 func Open(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	db, err := OpenUnmigrated(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run migrations
+	if err := db.upgrade(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	if err := db.ensureEventSearch(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// OpenUnmigrated opens the database without touching its schema, for
+// inspecting or migrating it explicitly
+func OpenUnmigrated(path string) (*DB, error) {
+	conn, err := openConn(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Test connection
 	if err := conn.Ping(); err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Run migrations
-	if err := RunMigrations(conn); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %w", err)
-	}
-
-	return &DB{conn: conn}, nil
+	return &DB{conn: conn, path: path}, nil
 }
 
 // Close closes the database connection
@@ -41,8 +62,9 @@ func (db *DB) Close() error {
 
 // --- Credentials ---
 
-// SaveCredentials stores encrypted TCC credentials
-func (db *DB) SaveCredentials(username string, passwordEncrypted []byte) error {
+// SaveCredentials stores encrypted TCC credentials along with the version
+// of the key that encrypted them
+func (db *DB) SaveCredentials(username string, passwordEncrypted []byte, keyVersion int) error {
 	// Delete existing credentials first (single-user system)
 	_, err := db.conn.Exec("DELETE FROM credentials")
 	if err != nil {
@@ -50,8 +72,8 @@ func (db *DB) SaveCredentials(username string, passwordEncrypted []byte) error {
 	}
 
 	_, err = db.conn.Exec(
-		"INSERT INTO credentials (username, password_encrypted, created_at, updated_at) VALUES (?, ?, ?, ?)",
-		username, passwordEncrypted, time.Now(), time.Now(),
+		"INSERT INTO credentials (username, password_encrypted, key_version, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		username, passwordEncrypted, keyVersion, time.Now(), time.Now(),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to save credentials: %w", err)
@@ -63,11 +85,11 @@ func (db *DB) SaveCredentials(username string, passwordEncrypted []byte) error {
 // GetCredentials retrieves stored credentials
 func (db *DB) GetCredentials() (*Credentials, error) {
 	row := db.conn.QueryRow(
-		"SELECT id, username, password_encrypted, created_at, updated_at FROM credentials LIMIT 1",
+		"SELECT id, username, password_encrypted, key_version, created_at, updated_at FROM credentials LIMIT 1",
 	)
 
 	var cred Credentials
-	err := row.Scan(&cred.ID, &cred.Username, &cred.PasswordEncrypted, &cred.CreatedAt, &cred.UpdatedAt)
+	err := row.Scan(&cred.ID, &cred.Username, &cred.PasswordEncrypted, &cred.KeyVersion, &cred.CreatedAt, &cred.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -84,13 +106,64 @@ func (db *DB) DeleteCredentials() error {
 	return err
 }
 
+// reencryptCredentials rewrites every stored password with reencrypt and
+// marks it as encrypted by keyVersion, all in one transaction
+func (db *DB) reencryptCredentials(reencrypt func(keyVersion int, ciphertext []byte) ([]byte, error), keyVersion int) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, password_encrypted, key_version FROM credentials")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query credentials: %w", err)
+	}
+	type credential struct {
+		id         int
+		ciphertext []byte
+		keyVersion int
+	}
+	var creds []credential
+	for rows.Next() {
+		var c credential
+		if err := rows.Scan(&c.id, &c.ciphertext, &c.keyVersion); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan credentials: %w", err)
+		}
+		creds = append(creds, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query credentials: %w", err)
+	}
+
+	for _, c := range creds {
+		ciphertext, err := reencrypt(c.keyVersion, c.ciphertext)
+		if err != nil {
+			return 0, fmt.Errorf("failed to re-encrypt credentials %d: %w", c.id, err)
+		}
+		_, err = tx.Exec("UPDATE credentials SET password_encrypted = ?, key_version = ?, updated_at = ? WHERE id = ?",
+			ciphertext, keyVersion, time.Now(), c.id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update credentials %d: %w", c.id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit re-encrypted credentials: %w", err)
+	}
+
+	return len(creds), nil
+}
+
 // --- Thermostat State ---
 
 // SaveThermostatState saves or updates thermostat state
 func (db *DB) SaveThermostatState(state *ThermostatState) error {
 	_, err := db.conn.Exec(`
-		INSERT INTO thermostat_state (device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO thermostat_state (device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, outdoor_temp, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(device_id) DO UPDATE SET
 			name = excluded.name,
 			current_temp = excluded.current_temp,
@@ -100,9 +173,10 @@ func (db *DB) SaveThermostatState(state *ThermostatState) error {
 			humidity = excluded.humidity,
 			is_heating = excluded.is_heating,
 			is_cooling = excluded.is_cooling,
+			outdoor_temp = excluded.outdoor_temp,
 			updated_at = excluded.updated_at
 	`, state.DeviceID, state.Name, state.CurrentTemp, state.HeatSetpoint, state.CoolSetpoint,
-		state.SystemMode, state.Humidity, state.IsHeating, state.IsCooling, time.Now())
+		state.SystemMode, state.Humidity, state.IsHeating, state.IsCooling, state.OutdoorTemp, time.Now())
 
 	if err != nil {
 		return fmt.Errorf("failed to save thermostat state: %w", err)
@@ -114,15 +188,16 @@ func (db *DB) SaveThermostatState(state *ThermostatState) error {
 // GetThermostatState retrieves the current thermostat state
 func (db *DB) GetThermostatState() (*ThermostatState, error) {
 	row := db.conn.QueryRow(`
-		SELECT id, device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, updated_at
+		SELECT id, device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, outdoor_temp, active_preset, updated_at
 		FROM thermostat_state
 		LIMIT 1
 	`)
 
 	var state ThermostatState
+	var activePreset sql.NullString
 	err := row.Scan(
 		&state.ID, &state.DeviceID, &state.Name, &state.CurrentTemp, &state.HeatSetpoint,
-		&state.CoolSetpoint, &state.SystemMode, &state.Humidity, &state.IsHeating, &state.IsCooling, &state.UpdatedAt,
+		&state.CoolSetpoint, &state.SystemMode, &state.Humidity, &state.IsHeating, &state.IsCooling, &state.OutdoorTemp, &activePreset, &state.UpdatedAt,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -130,6 +205,7 @@ func (db *DB) GetThermostatState() (*ThermostatState, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get thermostat state: %w", err)
 	}
+	state.ActivePreset = activePreset.String
 
 	return &state, nil
 }
@@ -137,7 +213,7 @@ func (db *DB) GetThermostatState() (*ThermostatState, error) {
 // GetAllThermostatStates retrieves all thermostat states
 func (db *DB) GetAllThermostatStates() ([]ThermostatState, error) {
 	rows, err := db.conn.Query(`
-		SELECT id, device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, updated_at
+		SELECT id, device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, outdoor_temp, active_preset, updated_at
 		FROM thermostat_state
 		ORDER BY device_id
 	`)
@@ -149,13 +225,15 @@ func (db *DB) GetAllThermostatStates() ([]ThermostatState, error) {
 	var states []ThermostatState
 	for rows.Next() {
 		var state ThermostatState
+		var activePreset sql.NullString
 		err := rows.Scan(
 			&state.ID, &state.DeviceID, &state.Name, &state.CurrentTemp, &state.HeatSetpoint,
-			&state.CoolSetpoint, &state.SystemMode, &state.Humidity, &state.IsHeating, &state.IsCooling, &state.UpdatedAt,
+			&state.CoolSetpoint, &state.SystemMode, &state.Humidity, &state.IsHeating, &state.IsCooling, &state.OutdoorTemp, &activePreset, &state.UpdatedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan thermostat state: %w", err)
 		}
+		state.ActivePreset = activePreset.String
 		states = append(states, state)
 	}
 
@@ -165,25 +243,55 @@ func (db *DB) GetAllThermostatStates() ([]ThermostatState, error) {
 // GetThermostatStateByDeviceID retrieves thermostat state for a specific device
 func (db *DB) GetThermostatStateByDeviceID(deviceID int) (*ThermostatState, error) {
 	var state ThermostatState
+	var activePreset sql.NullString
 	err := db.conn.QueryRow(`
-		SELECT id, device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, updated_at
+		SELECT id, device_id, name, current_temp, heat_setpoint, cool_setpoint, system_mode, humidity, is_heating, is_cooling, outdoor_temp, active_preset, updated_at
 		FROM thermostat_state
 		WHERE device_id = ?
 		LIMIT 1
 	`, deviceID).Scan(
 		&state.ID, &state.DeviceID, &state.Name, &state.CurrentTemp, &state.HeatSetpoint,
-		&state.CoolSetpoint, &state.SystemMode, &state.Humidity, &state.IsHeating, &state.IsCooling, &state.UpdatedAt,
+		&state.CoolSetpoint, &state.SystemMode, &state.Humidity, &state.IsHeating, &state.IsCooling, &state.OutdoorTemp, &activePreset, &state.UpdatedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get thermostat state for device %d: %w", deviceID, err)
 	}
+	state.ActivePreset = activePreset.String
 	return &state, nil
 }
 
 // --- Event Log ---
 
+const eventLogColumns = "id, timestamp, source, event_type, message, details, correlation_id, device_id"
+
+// scanEventLog reads an event log row
+func scanEventLog(row scanner) (*EventLog, error) {
+	var event EventLog
+	var details, correlationID sql.NullString
+	var deviceID sql.NullInt64
+	err := row.Scan(&event.ID, &event.Timestamp, &event.Source, &event.EventType, &event.Message,
+		&details, &correlationID, &deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if details.Valid && details.String != "" {
+		event.Details = json.RawMessage(details.String)
+	}
+	event.CorrelationID = correlationID.String
+	event.DeviceID = int(deviceID.Int64)
+
+	return &event, nil
+}
+
 // LogEvent records an event in the log
 func (db *DB) LogEvent(source EventSource, eventType EventType, message string, details interface{}) error {
+	return db.LogEventContext(context.Background(), source, eventType, message, details)
+}
+
+// LogEventContext records an event in the log, tagged with the correlation
+// ID carried by ctx
+func (db *DB) LogEventContext(ctx context.Context, source EventSource, eventType EventType, message string, details interface{}) error {
 	var detailsJSON []byte
 	if details != nil {
 		var err error
@@ -193,9 +301,14 @@ func (db *DB) LogEvent(source EventSource, eventType EventType, message string,
 		}
 	}
 
+	var correlationID interface{}
+	if id := log.CorrelationID(ctx); id != "" {
+		correlationID = id
+	}
+
 	_, err := db.conn.Exec(
-		"INSERT INTO event_log (timestamp, source, event_type, message, details) VALUES (?, ?, ?, ?, ?)",
-		time.Now(), source, eventType, message, detailsJSON,
+		"INSERT INTO event_log (timestamp, source, event_type, message, details, correlation_id, device_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		time.Now().UTC(), source, eventType, message, detailsJSON, correlationID, eventDeviceID(detailsJSON),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to log event: %w", err)
@@ -204,29 +317,17 @@ func (db *DB) LogEvent(source EventSource, eventType EventType, message string,
 	return nil
 }
 
-// GetEventLogs retrieves events with optional filtering
+// GetEventLogs retrieves events with optional filtering, newest first
 func (db *DB) GetEventLogs(filter EventLogFilter) ([]EventLog, error) {
-	query := "SELECT id, timestamp, source, event_type, message, details FROM event_log WHERE 1=1"
-	args := []interface{}{}
+	where, args := db.eventLogWhere(filter)
+	query := "SELECT " + eventLogColumns + " FROM event_log WHERE " + where
 
-	if filter.Source != nil {
-		query += " AND source = ?"
-		args = append(args, *filter.Source)
-	}
-	if filter.EventType != nil {
-		query += " AND event_type = ?"
-		args = append(args, *filter.EventType)
-	}
-	if filter.Since != nil {
-		query += " AND timestamp >= ?"
-		args = append(args, *filter.Since)
-	}
-	if filter.Until != nil {
-		query += " AND timestamp <= ?"
-		args = append(args, *filter.Until)
+	if filter.BeforeID > 0 {
+		query += " AND id < ?"
+		args = append(args, filter.BeforeID)
 	}
 
-	query += " ORDER BY timestamp DESC"
+	query += " ORDER BY id DESC"
 
 	if filter.Limit > 0 {
 		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
@@ -243,19 +344,14 @@ func (db *DB) GetEventLogs(filter EventLogFilter) ([]EventLog, error) {
 
 	var logs []EventLog
 	for rows.Next() {
-		var log EventLog
-		var details sql.NullString
-		err := rows.Scan(&log.ID, &log.Timestamp, &log.Source, &log.EventType, &log.Message, &details)
+		event, err := scanEventLog(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan event log: %w", err)
 		}
-		if details.Valid && details.String != "" {
-			log.Details = json.RawMessage(details.String)
-		}
-		logs = append(logs, log)
+		logs = append(logs, *event)
 	}
 
-	return logs, nil
+	return logs, rows.Err()
 }
 
 // --- Matter State ---
@@ -263,13 +359,16 @@ func (db *DB) GetEventLogs(filter EventLogFilter) ([]EventLog, error) {
 // GetMatterState retrieves the Matter commissioning state
 func (db *DB) GetMatterState() (*MatterState, error) {
 	row := db.conn.QueryRow(`
-		SELECT id, is_commissioned, fabric_id, node_id, qr_code, manual_pair_code, updated_at
+		SELECT id, is_commissioned, fabric_id, node_id, fabrics, qr_code, manual_pair_code,
+			commissioned_at, decommissioned_at, verified_at, updated_at
 		FROM matter_state WHERE id = 1
 	`)
 
 	var state MatterState
-	var fabricID, nodeID, qrCode, manualPairCode sql.NullString
-	err := row.Scan(&state.ID, &state.IsCommissioned, &fabricID, &nodeID, &qrCode, &manualPairCode, &state.UpdatedAt)
+	var fabricID, nodeID, fabrics, qrCode, manualPairCode sql.NullString
+	var commissionedAt, decommissionedAt, verifiedAt sql.NullTime
+	err := row.Scan(&state.ID, &state.IsCommissioned, &fabricID, &nodeID, &fabrics, &qrCode, &manualPairCode,
+		&commissionedAt, &decommissionedAt, &verifiedAt, &state.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -281,22 +380,50 @@ func (db *DB) GetMatterState() (*MatterState, error) {
 	state.NodeID = nodeID.String
 	state.QRCode = qrCode.String
 	state.ManualPairCode = manualPairCode.String
+	if commissionedAt.Valid {
+		state.CommissionedAt = &commissionedAt.Time
+	}
+	if decommissionedAt.Valid {
+		state.DecommissionedAt = &decommissionedAt.Time
+	}
+	if verifiedAt.Valid {
+		state.VerifiedAt = &verifiedAt.Time
+	}
+	if fabrics.Valid && fabrics.String != "" {
+		if err := json.Unmarshal([]byte(fabrics.String), &state.Fabrics); err != nil {
+			return nil, fmt.Errorf("failed to decode matter fabrics: %w", err)
+		}
+	}
 
 	return &state, nil
 }
 
 // SaveMatterState saves the Matter commissioning state
 func (db *DB) SaveMatterState(state *MatterState) error {
+	var fabrics interface{}
+	if len(state.Fabrics) > 0 {
+		data, err := json.Marshal(state.Fabrics)
+		if err != nil {
+			return fmt.Errorf("failed to marshal matter fabrics: %w", err)
+		}
+		fabrics = string(data)
+	}
+
 	_, err := db.conn.Exec(`
 		UPDATE matter_state SET
 			is_commissioned = ?,
 			fabric_id = ?,
 			node_id = ?,
+			fabrics = ?,
 			qr_code = ?,
 			manual_pair_code = ?,
+			commissioned_at = ?,
+			decommissioned_at = ?,
+			verified_at = ?,
 			updated_at = ?
 		WHERE id = 1
-	`, state.IsCommissioned, state.FabricID, state.NodeID, state.QRCode, state.ManualPairCode, time.Now())
+	`, state.IsCommissioned, state.FabricID, state.NodeID, fabrics, state.QRCode, state.ManualPairCode,
+		state.CommissionedAt, state.DecommissionedAt, state.VerifiedAt, time.Now())
 
 	if err != nil {
 		return fmt.Errorf("failed to save matter state: %w", err)
@@ -307,10 +434,5 @@ func (db *DB) SaveMatterState(state *MatterState) error {
 
 // PruneEventLogs removes old event logs
 func (db *DB) PruneEventLogs(olderThan time.Time) (int64, error) {
-	result, err := db.conn.Exec("DELETE FROM event_log WHERE timestamp < ?", olderThan)
-	if err != nil {
-		return 0, fmt.Errorf("failed to prune event logs: %w", err)
-	}
-
-	return result.RowsAffected()
+	return db.PruneEventLogsMatching(EventLogMatch{}, olderThan, nil)
 }
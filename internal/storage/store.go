@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the persistence the bridge and its API need: credentials,
+// thermostat state, the event log, Matter state, device settings,
+// schedules, rules, presets, queued commands, reading history, HVAC runtime
+// and energy totals. DB implements it on SQLite and MemoryStore implements
+// it in memory for tests.
+//
+// File maintenance (backup, key rotation, migrations and vacuuming) remains
+// SQLite-only and takes a *DB.
+type Store interface {
+	// Credentials
+	SaveCredentials(username string, passwordEncrypted []byte, keyVersion int) error
+	GetCredentials() (*Credentials, error)
+	DeleteCredentials() error
+
+	// Thermostat state
+	SaveThermostatState(state *ThermostatState) error
+	GetThermostatState() (*ThermostatState, error)
+	GetAllThermostatStates() ([]ThermostatState, error)
+	GetThermostatStateByDeviceID(deviceID int) (*ThermostatState, error)
+
+	// Event log
+	LogEvent(source EventSource, eventType EventType, message string, details interface{}) error
+	LogEventContext(ctx context.Context, source EventSource, eventType EventType, message string, details interface{}) error
+	GetEventLogs(filter EventLogFilter) ([]EventLog, error)
+	CountMatchingEventLogs(filter EventLogFilter) (int, error)
+	EachEventLog(ctx context.Context, filter EventLogFilter, fn func(*EventLog) error) error
+	GetEventLogsAfter(afterID, limit int) ([]EventLog, error)
+	GetLatestEventLogID() (int, error)
+
+	// Matter state
+	GetMatterState() (*MatterState, error)
+	SaveMatterState(state *MatterState) error
+	GetMatterEndpoints() ([]MatterEndpoint, error)
+	SaveMatterEndpoint(ep *MatterEndpoint) error
+
+	// Device settings
+	GetDeviceSettings(deviceID int) (*DeviceSettings, error)
+	GetAllDeviceSettings() ([]DeviceSettings, error)
+	SaveDeviceSettings(ds *DeviceSettings) error
+
+	// Schedules
+	CreateSchedule(sched *Schedule) error
+	UpdateSchedule(sched *Schedule) error
+	GetSchedule(id int) (*Schedule, error)
+	GetSchedules(deviceID int) ([]Schedule, error)
+	DeleteSchedule(id int) error
+	MarkScheduleApplied(id int, key string) error
+
+	// Automation rules
+	CreateRule(rule *AutomationRule) error
+	UpdateRule(rule *AutomationRule) error
+	GetRule(id int) (*AutomationRule, error)
+	GetRules() ([]AutomationRule, error)
+	DeleteRule(id int) error
+	MarkRuleFired(id int, at time.Time) error
+
+	// Presets
+	GetPresets(deviceID int) ([]Preset, error)
+	GetPreset(deviceID int, name string) (*Preset, error)
+	SavePreset(p *Preset) error
+	DeletePreset(deviceID int, name string) error
+	SetActivePreset(deviceID int, name string) error
+
+	// Command outbox
+	EnqueueCommand(cmd *QueuedCommand) error
+	GetCommand(id int) (*QueuedCommand, error)
+	GetCommands(status CommandStatus, limit int) ([]QueuedCommand, error)
+	GetPendingCommands() ([]QueuedCommand, error)
+	ClaimCommand(id int) error
+	CompleteCommand(id int, from, to CommandStatus, errMsg string) error
+	NoteCommandAttempt(id int, errMsg string) error
+
+	// Reading history
+	SaveReading(r *Reading) error
+	GetReadings(deviceID int, from, to time.Time) ([]Reading, error)
+	EachReading(ctx context.Context, deviceID int, from, to time.Time, fn func(*Reading) error) error
+	SaveAggregates(resolution Resolution, aggregates []ReadingAggregate) error
+	GetAggregates(resolution Resolution, deviceID int, from, to time.Time) ([]ReadingAggregate, error)
+	EachAggregate(ctx context.Context, resolution Resolution, deviceID int, from, to time.Time, fn func(*ReadingAggregate) error) error
+	PruneReadings(olderThan time.Time) (int64, error)
+	PruneAggregates(resolution Resolution, olderThan time.Time) (int64, error)
+
+	// HVAC runtime
+	AddRuntime(days []RuntimeDay, hours []RuntimeHour) error
+	GetRuntimeDays(deviceID int, from, to string) ([]RuntimeDay, error)
+	GetRuntimeHours(deviceID int, from, to string) ([]RuntimeHour, error)
+	SaveRuntimeWeek(w *RuntimeWeek) (bool, error)
+	GetRuntimeWeeks(deviceID int, from, to string) ([]RuntimeWeek, error)
+
+	// Energy
+	SaveEnergyMonth(m *EnergyMonth) (bool, error)
+
+	// Event log retention
+	PruneEventLogsMatching(m EventLogMatch, olderThan time.Time, except []EventLogMatch) (int64, error)
+	TrimEventLogs(maxRows int) (int64, error)
+	CountEventLogs() (int64, error)
+
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -27,19 +27,20 @@ const (
 	DeviceDataPath = "/portal/Device/CheckDataSession/%d"
 	ControlPath    = "/portal/Device/SubmitControlScreenChanges"
 
-	// Rate limiting: minimum 10 minutes between polls
+	// Rate limiting: default minimum 10 minutes between polls
 	MinPollInterval = 10 * time.Minute
 )
 
 // Client is a TCC API client
 type Client struct {
-	baseURL   string
-	session   *Session
-	limiter   *rate.Limiter
-	lastPoll  time.Time
-	pollMu    sync.Mutex
-	devices   []ThermostatState
-	devicesMu sync.RWMutex
+	baseURL         string
+	session         *Session
+	limiter         *rate.Limiter
+	lastPoll        time.Time
+	minPollInterval time.Duration
+	pollMu          sync.Mutex
+	devices         []ThermostatState
+	devicesMu       sync.RWMutex
 }
 
 // NewClient creates a new TCC client
@@ -57,12 +58,21 @@ func NewClient(baseURL string) (*Client, error) {
 	limiter := rate.NewLimiter(rate.Every(time.Minute), 5)
 
 	return &Client{
-		baseURL: baseURL,
-		session: session,
-		limiter: limiter,
+		baseURL:         baseURL,
+		session:         session,
+		limiter:         limiter,
+		minPollInterval: MinPollInterval,
 	}, nil
 }
 
+// SetMinPollInterval sets how long GetDevices serves cached data before
+// hitting TCC again. The request rate limiter still applies.
+func (c *Client) SetMinPollInterval(d time.Duration) {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	c.minPollInterval = d
+}
+
 // SetCredentials sets the login credentials
 func (c *Client) SetCredentials(username, password string) {
 	c.session.SetCredentials(username, password)
@@ -77,12 +87,12 @@ func (c *Client) Login(ctx context.Context) error {
 
 	// Wait for rate limiter
 	if err := c.limiter.Wait(ctx); err != nil {
-		return fmt.Errorf("rate limit wait: %w", err)
+		return rateLimitWait(err)
 	}
 
 	// First, get the login page to get any required tokens
 	loginURL := c.baseURL + LoginPath
-	log.Debug("TCC connecting to %s", loginURL)
+	log.FromContext(ctx).Debug("TCC connecting to %s", loginURL)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", loginURL, nil)
 	if err != nil {
@@ -92,16 +102,16 @@ func (c *Client) Login(ctx context.Context) error {
 
 	resp, err := c.session.GetClient().Do(req)
 	if err != nil {
-		log.Error("TCC connection failed to %s: %v", loginURL, err)
+		log.FromContext(ctx).Error("TCC connection failed to %s: %v", loginURL, err)
 		return fmt.Errorf("failed to get login page: %w", err)
 	}
 	defer resp.Body.Close()
 
-	log.Debug("TCC login page response: status %d from %s", resp.StatusCode, loginURL)
+	log.FromContext(ctx).Debug("TCC login page response: status %d from %s", resp.StatusCode, loginURL)
 
 	if resp.StatusCode != http.StatusOK {
-		log.Error("TCC login page returned status %d from %s", resp.StatusCode, loginURL)
-		return fmt.Errorf("failed to get login page: unexpected status %d", resp.StatusCode)
+		log.FromContext(ctx).Error("TCC login page returned status %d from %s", resp.StatusCode, loginURL)
+		return &StatusError{Op: "failed to get login page", StatusCode: resp.StatusCode}
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -123,11 +133,11 @@ func (c *Client) Login(ctx context.Context) error {
 
 	// Wait for rate limiter
 	if err := c.limiter.Wait(ctx); err != nil {
-		return fmt.Errorf("rate limit wait: %w", err)
+		return rateLimitWait(err)
 	}
 
 	// Submit login
-	log.Debug("TCC submitting login credentials to %s", loginURL)
+	log.FromContext(ctx).Debug("TCC submitting login credentials to %s", loginURL)
 
 	req, err = http.NewRequestWithContext(ctx, "POST", loginURL, strings.NewReader(formData.Encode()))
 	if err != nil {
@@ -138,7 +148,7 @@ func (c *Client) Login(ctx context.Context) error {
 
 	resp, err = c.session.GetClient().Do(req)
 	if err != nil {
-		log.Error("TCC login POST failed to %s: %v", loginURL, err)
+		log.FromContext(ctx).Error("TCC login POST failed to %s: %v", loginURL, err)
 		return fmt.Errorf("failed to submit login: %w", err)
 	}
 	defer resp.Body.Close()
@@ -150,11 +160,11 @@ func (c *Client) Login(ctx context.Context) error {
 
 	// Check final URL after redirects
 	finalURL := resp.Request.URL.String()
-	log.Debug("TCC login final URL: %s (status %d)", finalURL, resp.StatusCode)
+	log.FromContext(ctx).Debug("TCC login final URL: %s (status %d)", finalURL, resp.StatusCode)
 
 	// Try to extract device ID from URL like /portal/Device/Control/2246437
 	if deviceID := extractDeviceIDFromURL(finalURL); deviceID != 0 {
-		log.Debug("Extracted device ID from login redirect: %d", deviceID)
+		log.FromContext(ctx).Debug("Extracted device ID from login redirect: %d", deviceID)
 		c.session.SetLastDeviceID(deviceID)
 	}
 
@@ -162,16 +172,16 @@ func (c *Client) Login(ctx context.Context) error {
 		// Check for error pages
 		if strings.Contains(finalURL, "/Error/") {
 			if strings.Contains(finalURL, "TooManyAttempts") {
-				log.Warn("TCC login rate limited: too many attempts")
-				return fmt.Errorf("rate_limited: too many login attempts, please wait a few minutes")
+				log.FromContext(ctx).Warn("TCC login rate limited: too many attempts")
+				return &rateLimitError{msg: "rate_limited: too many login attempts, please wait a few minutes"}
 			}
-			log.Debug("TCC login error page: %s", finalURL)
+			log.FromContext(ctx).Debug("TCC login error page: %s", finalURL)
 			return fmt.Errorf("login failed: redirected to error page")
 		}
 
 		// Check if we're on the portal (not login page)
 		if strings.Contains(finalURL, "/portal") && !strings.Contains(finalURL, "Login") {
-			log.Debug("TCC login successful (landed on portal)")
+			log.FromContext(ctx).Debug("TCC login successful (landed on portal)")
 			c.session.MarkAuthenticated()
 			return nil
 		}
@@ -179,7 +189,7 @@ func (c *Client) Login(ctx context.Context) error {
 		// Also check body for login indicators
 		if strings.Contains(bodyStr, "LogoutLink") || strings.Contains(bodyStr, "Welcome") ||
 			strings.Contains(bodyStr, "SignOut") || strings.Contains(bodyStr, "Total Connect") {
-			log.Debug("TCC login successful (found auth indicators in response)")
+			log.FromContext(ctx).Debug("TCC login successful (found auth indicators in response)")
 			c.session.MarkAuthenticated()
 			return nil
 		}
@@ -187,12 +197,12 @@ func (c *Client) Login(ctx context.Context) error {
 		// Check for login failure indicators
 		if strings.Contains(bodyStr, "Login failed") || strings.Contains(bodyStr, "Invalid") ||
 			strings.Contains(bodyStr, "incorrect") {
-			log.Debug("TCC login failed: invalid credentials")
+			log.FromContext(ctx).Debug("TCC login failed: invalid credentials")
 			return fmt.Errorf("login failed: invalid credentials")
 		}
 	}
 
-	log.Debug("TCC login response: %s", truncateForLog(bodyStr, 500))
+	log.FromContext(ctx).Debug("TCC login response: %s", truncateForLog(bodyStr, 500))
 	return fmt.Errorf("login failed: unexpected response %d at %s", resp.StatusCode, finalURL)
 }
 
@@ -212,12 +222,13 @@ func (c *Client) GetDevices(ctx context.Context) ([]ThermostatState, error) {
 	// Check poll interval
 	c.pollMu.Lock()
 	timeSinceLast := time.Since(c.lastPoll)
-	if timeSinceLast < MinPollInterval && len(c.devices) > 0 {
+	minInterval := c.minPollInterval
+	if timeSinceLast < minInterval && len(c.devices) > 0 {
 		c.pollMu.Unlock()
 		c.devicesMu.RLock()
 		defer c.devicesMu.RUnlock()
-		log.Debug("Returning cached device data (last poll %.1f minutes ago, min interval %d minutes)",
-			timeSinceLast.Minutes(), int(MinPollInterval.Minutes()))
+		log.FromContext(ctx).Debug("Returning cached device data (last poll %.1f minutes ago, min interval %.1f minutes)",
+			timeSinceLast.Minutes(), minInterval.Minutes())
 		return c.devices, nil
 	}
 	c.pollMu.Unlock()
@@ -230,7 +241,7 @@ func (c *Client) GetDevices(ctx context.Context) ([]ThermostatState, error) {
 	for _, endpoint := range endpoints {
 		// Wait for rate limiter
 		if err := c.limiter.Wait(ctx); err != nil {
-			return nil, fmt.Errorf("rate limit wait: %w", err)
+			return nil, rateLimitWait(err)
 		}
 
 		req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+endpoint, nil)
@@ -243,7 +254,7 @@ func (c *Client) GetDevices(ctx context.Context) ([]ThermostatState, error) {
 
 		resp, err := c.session.GetClient().Do(req)
 		if err != nil {
-			log.Debug("TCC endpoint %s failed: %v", endpoint, err)
+			log.FromContext(ctx).Debug("TCC endpoint %s failed: %v", endpoint, err)
 			continue
 		}
 
@@ -254,18 +265,18 @@ func (c *Client) GetDevices(ctx context.Context) ([]ThermostatState, error) {
 		}
 
 		finalURL := resp.Request.URL.String()
-		log.Debug("TCC %s response (status %d, url %s): %s", endpoint, resp.StatusCode, finalURL, truncateForLog(string(body), 500))
+		log.FromContext(ctx).Debug("TCC %s response (status %d, url %s): %s", endpoint, resp.StatusCode, finalURL, truncateForLog(string(body), 500))
 
 		// Check for redirects to error or login pages
 		if strings.Contains(finalURL, "Error") || strings.Contains(finalURL, "Login") {
-			log.Debug("TCC endpoint %s redirected to error/login", endpoint)
+			log.FromContext(ctx).Debug("TCC endpoint %s redirected to error/login", endpoint)
 			continue
 		}
 
 		// Try to parse the response
 		devices = c.parseDeviceResponse(body)
 		if len(devices) > 0 {
-			log.Debug("Found %d devices from %s", len(devices), endpoint)
+			log.FromContext(ctx).Debug("Found %d devices from %s", len(devices), endpoint)
 			break
 		}
 	}
@@ -273,12 +284,12 @@ func (c *Client) GetDevices(ctx context.Context) ([]ThermostatState, error) {
 	// If no devices found from list endpoints, try to get device from login redirect
 	lastDeviceID := c.session.GetLastDeviceID()
 	if len(devices) == 0 && lastDeviceID != 0 {
-		log.Debug("Trying to fetch known device ID %d", lastDeviceID)
+		log.FromContext(ctx).Debug("Trying to fetch known device ID %d", lastDeviceID)
 		if device, err := c.GetDeviceData(ctx, lastDeviceID); err == nil && device != nil {
-			log.Debug("Successfully fetched device %d", lastDeviceID)
+			log.FromContext(ctx).Debug("Successfully fetched device %d", lastDeviceID)
 			devices = append(devices, *device)
 		} else if err != nil {
-			log.Debug("Failed to fetch device %d: %v", lastDeviceID, err)
+			log.FromContext(ctx).Debug("Failed to fetch device %d: %v", lastDeviceID, err)
 		}
 	}
 
@@ -305,10 +316,6 @@ func (c *Client) parseDeviceResponse(body []byte) []ThermostatState {
 	if err := json.Unmarshal(body, &zones); err == nil && len(zones) > 0 {
 		log.Debug("Parsed as ZoneData array: %d zones", len(zones))
 		for _, z := range zones {
-			humidity := int(z.IndoorHumidity)
-			if humidity > 100 {
-				humidity = 0 // Hide invalid humidity
-			}
 			devices = append(devices, ThermostatState{
 				DeviceID:     z.DeviceID,
 				Name:         z.Name,
@@ -316,9 +323,11 @@ func (c *Client) parseDeviceResponse(body []byte) []ThermostatState {
 				HeatSetpoint: z.HeatSetpoint,
 				CoolSetpoint: z.CoolSetpoint,
 				SystemMode:   SystemModeFromTCC(z.SystemSwitchPos),
-				Humidity:     humidity,
+				Humidity:     indoorHumidity(z.IndoorHumidity),
 				IsHeating:    IsEquipmentHeating(z.EquipmentStatus),
 				IsCooling:    IsEquipmentCooling(z.EquipmentStatus),
+				IsFanRunning: z.IsFanRunning,
+				HoldStatus:   HoldStatusFromTCC(z.StatusHeat, z.StatusCool),
 				UpdatedAt:    time.Now(),
 			})
 		}
@@ -332,10 +341,6 @@ func (c *Client) parseDeviceResponse(body []byte) []ThermostatState {
 		for _, loc := range locResp {
 			log.Debug("Location %s has %d zones", loc.Name, len(loc.Devices))
 			for _, z := range loc.Devices {
-				humidity := int(z.IndoorHumidity)
-				if humidity > 100 {
-					humidity = 0 // Hide invalid humidity
-				}
 				devices = append(devices, ThermostatState{
 					DeviceID:     z.DeviceID,
 					Name:         z.Name,
@@ -343,9 +348,11 @@ func (c *Client) parseDeviceResponse(body []byte) []ThermostatState {
 					HeatSetpoint: z.HeatSetpoint,
 					CoolSetpoint: z.CoolSetpoint,
 					SystemMode:   SystemModeFromTCC(z.SystemSwitchPos),
-					Humidity:     humidity,
+					Humidity:     indoorHumidity(z.IndoorHumidity),
 					IsHeating:    IsEquipmentHeating(z.EquipmentStatus),
 					IsCooling:    IsEquipmentCooling(z.EquipmentStatus),
+					IsFanRunning: z.IsFanRunning,
+					HoldStatus:   HoldStatusFromTCC(z.StatusHeat, z.StatusCool),
 					UpdatedAt:    time.Now(),
 				})
 			}
@@ -366,11 +373,11 @@ func (c *Client) GetDeviceData(ctx context.Context, deviceID int) (*ThermostatSt
 
 	// Wait for rate limiter
 	if err := c.limiter.Wait(ctx); err != nil {
-		return nil, fmt.Errorf("rate limit wait: %w", err)
+		return nil, rateLimitWait(err)
 	}
 
 	path := fmt.Sprintf(DeviceDataPath, deviceID)
-	log.Debug("Fetching device data for device %d from %s", deviceID, path)
+	log.FromContext(ctx).Debug("Fetching device data for device %d from %s", deviceID, path)
 
 	// Add timestamp to prevent caching
 	fullURL := fmt.Sprintf("%s%s?_=%d", c.baseURL, path, time.Now().UnixMilli())
@@ -387,7 +394,7 @@ func (c *Client) GetDeviceData(ctx context.Context, deviceID int) (*ThermostatSt
 
 	resp, err := c.session.GetClient().Do(req)
 	if err != nil {
-		log.Debug("Failed to fetch device data: %v", err)
+		log.FromContext(ctx).Debug("Failed to fetch device data: %v", err)
 		return nil, fmt.Errorf("failed to get device data: %w", err)
 	}
 	defer resp.Body.Close()
@@ -395,7 +402,7 @@ func (c *Client) GetDeviceData(ctx context.Context, deviceID int) (*ThermostatSt
 	finalURL := resp.Request.URL.String()
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		log.Debug("Device data request unauthorized")
+		log.FromContext(ctx).Debug("Device data request unauthorized")
 		c.session.MarkUnauthenticated()
 		return nil, fmt.Errorf("session expired")
 	}
@@ -405,11 +412,11 @@ func (c *Client) GetDeviceData(ctx context.Context, deviceID int) (*ThermostatSt
 		return nil, fmt.Errorf("failed to read device data: %w", err)
 	}
 
-	log.Debug("Device data response (status %d, url %s): %s", resp.StatusCode, finalURL, truncateForLog(string(body), 500))
+	log.FromContext(ctx).Debug("Device data response (status %d, url %s): %s", resp.StatusCode, finalURL, truncateForLog(string(body), 500))
 
 	// Check for error redirects
 	if strings.Contains(finalURL, "Error") || strings.Contains(finalURL, "Login") {
-		log.Debug("Device data request redirected to error/login page")
+		log.FromContext(ctx).Debug("Device data request redirected to error/login page")
 		return nil, fmt.Errorf("session expired or invalid device")
 	}
 
@@ -420,21 +427,19 @@ func (c *Client) GetDeviceData(ctx context.Context, deviceID int) (*ThermostatSt
 		} `json:"latestData"`
 	}
 	if err := json.Unmarshal(body, &dataResp); err != nil {
-		log.Debug("Failed to parse device data: %v", err)
+		log.FromContext(ctx).Debug("Failed to parse device data: %v", err)
 		return nil, fmt.Errorf("failed to parse device data: %w", err)
 	}
 
 	ui := dataResp.LatestData.UIData
 
 	// Log raw TCC values for debugging cache issues
-	log.Debug("TCC raw values: SystemSwitchPosition=%d, DispTemperature=%.1f, HeatSetpoint=%.1f, CoolSetpoint=%.1f, EquipmentOutputStatus=%d",
+	log.FromContext(ctx).Debug("TCC raw values: SystemSwitchPosition=%d, DispTemperature=%.1f, HeatSetpoint=%.1f, CoolSetpoint=%.1f, EquipmentOutputStatus=%d",
 		ui.SystemSwitchPosition, ui.DispTemperature, ui.HeatSetpoint, ui.CoolSetpoint, ui.EquipmentOutputStatus)
 
-	// Cap humidity at 100% (TCC sometimes returns invalid values)
-	humidity := int(ui.IndoorHumidity)
-	if humidity > 100 {
-		log.Debug("Invalid humidity value %d from TCC, capping at 100%%", humidity)
-		humidity = 0 // Hide invalid humidity
+	humidity := indoorHumidity(float64(ui.IndoorHumidity))
+	if humidity == nil {
+		log.FromContext(ctx).Debug("Invalid humidity value %v from TCC, treating as no reading", ui.IndoorHumidity)
 	}
 
 	state := &ThermostatState{
@@ -446,11 +451,21 @@ func (c *Client) GetDeviceData(ctx context.Context, deviceID int) (*ThermostatSt
 		Humidity:     humidity,
 		IsHeating:    IsEquipmentHeating(ui.EquipmentOutputStatus),
 		IsCooling:    IsEquipmentCooling(ui.EquipmentOutputStatus),
+		IsFanRunning: ui.IsFanRunning,
 		Units:        ui.DisplayedUnits,
+		HoldStatus:   HoldStatusFromTCC(ui.StatusHeat, ui.StatusCool),
 		UpdatedAt:    time.Now(),
 	}
+	if ui.OutdoorTempAvailable {
+		outdoor := ui.OutdoorTemperature
+		state.OutdoorTemp = &outdoor
+	}
+	if ui.OutdoorHumidityAvailable && ui.OutdoorHumidity >= 0 && ui.OutdoorHumidity <= 100 {
+		outdoorHumidity := ui.OutdoorHumidity
+		state.OutdoorHumidity = &outdoorHumidity
+	}
 
-	log.Debug("Successfully fetched device data: temp=%.1f°%s, heat=%.1f, cool=%.1f, mode=%s",
+	log.FromContext(ctx).Debug("Successfully fetched device data: temp=%.1f°%s, heat=%.1f, cool=%.1f, mode=%s",
 		state.CurrentTemp, state.Units, state.HeatSetpoint, state.CoolSetpoint, state.SystemMode)
 
 	c.session.RefreshSession()
@@ -487,6 +502,27 @@ func (c *Client) SetSystemMode(ctx context.Context, deviceID int, mode string) e
 	})
 }
 
+// ApplySettings changes mode and setpoints in a single control request so
+// they take effect together. Nil setpoints and an empty mode are left as is.
+func (c *Client) ApplySettings(ctx context.Context, deviceID int, settings Settings) error {
+	req := ControlRequest{DeviceID: deviceID}
+	if settings.SystemMode != "" {
+		tccMode := SystemModeToTCC(settings.SystemMode)
+		req.SystemSwitch = &tccMode
+	}
+	if settings.HeatSetpoint != nil {
+		req.HeatSetpoint = settings.HeatSetpoint
+		req.StatusHeat = intPtr(1) // Hold
+		req.HeatNextPeriod = intPtr(0)
+	}
+	if settings.CoolSetpoint != nil {
+		req.CoolSetpoint = settings.CoolSetpoint
+		req.StatusCool = intPtr(1) // Hold
+		req.CoolNextPeriod = intPtr(0)
+	}
+	return c.submitControl(ctx, req)
+}
+
 // submitControl sends a control request to TCC
 func (c *Client) submitControl(ctx context.Context, req ControlRequest) error {
 	if !c.session.IsAuthenticated() {
@@ -497,7 +533,7 @@ func (c *Client) submitControl(ctx context.Context, req ControlRequest) error {
 
 	// Wait for rate limiter
 	if err := c.limiter.Wait(ctx); err != nil {
-		return fmt.Errorf("rate limit wait: %w", err)
+		return rateLimitWait(err)
 	}
 
 	jsonData, err := json.Marshal(req)
@@ -526,7 +562,7 @@ func (c *Client) submitControl(ctx context.Context, req ControlRequest) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("control request failed: %d - %s", resp.StatusCode, string(body))
+		return &StatusError{Op: "control request failed", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	c.session.RefreshSession()
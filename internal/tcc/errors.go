@@ -0,0 +1,65 @@
+package tcc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrRateLimited matches errors caused by rate limiting, either our own
+// limiter or TCC refusing requests
+var ErrRateLimited = errors.New("rate limited")
+
+// rateLimitError keeps the original message while matching ErrRateLimited
+type rateLimitError struct {
+	msg string
+	err error
+}
+
+func (e *rateLimitError) Error() string        { return e.msg }
+func (e *rateLimitError) Unwrap() error        { return e.err }
+func (e *rateLimitError) Is(target error) bool { return target == ErrRateLimited }
+
+// rateLimitWait wraps an error from the request limiter
+func rateLimitWait(err error) error {
+	return &rateLimitError{msg: fmt.Sprintf("rate limit wait: %v", err), err: err}
+}
+
+// StatusError is returned when TCC answers with an unexpected HTTP status
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("%s: %d - %s", e.Op, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("%s: unexpected status %d", e.Op, e.StatusCode)
+}
+
+// IsUnavailable reports whether err means TCC couldn't be reached or is
+// refusing requests for now, as opposed to rejecting the request itself
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
@@ -24,6 +24,8 @@ type ZoneData struct {
 	SystemSwitchPos  int     `json:"SystemSwitchPosition"`
 	EquipmentStatus  int     `json:"EquipmentOutputStatus"`
 	IsFanRunning     bool    `json:"IsFanRunning"`
+	StatusHeat       int     `json:"StatusHeat"`
+	StatusCool       int     `json:"StatusCool"`
 	CanHeat          bool    `json:"CanHeat"`
 	CanCool          bool    `json:"CanCool"`
 	TemperatureScale string  `json:"ScheduleCapable"` // This isn't right, need to check actual response
@@ -64,19 +66,21 @@ type LatestData struct {
 
 // UIData represents the UI data from CheckDataSession
 type UIData struct {
-	DispTemperature        float64 `json:"DispTemperature"`
-	HeatSetpoint           float64 `json:"HeatSetpoint"`
-	CoolSetpoint           float64 `json:"CoolSetpoint"`
-	IndoorHumidity         float64 `json:"IndoorHumidity"`
-	OutdoorHumidity        float64 `json:"OutdoorHumidity"`
-	OutdoorTemperature     float64 `json:"OutdoorTemperature"`
-	SystemSwitchPosition   int     `json:"SystemSwitchPosition"`
-	EquipmentOutputStatus  int     `json:"EquipmentOutputStatus"`
-	IsFanRunning           bool    `json:"IsFanRunning"`
-	DisplayedUnits         string  `json:"DisplayUnits"` // "F" or "C"
-	StatusHeat             int     `json:"StatusHeat"`
-	StatusCool             int     `json:"StatusCool"`
-	DeviceID               int     `json:"DeviceID"`
+	DispTemperature          float64 `json:"DispTemperature"`
+	HeatSetpoint             float64 `json:"HeatSetpoint"`
+	CoolSetpoint             float64 `json:"CoolSetpoint"`
+	IndoorHumidity           float64 `json:"IndoorHumidity"`
+	OutdoorHumidity          float64 `json:"OutdoorHumidity"`
+	OutdoorTemperature       float64 `json:"OutdoorTemperature"`
+	OutdoorTempAvailable     bool    `json:"OutdoorTemperatureAvailable"`
+	OutdoorHumidityAvailable bool    `json:"OutdoorHumidityAvailable"`
+	SystemSwitchPosition     int     `json:"SystemSwitchPosition"`
+	EquipmentOutputStatus    int     `json:"EquipmentOutputStatus"`
+	IsFanRunning             bool    `json:"IsFanRunning"`
+	DisplayedUnits           string  `json:"DisplayUnits"` // "F" or "C"
+	StatusHeat               int     `json:"StatusHeat"`
+	StatusCool               int     `json:"StatusCool"`
+	DeviceID                 int     `json:"DeviceID"`
 }
 
 // ControlRequest represents a request to change thermostat settings
@@ -92,6 +96,13 @@ type ControlRequest struct {
 	FanMode                *int     `json:"FanMode,omitempty"`
 }
 
+// Settings is a combined mode and setpoint change
+type Settings struct {
+	SystemMode   string
+	HeatSetpoint *float64
+	CoolSetpoint *float64
+}
+
 // SystemMode constants
 const (
 	TCCModeEmergencyHeat = 0
@@ -108,19 +119,48 @@ const (
 	EquipmentCooling = 2
 )
 
+// Hold status constants (StatusHeat/StatusCool values)
+const (
+	TCCStatusSchedule      = 0
+	TCCStatusTemporaryHold = 1
+	TCCStatusPermanentHold = 2
+)
+
+// Hold status strings
+const (
+	HoldStatusSchedule  = "schedule"
+	HoldStatusTemporary = "temporary"
+	HoldStatusPermanent = "permanent"
+)
+
 // ThermostatState represents the parsed thermostat state
 type ThermostatState struct {
-	DeviceID      int       `json:"device_id"`
-	Name          string    `json:"name"`
-	CurrentTemp   float64   `json:"current_temp"`
-	HeatSetpoint  float64   `json:"heat_setpoint"`
-	CoolSetpoint  float64   `json:"cool_setpoint"`
-	SystemMode    string    `json:"system_mode"`
-	Humidity      int       `json:"humidity"`
-	IsHeating     bool      `json:"is_heating"`
-	IsCooling     bool      `json:"is_cooling"`
-	Units         string    `json:"units"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	DeviceID        int       `json:"device_id"`
+	Name            string    `json:"name"`
+	CurrentTemp     float64   `json:"current_temp"`
+	HeatSetpoint    float64   `json:"heat_setpoint"`
+	CoolSetpoint    float64   `json:"cool_setpoint"`
+	SystemMode      string    `json:"system_mode"`
+	Humidity        *int      `json:"humidity"` // nil when TCC had no valid reading
+	IsHeating       bool      `json:"is_heating"`
+	IsCooling       bool      `json:"is_cooling"`
+	IsFanRunning    bool      `json:"is_fan_running"`
+	Units           string    `json:"units"`
+	HoldStatus      string    `json:"hold_status,omitempty"`
+	OutdoorTemp     *float64  `json:"outdoor_temp,omitempty"`
+	OutdoorHumidity *float64  `json:"outdoor_humidity,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// indoorHumidity converts a TCC indoor humidity reading, returning nil when
+// there is none. TCC reports humidity above 100% (usually 128) when it has
+// no reading.
+func indoorHumidity(v float64) *int {
+	if v < 0 || v > 100 {
+		return nil
+	}
+	humidity := int(v)
+	return &humidity
 }
 
 // SystemModeFromTCC converts TCC system switch position to mode string
@@ -159,6 +199,25 @@ func SystemModeToTCC(mode string) int {
 	}
 }
 
+// HoldStatusFromTCC converts TCC StatusHeat/StatusCool values to a hold
+// status string. A hold on either setpoint counts as a hold.
+func HoldStatusFromTCC(statusHeat, statusCool int) string {
+	status := statusHeat
+	if statusCool > status {
+		status = statusCool
+	}
+	switch status {
+	case TCCStatusSchedule:
+		return HoldStatusSchedule
+	case TCCStatusTemporaryHold:
+		return HoldStatusTemporary
+	case TCCStatusPermanentHold:
+		return HoldStatusPermanent
+	default:
+		return ""
+	}
+}
+
 // IsEquipmentHeating returns true if equipment is heating
 func IsEquipmentHeating(status int) bool {
 	return status == EquipmentHeating
@@ -0,0 +1,30 @@
+package tcc
+
+import "testing"
+
+func TestIndoorHumidity(t *testing.T) {
+	tests := []struct {
+		raw  float64
+		want *int
+	}{
+		{raw: 0, want: intPtr(0)},
+		{raw: 45, want: intPtr(45)},
+		{raw: 100, want: intPtr(100)},
+		{raw: 128, want: nil}, // TCC's "no reading"
+		{raw: -1, want: nil},
+	}
+
+	for _, tt := range tests {
+		got := indoorHumidity(tt.raw)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("indoorHumidity(%v) = %v, want %v", tt.raw, deref(got), deref(tt.want))
+		}
+	}
+}
+
+func deref(p *int) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
@@ -0,0 +1,150 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/backup"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// backupPassphraseHeader optionally carries the passphrase that encrypts a
+// downloaded backup. A header keeps it out of URLs and access logs.
+const backupPassphraseHeader = "X-Backup-Passphrase"
+
+// backupTimeout bounds how long building and sending a backup may take
+const backupTimeout = 5 * time.Minute
+
+// requireAdmin only lets through requests bearing the admin token. The
+// admin API is refused outright while no token is configured.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := s.service.GetConfig().AdminToken()
+		if err != nil {
+			log.FromContext(r.Context()).Error("Failed to load admin token: %v", err)
+			writeError(w, http.StatusInternalServerError, "Failed to load admin token")
+			return
+		}
+		if token == "" {
+			writeError(w, http.StatusForbidden, "Admin API is disabled; configure an admin token to enable it")
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.FromContext(r.Context()).Warn("Rejected admin request from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tcc-bridge admin"`)
+			writeError(w, http.StatusUnauthorized, "Admin token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleBackup streams a bundle of the database, encryption key and config.
+// An unencrypted bundle would hand out the key that decrypts the stored TCC
+// password, so a passphrase is required unless the key has one of its own.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := s.service.GetConfig()
+	passphrase := r.Header.Get(backupPassphraseHeader)
+
+	if passphrase == "" && !s.service.GetEncryptionKey().Protected() {
+		writeError(w, http.StatusBadRequest,
+			"The encryption key has no passphrase, so backups must be encrypted: send "+backupPassphraseHeader)
+		return
+	}
+
+	// The bundle is spooled to a temp file before anything is sent so a
+	// failure can still be reported as an error response
+	spool, err := os.CreateTemp("", "tcc-bridge-backup-*.tar.gz")
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to create backup file: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create backup")
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	manifest, err := backup.Create(ctx, spool, backup.Source{
+		DB:         s.service.GetSQLiteDB(),
+		KeyPath:    cfg.EncryptionKeyPath,
+		Config:     cfg,
+		AppVersion: Version,
+	}, passphrase)
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to create backup: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create backup")
+		return
+	}
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to read back backup: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create backup")
+		return
+	}
+
+	name := "tcc-bridge-backup-" + manifest.CreatedAt.Local().Format("20060102-150405") + ".tar.gz"
+	contentType := "application/gzip"
+	if passphrase != "" {
+		name += ".enc"
+		contentType = "application/octet-stream"
+	}
+
+	s.service.GetDB().LogEventContext(ctx, storage.EventSourceUser, storage.EventTypeInfo,
+		fmt.Sprintf("Backup downloaded (schema version %d)", manifest.SchemaVersion),
+		map[string]interface{}{
+			"schema_version": manifest.SchemaVersion,
+			"encrypted":      passphrase != "",
+			"bytes":          size,
+		})
+
+	// Large databases can take longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(backupTimeout))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, spool); err != nil {
+		log.FromContext(ctx).Warn("Failed to send backup: %v", err)
+	}
+}
+
+// RotateKeyResponse reports the outcome of a key rotation
+type RotateKeyResponse struct {
+	KeyVersion  int `json:"key_version"`
+	Reencrypted int `json:"reencrypted"`
+}
+
+// handleRotateKey replaces the encryption key and re-encrypts stored
+// credentials with it
+func (s *Server) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	db := s.service.GetSQLiteDB()
+
+	version, count, err := s.service.GetEncryptionKey().Rotate(db)
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to rotate encryption key: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to rotate encryption key")
+		return
+	}
+
+	log.FromContext(ctx).Info("Rotated encryption key to version %d", version)
+	db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypeCredentials,
+		fmt.Sprintf("Encryption key rotated to version %d", version),
+		map[string]interface{}{"key_version": version, "reencrypted": count, "via": "api"})
+
+	writeJSON(w, RotateKeyResponse{KeyVersion: version, Reencrypted: count})
+}
@@ -0,0 +1,132 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/automation"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// handleListRules returns all automation rules
+func (s *Server) handleListRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.service.GetDB().GetRules()
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get automation rules: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get rules")
+		return
+	}
+	if rules == nil {
+		rules = []storage.AutomationRule{}
+	}
+
+	writeJSON(w, rules)
+}
+
+// handleGetRule returns a single automation rule
+func (s *Server) handleGetRule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	rule, err := s.service.GetDB().GetRule(id)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get automation rule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get rule")
+		return
+	}
+	if rule == nil {
+		writeError(w, http.StatusNotFound, "Rule not found")
+		return
+	}
+
+	writeJSON(w, rule)
+}
+
+// handleCreateRule stores a new automation rule
+func (s *Server) handleCreateRule(w http.ResponseWriter, r *http.Request) {
+	var rule storage.AutomationRule
+	rule.Enabled = true
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := automation.Validate(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := s.service.GetDB()
+	if err := db.CreateRule(&rule); err != nil {
+		log.FromContext(r.Context()).Error("Failed to create automation rule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create rule")
+		return
+	}
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeAutomation,
+		fmt.Sprintf("Rule %q created", rule.Name),
+		map[string]interface{}{"rule_id": rule.ID, "device_id": rule.DeviceID, "dry_run": rule.DryRun})
+
+	writeJSONStatus(w, http.StatusCreated, rule)
+}
+
+// handleUpdateRule replaces an existing automation rule
+func (s *Server) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var rule storage.AutomationRule
+	rule.Enabled = true
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	rule.ID = id
+
+	if err := automation.Validate(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := s.service.GetDB()
+	if err := db.UpdateRule(&rule); err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Rule not found")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to update automation rule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to update rule")
+		return
+	}
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeAutomation,
+		fmt.Sprintf("Rule %q updated", rule.Name),
+		map[string]interface{}{"rule_id": rule.ID, "device_id": rule.DeviceID, "dry_run": rule.DryRun})
+
+	writeJSON(w, rule)
+}
+
+// handleDeleteRule removes an automation rule
+func (s *Server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	db := s.service.GetDB()
+	if err := db.DeleteRule(id); err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Rule not found")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to delete automation rule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to delete rule")
+		return
+	}
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeAutomation,
+		fmt.Sprintf("Rule %d deleted", id),
+		map[string]interface{}{"rule_id": id})
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/outbox"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// handleListCommands returns queued commands, optionally filtered by status
+func (s *Server) handleListCommands(w http.ResponseWriter, r *http.Request) {
+	status := storage.CommandStatus(r.URL.Query().Get("status"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	commands, err := s.service.GetDB().GetCommands(status, limit)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get queued commands: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get commands")
+		return
+	}
+	if commands == nil {
+		commands = []storage.QueuedCommand{}
+	}
+
+	writeJSON(w, commands)
+}
+
+// handleCancelCommand cancels a pending queued command
+func (s *Server) handleCancelCommand(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := s.service.GetOutbox().Cancel(r.Context(), id); err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Pending command not found")
+			return
+		}
+		if err == outbox.ErrInFlight {
+			writeError(w, http.StatusConflict, "Command is already being sent to TCC")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to cancel command: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to cancel command")
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
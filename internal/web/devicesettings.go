@@ -0,0 +1,54 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/devices"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// handleGetDeviceSettings returns a device's settings, or the defaults if
+// none have been saved
+func (s *Server) handleGetDeviceSettings(w http.ResponseWriter, r *http.Request) {
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	writeJSON(w, s.service.GetDeviceSettings().Get(deviceID))
+}
+
+// handleSaveDeviceSettings replaces a device's settings
+func (s *Server) handleSaveDeviceSettings(w http.ResponseWriter, r *http.Request) {
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var settings storage.DeviceSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	settings.DeviceID = deviceID
+
+	if err := devices.Validate(&settings); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.service.GetDeviceSettings().Save(&settings); err != nil {
+		log.FromContext(r.Context()).Error("Failed to save device settings: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save device settings")
+		return
+	}
+
+	s.service.GetDB().LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeSettings,
+		"Device settings updated",
+		map[string]interface{}{
+			"device_id":        deviceID,
+			"display_name":     settings.DisplayName,
+			"hide_from_matter": settings.HideFromMatter,
+			"temp_offset":      settings.TempOffset,
+			"temperature_unit": settings.TemperatureUnit,
+		})
+
+	writeJSON(w, settings)
+}
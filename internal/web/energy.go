@@ -0,0 +1,56 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// handleGetEnergy returns estimated HVAC energy use and cost per device
+func (s *Server) handleGetEnergy(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	deviceID := 0
+	if v := query.Get("device_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid device_id")
+			return
+		}
+		deviceID = id
+	}
+
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD")
+			return
+		}
+		to = t
+	}
+	from := time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.Local)
+	if v := query.Get("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD")
+			return
+		}
+		from = t
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	report, err := s.service.GetEnergyEstimator().Estimate(deviceID, from, to)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to estimate energy cost: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to estimate energy cost")
+		return
+	}
+
+	writeJSON(w, report)
+}
@@ -0,0 +1,106 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/export"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// exportTimeout bounds how long streaming an export may take
+const exportTimeout = 30 * time.Minute
+
+// defaultExportRange is exported when no from time is given
+const defaultExportRange = 30 * 24 * time.Hour
+
+// handleExport streams events or readings for a time range as CSV, NDJSON
+// or Arrow. The schema is also sent as JSON in the X-Export-Schema header.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	req := export.Request{
+		Dataset:    export.Dataset(mux.Vars(r)["dataset"]),
+		Format:     export.Format(query.Get("format")),
+		Resolution: storage.Resolution(query.Get("resolution")),
+		To:         time.Now(),
+	}
+	if req.Format == "" {
+		req.Format = export.FormatCSV
+	}
+	if v := query.Get("gzip"); v != "" {
+		gz, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid gzip, expected true or false")
+			return
+		}
+		req.Gzip = gz
+	}
+	if v := query.Get("to"); v != "" {
+		t, err := export.ParseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.To = t
+	}
+	req.From = req.To.Add(-defaultExportRange)
+	if v := query.Get("from"); v != "" {
+		t, err := export.ParseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.From = t
+	}
+	if v := query.Get("device_id"); v != "" {
+		deviceID, err := strconv.Atoi(v)
+		if err != nil || deviceID <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid device_id")
+			return
+		}
+		req.DeviceID = deviceID
+	}
+	if v := query.Get("source"); v != "" {
+		src := storage.EventSource(v)
+		req.Source = &src
+	}
+	if v := query.Get("event_type"); v != "" {
+		eventType := storage.EventType(v)
+		req.EventType = &eventType
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	schema, err := json.Marshal(req.Schema())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to encode schema")
+		return
+	}
+
+	// Exports can run far longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(exportTimeout))
+
+	w.Header().Set("Content-Type", req.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", req.Filename()))
+	w.Header().Set("X-Export-Schema", string(schema))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Once rows are streaming the status is sent, so failures can only
+	// be logged; the truncated body will not parse as a complete export
+	start := time.Now()
+	rows, err := export.Export(ctx, s.service.GetDB(), req, w)
+	if err != nil {
+		log.FromContext(ctx).Warn("Export of %s stopped after %d rows: %v", req.Dataset, rows, err)
+		return
+	}
+	log.FromContext(ctx).Info("Exported %d %s rows as %s in %s", rows, req.Dataset, req.Format, time.Since(start).Round(time.Millisecond))
+}
@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/polling"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/retention"
 	"github.com/stephens/tcc-bridge/internal/storage"
+	"github.com/stephens/tcc-bridge/internal/tcc"
 )
 
 // Version information, set via ldflags at build time
@@ -23,6 +27,8 @@ var (
 type StatusResponse struct {
 	TCC        ConnectionStatus `json:"tcc"`
 	Matter     MatterStatus     `json:"matter"`
+	Polling    polling.Status   `json:"polling"`
+	Storage    retention.Status `json:"storage"`
 	Configured bool             `json:"configured"`
 }
 
@@ -33,25 +39,30 @@ type ConnectionStatus struct {
 	Error     string    `json:"error,omitempty"`
 }
 
-// MatterStatus represents Matter bridge status
+// MatterStatus represents Matter bridge status. Commissioning fields come
+// from the bridge when it is running and from the stored state otherwise.
 type MatterStatus struct {
-	Running      bool   `json:"running"`
-	Commissioned bool   `json:"commissioned"`
-	FabricID     string `json:"fabric_id,omitempty"`
+	Running bool `json:"running"`
+	matter.CommissioningState
+	Supervisor matter.SupervisorStatus `json:"supervisor"`
+	Commands   matter.CommandStats     `json:"commands"`
+	Connection matter.ConnectionStats  `json:"connection"`
 }
 
 // ThermostatResponse represents thermostat data for the API
 type ThermostatResponse struct {
-	DeviceID     int     `json:"device_id"`
-	Name         string  `json:"name"`
-	CurrentTemp  float64 `json:"current_temp"`
-	HeatSetpoint float64 `json:"heat_setpoint"`
-	CoolSetpoint float64 `json:"cool_setpoint"`
-	SystemMode   string  `json:"system_mode"`
-	Humidity     int     `json:"humidity"`
-	IsHeating    bool    `json:"is_heating"`
-	IsCooling    bool    `json:"is_cooling"`
-	UpdatedAt    string  `json:"updated_at"`
+	DeviceID        int     `json:"device_id"`
+	Name            string  `json:"name"`
+	CurrentTemp     float64 `json:"current_temp"`
+	HeatSetpoint    float64 `json:"heat_setpoint"`
+	CoolSetpoint    float64 `json:"cool_setpoint"`
+	SystemMode      string  `json:"system_mode"`
+	Humidity        *int    `json:"humidity"` // nil when TCC had no valid reading
+	IsHeating       bool    `json:"is_heating"`
+	IsCooling       bool    `json:"is_cooling"`
+	ActivePreset    string  `json:"active_preset,omitempty"`
+	TemperatureUnit string  `json:"temperature_unit,omitempty"` // Display preference from device settings
+	UpdatedAt       string  `json:"updated_at"`
 }
 
 // ConfigResponse represents configuration status
@@ -84,6 +95,7 @@ type PairingResponse struct {
 	QRCode         string `json:"qr_code"`
 	ManualPairCode string `json:"manual_pair_code"`
 	Commissioned   bool   `json:"commissioned"`
+	Source         string `json:"source"` // "bridge", or "stored" while the bridge is down
 }
 
 // VersionResponse represents version info
@@ -102,24 +114,31 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	creds, _ := db.GetCredentials()
 	configured := creds != nil
 
+	pollStatus := s.service.GetPollScheduler().Status()
+
 	status := StatusResponse{
 		TCC: ConnectionStatus{
 			Connected: tccClient.IsAuthenticated(),
+			LastPoll:  pollStatus.LastPoll,
 		},
 		Matter: MatterStatus{
-			Running: matterBridge.IsRunning(),
+			Running:    matterBridge.IsRunning(),
+			Supervisor: s.service.GetMatterSupervisor().Status(),
+			Commands:   matterBridge.CommandStats(),
+			Connection: matterBridge.ConnectionStats(),
 		},
+		Polling:    pollStatus,
+		Storage:    s.service.GetRetentionJob().Status(),
 		Configured: configured,
 	}
 
-	// Get Matter status if running
-	if matterBridge.IsRunning() {
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		defer cancel()
-		if matterStatus, err := matterBridge.GetStatus(ctx); err == nil {
-			status.Matter.Commissioned = matterStatus.Commissioned
-			status.Matter.FabricID = matterStatus.FabricID
-		}
+	// Get commissioning state from the bridge, or the stored copy if it's down
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if commissioning, err := s.service.GetMatterCommissioning().State(ctx, matterBridge); err == nil {
+		status.Matter.CommissioningState = *commissioning
+	} else {
+		log.FromContext(ctx).Warn("Failed to get Matter commissioning state: %v", err)
 	}
 
 	writeJSON(w, status)
@@ -135,19 +154,22 @@ func (s *Server) handleGetThermostat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	settings := s.service.GetDeviceSettings()
 	response := make([]ThermostatResponse, 0, len(states))
 	for _, state := range states {
 		response = append(response, ThermostatResponse{
-			DeviceID:     state.DeviceID,
-			Name:         state.Name,
-			CurrentTemp:  state.CurrentTemp,
-			HeatSetpoint: state.HeatSetpoint,
-			CoolSetpoint: state.CoolSetpoint,
-			SystemMode:   state.SystemMode.String(),
-			Humidity:     state.Humidity,
-			IsHeating:    state.IsHeating,
-			IsCooling:    state.IsCooling,
-			UpdatedAt:    state.UpdatedAt.Format(time.RFC3339),
+			DeviceID:        state.DeviceID,
+			Name:            state.Name,
+			CurrentTemp:     state.CurrentTemp,
+			HeatSetpoint:    state.HeatSetpoint,
+			CoolSetpoint:    state.CoolSetpoint,
+			SystemMode:      state.SystemMode.String(),
+			Humidity:        state.Humidity,
+			IsHeating:       state.IsHeating,
+			IsCooling:       state.IsCooling,
+			ActivePreset:    state.ActivePreset,
+			TemperatureUnit: settings.Get(state.DeviceID).TemperatureUnit,
+			UpdatedAt:       state.UpdatedAt.Format(time.RFC3339),
 		})
 	}
 
@@ -177,8 +199,19 @@ func (s *Server) handleSetSetpoint(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if req.Type != "heat" && req.Type != "cool" {
+		writeError(w, http.StatusBadRequest, "Invalid setpoint type")
+		return
+	}
+
+	value, err := s.service.GetPolicyEnforcer().CheckSetpoint(ctx, storage.EventSourceUser, req.DeviceID, req.Type, req.Value)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	req.Value = value
+
 	// Set the setpoint in TCC
-	var err error
 	switch req.Type {
 	case "heat":
 		err = tccClient.SetHeatSetpoint(ctx, req.DeviceID, req.Value)
@@ -189,20 +222,38 @@ func (s *Server) handleSetSetpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	field := provenance.FieldHeatSetpoint
+	if req.Type == "cool" {
+		field = provenance.FieldCoolSetpoint
+	}
 	if err != nil {
-		log.Error("Failed to set setpoint: %v", err)
+		if ob := s.service.GetOutbox(); ob.Enabled() && tcc.IsUnavailable(err) {
+			cmd, qerr := ob.EnqueueSetpoint(ctx, storage.EventSourceUser, req.DeviceID, field, req.Value, err)
+			if qerr == nil {
+				s.clearActivePreset(ctx, oldState)
+				writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{"status": "queued", "command": cmd})
+				return
+			}
+			log.FromContext(ctx).Error("Failed to queue setpoint: %v", qerr)
+		}
+		log.FromContext(ctx).Error("Failed to set setpoint: %v", err)
 		writeError(w, http.StatusInternalServerError, "Failed to set setpoint")
 		return
 	}
+	s.service.GetPollScheduler().NoteCommand()
+	s.service.GetCommandTracker().RecordSetpoint(req.DeviceID, field, req.Value, storage.EventSourceUser)
+	s.clearActivePreset(ctx, oldState)
 
-	log.Debug("Web setpoint request applied: device=%d type=%s old=%.2f new=%.2f remote=%s ua=%q",
+	log.FromContext(ctx).Debug("Web setpoint request applied: device=%d type=%s old=%.2f new=%.2f remote=%s ua=%q",
 		req.DeviceID, req.Type, oldValue, req.Value, r.RemoteAddr, r.UserAgent())
 
 	// Fetch updated state from TCC
 	updatedDevice, err := tccClient.GetDeviceData(ctx, req.DeviceID)
 	if err != nil {
-		log.Warn("Failed to fetch updated state after setpoint change: %v", err)
+		log.FromContext(ctx).Warn("Failed to fetch updated state after setpoint change: %v", err)
 	} else {
+		s.service.GetDeviceSettings().Apply(updatedDevice)
+
 		// Save to database
 		state := &storage.ThermostatState{
 			DeviceID:     updatedDevice.DeviceID,
@@ -214,13 +265,15 @@ func (s *Server) handleSetSetpoint(w http.ResponseWriter, r *http.Request) {
 			Humidity:     updatedDevice.Humidity,
 			IsHeating:    updatedDevice.IsHeating,
 			IsCooling:    updatedDevice.IsCooling,
+			OutdoorTemp:  updatedDevice.OutdoorTemp,
 		}
 		db.SaveThermostatState(state)
+		s.service.GetCommandTracker().Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
 
 		// Update Matter bridge
 		matterBridge := s.service.GetMatterBridge()
 		if err := matterBridge.UpdateState(ctx, *updatedDevice); err != nil {
-			log.Debug("Failed to update Matter state: %v", err)
+			log.FromContext(ctx).Debug("Failed to update Matter state: %v", err)
 		}
 
 		// Broadcast update via WebSocket
@@ -242,7 +295,7 @@ func (s *Server) handleSetSetpoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Log the event with details
-	db.LogEvent(storage.EventSourceUser, storage.EventTypeTempChange,
+	db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypeTempChange,
 		fmt.Sprintf("%s setpoint changed from %.1f°F to %.1f°F",
 			strings.Title(req.Type), oldValue, req.Value), map[string]interface{}{
 			"device_id":  req.DeviceID,
@@ -276,18 +329,37 @@ func (s *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
 		oldMode = oldState.SystemMode.String()
 	}
 
+	if err := s.service.GetPolicyEnforcer().CheckMode(ctx, storage.EventSourceUser, req.DeviceID, req.Mode); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
 	// Set the mode in TCC
 	if err := tccClient.SetSystemMode(ctx, req.DeviceID, req.Mode); err != nil {
-		log.Error("Failed to set mode: %v", err)
+		if ob := s.service.GetOutbox(); ob.Enabled() && tcc.IsUnavailable(err) {
+			cmd, qerr := ob.EnqueueMode(ctx, storage.EventSourceUser, req.DeviceID, req.Mode, err)
+			if qerr == nil {
+				s.clearActivePreset(ctx, oldState)
+				writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{"status": "queued", "command": cmd})
+				return
+			}
+			log.FromContext(ctx).Error("Failed to queue mode change: %v", qerr)
+		}
+		log.FromContext(ctx).Error("Failed to set mode: %v", err)
 		writeError(w, http.StatusInternalServerError, "Failed to set mode")
 		return
 	}
+	s.service.GetPollScheduler().NoteCommand()
+	s.service.GetCommandTracker().RecordMode(req.DeviceID, req.Mode, storage.EventSourceUser)
+	s.clearActivePreset(ctx, oldState)
 
 	// Fetch updated state from TCC
 	updatedDevice, err := tccClient.GetDeviceData(ctx, req.DeviceID)
 	if err != nil {
-		log.Warn("Failed to fetch updated state after mode change: %v", err)
+		log.FromContext(ctx).Warn("Failed to fetch updated state after mode change: %v", err)
 	} else {
+		s.service.GetDeviceSettings().Apply(updatedDevice)
+
 		// Save to database
 		state := &storage.ThermostatState{
 			DeviceID:     updatedDevice.DeviceID,
@@ -299,13 +371,15 @@ func (s *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
 			Humidity:     updatedDevice.Humidity,
 			IsHeating:    updatedDevice.IsHeating,
 			IsCooling:    updatedDevice.IsCooling,
+			OutdoorTemp:  updatedDevice.OutdoorTemp,
 		}
 		db.SaveThermostatState(state)
+		s.service.GetCommandTracker().Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
 
 		// Update Matter bridge
 		matterBridge := s.service.GetMatterBridge()
 		if err := matterBridge.UpdateState(ctx, *updatedDevice); err != nil {
-			log.Debug("Failed to update Matter state: %v", err)
+			log.FromContext(ctx).Debug("Failed to update Matter state: %v", err)
 		}
 
 		// Broadcast update via WebSocket
@@ -327,7 +401,7 @@ func (s *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Log the event with details
-	db.LogEvent(storage.EventSourceUser, storage.EventTypeModeChange,
+	db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypeModeChange,
 		fmt.Sprintf("Mode changed from %s to %s", oldMode, req.Mode), map[string]interface{}{
 			"device_id": req.DeviceID,
 			"old_mode":  oldMode,
@@ -343,6 +417,7 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 
 	creds, err := db.GetCredentials()
 	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get credentials: %v", err)
 		writeError(w, http.StatusInternalServerError, "Failed to get config")
 		return
 	}
@@ -372,15 +447,17 @@ func (s *Server) handleSaveCredentials(w http.ResponseWriter, r *http.Request) {
 
 	// Encrypt password
 	encKey := s.service.GetEncryptionKey()
-	encryptedPassword, err := encKey.EncryptString(req.Password)
+	encryptedPassword, keyVersion, err := encKey.EncryptString(req.Password)
 	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to encrypt password: %v", err)
 		writeError(w, http.StatusInternalServerError, "Failed to encrypt password")
 		return
 	}
 
 	// Save to database
 	db := s.service.GetDB()
-	if err := db.SaveCredentials(req.Username, encryptedPassword); err != nil {
+	if err := db.SaveCredentials(req.Username, encryptedPassword, keyVersion); err != nil {
+		log.FromContext(r.Context()).Error("Failed to save credentials: %v", err)
 		writeError(w, http.StatusInternalServerError, "Failed to save credentials")
 		return
 	}
@@ -388,9 +465,10 @@ func (s *Server) handleSaveCredentials(w http.ResponseWriter, r *http.Request) {
 	// Update TCC client
 	tccClient := s.service.GetTCCClient()
 	tccClient.SetCredentials(req.Username, req.Password)
+	log.FromContext(r.Context()).Info("TCC credentials saved for %s", req.Username)
 
 	// Log the event
-	db.LogEvent(storage.EventSourceUser, storage.EventTypeCredentials,
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeCredentials,
 		"Credentials saved", map[string]interface{}{"username": req.Username})
 
 	writeJSON(w, map[string]string{"status": "ok"})
@@ -407,7 +485,7 @@ func (s *Server) handleTestCredentials(w http.ResponseWriter, r *http.Request) {
 	db := s.service.GetDB()
 
 	// Log the test attempt
-	db.LogEvent(storage.EventSourceUser, storage.EventTypeConnection,
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeConnection,
 		"Testing TCC connection", map[string]interface{}{"username": req.Username})
 
 	tccClient := s.service.GetTCCClient()
@@ -417,8 +495,10 @@ func (s *Server) handleTestCredentials(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	if err := tccClient.TestConnection(ctx); err != nil {
+		log.FromContext(ctx).Warn("TCC connection test failed: %v", err)
+
 		// Log failure
-		db.LogEvent(storage.EventSourceTCC, storage.EventTypeError,
+		db.LogEventContext(r.Context(), storage.EventSourceTCC, storage.EventTypeError,
 			"Connection test failed", map[string]interface{}{"error": err.Error()})
 
 		writeJSON(w, map[string]interface{}{
@@ -429,7 +509,7 @@ func (s *Server) handleTestCredentials(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Log success
-	db.LogEvent(storage.EventSourceTCC, storage.EventTypeConnection,
+	db.LogEventContext(r.Context(), storage.EventSourceTCC, storage.EventTypeConnection,
 		"Connection test successful", map[string]interface{}{"username": req.Username})
 
 	writeJSON(w, map[string]interface{}{
@@ -441,24 +521,28 @@ func (s *Server) handleTestCredentials(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetPairing(w http.ResponseWriter, r *http.Request) {
 	matterBridge := s.service.GetMatterBridge()
 
-	// Return a response even if Matter bridge isn't running
-	response := PairingResponse{
-		Commissioned: false,
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// Start from what was stored when the bridge last ran, so a response
+	// is returned even if the bridge isn't running
+	response := PairingResponse{Source: matter.StateSourceStored}
+	if stored, err := s.service.GetMatterCommissioning().Stored(); err == nil {
+		response.QRCode = stored.QRCode
+		response.ManualPairCode = stored.ManualPairCode
+		response.Commissioned = stored.IsCommissioned
+	} else {
+		log.FromContext(ctx).Warn("Failed to get stored Matter state: %v", err)
 	}
 
 	if !matterBridge.IsRunning() {
-		// Return empty pairing info with running=false indicator
 		writeJSON(w, response)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
 	info, err := matterBridge.GetPairingInfo(ctx)
 	if err != nil {
-		log.Debug("Failed to get pairing info: %v", err)
-		// Still return a response, just without pairing codes
+		log.FromContext(ctx).Debug("Failed to get pairing info: %v", err)
 		writeJSON(w, response)
 		return
 	}
@@ -467,6 +551,7 @@ func (s *Server) handleGetPairing(w http.ResponseWriter, r *http.Request) {
 
 	response.QRCode = info.QRCode
 	response.ManualPairCode = info.ManualPairCode
+	response.Source = matter.StateSourceBridge
 	if status != nil {
 		response.Commissioned = status.Commissioned
 	}
@@ -488,13 +573,17 @@ func (s *Server) handleDecommission(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	if err := matterBridge.Decommission(ctx); err != nil {
-		log.Error("Failed to decommission device: %v", err)
+		log.FromContext(r.Context()).Error("Failed to decommission device: %v", err)
 		writeError(w, http.StatusInternalServerError, "Failed to decommission device")
 		return
 	}
 
+	if err := s.service.GetMatterCommissioning().Record(r.Context(), false, nil); err != nil {
+		log.FromContext(r.Context()).Error("Failed to record Matter decommissioning: %v", err)
+	}
+
 	// Log the event
-	db.LogEvent(storage.EventSourceUser, storage.EventTypeConnection,
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeConnection,
 		"Matter device decommissioned - ready for re-pairing", nil)
 
 	// Broadcast WebSocket event
@@ -505,37 +594,21 @@ func (s *Server) handleDecommission(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]string{"status": "ok"})
 }
 
-// handleGetLogs returns event logs
-func (s *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
+// handleRestartMatter asks the supervisor to restart the Matter bridge
+func (s *Server) handleRestartMatter(w http.ResponseWriter, r *http.Request) {
 	db := s.service.GetDB()
 
-	filter := storage.EventLogFilter{
-		Limit: 100,
-	}
-
-	// Parse query parameters
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if limit, err := strconv.Atoi(limitStr); err == nil && limit > 0 {
-			filter.Limit = limit
-		}
-	}
-	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
-		if offset, err := strconv.Atoi(offsetStr); err == nil && offset >= 0 {
-			filter.Offset = offset
-		}
-	}
-	if source := r.URL.Query().Get("source"); source != "" {
-		src := storage.EventSource(source)
-		filter.Source = &src
-	}
+	log.FromContext(r.Context()).Info("Matter bridge restart requested from %s", r.RemoteAddr)
+	s.service.GetMatterSupervisor().Restart("manual restart requested from web UI")
 
-	logs, err := db.GetEventLogs(filter)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to get logs")
-		return
-	}
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeConnection,
+		"Matter bridge restart requested",
+		map[string]interface{}{
+			"remote":     r.RemoteAddr,
+			"user_agent": r.UserAgent(),
+		})
 
-	writeJSON(w, logs)
+	writeJSONStatus(w, http.StatusAccepted, map[string]string{"status": "restarting"})
 }
 
 // handleVersion returns version information
@@ -552,6 +625,13 @@ func writeJSON(w http.ResponseWriter, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// writeJSONStatus writes a JSON response with a non-200 status code
+func writeJSONStatus(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
 // writeError writes an error response
 func writeError(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// handleGetHistory returns a device's reading history for charting
+func (s *Server) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	query := r.URL.Query()
+
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid to time, expected RFC 3339")
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid from time, expected RFC 3339")
+			return
+		}
+		from = t
+	}
+	if !to.After(from) {
+		writeError(w, http.StatusBadRequest, "to must be after from")
+		return
+	}
+
+	var resolution storage.Resolution
+	switch v := query.Get("resolution"); v {
+	case "", "auto":
+	case string(storage.ResolutionRaw), string(storage.ResolutionHourly), string(storage.ResolutionDaily):
+		resolution = storage.Resolution(v)
+	default:
+		writeError(w, http.StatusBadRequest, "Invalid resolution")
+		return
+	}
+
+	series, err := s.service.GetHistory().Query(deviceID, from, to, resolution)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get reading history: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get history")
+		return
+	}
+
+	writeJSON(w, series)
+}
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// Event log page sizes
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// Event log output formats
+const (
+	logFormatJSON   = "json"
+	logFormatNDJSON = "ndjson"
+	logFormatCSV    = "csv"
+)
+
+// eventLogCSVHeader names the columns written by writeEventLogCSV
+var eventLogCSVHeader = []string{"id", "timestamp", "source", "event_type", "device_id", "message", "details", "correlation_id"}
+
+// handleGetLogs returns event logs, newest first. Paging is by cursor: the
+// X-Next-Cursor header holds the value to pass as ?cursor= for the next
+// page, which stays stable while new events arrive. X-Total-Count is the
+// number of events matching the filters.
+func (s *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
+	db := s.service.GetDB()
+
+	filter, err := parseEventLogFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format, err := eventLogFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logs, err := db.GetEventLogs(filter)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get logs: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get logs")
+		return
+	}
+	total, err := db.CountMatchingEventLogs(filter)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to count logs: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get logs")
+		return
+	}
+	if logs == nil {
+		logs = []storage.EventLog{}
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if len(logs) == filter.Limit {
+		cursor := strconv.Itoa(logs[len(logs)-1].ID)
+		next := *r.URL
+		q := next.Query()
+		q.Set("cursor", cursor)
+		q.Del("offset")
+		next.RawQuery = q.Encode()
+		w.Header().Set("X-Next-Cursor", cursor)
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+
+	switch format {
+	case logFormatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, event := range logs {
+			enc.Encode(event)
+		}
+	case logFormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(eventLogCSVHeader)
+		for _, event := range logs {
+			writeEventLogCSV(cw, event)
+		}
+		cw.Flush()
+	default:
+		writeJSON(w, logs)
+	}
+}
+
+// parseEventLogFilter reads /api/logs query parameters
+func parseEventLogFilter(query url.Values) (storage.EventLogFilter, error) {
+	filter := storage.EventLogFilter{
+		Limit:         defaultLogLimit,
+		CorrelationID: query.Get("correlation_id"),
+		Search:        strings.TrimSpace(query.Get("q")),
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return filter, errors.New("invalid limit")
+		}
+		filter.Limit = min(limit, maxLogLimit)
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return filter, errors.New("invalid offset")
+		}
+		filter.Offset = offset
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := strconv.Atoi(v)
+		if err != nil || cursor <= 0 {
+			return filter, errors.New("invalid cursor")
+		}
+		filter.BeforeID = cursor
+	}
+	if v := query.Get("source"); v != "" {
+		src := storage.EventSource(v)
+		filter.Source = &src
+	}
+	if v := query.Get("event_type"); v != "" {
+		eventType := storage.EventType(v)
+		filter.EventType = &eventType
+	}
+	if v := query.Get("device_id"); v != "" {
+		deviceID, err := strconv.Atoi(v)
+		if err != nil || deviceID <= 0 {
+			return filter, errors.New("invalid device_id")
+		}
+		filter.DeviceID = deviceID
+	}
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("invalid since time, expected RFC 3339")
+		}
+		filter.Since = &t
+	}
+	if v := query.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("invalid until time, expected RFC 3339")
+		}
+		filter.Until = &t
+	}
+	if filter.Since != nil && filter.Until != nil && filter.Until.Before(*filter.Since) {
+		return filter, errors.New("until must not be before since")
+	}
+
+	return filter, nil
+}
+
+// eventLogFormat picks the output format from ?format= or the Accept header
+func eventLogFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case logFormatJSON, logFormatNDJSON, logFormatCSV:
+		return format, nil
+	case "":
+	default:
+		return "", errors.New("invalid format, expected json, ndjson or csv")
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return logFormatCSV, nil
+	case strings.Contains(accept, "application/x-ndjson"):
+		return logFormatNDJSON, nil
+	}
+	return logFormatJSON, nil
+}
+
+// writeEventLogCSV writes one event as a CSV record
+func writeEventLogCSV(cw *csv.Writer, event storage.EventLog) error {
+	deviceID := ""
+	if event.DeviceID != 0 {
+		deviceID = strconv.Itoa(event.DeviceID)
+	}
+	return cw.Write([]string{
+		strconv.Itoa(event.ID),
+		event.Timestamp.Format(time.RFC3339),
+		string(event.Source),
+		string(event.EventType),
+		deviceID,
+		event.Message,
+		string(event.Details),
+		event.CorrelationID,
+	})
+}
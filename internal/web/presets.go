@@ -0,0 +1,286 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/presets"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// PresetsResponse lists a device's presets and which one is active
+type PresetsResponse struct {
+	DeviceID     int              `json:"device_id"`
+	ActivePreset string           `json:"active_preset,omitempty"`
+	Presets      []storage.Preset `json:"presets"`
+}
+
+// ApplyPresetRequest selects a preset to apply
+type ApplyPresetRequest struct {
+	Name string `json:"name"`
+}
+
+// handleListPresets returns a device's presets
+func (s *Server) handleListPresets(w http.ResponseWriter, r *http.Request) {
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	db := s.service.GetDB()
+
+	list, err := presets.List(db, deviceID)
+	if errors.Is(err, presets.ErrUnknownDevice) {
+		writeError(w, http.StatusNotFound, "Device not found")
+		return
+	}
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get presets: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get presets")
+		return
+	}
+
+	response := PresetsResponse{DeviceID: deviceID, Presets: list}
+	if state, err := db.GetThermostatStateByDeviceID(deviceID); err == nil {
+		response.ActivePreset = state.ActivePreset
+	}
+
+	writeJSON(w, response)
+}
+
+// handleSavePreset creates or replaces a preset
+func (s *Server) handleSavePreset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID, _ := strconv.Atoi(vars["id"])
+
+	var preset storage.Preset
+	if err := json.NewDecoder(r.Body).Decode(&preset); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	preset.DeviceID = deviceID
+	preset.Name = vars["name"]
+
+	if err := presets.Validate(&preset); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := s.service.GetDB()
+	// Make sure the defaults exist before the first custom preset
+	if _, err := presets.List(db, deviceID); err != nil {
+		if errors.Is(err, presets.ErrUnknownDevice) {
+			writeError(w, http.StatusNotFound, "Device not found")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to get presets: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save preset")
+		return
+	}
+	if err := db.SavePreset(&preset); err != nil {
+		log.FromContext(r.Context()).Error("Failed to save preset: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save preset")
+		return
+	}
+	s.syncMatterPresets(r.Context(), deviceID)
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypePreset,
+		fmt.Sprintf("Preset %q saved", preset.Name),
+		map[string]interface{}{
+			"device_id":     deviceID,
+			"preset":        preset.Name,
+			"system_mode":   preset.SystemMode,
+			"heat_setpoint": preset.HeatSetpoint,
+			"cool_setpoint": preset.CoolSetpoint,
+		})
+
+	writeJSON(w, preset)
+}
+
+// handleDeletePreset removes a preset
+func (s *Server) handleDeletePreset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID, _ := strconv.Atoi(vars["id"])
+	name := vars["name"]
+	db := s.service.GetDB()
+
+	if err := db.DeletePreset(deviceID, name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "Preset not found")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to delete preset: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to delete preset")
+		return
+	}
+
+	if state, err := db.GetThermostatStateByDeviceID(deviceID); err == nil && strings.EqualFold(state.ActivePreset, name) {
+		db.SetActivePreset(deviceID, "")
+	}
+	s.syncMatterPresets(r.Context(), deviceID)
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypePreset,
+		fmt.Sprintf("Preset %q deleted", name),
+		map[string]interface{}{
+			"device_id": deviceID,
+			"preset":    name,
+		})
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handleApplyPreset applies a preset to a thermostat
+func (s *Server) handleApplyPreset(w http.ResponseWriter, r *http.Request) {
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req ApplyPresetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	db := s.service.GetDB()
+	tccClient := s.service.GetTCCClient()
+	ctx := r.Context()
+
+	preset, err := presets.Apply(ctx, db, tccClient, s.service.GetPolicyEnforcer(), storage.EventSourceUser, deviceID, req.Name)
+	if err != nil {
+		if errors.Is(err, presets.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "Preset not found")
+			return
+		}
+		if errors.Is(err, presets.ErrUnknownDevice) {
+			writeError(w, http.StatusNotFound, "Device not found")
+			return
+		}
+		var violation *policy.Violation
+		if errors.As(err, &violation) {
+			writeError(w, http.StatusForbidden, violation.Message)
+			return
+		}
+		log.FromContext(ctx).Error("Failed to apply preset: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to apply preset")
+		return
+	}
+	s.service.GetPollScheduler().NoteCommand()
+
+	tracker := s.service.GetCommandTracker()
+	if preset.SystemMode != "" {
+		tracker.RecordMode(deviceID, preset.SystemMode, storage.EventSourceUser)
+	}
+	if preset.HeatSetpoint != nil {
+		tracker.RecordSetpoint(deviceID, provenance.FieldHeatSetpoint, *preset.HeatSetpoint, storage.EventSourceUser)
+	}
+	if preset.CoolSetpoint != nil {
+		tracker.RecordSetpoint(deviceID, provenance.FieldCoolSetpoint, *preset.CoolSetpoint, storage.EventSourceUser)
+	}
+	s.service.GetMatterBridge().SetActivePreset(deviceID, preset.Name)
+
+	// Fetch updated state from TCC
+	updatedDevice, err := tccClient.GetDeviceData(ctx, deviceID)
+	if err != nil {
+		log.FromContext(ctx).Warn("Failed to fetch updated state after preset change: %v", err)
+	} else {
+		s.service.GetDeviceSettings().Apply(updatedDevice)
+
+		// Save to database
+		state := &storage.ThermostatState{
+			DeviceID:     updatedDevice.DeviceID,
+			Name:         updatedDevice.Name,
+			CurrentTemp:  updatedDevice.CurrentTemp,
+			HeatSetpoint: updatedDevice.HeatSetpoint,
+			CoolSetpoint: updatedDevice.CoolSetpoint,
+			SystemMode:   storage.ParseSystemMode(updatedDevice.SystemMode),
+			Humidity:     updatedDevice.Humidity,
+			IsHeating:    updatedDevice.IsHeating,
+			IsCooling:    updatedDevice.IsCooling,
+			OutdoorTemp:  updatedDevice.OutdoorTemp,
+		}
+		db.SaveThermostatState(state)
+		s.service.GetCommandTracker().Confirm(updatedDevice.DeviceID, updatedDevice.HeatSetpoint, updatedDevice.CoolSetpoint, updatedDevice.SystemMode)
+
+		// Update Matter bridge
+		matterBridge := s.service.GetMatterBridge()
+		if err := matterBridge.UpdateState(ctx, *updatedDevice); err != nil {
+			log.FromContext(ctx).Debug("Failed to update Matter state: %v", err)
+		}
+
+		// Broadcast update via WebSocket
+		s.hub.Broadcast(map[string]interface{}{
+			"type": "thermostat_update",
+			"data": ThermostatResponse{
+				DeviceID:     updatedDevice.DeviceID,
+				Name:         updatedDevice.Name,
+				CurrentTemp:  updatedDevice.CurrentTemp,
+				HeatSetpoint: updatedDevice.HeatSetpoint,
+				CoolSetpoint: updatedDevice.CoolSetpoint,
+				SystemMode:   updatedDevice.SystemMode,
+				Humidity:     updatedDevice.Humidity,
+				IsHeating:    updatedDevice.IsHeating,
+				IsCooling:    updatedDevice.IsCooling,
+				ActivePreset: preset.Name,
+				UpdatedAt:    updatedDevice.UpdatedAt.Format(time.RFC3339),
+			},
+		})
+	}
+
+	db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypePreset,
+		fmt.Sprintf("Preset %q applied", preset.Name),
+		map[string]interface{}{
+			"device_id":     deviceID,
+			"preset":        preset.Name,
+			"system_mode":   preset.SystemMode,
+			"heat_setpoint": preset.HeatSetpoint,
+			"cool_setpoint": preset.CoolSetpoint,
+			"remote":        r.RemoteAddr,
+			"user_agent":    r.UserAgent(),
+			"source":        "web",
+		})
+
+	writeJSON(w, preset)
+}
+
+// clearActivePreset drops the active preset after a manual change
+func (s *Server) clearActivePreset(ctx context.Context, oldState *storage.ThermostatState) {
+	if oldState == nil || oldState.ActivePreset == "" {
+		return
+	}
+
+	db := s.service.GetDB()
+	if err := db.SetActivePreset(oldState.DeviceID, ""); err != nil {
+		log.FromContext(ctx).Error("Failed to clear active preset: %v", err)
+		return
+	}
+	s.service.GetMatterBridge().SetActivePreset(oldState.DeviceID, "")
+
+	db.LogEventContext(ctx, storage.EventSourceUser, storage.EventTypePreset,
+		fmt.Sprintf("Preset %q no longer active: overridden from web", oldState.ActivePreset),
+		map[string]interface{}{
+			"device_id": oldState.DeviceID,
+			"preset":    oldState.ActivePreset,
+		})
+}
+
+// syncMatterPresets refreshes the presets sent with the device's next
+// Matter state update
+func (s *Server) syncMatterPresets(ctx context.Context, deviceID int) {
+	db := s.service.GetDB()
+	list, err := presets.List(db, deviceID)
+	if err != nil {
+		log.FromContext(ctx).Warn("Failed to load presets for device %d: %v", deviceID, err)
+		return
+	}
+
+	active := ""
+	if state, err := db.GetThermostatStateByDeviceID(deviceID); err == nil {
+		active = state.ActivePreset
+	}
+	s.service.GetMatterBridge().SetPresets(deviceID, presets.ToMatter(list), active)
+}
@@ -0,0 +1,48 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/log"
+)
+
+// handleGetRuntime returns a device's daily and weekly equipment runtime
+func (s *Server) handleGetRuntime(w http.ResponseWriter, r *http.Request) {
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	query := r.URL.Query()
+
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD")
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -6)
+	if v := query.Get("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD")
+			return
+		}
+		from = t
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	report, err := s.service.GetRuntimeTracker().Query(deviceID, from, to)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get runtime: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get runtime")
+		return
+	}
+
+	writeJSON(w, report)
+}
@@ -0,0 +1,164 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/log"
+	"github.com/stephens/tcc-bridge/internal/schedule"
+	"github.com/stephens/tcc-bridge/internal/storage"
+)
+
+// ScheduleResponse is a schedule along with what it currently wants
+type ScheduleResponse struct {
+	storage.Schedule
+	Current *schedule.Target `json:"current,omitempty"`
+}
+
+// handleListSchedules returns all schedules, optionally filtered by device_id
+func (s *Server) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	deviceID := 0
+	if idStr := r.URL.Query().Get("device_id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid device_id")
+			return
+		}
+		deviceID = id
+	}
+
+	schedules, err := s.service.GetDB().GetSchedules(deviceID)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get schedules: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get schedules")
+		return
+	}
+
+	response := make([]ScheduleResponse, 0, len(schedules))
+	for i := range schedules {
+		response = append(response, newScheduleResponse(&schedules[i]))
+	}
+
+	writeJSON(w, response)
+}
+
+// handleGetSchedule returns a single schedule
+func (s *Server) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	sched, err := s.service.GetDB().GetSchedule(id)
+	if err != nil {
+		log.FromContext(r.Context()).Error("Failed to get schedule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to get schedule")
+		return
+	}
+	if sched == nil {
+		writeError(w, http.StatusNotFound, "Schedule not found")
+		return
+	}
+
+	writeJSON(w, newScheduleResponse(sched))
+}
+
+// handleCreateSchedule stores a new schedule
+func (s *Server) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var sched storage.Schedule
+	sched.Enabled = true
+	if err := json.NewDecoder(r.Body).Decode(&sched); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := schedule.Validate(&sched); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := s.service.GetDB()
+	if err := db.CreateSchedule(&sched); err != nil {
+		log.FromContext(r.Context()).Error("Failed to create schedule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create schedule")
+		return
+	}
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeSchedule,
+		fmt.Sprintf("Schedule %q created for device %d", sched.Name, sched.DeviceID),
+		map[string]interface{}{"schedule_id": sched.ID, "device_id": sched.DeviceID})
+
+	s.service.GetScheduleEngine().Reload()
+
+	writeJSONStatus(w, http.StatusCreated, newScheduleResponse(&sched))
+}
+
+// handleUpdateSchedule replaces an existing schedule
+func (s *Server) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var sched storage.Schedule
+	sched.Enabled = true
+	if err := json.NewDecoder(r.Body).Decode(&sched); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	sched.ID = id
+
+	if err := schedule.Validate(&sched); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := s.service.GetDB()
+	if err := db.UpdateSchedule(&sched); err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Schedule not found")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to update schedule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to update schedule")
+		return
+	}
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeSchedule,
+		fmt.Sprintf("Schedule %q updated", sched.Name),
+		map[string]interface{}{"schedule_id": sched.ID, "device_id": sched.DeviceID})
+
+	s.service.GetScheduleEngine().Reload()
+
+	writeJSON(w, newScheduleResponse(&sched))
+}
+
+// handleDeleteSchedule removes a schedule
+func (s *Server) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	db := s.service.GetDB()
+	if err := db.DeleteSchedule(id); err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Schedule not found")
+			return
+		}
+		log.FromContext(r.Context()).Error("Failed to delete schedule: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to delete schedule")
+		return
+	}
+
+	db.LogEventContext(r.Context(), storage.EventSourceUser, storage.EventTypeSchedule,
+		fmt.Sprintf("Schedule %d deleted", id),
+		map[string]interface{}{"schedule_id": id})
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// newScheduleResponse attaches the schedule's current target
+func newScheduleResponse(sched *storage.Schedule) ScheduleResponse {
+	response := ScheduleResponse{Schedule: *sched}
+	if target, err := schedule.Evaluate(sched, time.Now()); err == nil {
+		response.Current = target
+	}
+	return response
+}
@@ -7,18 +7,43 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/stephens/tcc-bridge/internal/config"
+	"github.com/stephens/tcc-bridge/internal/devices"
+	"github.com/stephens/tcc-bridge/internal/energy"
+	"github.com/stephens/tcc-bridge/internal/history"
+	"github.com/stephens/tcc-bridge/internal/hvac"
 	"github.com/stephens/tcc-bridge/internal/log"
 	"github.com/stephens/tcc-bridge/internal/matter"
+	"github.com/stephens/tcc-bridge/internal/outbox"
+	"github.com/stephens/tcc-bridge/internal/policy"
+	"github.com/stephens/tcc-bridge/internal/polling"
+	"github.com/stephens/tcc-bridge/internal/provenance"
+	"github.com/stephens/tcc-bridge/internal/retention"
+	"github.com/stephens/tcc-bridge/internal/schedule"
 	"github.com/stephens/tcc-bridge/internal/storage"
 	"github.com/stephens/tcc-bridge/internal/tcc"
 )
 
 // ServiceInterface defines the interface for the main service
 type ServiceInterface interface {
-	GetDB() *storage.DB
+	GetDB() storage.Store
+	GetSQLiteDB() *storage.DB // Backups and key rotation only
+	GetConfig() *config.Config
 	GetEncryptionKey() *storage.EncryptionKey
 	GetTCCClient() *tcc.Client
 	GetMatterBridge() *matter.Bridge
+	GetMatterSupervisor() *matter.Supervisor
+	GetMatterCommissioning() *matter.Commissioning
+	GetDeviceSettings() *devices.Settings
+	GetPollScheduler() *polling.Scheduler
+	GetCommandTracker() *provenance.Tracker
+	GetScheduleEngine() *schedule.Engine
+	GetPolicyEnforcer() *policy.Enforcer
+	GetOutbox() *outbox.Outbox
+	GetHistory() *history.Recorder
+	GetRuntimeTracker() *hvac.Tracker
+	GetEnergyEstimator() *energy.Estimator
+	GetRetentionJob() *retention.Job
 }
 
 // Server is the HTTP server
@@ -46,19 +71,51 @@ func NewServer(port int, service ServiceInterface) *Server {
 func (s *Server) setupRoutes() {
 	// API routes
 	api := s.router.PathPrefix("/api").Subrouter()
+	api.Use(correlate)
+	api.Use(s.noteActivity)
 	api.HandleFunc("/status", s.handleStatus).Methods("GET")
 	api.HandleFunc("/thermostat", s.handleGetThermostat).Methods("GET")
 	api.HandleFunc("/thermostat/setpoint", s.handleSetSetpoint).Methods("POST")
 	api.HandleFunc("/thermostat/mode", s.handleSetMode).Methods("POST")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/settings", s.handleGetDeviceSettings).Methods("GET")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/settings", s.handleSaveDeviceSettings).Methods("PUT")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/presets", s.handleListPresets).Methods("GET")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/presets/{name}", s.handleSavePreset).Methods("PUT")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/presets/{name}", s.handleDeletePreset).Methods("DELETE")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/preset", s.handleApplyPreset).Methods("POST")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/history", s.handleGetHistory).Methods("GET")
+	api.HandleFunc("/thermostats/{id:[0-9]+}/runtime", s.handleGetRuntime).Methods("GET")
+	api.HandleFunc("/energy", s.handleGetEnergy).Methods("GET")
 	api.HandleFunc("/config", s.handleGetConfig).Methods("GET")
 	api.HandleFunc("/config/credentials", s.handleSaveCredentials).Methods("POST")
 	api.HandleFunc("/config/credentials/test", s.handleTestCredentials).Methods("POST")
 	api.HandleFunc("/pairing", s.handleGetPairing).Methods("GET")
 	api.HandleFunc("/pairing", s.handleDecommission).Methods("DELETE")
+	api.HandleFunc("/matter/restart", s.handleRestartMatter).Methods("POST")
 	api.HandleFunc("/logs", s.handleGetLogs).Methods("GET")
+	api.HandleFunc("/export/{dataset}", s.handleExport).Methods("GET")
+	api.HandleFunc("/commands", s.handleListCommands).Methods("GET")
+	api.HandleFunc("/commands/{id:[0-9]+}", s.handleCancelCommand).Methods("DELETE")
+	api.HandleFunc("/schedules", s.handleListSchedules).Methods("GET")
+	api.HandleFunc("/schedules", s.handleCreateSchedule).Methods("POST")
+	api.HandleFunc("/schedules/{id:[0-9]+}", s.handleGetSchedule).Methods("GET")
+	api.HandleFunc("/schedules/{id:[0-9]+}", s.handleUpdateSchedule).Methods("PUT")
+	api.HandleFunc("/schedules/{id:[0-9]+}", s.handleDeleteSchedule).Methods("DELETE")
+	api.HandleFunc("/automation/rules", s.handleListRules).Methods("GET")
+	api.HandleFunc("/automation/rules", s.handleCreateRule).Methods("POST")
+	api.HandleFunc("/automation/rules/{id:[0-9]+}", s.handleGetRule).Methods("GET")
+	api.HandleFunc("/automation/rules/{id:[0-9]+}", s.handleUpdateRule).Methods("PUT")
+	api.HandleFunc("/automation/rules/{id:[0-9]+}", s.handleDeleteRule).Methods("DELETE")
 	api.HandleFunc("/version", s.handleVersion).Methods("GET")
 	api.HandleFunc("/ws", s.handleWebSocket)
 
+	// Admin routes hand out or replace the encryption key, so they need
+	// the admin token
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(s.requireAdmin)
+	admin.HandleFunc("/backup", s.handleBackup).Methods("GET")
+	admin.HandleFunc("/rotate-key", s.handleRotateKey).Methods("POST")
+
 	// Serve static files for frontend
 	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/dist")))
 }
@@ -94,7 +151,9 @@ func (s *Server) Run(ctx context.Context) error {
 	return nil
 }
 
-// broadcastEvents broadcasts Matter events to WebSocket clients
+// broadcastEvents broadcasts Matter events to WebSocket clients. Bridge
+// events don't count as activity for polling: HomeKit commands are noted
+// by the service's command handler.
 func (s *Server) broadcastEvents(ctx context.Context) {
 	bridge := s.service.GetMatterBridge()
 	if bridge == nil {
@@ -113,13 +172,51 @@ func (s *Server) broadcastEvents(ctx context.Context) {
 			// Log Matter events to database
 			if event.Type == matter.EventTypeMatterEvent && event.Data != nil {
 				if message, ok := event.Data["message"].(string); ok {
-					db.LogEvent(storage.EventSourceMatter, storage.EventTypeConnection, message, event.Data)
+					db.LogEventContext(ctx, storage.EventSourceMatter, storage.EventTypeConnection, message, event.Data)
 				}
 			}
 		}
 	}
 }
 
+// correlate tags each API request with a correlation ID, reusing the
+// caller's X-Correlation-ID header when it looks sane
+func correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(log.CorrelationHeader)
+		if !validCorrelationID(id) {
+			id = log.NewCorrelationID()
+		}
+		w.Header().Set(log.CorrelationHeader, id)
+		next.ServeHTTP(w, r.WithContext(log.WithCorrelationID(r.Context(), id)))
+	})
+}
+
+// validCorrelationID accepts short IDs made of letters, digits, '-' and '_'
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// noteActivity tells the polling scheduler that someone changed something
+// through the API. Reads don't count: the UI polls status and logs on a
+// timer, and an open UI is already seen through its WebSocket connection.
+func (s *Server) noteActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.service.GetPollScheduler().NoteActivity()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // GetHub returns the WebSocket hub
 func (s *Server) GetHub() *Hub {
 	return s.hub
@@ -0,0 +1,87 @@
+import { Endpoint } from "@matter/main";
+import { HumiditySensorDevice } from "@matter/node/devices";
+import { BridgedDeviceBasicInformationServer } from "@matter/main/behaviors/bridged-device-basic-information";
+
+// Convert a percentage to Matter's 0.01% units; null means no valid reading
+function humidityToMatter(humidity: number | null): number | null {
+  return humidity === null ? null : Math.round(humidity * 100);
+}
+
+// Matter limits node labels to 32 characters
+function nodeLabel(name: string): string {
+  return `${name} Humidity`.slice(0, 32);
+}
+
+// Create the device type with humidity measurement, bridged under the
+// aggregator
+const TccHumiditySensorDevice = HumiditySensorDevice.with(BridgedDeviceBasicInformationServer);
+
+// HumiditySensorEndpoint is the companion humidity sensor of a thermostat,
+// since the Thermostat cluster has no humidity attribute
+export class HumiditySensorEndpoint {
+  private endpoint: Endpoint<typeof TccHumiditySensorDevice>;
+  private deviceId: number;
+  private endpointNumber: number;
+  private humidity: number | null;
+
+  constructor(deviceId: number, name: string, endpointNumber: number, humidity: number | null) {
+    this.deviceId = deviceId;
+    this.endpointNumber = endpointNumber;
+    this.humidity = humidity;
+
+    this.endpoint = new Endpoint(
+      TccHumiditySensorDevice,
+      {
+        id: `humidity-${deviceId}`,
+        number: endpointNumber,
+        bridgedDeviceBasicInformation: {
+          nodeLabel: nodeLabel(name),
+          productName: "TCC Humidity Sensor",
+          serialNumber: `TCC-${deviceId}-H`,
+          uniqueId: `tcc-${deviceId}-humidity`,
+          reachable: true,
+        },
+        relativeHumidityMeasurement: {
+          measuredValue: humidityToMatter(humidity),
+          minMeasuredValue: 0,
+          maxMeasuredValue: 10000,
+        },
+      }
+    );
+  }
+
+  getEndpoint(): Endpoint<typeof TccHumiditySensorDevice> {
+    return this.endpoint;
+  }
+
+  getEndpointNumber(): number {
+    return this.endpointNumber;
+  }
+
+  async rename(name: string): Promise<void> {
+    await this.endpoint.set({
+      bridgedDeviceBasicInformation: { nodeLabel: nodeLabel(name) },
+    });
+  }
+
+  async updateHumidity(humidity: number | null): Promise<void> {
+    if (humidity === this.humidity) {
+      return;
+    }
+    this.humidity = humidity;
+
+    try {
+      await this.endpoint.set({
+        relativeHumidityMeasurement: { measuredValue: humidityToMatter(humidity) },
+      });
+      console.log(`Humidity for device ${this.deviceId}: ${humidity === null ? "no reading" : `${humidity}%`}`);
+    } catch (error) {
+      console.error("Failed to update humidity:", error);
+    }
+  }
+
+  async remove(): Promise<void> {
+    await this.endpoint.delete();
+    console.log(`Humidity sensor for device ${this.deviceId} removed from endpoint ${this.endpointNumber}`);
+  }
+}
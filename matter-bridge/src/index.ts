@@ -1,35 +1,61 @@
 import "@matter/nodejs";
-import { ServerNode, VendorId } from "@matter/main";
+import { Endpoint, ServerNode, VendorId } from "@matter/main";
+import { AggregatorEndpoint } from "@matter/main/endpoints/aggregator";
 import { ThermostatEndpoint, ThermostatState } from "./thermostat.js";
-import { BridgeServer } from "./server.js";
+import { HumiditySensorEndpoint } from "./humidity.js";
+import { BridgeServer, BridgedDevice, CommandResult, FabricInfo } from "./server.js";
 import { StorageManager } from "./storage.js";
 
 const VENDOR_ID = VendorId(0xFFF1); // Test vendor ID
 const PRODUCT_ID = 0x8001;
-const DEVICE_NAME = "TCC Thermostat";
+const DEVICE_NAME = "TCC Bridge";
 const PORT = parseInt(process.env.MATTER_PORT || "5540", 10);
 const DATA_DIR = process.env.MATTER_DATA_DIR || "./data";
 
 class MatterBridge {
   private server?: ServerNode;
-  private thermostat: ThermostatEndpoint;
+  private aggregator: Endpoint<typeof AggregatorEndpoint>;
+  private bridged: Map<number, BridgedDevice> = new Map(); // By TCC device ID
+  private thermostats: Map<number, ThermostatEndpoint> = new Map();
+  private humiditySensors: Map<number, HumiditySensorEndpoint> = new Map();
   private bridgeServer: BridgeServer;
   private storage: StorageManager;
 
   constructor() {
     this.storage = new StorageManager(DATA_DIR);
-    this.thermostat = new ThermostatEndpoint(DEVICE_NAME);
+    this.aggregator = new Endpoint(AggregatorEndpoint, { id: "aggregator", number: 1 });
     this.bridgeServer = new BridgeServer(PORT);
 
     // Set up state update handler
     this.bridgeServer.setStateHandler(async (state: ThermostatState) => {
-      await this.thermostat.updateState(state);
+      const thermostat = this.thermostats.get(state.deviceId);
+      if (!thermostat) {
+        return false;
+      }
+      await thermostat.updateState(state);
+      await this.updateHumidity(state);
+      return true;
     });
 
-    // Set up command handler
-    this.thermostat.setCommandHandler(async (action: string, value: unknown) => {
-      console.log(`Command received: ${action} = ${value}`);
-      this.bridgeServer.broadcastCommand(action, value);
+    // Set up bridged device handlers
+    this.bridgeServer.setDeviceHandlers({
+      list: () => this.listDevices(),
+      put: (device: BridgedDevice) => this.putDevice(device),
+      remove: (deviceId: number) => this.removeDevice(deviceId),
+    });
+
+    // A failed command leaves HomeKit showing the value it asked for, so
+    // put back the state the backend reports. A queued command keeps that
+    // value pending until the backend applies it. Successful commands are
+    // followed by a normal state update.
+    this.bridgeServer.setCommandResultHandler(async (result: CommandResult, command: Record<string, unknown>) => {
+      if (result.code === "queued") {
+        this.thermostats.get(command.deviceId as number)?.holdPending(command.action as string, command.value);
+        return;
+      }
+      if (!result.success && result.state) {
+        await this.thermostats.get(result.state.deviceId)?.updateState(result.state);
+      }
     });
 
     // Set up decommission handler
@@ -51,7 +77,7 @@ class MatterBridge {
       // Basic information about this device
       productDescription: {
         name: DEVICE_NAME,
-        deviceType: 0x0301, // Thermostat device type
+        deviceType: AggregatorEndpoint.deviceType,
       },
 
       // Commissioning options
@@ -80,14 +106,14 @@ class MatterBridge {
       },
     });
 
-    // Add the thermostat endpoint
-    await this.server.add(this.thermostat.getEndpoint());
+    // Add the aggregator; thermostats are bridged under it as the Go
+    // service reports them
+    await this.server.add(this.aggregator);
 
     // Set up commissioning event handlers
     this.server.lifecycle.commissioned.on(() => {
       console.log("Device commissioned!");
-      this.storage.setCommissioned(true);
-      this.bridgeServer.setCommissioned(true);
+      this.syncCommissioned(true);
       this.bridgeServer.broadcastEvent({
         type: "matter_event",
         timestamp: new Date().toISOString(),
@@ -97,8 +123,7 @@ class MatterBridge {
 
     this.server.lifecycle.decommissioned.on(() => {
       console.log("Device decommissioned");
-      this.storage.setCommissioned(false);
-      this.bridgeServer.setCommissioned(false);
+      this.syncCommissioned(false);
       this.bridgeServer.broadcastEvent({
         type: "matter_event",
         timestamp: new Date().toISOString(),
@@ -106,6 +131,11 @@ class MatterBridge {
       });
     });
 
+    // Report controllers being added or removed (multi-admin)
+    this.server.events.commissioning.fabricsChanged.on(() => {
+      this.syncCommissioned(this.server!.state.commissioning.commissioned);
+    });
+
     // Set up session event handlers for HomeKit connections
     this.server.lifecycle.online.on(() => {
       console.log("HomeKit controller connected");
@@ -133,8 +163,7 @@ class MatterBridge {
     const isCommissioned = this.server.state.commissioning.commissioned;
     if (isCommissioned) {
       console.log("Device already commissioned (restored from previous session)");
-      this.storage.setCommissioned(true);
-      this.bridgeServer.setCommissioned(true);
+      this.syncCommissioned(true);
     }
 
     // Get and broadcast pairing information
@@ -150,12 +179,99 @@ class MatterBridge {
 
     this.bridgeServer.setPairingInfo(qrCode, manualPairCode);
 
-    // Set up thermostat command handlers
-    await this.thermostat.setupCommandHandlers();
-
     console.log("Matter Bridge ready!");
   }
 
+  // listDevices lists the bridged thermostats
+  private listDevices(): BridgedDevice[] {
+    return [...this.bridged.values()];
+  }
+
+  // putDevice bridges a thermostat on its endpoint, or renames it if it is
+  // already bridged there
+  private async putDevice(device: BridgedDevice): Promise<void> {
+    const existing = this.bridged.get(device.deviceId);
+    if (existing && existing.endpoint === device.endpoint && existing.humidityEndpoint === device.humidityEndpoint) {
+      if (existing.name !== device.name) {
+        await this.thermostats.get(device.deviceId)?.rename(device.name);
+        await this.humiditySensors.get(device.deviceId)?.rename(device.name);
+        this.bridged.set(device.deviceId, device);
+      }
+      return;
+    }
+    if (existing) {
+      await this.removeDevice(device.deviceId);
+    }
+
+    const thermostat = new ThermostatEndpoint(device.deviceId, device.name, device.endpoint);
+    thermostat.setCommandHandler(async (action: string, value: unknown) => {
+      console.log(`Command received for device ${device.deviceId}: ${action} = ${value}`);
+      this.bridgeServer.broadcastCommand(action, value, device.deviceId);
+    });
+    await this.aggregator.add(thermostat.getEndpoint());
+    await thermostat.setupCommandHandlers();
+    this.thermostats.set(device.deviceId, thermostat);
+    this.bridged.set(device.deviceId, device);
+    console.log(`Bridged device ${device.deviceId} (${device.name}) on endpoint ${device.endpoint}`);
+  }
+
+  // removeDevice removes a thermostat's endpoints, returning false if it
+  // wasn't bridged
+  private async removeDevice(deviceId: number): Promise<boolean> {
+    const thermostat = this.thermostats.get(deviceId);
+    if (!thermostat) {
+      return false;
+    }
+    const sensor = this.humiditySensors.get(deviceId);
+    this.bridged.delete(deviceId);
+    this.thermostats.delete(deviceId);
+    this.humiditySensors.delete(deviceId);
+    await sensor?.remove();
+    await thermostat.remove();
+    return true;
+  }
+
+  // updateHumidity publishes a thermostat's humidity on its companion
+  // sensor, adding the sensor the first time a valid reading arrives so
+  // thermostats without humidity sensing don't show an empty one
+  private async updateHumidity(state: ThermostatState): Promise<void> {
+    const humidity = state.humidity ?? null;
+    const sensor = this.humiditySensors.get(state.deviceId);
+    if (sensor) {
+      await sensor.updateHumidity(humidity);
+      return;
+    }
+
+    const device = this.bridged.get(state.deviceId);
+    if (humidity === null || !device?.humidityEndpoint) {
+      return;
+    }
+    const added = new HumiditySensorEndpoint(device.deviceId, device.name, device.humidityEndpoint, humidity);
+    await this.aggregator.add(added.getEndpoint());
+    this.humiditySensors.set(device.deviceId, added);
+    console.log(`Bridged humidity sensor for device ${device.deviceId} on endpoint ${device.humidityEndpoint}`);
+  }
+
+  // fabrics lists the controllers this node is commissioned into
+  private fabrics(): FabricInfo[] {
+    const fabrics = this.server?.state.commissioning.fabrics ?? {};
+    return Object.values(fabrics).map((fabric) => ({
+      fabricIndex: fabric.fabricIndex,
+      fabricId: fabric.fabricId.toString(),
+      nodeId: fabric.nodeId.toString(),
+      vendorId: fabric.rootVendorId,
+      label: fabric.label || undefined,
+    }));
+  }
+
+  // syncCommissioned records the commissioning state and reports it, with
+  // the current fabrics, to the Go service
+  private syncCommissioned(commissioned: boolean): void {
+    const fabrics = commissioned ? this.fabrics() : [];
+    this.storage.setCommissioned(commissioned, fabrics[0]?.fabricId, fabrics[0]?.nodeId);
+    this.bridgeServer.setCommissioned(commissioned, fabrics);
+  }
+
   async decommission(): Promise<void> {
     console.log("Decommissioning Matter device...");
 
@@ -1,13 +1,23 @@
 import express, { Express, Request, Response } from "express";
 import { WebSocketServer, WebSocket } from "ws";
-import { createServer, Server as HttpServer } from "http";
+import { createServer, IncomingMessage, Server as HttpServer } from "http";
+import { randomUUID } from "crypto";
 import { ThermostatState } from "./thermostat.js";
 
+export interface FabricInfo {
+  fabricIndex: number;
+  fabricId: string;
+  nodeId: string;
+  vendorId?: number;
+  label?: string;
+}
+
 export interface ServerStatus {
   running: boolean;
   commissioned: boolean;
   fabricId?: string;
   nodeId?: string;
+  fabrics: FabricInfo[];
   connectedPeers: number;
   uptime: number;
   lastUpdate: string;
@@ -23,10 +33,51 @@ export interface MatterEvent {
   type: string;
   timestamp: string;
   data?: Record<string, unknown>;
+  seq?: number; // Set when broadcast
+}
+
+export interface BridgedDevice {
+  deviceId: number;
+  endpoint: number;
+  humidityEndpoint?: number; // Added once the thermostat reports humidity
+  name: string;
+}
+
+export interface DeviceHandlers {
+  list: () => BridgedDevice[];
+  put: (device: BridgedDevice) => Promise<void>;
+  remove: (deviceId: number) => Promise<boolean>;
+}
+
+export interface CommandResult {
+  id: string;
+  success: boolean;
+  code: string;
+  error?: string;
+  state?: ThermostatState;
+  durationMs: number;
 }
 
-export type StateUpdateHandler = (state: ThermostatState) => Promise<void>;
+interface PendingCommand {
+  data: Record<string, unknown>;
+  sentAt: number;
+}
+
+// How long to wait for a command result before giving up on it
+const COMMAND_RESULT_TIMEOUT_MS = 60_000;
+
+// How many recent events are kept to replay to a reconnecting client
+const EVENT_HISTORY_SIZE = 1000;
+
+// A client with this much unsent data has stopped reading. It is dropped
+// and catches up from the history when it reconnects.
+const MAX_BUFFERED_BYTES = 1 << 20;
+
+// StateUpdateHandler applies state to a bridged device, returning false if
+// the device isn't bridged
+export type StateUpdateHandler = (state: ThermostatState) => Promise<boolean>;
 export type DecommissionHandler = () => Promise<void>;
+export type CommandResultHandler = (result: CommandResult, command: Record<string, unknown>) => Promise<void>;
 
 export class BridgeServer {
   private app: Express;
@@ -37,11 +88,22 @@ export class BridgeServer {
   private startTime: Date;
   private stateHandler?: StateUpdateHandler;
   private decommissionHandler?: DecommissionHandler;
+  private deviceHandlers?: DeviceHandlers;
+  private resultHandler?: CommandResultHandler;
+  private pendingCommands: Map<string, PendingCommand> = new Map();
+  private pendingSweep?: NodeJS.Timeout;
+
+  // Event sequencing. Sequence numbers restart with the process, which
+  // bootId identifies.
+  private readonly bootId = randomUUID();
+  private seq = 0;
+  private history: MatterEvent[] = [];
 
   // Status fields
   private commissioned = false;
   private fabricId?: string;
   private nodeId?: string;
+  private fabrics: FabricInfo[] = [];
   private qrCode = "";
   private manualPairCode = "";
   private connectedPeers = 0;
@@ -73,6 +135,7 @@ export class BridgeServer {
         commissioned: this.commissioned,
         fabricId: this.fabricId,
         nodeId: this.nodeId,
+        fabrics: this.fabrics,
         connectedPeers: this.connectedPeers,
         uptime: Math.floor((Date.now() - this.startTime.getTime()) / 1000),
         lastUpdate: new Date().toISOString(),
@@ -89,14 +152,59 @@ export class BridgeServer {
       res.json(info);
     });
 
-    // Update thermostat state (from Go backend)
-    this.app.post("/state", async (req: Request, res: Response) => {
+    // List bridged devices
+    this.app.get("/devices", (_req: Request, res: Response) => {
+      res.json(this.deviceHandlers?.list() ?? []);
+    });
+
+    // Add or update a bridged device (from Go backend)
+    this.app.put("/devices/:id", async (req: Request, res: Response) => {
+      const deviceId = parseInt(req.params.id, 10);
+      const device = req.body as BridgedDevice;
+      if (!this.deviceHandlers || !this.matterReady) {
+        res.status(503).json({ error: "Matter server not ready" });
+        return;
+      }
+      const validEndpoint = (n?: number) => n === undefined || (Number.isInteger(n) && n >= 2);
+      if (device.deviceId !== deviceId || device.endpoint === undefined || !validEndpoint(device.endpoint) ||
+          !validEndpoint(device.humidityEndpoint) || device.humidityEndpoint === device.endpoint) {
+        res.status(400).json({ error: "Invalid device" });
+        return;
+      }
+      try {
+        await this.deviceHandlers.put(device);
+        res.json({ status: "ok" });
+      } catch (error) {
+        console.error(`Failed to bridge device ${deviceId}:`, error);
+        res.status(500).json({ error: "Failed to bridge device" });
+      }
+    });
+
+    // Remove a bridged device (from Go backend)
+    this.app.delete("/devices/:id", async (req: Request, res: Response) => {
+      const deviceId = parseInt(req.params.id, 10);
+      try {
+        if (!(await this.deviceHandlers?.remove(deviceId))) {
+          res.status(404).json({ error: "Device not bridged" });
+          return;
+        }
+        res.json({ status: "ok" });
+      } catch (error) {
+        console.error(`Failed to remove device ${deviceId}:`, error);
+        res.status(500).json({ error: "Failed to remove device" });
+      }
+    });
+
+    // Update a bridged device's thermostat state (from Go backend)
+    this.app.post("/devices/:id/state", async (req: Request, res: Response) => {
       try {
         const state = req.body as ThermostatState;
+        state.deviceId = parseInt(req.params.id, 10);
         const tempF = (state.currentTemp * 9/5 + 32).toFixed(1);
-        console.log(`Received state update: temp=${tempF}°F (${state.currentTemp.toFixed(1)}°C), mode=${state.systemMode}`);
-        if (this.stateHandler) {
-          await this.stateHandler(state);
+        console.log(`Received state update for device ${state.deviceId}: temp=${tempF}°F (${state.currentTemp.toFixed(1)}°C), mode=${state.systemMode}`);
+        if (this.stateHandler && !(await this.stateHandler(state))) {
+          res.status(404).json({ error: "Device not bridged" });
+          return;
         }
         res.json({ status: "ok" });
       } catch (error) {
@@ -120,9 +228,14 @@ export class BridgeServer {
   }
 
   private setupWebSocket(): void {
-    this.wss.on("connection", (ws: WebSocket) => {
+    this.wss.on("connection", (ws: WebSocket, req: IncomingMessage) => {
       console.log("WebSocket client connected");
       this.clients.add(ws);
+      this.replay(ws, new URL(req.url ?? "/", "http://localhost").searchParams);
+
+      ws.on("message", (raw) => {
+        this.handleMessage(raw.toString());
+      });
 
       ws.on("close", () => {
         console.log("WebSocket client disconnected");
@@ -136,6 +249,80 @@ export class BridgeServer {
     });
   }
 
+  // replay greets a new client and sends it the events it missed. A client
+  // resuming from this process gets the events after its "since" sequence;
+  // any other gets every event still held. Commands are only replayed
+  // while they're waiting for a result; the backend ignores any it has
+  // already seen.
+  private replay(ws: WebSocket, params: URLSearchParams): void {
+    const since = params.get("boot") === this.bootId ? Number(params.get("since")) || 0 : 0;
+    const oldest = this.history[0]?.seq ?? this.seq + 1;
+    const missed = Math.max(0, oldest - since - 1);
+    if (missed > 0) {
+      console.warn(`Client missed ${missed} events no longer held for replay`);
+    }
+    ws.send(JSON.stringify({
+      type: "hello",
+      timestamp: new Date().toISOString(),
+      data: { boot: this.bootId, seq: this.seq, missed },
+    }));
+
+    let replayed = 0;
+    for (const event of this.history) {
+      if (event.seq! <= since) {
+        continue;
+      }
+      if (event.type === "command" && !this.pendingCommands.has(event.data?.id as string)) {
+        continue;
+      }
+      ws.send(JSON.stringify(event));
+      replayed++;
+    }
+    if (replayed > 0) {
+      console.log(`Replayed ${replayed} events from sequence ${since + 1}`);
+    }
+  }
+
+  private handleMessage(raw: string): void {
+    let event: MatterEvent;
+    try {
+      event = JSON.parse(raw) as MatterEvent;
+    } catch (error) {
+      console.error("Invalid WebSocket message:", error);
+      return;
+    }
+    if (event.type !== "command_result" || !event.data) {
+      return;
+    }
+
+    const result = event.data as unknown as CommandResult;
+    const pending = this.pendingCommands.get(result.id);
+    if (!pending) {
+      return; // Already answered
+    }
+    this.pendingCommands.delete(result.id);
+    if (result.code === "queued") {
+      console.log(`Command ${result.id} queued until TCC is reachable`);
+    } else if (result.success) {
+      console.log(`Command ${result.id} succeeded in ${result.durationMs}ms`);
+    } else {
+      console.error(`Command ${result.id} failed (${result.code}): ${result.error}`);
+    }
+    this.resultHandler?.(result, pending.data).catch((error) => {
+      console.error("Failed to handle command result:", error);
+    });
+  }
+
+  private sweepPendingCommands(): void {
+    const cutoff = Date.now() - COMMAND_RESULT_TIMEOUT_MS;
+    for (const [id, pending] of this.pendingCommands) {
+      if (pending.sentAt < cutoff) {
+        console.warn(`No result for command ${id} (${pending.data.action}), giving up`);
+        this.pendingCommands.delete(id);
+      }
+    }
+  }
+
   setStateHandler(handler: StateUpdateHandler): void {
     this.stateHandler = handler;
   }
@@ -144,21 +331,30 @@ export class BridgeServer {
     this.decommissionHandler = handler;
   }
 
+  setDeviceHandlers(handlers: DeviceHandlers): void {
+    this.deviceHandlers = handlers;
+  }
+
+  setCommandResultHandler(handler: CommandResultHandler): void {
+    this.resultHandler = handler;
+  }
+
   setPairingInfo(qrCode: string, manualPairCode: string): void {
     this.qrCode = qrCode;
     this.manualPairCode = manualPairCode;
     this.matterReady = true;
   }
 
-  setCommissioned(commissioned: boolean, fabricId?: string, nodeId?: string): void {
+  setCommissioned(commissioned: boolean, fabrics: FabricInfo[] = []): void {
     this.commissioned = commissioned;
-    this.fabricId = fabricId;
-    this.nodeId = nodeId;
+    this.fabrics = commissioned ? fabrics : [];
+    this.fabricId = this.fabrics[0]?.fabricId;
+    this.nodeId = this.fabrics[0]?.nodeId;
 
     this.broadcastEvent({
       type: "commissioned",
       timestamp: new Date().toISOString(),
-      data: { commissioned, fabricId, nodeId },
+      data: { commissioned, fabricId: this.fabricId, nodeId: this.nodeId, fabrics: this.fabrics },
     });
   }
 
@@ -167,24 +363,45 @@ export class BridgeServer {
   }
 
   broadcastEvent(event: MatterEvent): void {
+    event.seq = ++this.seq;
+    this.history.push(event);
+    if (this.history.length > EVENT_HISTORY_SIZE) {
+      this.history.shift();
+    }
+
     const message = JSON.stringify(event);
     for (const client of this.clients) {
-      if (client.readyState === WebSocket.OPEN) {
-        client.send(message);
+      if (client.readyState !== WebSocket.OPEN) {
+        continue;
       }
+      if (client.bufferedAmount > MAX_BUFFERED_BYTES) {
+        console.warn("WebSocket client is not keeping up, disconnecting it");
+        client.terminate();
+        this.clients.delete(client);
+        continue;
+      }
+      client.send(message);
     }
   }
 
-  broadcastCommand(action: string, value: unknown): void {
+  broadcastCommand(action: string, value: unknown, deviceId?: number): string {
+    const id = randomUUID();
+    const data: Record<string, unknown> = { id, action, value };
+    if (deviceId) {
+      data.deviceId = deviceId;
+    }
+    this.pendingCommands.set(id, { data, sentAt: Date.now() });
     this.broadcastEvent({
       type: "command",
       timestamp: new Date().toISOString(),
-      data: { action, value },
+      data,
     });
+    return id;
   }
 
   async start(): Promise<void> {
     return new Promise((resolve) => {
+      this.pendingSweep = setInterval(() => this.sweepPendingCommands(), 10_000);
       this.httpServer.listen(this.port, () => {
         console.log(`Bridge server listening on port ${this.port}`);
         resolve();
@@ -194,6 +411,10 @@ export class BridgeServer {
 
   async stop(): Promise<void> {
     return new Promise((resolve) => {
+      if (this.pendingSweep) {
+        clearInterval(this.pendingSweep);
+      }
+
       // Close all WebSocket connections
       for (const client of this.clients) {
         client.close();
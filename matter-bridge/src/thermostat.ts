@@ -1,6 +1,9 @@
-import { Endpoint } from "@matter/main";
+import { createHash } from "node:crypto";
+import { Bytes, Endpoint } from "@matter/main";
 import { ThermostatDevice, ThermostatRequirements } from "@matter/node/devices";
-import { Thermostat } from "@matter/main/clusters";
+import { Thermostat, ThermostatUserInterfaceConfiguration } from "@matter/main/clusters";
+import { BridgedDeviceBasicInformationServer } from "@matter/main/behaviors/bridged-device-basic-information";
+import { StatusResponse } from "@matter/main/types";
 
 export interface ThermostatState {
   deviceId: number;
@@ -9,13 +12,39 @@ export interface ThermostatState {
   heatSetpoint: number;     // Celsius
   coolSetpoint: number;     // Celsius
   systemMode: string;       // "off", "heat", "cool", "auto"
-  humidity: number;         // Percentage
+  humidity: number | null;  // Percentage; null when TCC had no valid reading
   isHeating: boolean;
   isCooling: boolean;
+  presets?: Preset[];       // Comfort presets known to the Go service
+  activePreset?: string;    // Name of the preset currently applied
+  temperatureUnit?: string; // "celsius" or "fahrenheit" display preference
+}
+
+export interface Preset {
+  name: string;
+  systemMode?: string;
+  heatSetpoint?: number;    // Celsius
+  coolSetpoint?: number;    // Celsius
 }
 
 export type CommandHandler = (action: string, value: unknown) => Promise<void>;
 
+// How long a queued command's value keeps being shown while the backend
+// waits for TCC; matches the backend's default command queue TTL
+const QUEUED_HOLD_MS = 60 * 60_000;
+
+// State fields changed by each command action
+const HELD_FIELDS: Record<string, "heatSetpoint" | "coolSetpoint" | "systemMode"> = {
+  setHeatingSetpoint: "heatSetpoint",
+  setCoolingSetpoint: "coolSetpoint",
+  setSystemMode: "systemMode",
+};
+
+interface HeldValue {
+  value: unknown;
+  until: number;
+}
+
 // Convert Celsius to Matter's 0.01°C units
 function celsiusToMatter(celsius: number): number {
   return Math.round(celsius * 100);
@@ -56,27 +85,104 @@ function matterToSystemMode(mode: Thermostat.SystemMode): string {
   }
 }
 
-// Create a thermostat server with heating and cooling features
-const ThermostatServerWithFeatures = ThermostatRequirements.ThermostatServer.with("Heating", "Cooling");
+// Convert a display unit preference to Matter's display mode
+function displayModeToMatter(unit?: string): ThermostatUserInterfaceConfiguration.TemperatureDisplayMode {
+  return unit === "fahrenheit"
+    ? ThermostatUserInterfaceConfiguration.TemperatureDisplayMode.Fahrenheit
+    : ThermostatUserInterfaceConfiguration.TemperatureDisplayMode.Celsius;
+}
 
-// Create the device type with thermostat behavior
-const TccThermostatDevice = ThermostatDevice.with(ThermostatServerWithFeatures);
+// Matter limits node labels to 32 characters
+function nodeLabel(name: string): string {
+  return name.slice(0, 32);
+}
+
+// Most presets exposed per thermostat
+const MAX_PRESETS = 16;
+
+// Matter preset scenarios for the default preset names; anything else is
+// user defined
+const PRESET_SCENARIOS: Record<string, Thermostat.PresetScenario> = {
+  home: Thermostat.PresetScenario.Occupied,
+  away: Thermostat.PresetScenario.Unoccupied,
+  sleep: Thermostat.PresetScenario.Sleep,
+  vacation: Thermostat.PresetScenario.Vacation,
+};
+
+// Preset types advertised to controllers: one preset per named scenario
+// and the rest user defined
+const PRESET_TYPES = [
+  ...Object.values(PRESET_SCENARIOS).map((presetScenario) => ({
+    presetScenario,
+    numberOfPresets: 1,
+    presetTypeFeatures: { automatic: false, supportsNames: true },
+  })),
+  {
+    presetScenario: Thermostat.PresetScenario.UserDefined,
+    numberOfPresets: MAX_PRESETS,
+    presetTypeFeatures: { automatic: false, supportsNames: true },
+  },
+];
+
+// Preset names are unique per device, ignoring case, so a hash of the
+// lowercased name gives a stable handle within Matter's 16 byte limit
+function presetHandle(name: string): Uint8Array {
+  return new Uint8Array(createHash("sha256").update(name.toLowerCase()).digest().subarray(0, 16));
+}
+
+// Convert presets from the Go service to the Thermostat cluster's list
+function presetsToMatter(presets: Preset[] = []) {
+  return presets.slice(0, MAX_PRESETS).map((preset) => ({
+    presetHandle: presetHandle(preset.name),
+    presetScenario: PRESET_SCENARIOS[preset.name.toLowerCase()] ?? Thermostat.PresetScenario.UserDefined,
+    name: preset.name.slice(0, 64),
+    heatingSetpoint: preset.heatSetpoint === undefined ? undefined : celsiusToMatter(preset.heatSetpoint),
+    coolingSetpoint: preset.coolSetpoint === undefined ? undefined : celsiusToMatter(preset.coolSetpoint),
+    builtIn: false,
+  }));
+}
+
+// Thermostat server with heating, cooling and presets. Selecting a preset
+// only records it as active; the endpoint reports the change to the Go
+// service, which applies it to TCC.
+class TccThermostatServer extends ThermostatRequirements.ThermostatServer.with("Heating", "Cooling", "Presets") {
+  override setActivePresetRequest({ presetHandle }: Thermostat.SetActivePresetRequest): void {
+    if (presetHandle !== null && !this.state.presets.some(
+      (preset) => preset.presetHandle !== null && Bytes.areEqual(preset.presetHandle, presetHandle),
+    )) {
+      throw new StatusResponse.NotFoundError(`No preset with handle ${Bytes.toHex(presetHandle)}`);
+    }
+    this.state.activePresetHandle = presetHandle;
+  }
+}
+
+// Create the device type with thermostat behavior and a display unit,
+// bridged under the aggregator
+const TccThermostatDevice = ThermostatDevice.with(
+  BridgedDeviceBasicInformationServer,
+  TccThermostatServer,
+  ThermostatRequirements.ThermostatUserInterfaceConfigurationServer,
+);
 
 export class ThermostatEndpoint {
   private endpoint: Endpoint<typeof TccThermostatDevice>;
   private commandHandler?: CommandHandler;
   private currentState: ThermostatState;
   private isUpdating: boolean = false;
+  private endpointNumber: number;
+  private held: Map<string, HeldValue> = new Map();
+  private presetNames: Map<string, string> = new Map(); // By hex handle
 
-  constructor(name: string = "TCC Thermostat") {
+  constructor(deviceId: number, name: string, endpointNumber: number) {
+    this.endpointNumber = endpointNumber;
     this.currentState = {
-      deviceId: 0,
+      deviceId: deviceId,
       name: name,
       currentTemp: 20,
       heatSetpoint: 20,
       coolSetpoint: 24,
       systemMode: "off",
-      humidity: 50,
+      humidity: null,
       isHeating: false,
       isCooling: false,
     };
@@ -85,7 +191,15 @@ export class ThermostatEndpoint {
     this.endpoint = new Endpoint(
       TccThermostatDevice,
       {
-        id: "thermostat",
+        id: `thermostat-${deviceId}`,
+        number: endpointNumber,
+        bridgedDeviceBasicInformation: {
+          nodeLabel: nodeLabel(name),
+          productName: "TCC Thermostat",
+          serialNumber: `TCC-${deviceId}`,
+          uniqueId: `tcc-${deviceId}`,
+          reachable: true,
+        },
         thermostat: {
           localTemperature: celsiusToMatter(this.currentState.currentTemp),
           occupiedHeatingSetpoint: celsiusToMatter(this.currentState.heatSetpoint),
@@ -96,6 +210,14 @@ export class ThermostatEndpoint {
           maxHeatSetpointLimit: celsiusToMatter(32),
           minCoolSetpointLimit: celsiusToMatter(10),
           maxCoolSetpointLimit: celsiusToMatter(35),
+          presetTypes: PRESET_TYPES,
+          numberOfPresets: MAX_PRESETS,
+          presets: [],
+          activePresetHandle: null,
+        },
+        thermostatUserInterfaceConfiguration: {
+          temperatureDisplayMode: displayModeToMatter(),
+          keypadLockout: ThermostatUserInterfaceConfiguration.KeypadLockout.NoLockout,
         },
       }
     );
@@ -105,16 +227,75 @@ export class ThermostatEndpoint {
     return this.endpoint;
   }
 
+  getDeviceId(): number {
+    return this.currentState.deviceId;
+  }
+
+  getEndpointNumber(): number {
+    return this.endpointNumber;
+  }
+
+  getName(): string {
+    return this.currentState.name;
+  }
+
+  async rename(name: string): Promise<void> {
+    this.currentState.name = name;
+    await this.endpoint.set({
+      bridgedDeviceBasicInformation: { nodeLabel: nodeLabel(name) },
+    });
+    console.log(`Device ${this.currentState.deviceId} renamed to ${name}`);
+  }
+
+  async remove(): Promise<void> {
+    await this.endpoint.delete();
+    console.log(`Device ${this.currentState.deviceId} removed from endpoint ${this.endpointNumber}`);
+  }
+
   setCommandHandler(handler: CommandHandler): void {
     this.commandHandler = handler;
   }
 
+  // holdPending keeps showing the value a queued command asked for, rather
+  // than the unchanged state the backend reports, until a state update
+  // confirms it or the hold expires
+  holdPending(action: string, value: unknown): void {
+    if (HELD_FIELDS[action]) {
+      this.held.set(action, { value, until: Date.now() + QUEUED_HOLD_MS });
+    }
+  }
+
+  // applyHeld puts held values into state, releasing holds the state
+  // confirms or that have expired
+  private applyHeld(state: ThermostatState): ThermostatState {
+    const now = Date.now();
+    const result = { ...state };
+    for (const [action, hold] of this.held) {
+      const field = HELD_FIELDS[action];
+      if (hold.until < now) {
+        this.held.delete(action);
+      } else if (field === "systemMode") {
+        if (state.systemMode === hold.value) {
+          this.held.delete(action);
+        } else {
+          result.systemMode = hold.value as string;
+        }
+      } else if (celsiusToMatter(state[field]) === celsiusToMatter(hold.value as number)) {
+        this.held.delete(action);
+      } else {
+        result[field] = hold.value as number;
+      }
+    }
+    return result;
+  }
+
   async setupCommandHandlers(): Promise<void> {
     // Watch for attribute changes from HomeKit
     this.endpoint.events.thermostat.occupiedHeatingSetpoint$Changed.on(async (value: number) => {
       if (this.commandHandler && !this.isUpdating) {
         // Update our cached state so we don't try to re-set this value
         this.currentState.heatSetpoint = matterToCelsius(value);
+        this.held.delete("setHeatingSetpoint");
         await this.commandHandler("setHeatingSetpoint", matterToCelsius(value));
       }
     });
@@ -123,6 +304,7 @@ export class ThermostatEndpoint {
       if (this.commandHandler && !this.isUpdating) {
         // Update our cached state so we don't try to re-set this value
         this.currentState.coolSetpoint = matterToCelsius(value);
+        this.held.delete("setCoolingSetpoint");
         await this.commandHandler("setCoolingSetpoint", matterToCelsius(value));
       }
     });
@@ -131,14 +313,28 @@ export class ThermostatEndpoint {
       if (this.commandHandler && !this.isUpdating) {
         // Update our cached state so we don't try to re-set this value
         this.currentState.systemMode = matterToSystemMode(value);
+        this.held.delete("setSystemMode");
         await this.commandHandler("setSystemMode", matterToSystemMode(value));
       }
     });
+
+    this.endpoint.events.thermostat.activePresetHandle$Changed.on(async (value: Uint8Array | null) => {
+      if (this.commandHandler && !this.isUpdating && value !== null) {
+        const name = this.presetNames.get(Bytes.toHex(value));
+        if (name === undefined) {
+          return;
+        }
+        // Update our cached state so we don't try to re-set this value
+        this.currentState.activePreset = name;
+        await this.commandHandler("setActivePreset", name);
+      }
+    });
   }
 
   async updateState(state: ThermostatState): Promise<void> {
+    state = this.applyHeld(state);
     const prevState = this.currentState;
-    this.currentState = state;
+    this.currentState = { ...state, name: prevState.name };
 
     const prevTempF = (prevState.currentTemp * 9/5 + 32).toFixed(1);
     const newTempF = (state.currentTemp * 9/5 + 32).toFixed(1);
@@ -191,6 +387,19 @@ export class ThermostatEndpoint {
       } else {
         console.log("No changes to publish to Matter");
       }
+
+      // Only follow an explicit unit preference; otherwise leave the
+      // controller's choice alone
+      if (state.temperatureUnit && state.temperatureUnit !== prevState.temperatureUnit) {
+        await this.endpoint.set({
+          thermostatUserInterfaceConfiguration: {
+            temperatureDisplayMode: displayModeToMatter(state.temperatureUnit),
+          },
+        });
+        console.log(`Temperature display unit set to ${state.temperatureUnit}`);
+      }
+
+      await this.updatePresets(prevState, state);
     } catch (error) {
       console.error("Failed to update thermostat state:", error);
     } finally {
@@ -199,6 +408,26 @@ export class ThermostatEndpoint {
     }
   }
 
+  // updatePresets publishes the preset list and active preset when either
+  // has changed
+  private async updatePresets(prevState: ThermostatState, state: ThermostatState): Promise<void> {
+    const presets: Record<string, unknown> = {};
+    if (JSON.stringify(prevState.presets ?? []) !== JSON.stringify(state.presets ?? [])) {
+      const list = presetsToMatter(state.presets);
+      this.presetNames = new Map(list.map((preset) => [Bytes.toHex(preset.presetHandle), preset.name]));
+      presets.presets = list;
+    }
+    if ((prevState.activePreset ?? "") !== (state.activePreset ?? "") || presets.presets) {
+      const active = state.activePreset ? presetHandle(state.activePreset) : null;
+      presets.activePresetHandle = active !== null && this.presetNames.has(Bytes.toHex(active)) ? active : null;
+    }
+
+    if (Object.keys(presets).length > 0) {
+      await this.endpoint.set({ thermostat: presets });
+      console.log(`Presets published: ${(state.presets ?? []).map((p) => p.name).join(", ") || "none"}, active=${state.activePreset || "none"}`);
+    }
+  }
+
   getState(): ThermostatState {
     return this.currentState;
   }
@@ -8,6 +8,13 @@ export interface SystemStatus {
     running: boolean
     commissioned: boolean
     fabric_id?: string
+    node_id?: string
+    fabrics?: MatterFabric[]
+    commissioned_at?: string
+    decommissioned_at?: string
+    verified_at?: string
+    source: 'bridge' | 'stored'
+    mismatch?: string
   }
   configured: boolean
 }
@@ -19,21 +26,40 @@ export interface ThermostatState {
   heat_setpoint: number
   cool_setpoint: number
   system_mode: string
-  humidity: number
+  humidity: number | null // null when TCC has no valid reading
   is_heating: boolean
   is_cooling: boolean
+  temperature_unit?: 'F' | 'C'
   updated_at: string
 }
 
+export interface DeviceSettings {
+  device_id: number
+  display_name?: string
+  hide_from_matter: boolean
+  temp_offset: number
+  temperature_unit?: 'F' | 'C'
+  updated_at?: string
+}
+
 export interface ConfigStatus {
   has_credentials: boolean
   username?: string
 }
 
+export interface MatterFabric {
+  fabric_index: number
+  fabric_id: string
+  node_id: string
+  vendor_id?: number
+  label?: string
+}
+
 export interface PairingInfo {
   qr_code: string
   manual_pair_code: string
   commissioned: boolean
+  source: 'bridge' | 'stored'
 }
 
 export interface EventLog {
@@ -96,6 +122,17 @@ class ApiClient {
     })
   }
 
+  async getDeviceSettings(deviceId: number): Promise<DeviceSettings> {
+    return this.request<DeviceSettings>(`/thermostats/${deviceId}/settings`)
+  }
+
+  async saveDeviceSettings(settings: DeviceSettings): Promise<DeviceSettings> {
+    return this.request<DeviceSettings>(`/thermostats/${settings.device_id}/settings`, {
+      method: 'PUT',
+      body: JSON.stringify(settings),
+    })
+  }
+
   async getConfig(): Promise<ConfigStatus> {
     return this.request<ConfigStatus>('/config')
   }